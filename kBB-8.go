@@ -17,109 +17,464 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
-	"sync"
+	"text/tabwriter"
 	"time"
 
-	"github.com/briandowns/spinner"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
 
 	"github.com/fabriziopandini/kBB-8/pkg/controlplane"
+	"github.com/fabriziopandini/kBB-8/pkg/instance"
+	"github.com/fabriziopandini/kBB-8/pkg/kbb8"
+	"github.com/fabriziopandini/kBB-8/pkg/process"
 	"github.com/fabriziopandini/kBB-8/pkg/provider"
+	"github.com/fabriziopandini/kBB-8/pkg/ui"
 )
 
-var spinnerFrames = []string{
-	"⠈⠁",
-	"⠈⠑",
-	"⠈⠱",
-	"⠈⡱",
-	"⢀⡱",
-	"⢄⡱",
-	"⢄⡱",
-	"⢆⡱",
-	"⢎⡱",
-	"⢎⡰",
-	"⢎⡠",
-	"⢎⡀",
-	"⢎⠁",
-	"⠎⠁",
-	"⠊⠁",
+// stringSliceFlag is a flag.Value accepting a comma separated list of values, or the flag repeated multiple times.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, strings.Split(value, ",")...)
+	return nil
 }
 
 func main() {
+	// Default to the up command, so kBB-8 keeps working when invoked without arguments.
+	command, args := "up", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "up":
+		up(args)
+	case "status":
+		status(args)
+	case "down":
+		down(args)
+	case "apply":
+		applyOrDelete(args, "apply", kbb8.ApplyObjects)
+	case "delete":
+		applyOrDelete(args, "delete", kbb8.DeleteObjects)
+	case "config":
+		config(args)
+	case serveHealthCommand:
+		serveHealth(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", command)
+		os.Exit(1)
+	}
+}
+
+func up(args []string) {
+	var manifests, apiAudiences, enableAdmissionPlugins, disableAdmissionPlugins stringSliceFlag
+	fs := flag.NewFlagSet("up", flag.ExitOnError)
+	fs.Var(&manifests, "manifests", "YAML files or directories with objects to be applied after providers are ready.")
+	detach := fs.Bool("detach", false, "Return control to the shell once kBB-8 is started, leaving it running in background; use kBB-8 down to stop it.")
+	quiet := fs.Bool("quiet", false, "Do not report progress.")
+	outputFlag := fs.String("output", string(ui.TextOutput), "Output format, one of text, json; json implies --quiet.")
+	streamLogs := fs.Bool("stream-logs", false, "Stream the output of all the components to stderr, in addition to the log files under .tmp; it can't be used with --detach.")
+	name := fs.String("name", "", "Name of the instance, allowing to run multiple instances in the same directory; files are stored in .tmp/<name>.")
+	profiling := fs.Bool("profiling", false, "Enable the pprof endpoints of etcd and the API server; their URLs are reported by kBB-8 status.")
+	serviceCIDR := fs.String("service-cluster-ip-range", "", fmt.Sprintf("CIDR the cluster IPs of Services are allocated from (default %s).", controlplane.DefaultServiceClusterIPRange))
+	serviceAccountIssuer := fs.String("service-account-issuer", "", "Issuer of service account tokens, a URL (default https://kubernetes.default.svc.cluster.local).")
+	fs.Var(&apiAudiences, "api-audiences", "Audiences accepted for service account tokens; can be repeated or comma separated (default the service account issuer).")
+	apiServerReadinessPath := fs.String("apiserver-readiness-path", "", "Path probed for checking the API server readiness, e.g. /livez (default /readyz).")
+	apiServerSkipTLSVerify := fs.Bool("apiserver-skip-tls-verify-during-startup", false, "Skip verifying the API server serving cert until it starts responding, reducing TLS errors in the logs; it is verified afterwards.")
+	fs.Var(&enableAdmissionPlugins, "enable-admission-plugins", "Admission plugins to enable on the API server; can be repeated or comma separated.")
+	fs.Var(&disableAdmissionPlugins, "disable-admission-plugins", "Admission plugins to disable on the API server; can be repeated or comma separated.")
+	keepGoing := fs.Bool("keep-going", false, "Keep going if a provider fails to start, stopping only the failing provider and reporting it at the end.")
+	kubernetesVersion := fs.String("kubernetes-version", "", "Version of kube-apiserver to run, e.g. v1.23.0, downloaded to the binaries cache if missing; it defaults to the binary in the Kubernetes package.")
+	binariesCacheDir := fs.String("binaries-cache-dir", "", "Directory downloaded binaries are cached in (default kBB-8/binaries in the user cache dir).")
+	offline := fs.Bool("offline", false, "Do not download binaries, failing if --kubernetes-version is set and not in the binaries cache.")
+	listen := fs.String("listen", "", "Address of an HTTP server exposing /healthz, /readyz and /components for kBB-8, e.g. :8080; with --detach, the server runs in background until kBB-8 down.")
+	_ = fs.Parse(args)
+
+	if err := controlplane.ValidateServiceClusterIPRange(*serviceCIDR); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *streamLogs && *detach {
+		fmt.Fprintln(os.Stderr, "--stream-logs can't be used with --detach, because detached components write only to the log files")
+		os.Exit(1)
+	}
+
+	output := parseOutputFormat(*outputFlag)
+	if output == ui.JSONOutput {
+		*quiet = true
+	}
+
 	ctx := ctrl.SetupSignalHandler()
 
-	fmt.Println()
-
-	s := spinner.New(spinnerFrames, 200*time.Millisecond)
-	s.Prefix = " "
-	s.Suffix = " Starting kBB-8 ..."
-	s.FinalMSG = " \u001B[32m✓\u001B[0m kBB-8 started!\n"
-	s.Start()
-
-	// Start the control plane (only what we need to run providers).
-	// TODO: make the Kubernetes version configurable (from yaml or flags); download kubernetes package...
-	cp := controlplane.ControlPlane{
-		PackagePath: "./test/packages/bootstrap-kubernetes",
-	}
-	if err := cp.Start(); err != nil {
-		panic(err)
-	}
-
-	defer cp.Stop()
-	s.Stop()
-
-	s.Suffix = " Starting Cluster API ..."
-	s.Start()
-
-	// Start providers
-	// TODO: make the list of providers configurable (from yaml or flags); download providers packages...
-	providers := []provider.Provider{
-		{
-			PackagePath: "./test/packages/bootstrap-capi",
-			Args:        []string{"--feature-gates=MachinePool=true,ClusterResourceSet=true,ClusterTopology=true"},
-		},
-		{
-			PackagePath: "./test/packages/bootstrap-cabpk",
-			Args:        []string{"--feature-gates=MachinePool=true"},
-		},
-		{
-			PackagePath: "./test/packages/bootstrap-kcp",
-			Args:        []string{"--feature-gates=ClusterTopology=true"},
-		},
-		{
-			PackagePath: "./test/packages/bootstrap-capd",
-			Args:        []string{"--feature-gates=MachinePool=true,ClusterTopology=true", "--loadbalancer-use-host-port"},
-		},
+	r := ui.NewProgressReporter(os.Stdout, *quiet)
+	if !*quiet {
+		fmt.Println()
+	}
+	r.Step("Starting kBB-8 ...")
+
+	// Stop the processes left running by a previous run killed without stopping them, that would break this run.
+	if _, err := kbb8.ReapOrphans(*name); err != nil {
+		r.Fail(fmt.Errorf("error stopping orphaned processes from a previous run: %w", err))
+		os.Exit(1)
+	}
+
+	// TODO: download etcd, that is still read from the Kubernetes package.
+	providers, err := newProviders()
+	if err != nil {
+		r.Fail(err)
+		os.Exit(1)
+	}
+
+	opts := kbb8.Options{
+		KubernetesPackagePath:   "./test/packages/bootstrap-kubernetes",
+		Providers:               providers,
+		Manifests:               manifests,
+		InstanceName:            *name,
+		Profiling:               *profiling,
+		Detach:                  *detach,
+		ContinueOnProviderError: *keepGoing,
+		ServiceClusterIPRange:   *serviceCIDR,
+		ServiceAccountIssuer:    *serviceAccountIssuer,
+		APIAudiences:            apiAudiences,
+		EnableAdmissionPlugins:  enableAdmissionPlugins,
+		DisableAdmissionPlugins: disableAdmissionPlugins,
+		KubernetesVersion:       *kubernetesVersion,
+		BinariesCacheDir:        *binariesCacheDir,
+		Offline:                 *offline,
+
+		APIServerReadinessPath:              *apiServerReadinessPath,
+		APIServerSkipTLSVerifyDuringStartup: *apiServerSkipTLSVerify,
+	}
+	if *streamLogs {
+		opts.LogStream = os.Stderr
+	}
+	// The health server of a detached instance is started after Run, in a process outliving this one.
+	if !*detach {
+		opts.ListenAddress = *listen
+	}
+	m, err := kbb8.Run(ctx, opts)
+	if err != nil {
+		r.Fail(err)
+		if output == ui.JSONOutput {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+
+	if output == ui.JSONOutput {
+		if err := ui.PrintJSON(os.Stdout, m.Summary(ctx)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	providerErrors := m.ProviderErrors()
+	names := make([]string, 0, len(m.Providers))
+	for _, p := range m.Providers {
+		if providerErrors[p.Name()] == nil {
+			names = append(names, p.Name())
+		}
+	}
+
+	r.Done("kBB-8 started!")
+	r.Done(fmt.Sprintf("Cluster API with %s Ready!", strings.Join(names, ", ")))
+	for _, p := range m.Providers {
+		if err := providerErrors[p.Name()]; err != nil {
+			r.Fail(err)
+		}
+	}
+	if !*quiet {
+		fmt.Printf("\nSet kubectl context to \"%s\"\n", m.ControlPlane.KubeConfigContext)
+		fmt.Print("You can now use your bootstrap cluster with:\n\n kubectl cluster-info \n\n" +
+			"Enjoy Cluster API with kBB-8! 😊\n")
+	}
+
+	if *detach {
+		if *listen != "" {
+			if err := startDetachedHealthServer(*name, *listen); err != nil {
+				r.Fail(err)
+				if output == ui.JSONOutput {
+					fmt.Fprintln(os.Stderr, err)
+				}
+				os.Exit(1)
+			}
+		}
+		if !*quiet {
+			fmt.Print("\nkBB-8 is running in background, stop it with:\n\n kBB-8 down \n")
+		}
+		return
+	}
+
+	defer m.Shutdown()
+
+	<-ctx.Done()
+}
+
+// serveHealthCommand is the internal command serving the health of a detached instance, started by up.
+const serveHealthCommand = "serve-health"
+
+// detachedHealthServerStartTimeout is the maximum time to wait for the health server of a detached instance to start.
+const detachedHealthServerStartTimeout = 10 * time.Second
+
+// startDetachedHealthServer runs the serve-health command in background for the detached instance with the given
+// name, and waits for the health server to be recorded in the instance.
+func startDetachedHealthServer(name, addr string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to start the health server: %w", err)
+	}
+	dir, err := instance.Dir(name)
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(filepath.Join(dir, "health-server.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to start the health server: %w", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(executable, serveHealthCommand, "--name", name, "--listen", addr) //nolint:gosec
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := process.StartDetached(cmd); err != nil {
+		return fmt.Errorf("unable to start the health server: %w", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+
+	timeout := time.After(detachedHealthServerStartTimeout)
+	for {
+		if i, err := kbb8.LoadInstance(name); err == nil && i.HealthServer != nil && i.HealthServer.PID == cmd.Process.Pid {
+			return nil
+		}
+		select {
+		case <-exited:
+			return fmt.Errorf("the health server exited, see %s for details", logFile.Name())
+		case <-timeout:
+			_ = cmd.Process.Kill()
+			return fmt.Errorf("timed out waiting for the health server to start, see %s for details", logFile.Name())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// serveHealth serves the health of a detached instance until the instance is stopped.
+func serveHealth(args []string) {
+	fs := flag.NewFlagSet(serveHealthCommand, flag.ExitOnError)
+	name := fs.String("name", "", "Name of the instance.")
+	listen := fs.String("listen", "", "Address of the HTTP server, e.g. :8080.")
+	_ = fs.Parse(args)
+
+	if err := kbb8.ServeInstanceHealth(ctrl.SetupSignalHandler(), *name, *listen); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// newProviders returns the providers to run on top of the control plane; warnings about provider packages are
+// printed, while errors abort the startup.
+// TODO: make the list of providers configurable (from yaml or flags); download providers packages...
+func newProviders() ([]*provider.Provider, error) {
+	providers := []*provider.Provider{}
+	for _, def := range []struct {
+		packagePath string
+		opts        []provider.Option
+	}{
+		{"./test/packages/bootstrap-capi", []provider.Option{
+			provider.WithFeatureGates(map[string]bool{"MachinePool": true, "ClusterResourceSet": true, "ClusterTopology": true}),
+		}},
+		// Other providers reference types defined by the CAPI CRDs, so they are started after CAPI is ready.
+		{"./test/packages/bootstrap-cabpk", []provider.Option{
+			provider.WithFeatureGates(map[string]bool{"MachinePool": true}),
+			provider.WithDependsOn("CAPI"),
+		}},
+		{"./test/packages/bootstrap-kcp", []provider.Option{
+			provider.WithFeatureGates(map[string]bool{"ClusterTopology": true}),
+			provider.WithDependsOn("CAPI"),
+		}},
+		{"./test/packages/bootstrap-capd", []provider.Option{
+			provider.WithFeatureGates(map[string]bool{"MachinePool": true, "ClusterTopology": true}),
+			provider.WithDependsOn("CAPI"),
+			provider.WithArgs("--loadbalancer-use-host-port"),
+		}},
 		// TODO: CPI for cloud providers
+	} {
+		p, err := provider.NewProvider(def.packagePath, def.opts...)
+		if err != nil {
+			if !provider.IsWarning(err) {
+				return nil, err
+			}
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
+
+func status(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	outputFlag := fs.String("output", string(ui.TextOutput), "Output format, one of text, json.")
+	name := fs.String("name", "", "Name of the instance.")
+	_ = fs.Parse(args)
+
+	output := parseOutputFormat(*outputFlag)
+
+	instance, err := kbb8.LoadInstance(*name)
+	if err != nil {
+		exitOnInstanceError(err)
+	}
+
+	statuses := instance.Status(context.Background())
+	if output == ui.JSONOutput {
+		if err := ui.PrintJSON(os.Stdout, statuses); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tRUNNING\tHEALTHY\tPID\tURL\tERROR")
+	for _, c := range statuses {
+		fmt.Fprintf(w, "%s\t%t\t%t\t%d\t%s\t%s\n", c.Name, c.Running, c.Healthy, c.PID, c.URL, c.LastError)
+	}
+	_ = w.Flush()
+
+	// pprof URLs are printed after the table, because they are set only when profiling is enabled.
+	for _, c := range statuses {
+		if c.PprofURL != "" {
+			fmt.Printf("%s pprof: %s\n", c.Name, c.PprofURL)
+		}
 	}
+}
+
+// config implements the config command; config dump prints the effective configuration of a running instance,
+// after defaults, options and the values derived from the provider manifests are resolved.
+func config(args []string) {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprintln(os.Stderr, "usage: kBB-8 config dump [--name <name>]")
+		os.Exit(1)
+	}
+	fs := flag.NewFlagSet("config dump", flag.ExitOnError)
+	name := fs.String("name", "", "Name of the instance.")
+	_ = fs.Parse(args[1:])
+
+	c, err := kbb8.LoadConfig(*name)
+	if err != nil {
+		exitOnInstanceError(err)
+	}
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Print(string(b))
+}
+
+// exitOnInstanceError reports an error reading the persisted instance, e.g. because it is not running or because
+// the instance name is invalid, and exits.
+func exitOnInstanceError(err error) {
+	if os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "kBB-8 is not running")
+	} else {
+		fmt.Fprintf(os.Stderr, "unable to read the kBB-8 instance: %v\n", err)
+	}
+	os.Exit(1)
+}
+
+// parseOutputFormat parses the --output flag, exiting on invalid values.
+func parseOutputFormat(s string) ui.OutputFormat {
+	output, err := ui.ParseOutputFormat(s)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return output
+}
+
+func down(args []string) {
+	fs := flag.NewFlagSet("down", flag.ExitOnError)
+	quiet := fs.Bool("quiet", false, "Do not report progress.")
+	name := fs.String("name", "", "Name of the instance.")
+	force := fs.Bool("force", false, "Stop the processes left running by a kBB-8 process killed without stopping them, e.g. with SIGKILL; only processes matching the recorded executable and start time are stopped.")
+	_ = fs.Parse(args)
 
-	var wg sync.WaitGroup
-	names := make([]string, 0, len(providers))
-	for i := range providers {
-		p := providers[i]
-		wg.Add(1)
-		go func() {
-			if err := p.Start(ctx, cp.KubeConfigFile); err != nil {
-				panic(err)
+	r := ui.NewProgressReporter(os.Stdout, *quiet)
+	r.Step("Stopping kBB-8 ...")
+	if *force {
+		stopped, err := kbb8.ForceDown(*name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				err = fmt.Errorf("kBB-8 is not running")
 			}
-			names = append(names, p.Name())
+			r.Fail(err)
+			os.Exit(1)
+		}
+		if len(stopped) > 0 {
+			r.Done(fmt.Sprintf("Stopped %s", strings.Join(stopped, ", ")))
+		}
+		r.Done("kBB-8 stopped!")
+		return
+	}
+	if err := kbb8.Down(*name); err != nil {
+		if os.IsNotExist(err) {
+			r.Fail(fmt.Errorf("kBB-8 is not running"))
+			os.Exit(1)
+		}
+		r.Fail(err)
+		os.Exit(1)
+	}
+	r.Done("kBB-8 stopped!")
+}
+
+// applyOrDelete implements the apply and delete commands, that use the given action on the objects read
+// from the files passed with -f.
+func applyOrDelete(args []string, command string, action func(context.Context, client.Client, ...string) ([]kbb8.ObjectResult, error)) {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	var files stringSliceFlag
+	fs.Var(&files, "f", "YAML files or directories with the objects; can be repeated or comma separated.")
+	name := fs.String("name", "", "Name of the instance.")
+	_ = fs.Parse(args)
 
-			wg.Done()
-		}()
-		defer p.Stop()
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "at least one file must be passed with -f")
+		os.Exit(1)
 	}
-	wg.Wait()
 
-	s.FinalMSG = fmt.Sprintf(" \u001B[32m✓\u001B[0m Cluster API with %s Ready!\n\n", strings.Join(names, ", ")) +
-		fmt.Sprintf("Set kubectl context to \"%s\"\n", cp.KubeConfigContext) +
-		"You can now use your bootstrap cluster with:\n\n kubectl cluster-info \n\n" +
-		"Enjoy Cluster API with kBB-8! 😊\n"
+	instance, err := kbb8.LoadInstance(*name)
+	if err != nil {
+		exitOnInstanceError(err)
+	}
 
-	s.Stop()
+	c, err := kbb8.NewInstanceClient(instance)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	select {
-	case <-ctx.Done():
+	// Results are printed also on errors, so it is clear which objects were processed.
+	results, err := action(context.Background(), c, files...)
+	for _, r := range results {
+		fmt.Println(r)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,199 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package binaries implements a local cache for the binaries run by kBB-8, e.g. etcd and kube-apiserver,
+// so they are downloaded only once per version and platform, and can be used in air-gapped environments.
+package binaries
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// checksumSuffix is the suffix of the file storing the checksum of a cached binary.
+const checksumSuffix = ".sha256"
+
+// Binary identifies a binary for a specific version and platform.
+type Binary struct {
+	Name    string
+	Version string
+
+	// OS and Arch default to the ones kBB-8 is running on.
+	OS   string
+	Arch string
+}
+
+func (b Binary) String() string {
+	return fmt.Sprintf("%s %s (%s/%s)", b.Name, b.Version, b.OS, b.Arch)
+}
+
+// DownloadFunc downloads a binary, returning its content and its expected sha256 checksum, hex encoded.
+type DownloadFunc func(ctx context.Context, b Binary) (io.ReadCloser, string, error)
+
+// Cache stores downloaded binaries in a local directory, keyed by version, OS and arch; the checksum of cached
+// binaries is verified on each use, so corrupted binaries are downloaded again.
+type Cache struct {
+	dir      string
+	offline  bool
+	download DownloadFunc
+}
+
+// Option configures a Cache.
+type Option func(*Cache)
+
+// WithCacheDir sets the directory binaries are cached in; it defaults to kBB-8/binaries in the user cache dir.
+func WithCacheDir(dir string) Option {
+	return func(c *Cache) {
+		c.dir = dir
+	}
+}
+
+// WithOffline prevents downloading binaries, so only binaries already in the cache can be used,
+// e.g. in air-gapped environments; requesting a binary not in the cache fails fast.
+func WithOffline(offline bool) Option {
+	return func(c *Cache) {
+		c.offline = offline
+	}
+}
+
+// NewCache returns a Cache downloading binaries with download.
+func NewCache(download DownloadFunc, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		download: download,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	if c.dir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine the binaries cache dir, set one explicitly: %v", err)
+		}
+		c.dir = filepath.Join(userCacheDir, "kBB-8", "binaries")
+	}
+	return c, nil
+}
+
+// Dir returns the directory binaries are cached in.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Path returns the path of a binary in the cache, downloading it if it is missing or if it is corrupted.
+func (c *Cache) Path(ctx context.Context, b Binary) (string, error) {
+	if b.OS == "" {
+		b.OS = runtime.GOOS
+	}
+	if b.Arch == "" {
+		b.Arch = runtime.GOARCH
+	}
+	path := c.path(b)
+
+	err := verify(path)
+	if err == nil {
+		return path, nil
+	}
+	if c.offline {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%s is not in the binaries cache %s, and it can't be downloaded in offline mode", b, c.dir)
+		}
+		return "", fmt.Errorf("%s in the binaries cache %s is invalid, and it can't be downloaded again in offline mode: %v", b, c.dir, err)
+	}
+
+	if err := c.fetch(ctx, b, path); err != nil {
+		return "", fmt.Errorf("error downloading %s: %w", b, err)
+	}
+	return path, nil
+}
+
+// path returns the path of a binary in the cache.
+func (c *Cache) path(b Binary) string {
+	return filepath.Join(c.dir, b.Version, fmt.Sprintf("%s-%s", b.OS, b.Arch), b.Name)
+}
+
+// fetch downloads a binary to path, verifying its checksum, and then stores the checksum next to it.
+func (c *Cache) fetch(ctx context.Context, b Binary, path string) error {
+	if c.download == nil {
+		return fmt.Errorf("downloading binaries is not supported")
+	}
+	body, checksum, err := c.download(ctx, b)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// Download to a temporary file, so a failed download doesn't leave a partial binary in the cache.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), b.Name+".download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), body); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, checksum) {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", checksum, actual)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+checksumSuffix, []byte(strings.ToLower(checksum)+"\n"), 0600)
+}
+
+// verify checks that the binary at path matches the checksum stored next to it.
+func verify(path string) error {
+	expected, err := ioutil.ReadFile(path + checksumSuffix)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != strings.TrimSpace(string(expected)) {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", strings.TrimSpace(string(expected)), actual)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package binaries
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache", func() {
+	const content = "#!/bin/sh\necho kube-apiserver\n"
+
+	var (
+		dir       string
+		downloads int
+		checksum  string
+		apiServer = Binary{Name: "kube-apiserver", Version: "v1.23.0", OS: "linux", Arch: "amd64"}
+	)
+
+	download := func(ctx context.Context, b Binary) (io.ReadCloser, string, error) {
+		downloads++
+		return ioutil.NopCloser(strings.NewReader(content)), checksum, nil
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "binaries-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		downloads = 0
+		sum := sha256.Sum256([]byte(content))
+		checksum = hex.EncodeToString(sum[:])
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("downloads binaries once, keyed by version, OS and arch", func() {
+		c, err := NewCache(download, WithCacheDir(dir))
+		Expect(err).NotTo(HaveOccurred())
+
+		path, err := c.Path(context.Background(), apiServer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(Equal(filepath.Join(dir, "v1.23.0", "linux-amd64", "kube-apiserver")))
+		Expect(ioutil.ReadFile(path)).To(BeEquivalentTo(content))
+
+		// Cache hit.
+		path, err = c.Path(context.Background(), apiServer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(Equal(filepath.Join(dir, "v1.23.0", "linux-amd64", "kube-apiserver")))
+		Expect(downloads).To(Equal(1))
+
+		// A different arch is a cache miss.
+		arm := apiServer
+		arm.Arch = "arm64"
+		path, err = c.Path(context.Background(), arm)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(Equal(filepath.Join(dir, "v1.23.0", "linux-arm64", "kube-apiserver")))
+		Expect(downloads).To(Equal(2))
+	})
+
+	It("uses cached binaries in offline mode", func() {
+		c, err := NewCache(download, WithCacheDir(dir))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = c.Path(context.Background(), apiServer)
+		Expect(err).NotTo(HaveOccurred())
+
+		offline, err := NewCache(download, WithCacheDir(dir), WithOffline(true))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = offline.Path(context.Background(), apiServer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(downloads).To(Equal(1))
+	})
+
+	It("fails fast in offline mode if the binary is not cached", func() {
+		c, err := NewCache(download, WithCacheDir(dir), WithOffline(true))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = c.Path(context.Background(), apiServer)
+		Expect(err).To(MatchError(fmt.Sprintf("kube-apiserver v1.23.0 (linux/amd64) is not in the binaries cache %s, and it can't be downloaded in offline mode", dir)))
+		Expect(downloads).To(BeZero())
+	})
+
+	It("downloads again a corrupted binary", func() {
+		c, err := NewCache(download, WithCacheDir(dir))
+		Expect(err).NotTo(HaveOccurred())
+		path, err := c.Path(context.Background(), apiServer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(path, []byte("corrupted"), 0600)).To(Succeed())
+
+		path, err = c.Path(context.Background(), apiServer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.ReadFile(path)).To(BeEquivalentTo(content))
+		Expect(downloads).To(Equal(2))
+	})
+
+	It("fails in offline mode if the cached binary is corrupted", func() {
+		c, err := NewCache(download, WithCacheDir(dir))
+		Expect(err).NotTo(HaveOccurred())
+		path, err := c.Path(context.Background(), apiServer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(path, []byte("corrupted"), 0600)).To(Succeed())
+
+		offline, err := NewCache(download, WithCacheDir(dir), WithOffline(true))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = offline.Path(context.Background(), apiServer)
+		Expect(err).To(MatchError(ContainSubstring("is invalid, and it can't be downloaded again in offline mode: checksum mismatch")))
+	})
+
+	It("rejects downloads not matching the expected checksum", func() {
+		checksum = strings.Repeat("0", 64)
+		c, err := NewCache(download, WithCacheDir(dir))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = c.Path(context.Background(), apiServer)
+		Expect(err).To(MatchError(ContainSubstring("error downloading kube-apiserver v1.23.0 (linux/amd64): checksum mismatch")))
+		Expect(filepath.Join(dir, "v1.23.0", "linux-amd64", "kube-apiserver")).NotTo(BeAnExistingFile())
+	})
+})
+
+var _ = Describe("HTTPDownload", func() {
+	It("downloads binaries and their checksums", func() {
+		const content = "kube-apiserver"
+		sum := sha256.Sum256([]byte(content))
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v1.23.0/linux/amd64/kube-apiserver":
+				fmt.Fprint(w, content)
+			case "/v1.23.0/linux/amd64/kube-apiserver.sha256":
+				fmt.Fprintf(w, "%s  kube-apiserver\n", hex.EncodeToString(sum[:]))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer server.Close()
+
+		download := HTTPDownload(func(b Binary) string {
+			return fmt.Sprintf("%s/%s/%s/%s/%s", server.URL, b.Version, b.OS, b.Arch, b.Name)
+		})
+
+		body, checksum, err := download(context.Background(), Binary{Name: "kube-apiserver", Version: "v1.23.0", OS: "linux", Arch: "amd64"})
+		Expect(err).NotTo(HaveOccurred())
+		defer body.Close()
+		Expect(checksum).To(Equal(hex.EncodeToString(sum[:])))
+		Expect(ioutil.ReadAll(body)).To(BeEquivalentTo(content))
+
+		_, _, err = download(context.Background(), Binary{Name: "etcd", Version: "v1.23.0", OS: "linux", Arch: "amd64"})
+		Expect(err).To(MatchError(ContainSubstring("404 Not Found")))
+	})
+})
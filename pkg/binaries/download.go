@@ -0,0 +1,81 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package binaries
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// URLFunc returns the URL a binary is downloaded from.
+type URLFunc func(b Binary) string
+
+// KubernetesReleaseURL returns the URL of a Kubernetes binary, e.g. kube-apiserver, in the Kubernetes release
+// bucket; version is the Kubernetes version, e.g. v1.23.0.
+func KubernetesReleaseURL(b Binary) string {
+	return fmt.Sprintf("https://dl.k8s.io/%s/bin/%s/%s/%s", b.Version, b.OS, b.Arch, b.Name)
+}
+
+// HTTPDownload returns a DownloadFunc downloading binaries from the URLs returned by urlFunc; the sha256 checksum
+// of each binary is read from the same URL with the .sha256 suffix, as published for Kubernetes releases.
+func HTTPDownload(urlFunc URLFunc) DownloadFunc {
+	return func(ctx context.Context, b Binary) (io.ReadCloser, string, error) {
+		u := urlFunc(b)
+
+		checksumBody, err := get(ctx, u+checksumSuffix)
+		if err != nil {
+			return nil, "", err
+		}
+		defer checksumBody.Close()
+		checksum, err := ioutil.ReadAll(checksumBody)
+		if err != nil {
+			return nil, "", err
+		}
+		// Checksum files might be in the "<checksum>  <file name>" form.
+		fields := strings.Fields(string(checksum))
+		if len(fields) == 0 {
+			return nil, "", fmt.Errorf("empty checksum at %s", u+checksumSuffix)
+		}
+
+		body, err := get(ctx, u)
+		if err != nil {
+			return nil, "", err
+		}
+		return body, fields[0], nil
+	}
+}
+
+// get returns the body of a GET request to u, failing for non 200 responses.
+func get(ctx context.Context, u string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close() //nolint:errcheck
+		return nil, fmt.Errorf("GET %s returned %s", u, resp.Status)
+	}
+	return resp.Body, nil
+}
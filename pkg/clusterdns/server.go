@@ -0,0 +1,193 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package clusterdns implements a minimal DNS responder for the cluster-internal names of the Services kBB-8
+// rewrites to local URLs, e.g. the Services backing provider webhooks; it is not a full DNS server, and it
+// answers only A and AAAA queries for the registered names.
+package clusterdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// DefaultClusterDomain is the cluster domain Service names are resolved in.
+const DefaultClusterDomain = "cluster.local"
+
+// recordTTL is the TTL of the answers, in seconds; it is short because names are registered as providers start.
+const recordTTL = 5
+
+// Server is a DNS responder answering queries for registered Service names over UDP.
+type Server struct {
+	lock    sync.RWMutex
+	records map[string]net.IP
+
+	conn net.PacketConn
+	done chan struct{}
+}
+
+// NewServer returns a Server with no registered names.
+func NewServer() *Server {
+	return &Server{records: map[string]net.IP{}}
+}
+
+// AddService registers the names of a Service, <name>.<namespace>.svc and <name>.<namespace>.svc.cluster.local,
+// resolving to ip.
+func (s *Server) AddService(svc types.NamespacedName, ip net.IP) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, name := range serviceNames(svc) {
+		s.records[name] = ip
+	}
+}
+
+// RemoveService removes the names of a Service.
+func (s *Server) RemoveService(svc types.NamespacedName) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, name := range serviceNames(svc) {
+		delete(s.records, name)
+	}
+}
+
+// serviceNames returns the fully qualified names of a Service, as they appear in DNS queries.
+func serviceNames(svc types.NamespacedName) []string {
+	name := fmt.Sprintf("%s.%s.svc.", svc.Name, svc.Namespace)
+	return []string{
+		strings.ToLower(name),
+		strings.ToLower(name + DefaultClusterDomain + "."),
+	}
+}
+
+// Start starts serving on address, e.g. 127.0.0.1:0 for a random port; use Addr for getting the actual address.
+func (s *Server) Start(address string) error {
+	if s.conn != nil {
+		return nil
+	}
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return fmt.Errorf("unable to start the cluster DNS server: %w", err)
+	}
+	s.conn = conn
+	s.done = make(chan struct{})
+	go s.serve()
+	return nil
+}
+
+// Addr returns the address the server listens on, or an empty string if the server is not started.
+func (s *Server) Addr() string {
+	if s.conn == nil {
+		return ""
+	}
+	return s.conn.LocalAddr().String()
+}
+
+// Stop stops serving.
+func (s *Server) Stop() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	<-s.done
+	s.conn = nil
+	return err
+}
+
+func (s *Server) serve() {
+	defer close(s.done)
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		resp, err := s.answer(buf[:n])
+		if err != nil {
+			// Malformed queries are dropped.
+			continue
+		}
+		_, _ = s.conn.WriteTo(resp, addr)
+	}
+}
+
+// answer returns the response to a DNS query; queries for registered names get the registered address, if
+// matching the query type, queries for other Service names get NXDOMAIN, and any other query is refused.
+func (s *Server) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	header.Response = true
+	header.Authoritative = true
+	header.RecursionAvailable = false
+	header.RCode = dnsmessage.RCodeSuccess
+
+	name := strings.ToLower(question.Name.String())
+	s.lock.RLock()
+	ip, ok := s.records[name]
+	s.lock.RUnlock()
+
+	switch {
+	case ok:
+	case strings.Contains(name, ".svc."):
+		header.RCode = dnsmessage.RCodeNameError
+	default:
+		header.RCode = dnsmessage.RCodeRefused
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), header)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(question); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	// Queries for a registered name with a type not matching the address family get an empty answer.
+	rh := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: question.Class, TTL: recordTTL}
+	if ip4 := ip.To4(); ok && ip4 != nil && question.Type == dnsmessage.TypeA {
+		r := dnsmessage.AResource{}
+		copy(r.A[:], ip4)
+		if err := b.AResource(rh, r); err != nil {
+			return nil, err
+		}
+	} else if ok && ip4 == nil && question.Type == dnsmessage.TypeAAAA {
+		r := dnsmessage.AAAAResource{}
+		copy(r.AAAA[:], ip.To16())
+		if err := b.AAAAResource(rh, r); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusterdns
+
+import (
+	"context"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("Server", func() {
+	var (
+		s        *Server
+		resolver *net.Resolver
+	)
+
+	BeforeEach(func() {
+		s = NewServer()
+		Expect(s.Start("127.0.0.1:0")).To(Succeed())
+
+		// Use a resolver querying the server, like a controller configured with the cluster DNS would do.
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "udp", s.Addr())
+			},
+		}
+	})
+
+	AfterEach(func() {
+		Expect(s.Stop()).To(Succeed())
+	})
+
+	It("resolves the names of a registered Service", func() {
+		s.AddService(types.NamespacedName{Namespace: "capi-system", Name: "capi-webhook-service"}, net.IPv4(127, 0, 0, 1))
+
+		for _, name := range []string{"capi-webhook-service.capi-system.svc.", "capi-webhook-service.capi-system.svc.cluster.local."} {
+			addrs, err := resolver.LookupHost(context.Background(), name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(ConsistOf("127.0.0.1"))
+		}
+	})
+
+	It("resolves IPv6 addresses", func() {
+		s.AddService(types.NamespacedName{Namespace: "capi-system", Name: "capi-webhook-service"}, net.IPv6loopback)
+
+		addrs, err := resolver.LookupHost(context.Background(), "capi-webhook-service.capi-system.svc.cluster.local.")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addrs).To(ConsistOf("::1"))
+	})
+
+	It("doesn't resolve Services not registered, or removed", func() {
+		svc := types.NamespacedName{Namespace: "capi-system", Name: "capi-webhook-service"}
+		s.AddService(svc, net.IPv4(127, 0, 0, 1))
+		s.RemoveService(svc)
+
+		_, err := resolver.LookupHost(context.Background(), "capi-webhook-service.capi-system.svc.cluster.local.")
+		Expect(err).To(HaveOccurred())
+		dnsErr, ok := err.(*net.DNSError)
+		Expect(ok).To(BeTrue())
+		Expect(dnsErr.IsNotFound).To(BeTrue())
+	})
+
+	It("refuses names outside of the cluster domain", func() {
+		_, err := resolver.LookupHost(context.Background(), "example.com.")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -18,14 +18,31 @@ package controlplane
 
 import (
 	"bufio"
+	"context"
+	"crypto"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/keyutil"
+
+	"github.com/fabriziopandini/kBB-8/pkg/instance"
 	"github.com/fabriziopandini/kBB-8/pkg/process"
 	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/addr"
 	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
@@ -35,33 +52,147 @@ type APIServer struct {
 	EtcdURL *url.URL
 	Path    string
 
+	// InstanceName is the name of the kBB-8 instance the API server belongs to; the log file and the certs are
+	// created in the instance folder, see instance.Dir.
+	InstanceName string
+
+	// StopGracePeriod is the time the API server is given to shut down cleanly before being killed.
+	StopGracePeriod time.Duration
+
+	// Detached runs the process so it can keep running after kBB-8 exits.
+	Detached bool
+
+	// Env are additional environment variables for the process, in the key=value form, e.g. GOMAXPROCS=2.
+	Env []string
+
+	// FileModes defines the permissions of the log file, the certs and the other files created for the process.
+	FileModes process.FileModes
+
+	// LogStream, if set, gets a copy of the process output, with each line prefixed with the component name,
+	// e.g. os.Stderr for interactive debugging; it is ignored for detached processes.
+	LogStream io.Writer
+
+	// AdminToken, if set, is registered with the API server via --token-auth-file as a static bearer token
+	// for a member of the system:masters group.
+	AdminToken string
+
+	// ServiceAccountIssuer is the issuer of service account tokens, used for validating projected tokens;
+	// it must be a URL. If left empty it will default to https://kubernetes.default.svc.cluster.local.
+	ServiceAccountIssuer string
+
+	// APIAudiences are the audiences accepted for service account tokens;
+	// if left empty, the API server defaults to the service account issuer.
+	APIAudiences []string
+
+	// EnableAdmissionPlugins and DisableAdmissionPlugins are admission plugins to be enabled or disabled in addition
+	// to the API server defaults. The webhook admission plugins can't be disabled, because they are required
+	// for the provider webhooks to be called.
+	EnableAdmissionPlugins  []string
+	DisableAdmissionPlugins []string
+
+	// Profiling enables the API server pprof endpoints, see PprofURL; when not set, the API server default is used.
+	Profiling bool
+
+	// ReadinessPath is the path probed for checking the API server readiness, e.g. /healthz or /livez.
+	// If left empty it will default to /readyz.
+	ReadinessPath string
+
+	// ServiceClusterIPRange is the CIDR the cluster IPs of Services are allocated from.
+	// If left empty it will default to DefaultServiceClusterIPRange.
+	ServiceClusterIPRange string
+
+	// SkipTLSVerifyDuringStartup skips verifying the serving cert while waiting for the API server to start
+	// responding, avoiding TLS handshake errors in the logs before the serving certs are loaded; once the API server
+	// responds, the serving cert is verified with the CA, and the steady-state health check is not affected.
+	SkipTLSVerifyDuringStartup bool
+
 	URL *url.URL
-	CA  *certs.TinyCA
+	// CA is the API server CA; if set before Start, the API server serving cert is issued from it and it is used
+	// for validating client certs, otherwise a new CA is generated.
+	// For an API server adopted from a previous instance, it is the CA loaded from the instance folder.
+	CA *certs.TinyCA
+
+	// serviceAccountPrivateKeyFile is the private key used for signing service account tokens.
+	serviceAccountPrivateKeyFile string
+
+	// started, if set, is called once the API server process is started, before waiting for it to be ready.
+	started func()
+
+	// adopted identifies an API server process adopted from a previous instance, if any.
+	adopted *process.Identity
+
+	// adoptedArgs are the args of the adopted API server process, as persisted by the previous instance.
+	adoptedArgs []string
+
+	// versionOnce guards version and versionErr, read from the API server binary once.
+	versionOnce sync.Once
+	version     string
+	versionErr  error
 
 	// processState contains the actual details about this running process
 	processState *process.State
 
 	logFile       *os.File
 	logFileWriter *bufio.Writer
+	logStream     *process.PrefixWriter
 }
 
+// apiServerHealthPath is the path of the API server readiness endpoint.
+const apiServerHealthPath = "/readyz"
+
+// apiServerReadyTimeout is the maximum time to wait for the API server to be ready for clients using the kubeconfig.
+const apiServerReadyTimeout = 30 * time.Second
+
+// defaultServiceAccountIssuer is the default issuer of service account tokens.
+const defaultServiceAccountIssuer = "https://kubernetes.default.svc.cluster.local"
+
+// DefaultServiceClusterIPRange is the default CIDR the cluster IPs of Services are allocated from.
+const DefaultServiceClusterIPRange = "10.0.0.0/24"
+
+// requiredAdmissionPlugins are the admission plugins calling the provider webhooks, which can't be disabled.
+var requiredAdmissionPlugins = []string{"MutatingAdmissionWebhook", "ValidatingAdmissionWebhook"}
+
+// adminTokenUser is the user name the API server assigns to requests authenticated with the AdminToken.
+const adminTokenUser = "kBB-8-admin"
+
+// saKeySize is the size of the RSA key used for signing service account tokens.
+const saKeySize = 2048
+
 type apiServerPKI struct {
-	ca         *certs.TinyCA
-	caFile     string
-	certFile   string
-	keyFile    string
-	saCertFile string
-	saKeyFile  string
+	ca               *certs.TinyCA
+	caFile           string
+	certFile         string
+	keyFile          string
+	saPublicKeyFile  string
+	saPrivateKeyFile string
 }
 
 func (a *APIServer) Start() error {
 	if err := a.setProcessState(); err != nil {
-		return err
+		return process.NewStartupError(APIServerComponentName, process.PhaseSetup, err)
+	}
+	// Detached processes write directly to the log file, so logs keep being written after kBB-8 exits.
+	var w io.Writer = a.logFileWriter
+	if a.Detached {
+		w = a.logFile
+	} else if a.LogStream != nil {
+		a.logStream = process.NewPrefixWriter(a.LogStream, APIServerComponentName)
+		w = io.MultiWriter(a.logFileWriter, a.logStream)
 	}
-	return a.processState.Start(a.logFileWriter, a.logFileWriter)
+	return process.NewStartupError(APIServerComponentName, process.PhaseProcessStart, a.processState.Start(w, w))
 }
 
 func (a *APIServer) Stop() error {
+	if a.adopted != nil {
+		if err := a.adopted.Stop(stopGracePeriod(a.StopGracePeriod)); err != nil {
+			return err
+		}
+		a.adopted = nil
+		return nil
+	}
+	if a.processState == nil {
+		return nil
+	}
 	if err := a.processState.Stop(); err != nil {
 		return err
 	}
@@ -72,28 +203,181 @@ func (a *APIServer) Stop() error {
 		}
 	}
 
+	if a.logStream != nil {
+		if err := a.logStream.Flush(); err != nil {
+			return err
+		}
+	}
+
 	if a.logFile != nil {
 		if err := a.logFile.Close(); err != nil {
 			return err
 		}
 	}
 
-	// TODO: Cleanup dir? What about logs? What about idempotent restart?
+	// The local path is kept: the logs outlive the process.
+	return nil
+}
+
+// ServiceAccountPrivateKeyFile returns the path of the private key used for signing service account tokens;
+// components managing service account tokens, like the controller manager, must use the same key.
+func (a *APIServer) ServiceAccountPrivateKeyFile() string {
+	return a.serviceAccountPrivateKeyFile
+}
+
+// PprofURL returns the URL of the API server pprof endpoints, or an empty string if Profiling is not enabled
+// or the API server is not started.
+func (a *APIServer) PprofURL() string {
+	if !a.Profiling || a.URL == nil {
+		return ""
+	}
+	u := *a.URL
+	u.Path = pprofPath
+	return u.String()
+}
+
+// profilingArgs returns the args for enabling the pprof endpoints, if required.
+func (a *APIServer) profilingArgs() []string {
+	if !a.Profiling {
+		return []string{}
+	}
+	return []string{"--profiling=true"}
+}
+
+// Status returns the observed status of the API server process.
+func (a *APIServer) Status(ctx context.Context) process.Status {
+	if a.adopted != nil {
+		hc := process.HealthCheck{URL: *a.URL}
+		hc.Path = a.readinessPath()
+		if a.CA != nil {
+			hc.RootCAs = x509.NewCertPool()
+			hc.RootCAs.AddCert(a.CA.CA.Cert)
+		}
+		return a.adopted.Status(ctx, hc)
+	}
+	return a.processState.Status(ctx)
+}
+
+// PID returns the pid of the API server process, or 0 if it is not running, e.g. for supervising it externally;
+// the pid is stable for the life of the process.
+func (a *APIServer) PID() int {
+	if a.adopted != nil {
+		return a.adopted.PID
+	}
+	return a.processState.RunningPID()
+}
+
+// EffectiveArgs returns the args the API server runs with; for an API server adopted from a previous instance,
+// they are the args persisted by the previous instance, if any.
+func (a *APIServer) EffectiveArgs() []string {
+	if a.processState == nil {
+		if a.adoptedArgs == nil {
+			return nil
+		}
+		return append([]string{}, a.adoptedArgs...)
+	}
+	return append([]string{}, a.processState.Args...)
+}
+
+// EffectiveServiceClusterIPRange returns the CIDR the cluster IPs of Services are allocated from, as read from
+// the args the API server runs with, or an empty string if they are not known.
+func (a *APIServer) EffectiveServiceClusterIPRange() string {
+	return argValue(a.EffectiveArgs(), "--service-cluster-ip-range")
+}
+
+// KubernetesVersion returns the version of the API server binary, e.g. v1.23.0; the binary is run with --version
+// only once.
+func (a *APIServer) KubernetesVersion() (string, error) {
+	a.versionOnce.Do(func() {
+		out, err := exec.Command(a.Path, "--version").Output() //nolint:gosec
+		if err != nil {
+			a.versionErr = fmt.Errorf("unable to read the version of %s: %w", a.Path, err)
+			return
+		}
+		// The output is in the "Kubernetes v1.23.0" form.
+		fields := strings.Fields(string(out))
+		if len(fields) != 2 || fields[0] != "Kubernetes" {
+			a.versionErr = fmt.Errorf("unable to parse the version of %s: %q", a.Path, strings.TrimSpace(string(out)))
+			return
+		}
+		a.version = fields[1]
+	})
+	return a.version, a.versionErr
+}
+
+// ValidateServiceClusterIPRange returns an error if cidr is not a valid CIDR for the cluster IPs of Services;
+// an empty cidr selects DefaultServiceClusterIPRange.
+func ValidateServiceClusterIPRange(cidr string) error {
+	if cidr == "" {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(cidr); err != nil {
+		return fmt.Errorf("invalid service cluster IP range %q: %v", cidr, err)
+	}
 	return nil
 }
 
+// argValue returns the value of the last occurrence of flag in args, in the --flag=value form, or an empty
+// string if not set.
+func argValue(args []string, flag string) string {
+	value := ""
+	for _, a := range args {
+		if strings.HasPrefix(a, flag+"=") {
+			value = strings.TrimPrefix(a, flag+"=")
+		}
+	}
+	return value
+}
+
+// serviceClusterIPRange returns the CIDR the cluster IPs of Services are allocated from.
+func (a *APIServer) serviceClusterIPRange() string {
+	if a.ServiceClusterIPRange == "" {
+		return DefaultServiceClusterIPRange
+	}
+	return a.ServiceClusterIPRange
+}
+
+// readinessPath returns the path probed for checking the API server readiness.
+func (a *APIServer) readinessPath() string {
+	if a.ReadinessPath == "" {
+		return apiServerHealthPath
+	}
+	return a.ReadinessPath
+}
+
+// Killer returns the Killer for the API server process, e.g. for killing it if stopping it takes too long; it can be
+// used concurrently with Stop.
+func (a *APIServer) Killer() process.Killer {
+	if a.adopted != nil {
+		return *a.adopted
+	}
+	return a.processState
+}
+
+// ExitInfo returns how the API server process exited; it is empty for an adopted process.
+func (a *APIServer) ExitInfo() process.ExitInfo {
+	return a.processState.ExitInfo()
+}
+
 func (a *APIServer) setProcessState() error {
-	currentDir, err := os.Getwd()
+	serviceAccountArgs, err := a.serviceAccountArgs()
+	if err != nil {
+		return err
+	}
+	admissionPluginArgs, err := a.admissionPluginArgs()
 	if err != nil {
 		return err
 	}
 
 	// Set up the log file.
-	localPath := filepath.Join(currentDir, ".tmp", "kubernetes", "api-server")
-	if err := os.MkdirAll(localPath, 0744); err != nil {
+	localPath, err := apiServerDir(a.InstanceName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(localPath, a.FileModes.Dir()); err != nil {
 		return err
 	}
-	if a.logFile, err = os.OpenFile(filepath.Join(localPath, "api-server.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+	if a.logFile, err = os.OpenFile(filepath.Join(localPath, "api-server.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, a.FileModes.File()); err != nil {
 		return err
 	}
 	a.logFileWriter = bufio.NewWriter(a.logFile)
@@ -101,7 +385,7 @@ func (a *APIServer) setProcessState() error {
 	// Set up the listening url.
 	port, host, err := addr.Suggest("")
 	if err != nil {
-		return err
+		return process.NewStartupError("", process.PhasePortAlloc, err)
 	}
 	a.URL = &url.URL{
 		Scheme: "https",
@@ -109,11 +393,12 @@ func (a *APIServer) setProcessState() error {
 	}
 
 	// Set up the PKI.
-	pki, err := setupPKI(localPath, host)
+	pki, err := setupPKI(localPath, host, a.CA, a.FileModes)
 	if err != nil {
-		return err
+		return process.NewStartupError("", process.PhasePKI, err)
 	}
 	a.CA = pki.ca
+	a.serviceAccountPrivateKeyFile = pki.saPrivateKeyFile
 
 	// Starts the API server.
 	args := []string{
@@ -124,28 +409,43 @@ func (a *APIServer) setProcessState() error {
 		fmt.Sprintf("--tls-cert-file=%s", pki.certFile),
 		fmt.Sprintf("--tls-private-key-file=%s", pki.keyFile),
 
-		// Use a default CIDR for cluster ip services.
-		fmt.Sprintf("--service-cluster-ip-range=%s", "10.0.0.0/24"),
+		// Set the CIDR for cluster ip services.
+		fmt.Sprintf("--service-cluster-ip-range=%s", a.serviceClusterIPRange()),
 
 		// Setup authorizations.
 		fmt.Sprintf("--authorization-mode=%s", "RBAC"),
 
 		// Set up a service account signer
-		fmt.Sprintf("--service-account-key-file=%s", pki.saCertFile),
-		fmt.Sprintf("--service-account-signing-key-file=%s", pki.saKeyFile),
-		fmt.Sprintf("--service-account-issuer=%s", fmt.Sprintf("https://kubernetes.default.svc.%s", "cluster.local")),
+		fmt.Sprintf("--service-account-key-file=%s", pki.saPublicKeyFile),
+		fmt.Sprintf("--service-account-signing-key-file=%s", pki.saPrivateKeyFile),
 
 		// Connect to etcd
 		fmt.Sprintf("--etcd-servers=%s", a.EtcdURL.String()),
 	}
+	args = append(args, serviceAccountArgs...)
+	args = append(args, admissionPluginArgs...)
+	args = append(args, a.profilingArgs()...)
+
+	// Set up static token authentication.
+	if a.AdminToken != "" {
+		tokenAuthFile, err := writeTokenAuthFile(localPath, a.AdminToken, a.FileModes)
+		if err != nil {
+			return process.NewStartupError("", process.PhasePKI, err)
+		}
+		args = append(args, fmt.Sprintf("--token-auth-file=%s", tokenAuthFile))
+	}
 
 	a.processState = &process.State{
-		Path: a.Path,
-		Args: args,
+		Path:            a.Path,
+		Args:            args,
+		StopGracePeriod: a.StopGracePeriod,
+		Detached:        a.Detached,
+		Env:             a.Env,
+		Started:         a.started,
 	}
 
 	a.processState.HealthCheck.URL = *a.URL
-	a.processState.HealthCheck.Path = "/readyz"
+	a.processState.HealthCheck.Path = a.readinessPath()
 
 	if err := a.processState.Init(); err != nil {
 		return err
@@ -153,9 +453,135 @@ func (a *APIServer) setProcessState() error {
 	return nil
 }
 
-func setupPKI(localPath string, host string) (*apiServerPKI, error) {
-	// TODO: Skip create if pki already exists for idempotent restart?
+// apiServerWaitOptions defines how to wait for the API server to be ready.
+type apiServerWaitOptions struct {
+	// path is the readiness path; it defaults to /readyz.
+	path string
+
+	// skipTLSVerifyDuringStartup probes the API server without verifying the serving cert until it responds,
+	// and only then with the CA.
+	skipTLSVerifyDuringStartup bool
+}
+
+// waitForAPIServer waits up to timeout for the readiness endpoint of the API server at u to return 200, trusting ca
+// like clients using the kubeconfig file do; connection refused and TLS errors, e.g. while the API server is not
+// yet serving, are retried. If ca is nil, e.g. for an adopted API server, the serving cert is not verified.
+// With skipTLSVerifyDuringStartup, the serving cert is verified only once the API server responds.
+func waitForAPIServer(ctx context.Context, u *url.URL, ca *certs.TinyCA, timeout time.Duration, opts apiServerWaitOptions) error {
+	readyz := *u
+	readyz.Path = opts.path
+	if readyz.Path == "" {
+		readyz.Path = apiServerHealthPath
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if opts.skipTLSVerifyDuringStartup && ca != nil {
+		if err := pollAPIServer(ctx, readyz, nil); err != nil {
+			return fmt.Errorf("the API server is not ready after %s: %v", timeout, err)
+		}
+	}
+	if err := pollAPIServer(ctx, readyz, ca); err != nil {
+		return fmt.Errorf("the API server is not ready after %s: %v", timeout, err)
+	}
+	return nil
+}
 
+// pollAPIServer polls the API server readiness URL until it returns 200 or ctx is done, returning the last error
+// observed; the serving cert is verified with ca, unless nil.
+func pollAPIServer(ctx context.Context, readyz url.URL, ca *certs.TinyCA) error {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.CA.Cert)
+		tlsConfig.RootCAs = pool
+	} else {
+		tlsConfig.InsecureSkipVerify = true //nolint:gosec
+	}
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   5 * time.Second,
+	}
+	defer client.CloseIdleConnections()
+
+	var lastErr error
+	err := process.PollWithBackoff(ctx, process.HealthCheckBackoff(), func(ctx context.Context) (bool, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, readyz.String(), nil)
+		if err != nil {
+			return false, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			return false, nil
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("%s returned %s", readyz.Path, resp.Status)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		if lastErr == nil {
+			lastErr = err
+		}
+		return lastErr
+	}
+	return nil
+}
+
+// serviceAccountArgs returns the args for the service account token issuer and audiences,
+// validating the issuer is a URL.
+func (a *APIServer) serviceAccountArgs() ([]string, error) {
+	issuer := a.ServiceAccountIssuer
+	if issuer == "" {
+		issuer = defaultServiceAccountIssuer
+	}
+	if u, err := url.Parse(issuer); err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid service account issuer %q: must be a URL", issuer)
+	}
+
+	args := []string{fmt.Sprintf("--service-account-issuer=%s", issuer)}
+	if len(a.APIAudiences) > 0 {
+		args = append(args, fmt.Sprintf("--api-audiences=%s", strings.Join(a.APIAudiences, ",")))
+	}
+	return args, nil
+}
+
+// admissionPluginArgs returns the args for enabling and disabling admission plugins, validating that the
+// required admission plugins are not disabled and that no plugin is both enabled and disabled.
+func (a *APIServer) admissionPluginArgs() ([]string, error) {
+	enabled := map[string]bool{}
+	for _, p := range a.EnableAdmissionPlugins {
+		enabled[p] = true
+	}
+	for _, p := range a.DisableAdmissionPlugins {
+		for _, required := range requiredAdmissionPlugins {
+			if p == required {
+				return nil, fmt.Errorf("admission plugin %s can't be disabled, it is required for calling provider webhooks", p)
+			}
+		}
+		if enabled[p] {
+			return nil, fmt.Errorf("admission plugin %s can't be both enabled and disabled", p)
+		}
+	}
+
+	args := []string{}
+	if len(a.EnableAdmissionPlugins) > 0 {
+		args = append(args, fmt.Sprintf("--enable-admission-plugins=%s", strings.Join(a.EnableAdmissionPlugins, ",")))
+	}
+	if len(a.DisableAdmissionPlugins) > 0 {
+		args = append(args, fmt.Sprintf("--disable-admission-plugins=%s", strings.Join(a.DisableAdmissionPlugins, ",")))
+	}
+	return args, nil
+}
+
+// setupPKI sets up the API server PKI, issuing certs from ca, if not nil, or from a new CA.
+// The key of a new CA is persisted with its cert, so a kBB-8 process adopting the API server can keep issuing
+// certs from it; the key of a CA provided by the caller is never written to disk.
+func setupPKI(localPath string, host string, ca *certs.TinyCA, modes process.FileModes) (*apiServerPKI, error) {
 	// Set up the api server certificate.
 	names := []string{
 		host,
@@ -166,9 +592,14 @@ func setupPKI(localPath string, host string) (*apiServerPKI, error) {
 		// "kubernetes.default.svc.cluster.local",
 	}
 
-	ca, err := certs.NewTinyCA()
-	if err != nil {
-		return nil, err
+	generatedCA := ca == nil
+	if generatedCA {
+		var err error
+		if ca, err = certs.NewTinyCA(); err != nil {
+			return nil, err
+		}
+	} else if err := ca.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid Kubernetes CA: %v", err)
 	}
 
 	servingCert, err := ca.NewServingCert(names...)
@@ -177,7 +608,7 @@ func setupPKI(localPath string, host string) (*apiServerPKI, error) {
 	}
 
 	localServingCertDir := filepath.Join(localPath, "ca")
-	if err := os.MkdirAll(localServingCertDir, 0744); err != nil {
+	if err := os.MkdirAll(localServingCertDir, modes.Dir()); err != nil {
 		return nil, err
 	}
 
@@ -187,43 +618,123 @@ func setupPKI(localPath string, host string) (*apiServerPKI, error) {
 	}
 
 	caFile := filepath.Join(localServingCertDir, "ca.crt")
-	if err := ioutil.WriteFile(caFile, ca.CA.CertBytes(), 0640); err != nil {
+	if err := ioutil.WriteFile(caFile, ca.CA.CertBytes(), modes.File()); err != nil {
 		return nil, fmt.Errorf("unable to write Kubernetes CA cert to disk: %v", err)
 	}
+	caKeyFile := filepath.Join(localServingCertDir, "ca.key")
+	if generatedCA {
+		_, caKeyData, err := ca.CA.AsBytes()
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal Kubernetes CA key: %v", err)
+		}
+		if err := ioutil.WriteFile(caKeyFile, caKeyData, modes.Key()); err != nil {
+			return nil, fmt.Errorf("unable to write Kubernetes CA key to disk: %v", err)
+		}
+	} else if err := os.Remove(caKeyFile); err != nil && !os.IsNotExist(err) {
+		// Remove the key of a CA generated by a previous run, so it is not mistaken for the key of this CA.
+		return nil, err
+	}
 	certFile := filepath.Join(localServingCertDir, "tls.crt")
-	if err := ioutil.WriteFile(certFile, certData, 0640); err != nil {
+	if err := ioutil.WriteFile(certFile, certData, modes.File()); err != nil {
 		return nil, fmt.Errorf("unable to write API Server serving cert to disk: %v", err)
 	}
 	keyFile := filepath.Join(localServingCertDir, "tls.key")
-	if err := ioutil.WriteFile(keyFile, keyData, 0640); err != nil {
+	if err := ioutil.WriteFile(keyFile, keyData, modes.Key()); err != nil {
 		return nil, fmt.Errorf("unable to write API Server serving cert key to disk: %v", err)
 	}
 
-	// service account signing files too
-	saCA, err := certs.NewTinyCA()
+	// Set up a dedicated key pair for signing service account tokens.
+	saKey, err := rsa.GenerateKey(crand.Reader, saKeySize)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to generate Kubernetes sa-signer key: %v", err)
 	}
 
-	saCert, saKey, err := saCA.CA.AsBytes()
+	saPrivateKey, err := keyutil.MarshalPrivateKeyToPEM(saKey)
 	if err != nil {
-		return nil, fmt.Errorf("unable to marshal Kubernetes sa-signer: %v", err)
+		return nil, fmt.Errorf("unable to marshal Kubernetes sa-signer private key: %v", err)
 	}
 
-	saCertFile := filepath.Join(localServingCertDir, "sa-signer.crt")
-	if err := ioutil.WriteFile(saCertFile, saCert, 0640); err != nil {
-		return nil, fmt.Errorf("unable to write Kubernetes sa-signer cert to disk: %v", err)
+	saPublicKeyDer, err := x509.MarshalPKIXPublicKey(&saKey.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal Kubernetes sa-signer public key: %v", err)
+	}
+	saPublicKey := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: saPublicKeyDer,
+	})
+
+	saPublicKeyFile := filepath.Join(localServingCertDir, "sa.pub")
+	if err := ioutil.WriteFile(saPublicKeyFile, saPublicKey, modes.File()); err != nil {
+		return nil, fmt.Errorf("unable to write Kubernetes sa-signer public key to disk: %v", err)
 	}
-	saKeyFile := filepath.Join(localServingCertDir, "sa-signer.key")
-	if err := ioutil.WriteFile(saKeyFile, saKey, 0640); err != nil {
-		return nil, fmt.Errorf("unable to write Kubernetes sa-signer cert key to disk: %v", err)
+	saPrivateKeyFile := filepath.Join(localServingCertDir, "sa.key")
+	if err := ioutil.WriteFile(saPrivateKeyFile, saPrivateKey, modes.Key()); err != nil {
+		return nil, fmt.Errorf("unable to write Kubernetes sa-signer private key to disk: %v", err)
 	}
 	return &apiServerPKI{
-		ca:         ca,
-		caFile:     caFile,
-		certFile:   certFile,
-		keyFile:    keyFile,
-		saCertFile: saCertFile,
-		saKeyFile:  saKeyFile,
+		ca:               ca,
+		caFile:           caFile,
+		certFile:         certFile,
+		keyFile:          keyFile,
+		saPublicKeyFile:  saPublicKeyFile,
+		saPrivateKeyFile: saPrivateKeyFile,
 	}, nil
 }
+
+// loadCA loads the CA persisted by setupPKI in localPath, e.g. for an API server adopted from a previous instance.
+// The key of a CA provided by the caller is not persisted, so the same CA must be provided again as injected;
+// if injected is set, it must match the CA the API server runs with.
+func loadCA(localPath string, injected *certs.TinyCA) (*certs.TinyCA, error) {
+	localServingCertDir := filepath.Join(localPath, "ca")
+	certData, err := ioutil.ReadFile(filepath.Join(localServingCertDir, "ca.crt")) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("unable to read Kubernetes CA cert: %v", err)
+	}
+	caCerts, err := certutil.ParseCertsPEM(certData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse Kubernetes CA cert: %v", err)
+	}
+	if injected != nil {
+		if !injected.CA.Cert.Equal(caCerts[0]) {
+			return nil, fmt.Errorf("the CA provided does not match the CA the API server runs with")
+		}
+		return injected, nil
+	}
+	keyData, err := ioutil.ReadFile(filepath.Join(localServingCertDir, "ca.key")) //nolint:gosec
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("the API server runs with a CA provided by the caller, whose key is not persisted: the same CA must be provided")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read Kubernetes CA key: %v", err)
+	}
+	key, err := keyutil.ParsePrivateKeyPEM(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse Kubernetes CA key: %v", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unable to parse Kubernetes CA key: unsupported key type %T", key)
+	}
+	return certs.NewTinyCAFromCertPair(certs.CertPair{Key: signer, Cert: caCerts[0]})
+}
+
+// apiServerDir returns the folder where the API server of the instance with the given name stores its logs and certs.
+func apiServerDir(instanceName string) (string, error) {
+	instanceDir, err := instance.Dir(instanceName)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(instanceDir, "kubernetes", "api-server"), nil
+}
+
+// writeTokenAuthFile writes a static token file registering token for the admin user.
+func writeTokenAuthFile(localPath string, token string, modes process.FileModes) (string, error) {
+	// The file format is a csv with token, user name, user uid and a quoted list of groups.
+	data := fmt.Sprintf("%s,%s,%s,%q\n", token, adminTokenUser, adminTokenUser, "system:masters")
+
+	tokenAuthFile := filepath.Join(localPath, "token-auth.csv")
+	if err := ioutil.WriteFile(tokenAuthFile, []byte(data), modes.Key()); err != nil {
+		return "", fmt.Errorf("unable to write Kubernetes token auth file to disk: %v", err)
+	}
+	return tokenAuthFile, nil
+}
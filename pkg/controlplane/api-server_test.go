@@ -0,0 +1,437 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controlplane
+
+import (
+	"context"
+	"crypto"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/keyutil"
+
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/addr"
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
+)
+
+var _ = Describe("API server PKI", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "api-server-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("uses a dedicated key pair for signing service account tokens", func() {
+		pki, err := setupPKI(dir, "127.0.0.1", nil, process.FileModes{})
+		Expect(err).NotTo(HaveOccurred())
+
+		privateKey, err := keyutil.PrivateKeyFromFile(pki.saPrivateKeyFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(privateKey).To(BeAssignableToTypeOf(&rsa.PrivateKey{}))
+
+		publicKeys, err := keyutil.PublicKeysFromFile(pki.saPublicKeyFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(publicKeys).To(HaveLen(1))
+		Expect(publicKeys[0]).To(BeAssignableToTypeOf(&rsa.PublicKey{}))
+
+		// Sign a token with the signing key (like the API server does with RS256), and verify it with the published public key.
+		digest := sha256.Sum256([]byte("header.payload"))
+		signature, err := rsa.SignPKCS1v15(crand.Reader, privateKey.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rsa.VerifyPKCS1v15(publicKeys[0].(*rsa.PublicKey), crypto.SHA256, digest[:], signature)).To(Succeed())
+	})
+
+	It("issues the serving cert from a shared CA", func() {
+		ca, err := certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+
+		pki, err := setupPKI(dir, "127.0.0.1", ca, process.FileModes{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pki.ca).To(BeIdenticalTo(ca))
+
+		servingCerts, err := certutil.CertsFromFile(pki.certFile)
+		Expect(err).NotTo(HaveOccurred())
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.CA.Cert)
+		_, err = servingCerts[0].Verify(x509.VerifyOptions{Roots: roots})
+		Expect(err).NotTo(HaveOccurred())
+
+		caCerts, err := certutil.CertsFromFile(pki.caFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(caCerts[0].Equal(ca.CA.Cert)).To(BeTrue())
+	})
+
+	It("persists the key of a generated CA only", func() {
+		caKeyFile := filepath.Join(dir, "ca", "ca.key")
+		pki, err := setupPKI(dir, "127.0.0.1", nil, process.FileModes{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(caKeyFile).To(BeARegularFile())
+		loaded, err := loadCA(dir, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded.CA.Cert.Equal(pki.ca.CA.Cert)).To(BeTrue())
+
+		// The key of a CA provided by the caller is never written, and the one of the previous CA is removed.
+		ca, err := certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = setupPKI(dir, "127.0.0.1", ca, process.FileModes{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(caKeyFile).NotTo(BeAnExistingFile())
+
+		_, err = loadCA(dir, nil)
+		Expect(err).To(MatchError(ContainSubstring("the same CA must be provided")))
+		other, err := certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = loadCA(dir, other)
+		Expect(err).To(MatchError(ContainSubstring("does not match")))
+		loaded, err = loadCA(dir, ca)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded).To(BeIdenticalTo(ca))
+	})
+
+	It("writes private keys readable only by the owner", func() {
+		// Private keys are 0600 even when other files are more permissive.
+		pki, err := setupPKI(filepath.Join(dir, "kubernetes"), "127.0.0.1", nil, process.FileModes{FileMode: 0644})
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, f := range []string{pki.keyFile, pki.saPrivateKeyFile} {
+			info, err := os.Stat(f)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)), f)
+		}
+		info, err := os.Stat(filepath.Dir(pki.keyFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0700)))
+	})
+
+	It("rejects a CA not usable for signing", func() {
+		_, err := setupPKI(dir, "127.0.0.1", &certs.TinyCA{}, process.FileModes{})
+		Expect(err).To(MatchError(ContainSubstring("invalid Kubernetes CA")))
+	})
+
+	It("writes a token auth file for the admin token", func() {
+		tokenAuthFile, err := writeTokenAuthFile(dir, "secret", process.FileModes{})
+		Expect(err).NotTo(HaveOccurred())
+
+		data, err := ioutil.ReadFile(tokenAuthFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal("secret,kBB-8-admin,kBB-8-admin,\"system:masters\"\n"))
+	})
+})
+
+var _ = Describe("API server service account args", func() {
+	DescribeTable("reflect the configured issuer and audiences",
+		func(a *APIServer, expectedArgs []string) {
+			args, err := a.serviceAccountArgs()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(args).To(Equal(expectedArgs))
+		},
+		Entry("defaults", &APIServer{}, []string{
+			"--service-account-issuer=https://kubernetes.default.svc.cluster.local",
+		}),
+		Entry("custom issuer", &APIServer{ServiceAccountIssuer: "https://issuer.example.com"}, []string{
+			"--service-account-issuer=https://issuer.example.com",
+		}),
+		Entry("multiple audiences", &APIServer{ServiceAccountIssuer: "https://issuer.example.com", APIAudiences: []string{"api", "vault"}}, []string{
+			"--service-account-issuer=https://issuer.example.com",
+			"--api-audiences=api,vault",
+		}),
+	)
+
+	DescribeTable("fail for an invalid issuer",
+		func(issuer string) {
+			_, err := (&APIServer{ServiceAccountIssuer: issuer}).serviceAccountArgs()
+			Expect(err).To(MatchError(ContainSubstring("invalid service account issuer")))
+		},
+		Entry("not a URL", "kubernetes"),
+		Entry("without host", "https://"),
+		Entry("unparsable", "https://issuer example.com:port"),
+	)
+})
+
+var _ = Describe("API server admission plugin args", func() {
+	DescribeTable("reflect the enabled and disabled plugins",
+		func(a *APIServer, expectedArgs []string) {
+			args, err := a.admissionPluginArgs()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(args).To(Equal(expectedArgs))
+		},
+		Entry("defaults", &APIServer{}, []string{}),
+		Entry("enabled plugins", &APIServer{EnableAdmissionPlugins: []string{"NamespaceLifecycle", "ServiceAccount"}}, []string{
+			"--enable-admission-plugins=NamespaceLifecycle,ServiceAccount",
+		}),
+		Entry("enabled and disabled plugins", &APIServer{EnableAdmissionPlugins: []string{"AlwaysPullImages"}, DisableAdmissionPlugins: []string{"ServiceAccount", "DefaultStorageClass"}}, []string{
+			"--enable-admission-plugins=AlwaysPullImages",
+			"--disable-admission-plugins=ServiceAccount,DefaultStorageClass",
+		}),
+	)
+
+	DescribeTable("reject disabling the webhook admission plugins",
+		func(plugin string) {
+			_, err := (&APIServer{DisableAdmissionPlugins: []string{"ServiceAccount", plugin}}).admissionPluginArgs()
+			Expect(err).To(MatchError(fmt.Sprintf("admission plugin %s can't be disabled, it is required for calling provider webhooks", plugin)))
+		},
+		Entry("mutating webhooks", "MutatingAdmissionWebhook"),
+		Entry("validating webhooks", "ValidatingAdmissionWebhook"),
+	)
+
+	It("rejects plugins both enabled and disabled", func() {
+		_, err := (&APIServer{EnableAdmissionPlugins: []string{"ServiceAccount"}, DisableAdmissionPlugins: []string{"ServiceAccount"}}).admissionPluginArgs()
+		Expect(err).To(MatchError("admission plugin ServiceAccount can't be both enabled and disabled"))
+	})
+})
+
+var _ = Describe("API server service cluster IP range", func() {
+	var dir, currentDir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "api-server-test")
+		Expect(err).NotTo(HaveOccurred())
+		currentDir, err = os.Getwd()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Chdir(dir)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.Chdir(currentDir)).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	DescribeTable("is passed to the API server",
+		func(serviceClusterIPRange, expected string) {
+			a := &APIServer{Path: "kube-apiserver", EtcdURL: &url.URL{Scheme: "http", Host: "127.0.0.1:2379"}, ServiceClusterIPRange: serviceClusterIPRange}
+			Expect(a.EffectiveServiceClusterIPRange()).To(BeEmpty())
+			Expect(a.setProcessState()).To(Succeed())
+			defer a.logFile.Close()
+			Expect(a.EffectiveArgs()).To(ContainElement("--service-cluster-ip-range=" + expected))
+			Expect(a.EffectiveServiceClusterIPRange()).To(Equal(expected))
+		},
+		Entry("default", "", DefaultServiceClusterIPRange),
+		Entry("configured", "10.96.0.0/12", "10.96.0.0/12"),
+	)
+
+	It("is read from the args persisted for an adopted API server", func() {
+		a := &APIServer{adoptedArgs: []string{"--secure-port=6443", "--service-cluster-ip-range=10.96.0.0/12"}}
+		Expect(a.EffectiveServiceClusterIPRange()).To(Equal("10.96.0.0/12"))
+	})
+
+	DescribeTable("is validated",
+		func(serviceClusterIPRange string, valid bool) {
+			err := ValidateServiceClusterIPRange(serviceClusterIPRange)
+			if valid {
+				Expect(err).NotTo(HaveOccurred())
+				return
+			}
+			Expect(err).To(MatchError(ContainSubstring("invalid service cluster IP range")))
+		},
+		Entry("default", "", true),
+		Entry("IPv4", "10.96.0.0/12", true),
+		Entry("IPv6", "fd00:10:96::/112", true),
+		Entry("missing prefix length", "10.96.0.0", false),
+		Entry("not a CIDR", "services", false),
+	)
+})
+
+var _ = Describe("API server Kubernetes version", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "api-server-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("is read from the API server binary once", func() {
+		path := filepath.Join(dir, "kube-apiserver")
+		Expect(ioutil.WriteFile(path, []byte("#!/bin/sh\necho Kubernetes v1.23.0\n"), 0700)).To(Succeed())
+
+		a := &APIServer{Path: path}
+		Expect(a.KubernetesVersion()).To(Equal("v1.23.0"))
+
+		// The binary is not run again.
+		Expect(os.Remove(path)).To(Succeed())
+		Expect(a.KubernetesVersion()).To(Equal("v1.23.0"))
+	})
+
+	It("fails for unexpected output", func() {
+		path := filepath.Join(dir, "kube-apiserver")
+		Expect(ioutil.WriteFile(path, []byte("#!/bin/sh\necho unknown\n"), 0700)).To(Succeed())
+
+		_, err := (&APIServer{Path: path}).KubernetesVersion()
+		Expect(err).To(MatchError(ContainSubstring("unable to parse the version")))
+	})
+})
+
+var _ = Describe("API server profiling", func() {
+	It("doesn't set the profiling flag by default", func() {
+		a := &APIServer{URL: &url.URL{Scheme: "https", Host: "127.0.0.1:6443"}}
+		Expect(a.profilingArgs()).To(BeEmpty())
+		Expect(a.PprofURL()).To(BeEmpty())
+	})
+
+	It("sets the profiling flag when profiling is enabled", func() {
+		a := &APIServer{URL: &url.URL{Scheme: "https", Host: "127.0.0.1:6443"}, Profiling: true}
+		Expect(a.profilingArgs()).To(Equal([]string{"--profiling=true"}))
+		Expect(a.PprofURL()).To(Equal("https://127.0.0.1:6443/debug/pprof/"))
+	})
+})
+
+var _ = Describe("waitForAPIServer", func() {
+	var (
+		ca     *certs.TinyCA
+		server *httptest.Server
+	)
+
+	BeforeEach(func() {
+		var err error
+		ca, err = certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+
+		servingCert, err := ca.NewServingCert("127.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		certData, keyData, err := servingCert.AsBytes()
+		Expect(err).NotTo(HaveOccurred())
+		tlsCert, err := tls.X509KeyPair(certData, keyData)
+		Expect(err).NotTo(HaveOccurred())
+
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != apiServerHealthPath {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{tlsCert}, MinVersion: tls.VersionTLS12}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// serverURL returns the URL of a free local port, where nothing is listening yet.
+	serverURL := func() *url.URL {
+		port, host, err := addr.Suggest("")
+		Expect(err).NotTo(HaveOccurred())
+		return &url.URL{Scheme: "https", Host: net.JoinHostPort(host, strconv.Itoa(port))}
+	}
+
+	It("retries until the API server accepts connections", func() {
+		u := serverURL()
+
+		// The API server stub refuses connections for the first second.
+		started := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(started)
+			time.Sleep(time.Second)
+			l, err := net.Listen("tcp", u.Host)
+			Expect(err).NotTo(HaveOccurred())
+			server.Listener = l
+			server.StartTLS()
+		}()
+		defer func() {
+			<-started
+		}()
+
+		start := time.Now()
+		Expect(waitForAPIServer(context.Background(), u, ca, 10*time.Second, apiServerWaitOptions{})).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+	})
+
+	It("fails if the API server is not ready within the timeout", func() {
+		err := waitForAPIServer(context.Background(), serverURL(), ca, 500*time.Millisecond, apiServerWaitOptions{})
+		Expect(err).To(MatchError(ContainSubstring("the API server is not ready after 500ms")))
+		Expect(err).To(MatchError(ContainSubstring("connection refused")))
+	})
+
+	It("doesn't trust a serving cert not issued by the API server CA", func() {
+		server.StartTLS()
+		u, err := url.Parse(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		otherCA, err := certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+		err = waitForAPIServer(context.Background(), u, otherCA, 500*time.Millisecond, apiServerWaitOptions{})
+		Expect(err).To(MatchError(ContainSubstring("certificate signed by unknown authority")))
+
+		// Skipping verification during startup still verifies the serving cert once the API server responds.
+		err = waitForAPIServer(context.Background(), u, otherCA, 500*time.Millisecond, apiServerWaitOptions{skipTLSVerifyDuringStartup: true})
+		Expect(err).To(MatchError(ContainSubstring("certificate signed by unknown authority")))
+	})
+
+	It("tolerates TLS errors until the serving cert is loaded when skipping verification during startup", func() {
+		// The API server stub accepts connections, but fails TLS handshakes for the first second,
+		// like the API server before loading the serving certs.
+		loadedConfig := server.TLS
+		loaded := time.Now().Add(time.Second)
+		server.TLS = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				if time.Now().Before(loaded) {
+					return nil, errors.New("serving cert not loaded yet")
+				}
+				return loadedConfig, nil
+			},
+		}
+		server.StartTLS()
+		u, err := url.Parse(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		start := time.Now()
+		Expect(waitForAPIServer(context.Background(), u, ca, 10*time.Second, apiServerWaitOptions{skipTLSVerifyDuringStartup: true})).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically(">=", 900*time.Millisecond))
+	})
+
+	It("probes the configured readiness path", func() {
+		server.StartTLS()
+		u, err := url.Parse(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = waitForAPIServer(context.Background(), u, ca, 500*time.Millisecond, apiServerWaitOptions{path: "/livez"})
+		Expect(err).To(MatchError(ContainSubstring("/livez returned 404 Not Found")))
+	})
+})
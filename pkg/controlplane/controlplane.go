@@ -17,60 +17,575 @@ limitations under the License.
 package controlplane
 
 import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/fabriziopandini/kBB-8/pkg/clusterdns"
+	"github.com/fabriziopandini/kBB-8/pkg/instance"
 	"github.com/fabriziopandini/kBB-8/pkg/kubeconfig"
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
+)
+
+// clusterName is the name of the kBB-8 cluster in the kubeconfig file.
+const clusterName = "bootstrap"
+
+const (
+	// EtcdComponentName is the name identifying etcd, e.g. in post-start hooks.
+	EtcdComponentName = "etcd"
+
+	// APIServerComponentName is the name identifying the API server, e.g. in post-start hooks.
+	APIServerComponentName = "apiserver"
+
+	// ControllerManagerComponentName is the name identifying the controller manager; post-start hooks for it are
+	// rejected, because the control plane does not run a controller manager yet.
+	ControllerManagerComponentName = "controller-manager"
 )
 
 type ControlPlane struct {
 	// TODO: make private and create constructor
 	PackagePath string
 
+	// APIServerPath, if set, is the path of the kube-apiserver binary, e.g. from the binaries cache; it defaults
+	// to kube-apiserver in PackagePath.
+	APIServerPath string
+
+	// InstanceName is the name of the kBB-8 instance the control plane belongs to; etcd and the API server store
+	// their logs, data and certs in the instance folder, and the name is appended to the cluster name in the
+	// kubeconfig file. It defaults to the unnamed instance.
+	InstanceName string
+
+	// StopGracePeriod is the time etcd and the API server are given to shut down cleanly before being killed.
+	StopGracePeriod time.Duration
+
+	// Detached runs etcd and the API server so they can keep running after kBB-8 exits.
+	Detached bool
+
+	// Env are additional environment variables for etcd and the API server, in the key=value form, e.g. GOMAXPROCS=2.
+	Env []string
+
+	// FileModes defines the permissions of the files and directories created for etcd and the API server.
+	FileModes process.FileModes
+
+	// LogStream, if set, gets a copy of the etcd and API server output, with each line prefixed with the component
+	// name, e.g. os.Stderr for interactive debugging; it is ignored when Detached.
+	LogStream io.Writer
+
+	// EtcdOptions defines the etcd settings.
+	EtcdOptions EtcdOptions
+
+	// KubeConfigAuth defines how the kBB-8 user in the kubeconfig file authenticates to the API server.
+	// When using the Token auth mode without a token, a random token is generated.
+	KubeConfigAuth kubeconfig.AuthOptions
+
+	// ServiceAccountIssuer and APIAudiences define the issuer and the audiences of service account tokens,
+	// see APIServer for details.
+	ServiceAccountIssuer string
+	APIAudiences         []string
+
+	// EnableAdmissionPlugins and DisableAdmissionPlugins are admission plugins to be enabled or disabled on the
+	// API server, see APIServer for details.
+	EnableAdmissionPlugins  []string
+	DisableAdmissionPlugins []string
+
+	// ServiceClusterIPRange is the CIDR the cluster IPs of Services are allocated from, see APIServer for details.
+	ServiceClusterIPRange string
+
+	// CA, if set, is used for issuing the API server serving cert and the kubeconfig client cert, and it is the CA
+	// trusted by the kubeconfig file; otherwise a new CA is generated.
+	// NOTE: etcd serves plain HTTP on the loopback interface, so no cert is issued for it.
+	CA *certs.TinyCA
+
+	// APIServerReadinessPath and APIServerSkipTLSVerifyDuringStartup define how to check the API server readiness,
+	// see APIServer for details.
+	APIServerReadinessPath              string
+	APIServerSkipTLSVerifyDuringStartup bool
+
+	// Profiling enables the pprof endpoints of etcd and the API server, e.g. for investigating the control plane
+	// performance under provider load; see Etcd.PprofURL and APIServer.PprofURL.
+	Profiling bool
+
+	// EnableClusterDNS runs a minimal DNS responder in the current process, answering the cluster-internal names of
+	// the Services kBB-8 rewrites to local URLs, see ClusterDNS; it can't be used with Detached, because the
+	// responder stops when the current process exits.
+	EnableClusterDNS bool
+
+	// PostStartHook, if set, is called with the component name after each component is ready
+	// and before the next one starts; an error aborts Start.
+	// The API server hook is called after the kubeconfig file is written.
+	PostStartHook func(component string) error
+
+	// StartedHook, if set, is called with the component name as soon as the process of each component is started,
+	// before waiting for it to be ready; e.g. for recording the process in the instance manifest, so it can be
+	// cleaned up even if the current process crashes while waiting.
+	StartedHook func(component string)
+
 	// TODO: make private and create getter
 	KubeConfigFile    string
 	KubeConfigContext string
 
-	etcd      *Etcd
-	apiServer *APIServer
+	// componentsLock guards etcd and apiServer, so they can be read concurrently, e.g. by a health server, while
+	// the control plane is starting; each of them is set once its process is started, i.e. fully set up.
+	componentsLock sync.Mutex
+	etcd           *Etcd
+	apiServer      *APIServer
+
+	clusterDNS *clusterdns.Server
 }
 
+// Start starts etcd and the API server, and it is safe to call repeatedly.
+// If the control plane described in the instance manifest, e.g. by a previous kBB-8 process that crashed,
+// is still running and healthy it is adopted instead of starting a new one (post-start hooks are not called);
+// otherwise, the remnants of the previous instance are cleaned up before starting fresh.
 func (cp *ControlPlane) Start() error {
-	cp.etcd = &Etcd{
-		Path: filepath.Join(cp.PackagePath, "etcd"),
+	ctx := context.Background()
+	if cp.running(ctx) {
+		return nil
+	}
+	if err := instance.ValidateName(cp.InstanceName); err != nil {
+		return err
+	}
+	if err := cp.KubeConfigAuth.Validate(); err != nil {
+		return err
 	}
-	if err := cp.etcd.Start(); err != nil {
+	if err := cp.StartClusterDNS(); err != nil {
 		return err
 	}
+	adopted, err := cp.adoptOrCleanup(ctx)
+	if err != nil {
+		return err
+	}
+	if adopted {
+		return nil
+	}
 
-	cp.apiServer = &APIServer{
-		EtcdURL: cp.etcd.URL,
-		Path:    filepath.Join(cp.PackagePath, "kube-apiserver"),
+	etcd := &Etcd{
+		Path:            filepath.Join(cp.PackagePath, "etcd"),
+		InstanceName:    cp.InstanceName,
+		StopGracePeriod: cp.StopGracePeriod,
+		Detached:        cp.Detached,
+		Env:             cp.Env,
+		LogStream:       cp.LogStream,
+		FileModes:       cp.FileModes,
+		EtcdOptions:     cp.EtcdOptions,
+		Profiling:       cp.Profiling,
 	}
-	if err := cp.apiServer.Start(); err != nil {
+	etcd.started = cp.startedHook(EtcdComponentName, func() { cp.setEtcd(etcd) })
+	err = etcd.Start()
+	// Set etcd also if it failed to start, so Stop cleans it up.
+	cp.setEtcd(etcd)
+	if err != nil {
+		return err
+	}
+	// etcd might be healthy before being writable, while the API server requires a writable etcd.
+	if err := etcd.WaitWritable(ctx); err != nil {
+		return process.NewStartupError(EtcdComponentName, process.PhaseReadiness, err)
+	}
+	if err := cp.runPostStartHook(EtcdComponentName); err != nil {
 		return err
 	}
 
+	// If using token authentication, the API server must know the token used in the kubeconfig file.
+	auth := cp.KubeConfigAuth
+	if auth.Mode == kubeconfig.TokenAuthMode && auth.Token == "" {
+		token, err := generateToken()
+		if err != nil {
+			return err
+		}
+		auth.Token = token
+	}
+
+	apiServer := &APIServer{
+		EtcdURL:         etcd.URL,
+		Path:            cp.apiServerPath(),
+		InstanceName:    cp.InstanceName,
+		StopGracePeriod: cp.StopGracePeriod,
+		Detached:        cp.Detached,
+		Env:             cp.Env,
+		LogStream:       cp.LogStream,
+		FileModes:       cp.FileModes,
+		CA:              cp.CA,
+		Profiling:       cp.Profiling,
+
+		ReadinessPath:              cp.APIServerReadinessPath,
+		SkipTLSVerifyDuringStartup: cp.APIServerSkipTLSVerifyDuringStartup,
+
+		ServiceAccountIssuer: cp.ServiceAccountIssuer,
+		APIAudiences:         cp.APIAudiences,
+
+		EnableAdmissionPlugins:  cp.EnableAdmissionPlugins,
+		DisableAdmissionPlugins: cp.DisableAdmissionPlugins,
+
+		ServiceClusterIPRange: cp.ServiceClusterIPRange,
+	}
+	apiServer.started = cp.startedHook(APIServerComponentName, func() { cp.setAPIServer(apiServer) })
+	if auth.Mode == kubeconfig.TokenAuthMode {
+		apiServer.AdminToken = auth.Token
+	}
+	err = apiServer.Start()
+	// Set the API server also if it failed to start, so Stop cleans it up.
+	cp.setAPIServer(apiServer)
+	if err != nil {
+		return err
+	}
+	if err := cp.WaitForAPIServer(ctx); err != nil {
+		return process.NewStartupError(APIServerComponentName, process.PhaseReadiness, err)
+	}
+
 	// TODO: review this to provide a better library UX vs create and merge in the user's KubeConfig file
-	var err error
-	cp.KubeConfigFile, cp.KubeConfigContext, err = kubeconfig.CreateOrMerge(cp.apiServer.CA, cp.apiServer.URL.String(), "bootstrap", "")
+	cp.KubeConfigFile, cp.KubeConfigContext, err = kubeconfig.CreateOrMerge(apiServer.CA, apiServer.URL.String(), cp.ClusterName(), "", auth)
 	if err != nil {
 		return err
 	}
+	return cp.runPostStartHook(APIServerComponentName)
+}
+
+// WaitForAPIServer waits for the API server to be ready for clients using the kubeconfig file, i.e. for its
+// /readyz endpoint to return 200 when verifying the serving cert with the API server CA; Start calls it before
+// writing the kubeconfig file.
+func (cp *ControlPlane) WaitForAPIServer(ctx context.Context) error {
+	apiServer := cp.APIServer()
+	if apiServer == nil || apiServer.URL == nil {
+		return fmt.Errorf("the API server is not running")
+	}
+	return waitForAPIServer(ctx, apiServer.URL, apiServer.CA, apiServerReadyTimeout, apiServerWaitOptions{
+		path:                       apiServer.readinessPath(),
+		skipTLSVerifyDuringStartup: apiServer.SkipTLSVerifyDuringStartup,
+	})
+}
+
+// StartClusterDNS starts the cluster DNS responder, if enabled; Start calls it, and it is safe to call repeatedly.
+func (cp *ControlPlane) StartClusterDNS() error {
+	if !cp.EnableClusterDNS || cp.clusterDNS != nil {
+		return nil
+	}
+	if cp.Detached {
+		return fmt.Errorf("the cluster DNS can't be used with detached components, because it runs in the current process")
+	}
+	s := clusterdns.NewServer()
+	if err := s.Start(net.JoinHostPort("127.0.0.1", "0")); err != nil {
+		return err
+	}
+	cp.clusterDNS = s
 	return nil
 }
 
+// startedHook returns the function called once the process of component is started: it calls set, so the component
+// can be read concurrently, and then StartedHook, if set.
+func (cp *ControlPlane) startedHook(component string, set func()) func() {
+	return func() {
+		set()
+		if cp.StartedHook != nil {
+			cp.StartedHook(component)
+		}
+	}
+}
+
+func (cp *ControlPlane) runPostStartHook(component string) error {
+	if cp.PostStartHook == nil {
+		return nil
+	}
+	return cp.PostStartHook(component)
+}
+
 func (cp *ControlPlane) Stop() error {
-	if err := cp.apiServer.Stop(); err != nil {
-		return err
+	if apiServer := cp.APIServer(); apiServer != nil {
+		if err := apiServer.Stop(); err != nil {
+			return err
+		}
 	}
-	if err := cp.etcd.Stop(); err != nil {
-		return err
+	if etcd := cp.Etcd(); etcd != nil {
+		if err := etcd.Stop(); err != nil {
+			return err
+		}
+	}
+
+	if cp.clusterDNS != nil {
+		if err := cp.clusterDNS.Stop(); err != nil {
+			return err
+		}
+		cp.clusterDNS = nil
 	}
 
-	if err := kubeconfig.Remove("bootstrap", ""); err != nil {
+	if err := kubeconfig.Remove(cp.ClusterName(), ""); err != nil {
 		return err
 	}
 
-	// TODO: Cleanup dir? What about logs? What about idempotent restart?
+	// TODO: Cleanup dir? What about logs?
 	return nil
 }
+
+// running returns true if etcd and the API server are already running and healthy.
+func (cp *ControlPlane) running(ctx context.Context) bool {
+	etcd, apiServer := cp.Etcd(), cp.APIServer()
+	if etcd == nil || apiServer == nil {
+		return false
+	}
+	return etcd.Status(ctx).Healthy && apiServer.Status(ctx).Healthy
+}
+
+// adoptOrCleanup checks the instance manifest for a control plane previously started; if its etcd and API server
+// are still running and healthy the control plane is adopted, otherwise the previous instance is cleaned up.
+// Only instances whose kBB-8 process is gone, e.g. because it crashed, or detached instances can be adopted,
+// and only processes matching the recorded identity are adopted or stopped.
+// NOTE: the other components of an adopted instance, e.g. providers, are stopped, because they are expected
+// to be started again on top of the adopted control plane.
+func (cp *ControlPlane) adoptOrCleanup(ctx context.Context) (bool, error) {
+	i, err := instance.Load(cp.InstanceName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if i.Owner != nil && i.Owner.Alive() {
+		return false, fmt.Errorf("the instance is still run by the kBB-8 process with pid %d", i.Owner.PID)
+	}
+
+	etcd, etcdOK := cp.adoptEtcd(ctx, i)
+	apiServer, apiServerOK, err := cp.adoptAPIServer(ctx, i)
+	if err != nil {
+		return false, fmt.Errorf("unable to adopt the API server of the previous instance: %w", err)
+	}
+	if !etcdOK || !apiServerOK {
+		if _, err := i.StopOrphans(); err != nil {
+			return false, fmt.Errorf("error cleaning up the previous instance: %w", err)
+		}
+		return false, nil
+	}
+
+	errs := []error{}
+	if _, err := i.StopHealthServer(); err != nil {
+		errs = append(errs, fmt.Errorf("error stopping the health server from the previous instance: %w", err))
+	}
+	for _, c := range i.Components {
+		if c.Name == EtcdComponentName || c.Name == APIServerComponentName {
+			continue
+		}
+		if c.Identity == nil {
+			continue
+		}
+		if err := c.Identity.Stop(stopGracePeriod(cp.StopGracePeriod)); err != nil {
+			errs = append(errs, fmt.Errorf("error stopping %s from the previous instance: %w", c.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return false, kerrors.NewAggregate(errs)
+	}
+
+	cp.setEtcd(etcd)
+	cp.setAPIServer(apiServer)
+	cp.KubeConfigFile = i.KubeConfigFile
+	cp.KubeConfigContext = i.KubeConfigContext
+	return true, nil
+}
+
+// adoptEtcd returns the etcd described in the instance manifest, and true if it is running and healthy.
+func (cp *ControlPlane) adoptEtcd(ctx context.Context, i *instance.Instance) (*Etcd, bool) {
+	c, ok := i.Component(EtcdComponentName)
+	if !ok || c.Identity == nil {
+		return nil, false
+	}
+	u, err := componentURL(c)
+	if err != nil {
+		return nil, false
+	}
+	if c.UnixSocket != "" {
+		u = &url.URL{Scheme: "unix", Path: c.UnixSocket}
+	}
+	e := &Etcd{
+		Path:            filepath.Join(cp.PackagePath, "etcd"),
+		StopGracePeriod: cp.StopGracePeriod,
+		Detached:        cp.Detached,
+		EtcdOptions:     cp.EtcdOptions,
+		URL:             u,
+		dataDir:         i.EtcdDataDir,
+		unixSocket:      c.UnixSocket,
+		InstanceName:    cp.InstanceName,
+		adopted:         c.Identity,
+		adoptedArgs:     c.Args,
+		Profiling:       c.PprofURL != "",
+	}
+	return e, e.Status(ctx).Healthy
+}
+
+// adoptAPIServer returns the API server described in the instance manifest, with the CA persisted in the
+// instance folder or the CA provided by the caller, and true if it is running and healthy.
+// It returns an error if the API server is running but its CA is not available, e.g. because it runs with a CA
+// provided by the caller and a different CA, or none, is provided now.
+func (cp *ControlPlane) adoptAPIServer(ctx context.Context, i *instance.Instance) (*APIServer, bool, error) {
+	c, ok := i.Component(APIServerComponentName)
+	if !ok || c.Identity == nil {
+		return nil, false, nil
+	}
+	u, err := componentURL(c)
+	if err != nil {
+		return nil, false, nil
+	}
+	localPath, err := apiServerDir(cp.InstanceName)
+	if err != nil {
+		return nil, false, nil
+	}
+	ca, err := loadCA(localPath, cp.CA)
+	if err != nil {
+		if c.Identity.Alive() {
+			return nil, false, err
+		}
+		return nil, false, nil
+	}
+	a := &APIServer{
+		Path:            cp.apiServerPath(),
+		StopGracePeriod: cp.StopGracePeriod,
+		Detached:        cp.Detached,
+		InstanceName:    cp.InstanceName,
+		URL:             u,
+		CA:              ca,
+		adopted:         c.Identity,
+		adoptedArgs:     c.Args,
+		Profiling:       c.PprofURL != "",
+		ReadinessPath:   componentPath(c),
+	}
+	return a, a.Status(ctx).Healthy, nil
+}
+
+// componentURL returns the URL of a component from the instance manifest, without the health check path.
+func componentURL(c instance.Component) (*url.URL, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = ""
+	return u, nil
+}
+
+// componentPath returns the health check path of a component from the instance manifest.
+func componentPath(c instance.Component) string {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+// stopGracePeriod returns the grace period for stopping processes not started by this process.
+func stopGracePeriod(d time.Duration) time.Duration {
+	if d == 0 {
+		return process.DefaultStopGracePeriod
+	}
+	return d
+}
+
+// ClusterName returns the name of the control plane cluster in the kubeconfig file.
+func (cp *ControlPlane) ClusterName() string {
+	if cp.InstanceName == "" {
+		return clusterName
+	}
+	return clusterName + "-" + cp.InstanceName
+}
+
+// Etcd returns the etcd instance of the control plane.
+func (cp *ControlPlane) Etcd() *Etcd {
+	cp.componentsLock.Lock()
+	defer cp.componentsLock.Unlock()
+	return cp.etcd
+}
+
+func (cp *ControlPlane) setEtcd(etcd *Etcd) {
+	cp.componentsLock.Lock()
+	defer cp.componentsLock.Unlock()
+	cp.etcd = etcd
+}
+
+// ClusterDNS returns the cluster DNS responder, or nil if EnableClusterDNS is not set or the control plane
+// is not started.
+func (cp *ControlPlane) ClusterDNS() *clusterdns.Server {
+	return cp.clusterDNS
+}
+
+// APIServer returns the API server instance of the control plane.
+func (cp *ControlPlane) APIServer() *APIServer {
+	cp.componentsLock.Lock()
+	defer cp.componentsLock.Unlock()
+	return cp.apiServer
+}
+
+func (cp *ControlPlane) setAPIServer(apiServer *APIServer) {
+	cp.componentsLock.Lock()
+	defer cp.componentsLock.Unlock()
+	cp.apiServer = apiServer
+}
+
+// RESTConfig returns a rest.Config for connecting to the control plane using the kBB-8 context in KubeConfigFile;
+// if the kBB-8 user authenticates with an exec credential plugin, it uses an admin client cert issued from the
+// API server CA instead, see kubeconfig.AdminRESTConfig.
+func (cp *ControlPlane) RESTConfig() (*rest.Config, error) {
+	usesExec, err := kubeconfig.UsesExec(cp.KubeConfigFile, cp.KubeConfigContext)
+	if err != nil {
+		return nil, err
+	}
+	if usesExec {
+		apiServer := cp.APIServer()
+		if apiServer == nil || apiServer.URL == nil || apiServer.CA == nil {
+			return nil, fmt.Errorf("the API server is not running")
+		}
+		return kubeconfig.AdminRESTConfig(apiServer.CA, apiServer.URL.String(), cp.ClusterName())
+	}
+	config, err := clientcmd.LoadFromFile(cp.KubeConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	return clientcmd.NewNonInteractiveClientConfig(*config, cp.KubeConfigContext, &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+}
+
+// AdminRESTConfig returns a rest.Config for connecting to the API server of the given instance with an admin
+// client cert issued from the CA persisted in the instance folder, e.g. for kBB-8 commands acting on an instance
+// whose kubeconfig file relies on an exec credential plugin.
+func AdminRESTConfig(i *instance.Instance) (*rest.Config, error) {
+	c, ok := i.Component(APIServerComponentName)
+	if !ok {
+		return nil, fmt.Errorf("the instance has no API server")
+	}
+	u, err := componentURL(c)
+	if err != nil {
+		return nil, err
+	}
+	localPath, err := apiServerDir(i.Name)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := loadCA(localPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return kubeconfig.AdminRESTConfig(ca, u.String(), i.ClusterName)
+}
+
+// generateToken returns a random token to be used for static token authentication.
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := crand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// apiServerPath returns the path of the kube-apiserver binary.
+func (cp *ControlPlane) apiServerPath() string {
+	if cp.APIServerPath != "" {
+		return cp.APIServerPath
+	}
+	return filepath.Join(cp.PackagePath, "kube-apiserver")
+}
@@ -0,0 +1,386 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controlplane
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/fabriziopandini/kBB-8/pkg/instance"
+	"github.com/fabriziopandini/kBB-8/pkg/kubeconfig"
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
+)
+
+var _ = Describe("ControlPlane", func() {
+	var (
+		dir          string
+		currentDir   string
+		kubeConfig   string
+		healthServer *httptest.Server
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "controlplane-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		currentDir, err = os.Getwd()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Chdir(dir)).To(Succeed())
+
+		// Use a kubeconfig file in the test folder, so the user's kubeconfig file is not modified.
+		kubeConfig = os.Getenv("KUBECONFIG")
+		Expect(os.Setenv("KUBECONFIG", filepath.Join(dir, "kubeconfig"))).To(Succeed())
+
+		healthServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	})
+
+	AfterEach(func() {
+		healthServer.Close()
+		Expect(os.Setenv("KUBECONFIG", kubeConfig)).To(Succeed())
+		Expect(os.Chdir(currentDir)).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	// startProcess starts a long running process, reaping it once terminated.
+	startProcess := func() int {
+		cmd := exec.Command("/bin/sh", "-c", "while true; do sleep 0.1; done")
+		Expect(cmd.Start()).To(Succeed())
+		go func() {
+			_ = cmd.Wait()
+		}()
+		return cmd.Process.Pid
+	}
+
+	// deadPID returns the pid of a process already terminated.
+	deadPID := func() int {
+		cmd := exec.Command("/bin/sh", "-c", "true")
+		Expect(cmd.Run()).To(Succeed())
+		return cmd.Process.Pid
+	}
+
+	// identify returns the identity of a running process.
+	identify := func(pid int) *process.Identity {
+		id, err := process.Identify(pid)
+		Expect(err).NotTo(HaveOccurred())
+		return &id
+	}
+
+	// deadIdentity returns the identity of a process already terminated.
+	deadIdentity := func() *process.Identity {
+		pid := deadPID()
+		return &process.Identity{PID: pid, Executable: "sh", StartTime: "0"}
+	}
+
+	Describe("adoptOrCleanup", func() {
+		It("is a no-op without an instance manifest", func() {
+			cp := &ControlPlane{}
+			adopted, err := cp.adoptOrCleanup(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(adopted).To(BeFalse())
+		})
+
+		It("cleans up a stale instance with dead processes, so the control plane starts fresh", func() {
+			etcdDataDir := filepath.Join(dir, ".tmp", "kubernetes", "etcd", "data")
+			Expect(os.MkdirAll(etcdDataDir, 0700)).To(Succeed())
+			providerPID := startProcess()
+			// A process reusing the pid recorded for a component is not stopped.
+			reusedPID := startProcess()
+			defer func() {
+				Expect(identify(reusedPID).Stop(time.Second)).To(Succeed())
+			}()
+			reused := identify(reusedPID)
+			reused.StartTime = "0"
+
+			stale := &instance.Instance{
+				ClusterName: clusterName,
+				EtcdDataDir: etcdDataDir,
+				Owner:       deadIdentity(),
+				Components: []instance.Component{
+					{Name: EtcdComponentName, URL: healthServer.URL + etcdHealthPath, PID: reusedPID, Identity: reused},
+					{Name: APIServerComponentName, URL: healthServer.URL + apiServerHealthPath, PID: deadPID(), Identity: deadIdentity()},
+					{Name: "CAPI", URL: healthServer.URL + "/healthz", PID: providerPID, Identity: identify(providerPID)},
+				},
+			}
+			Expect(stale.Save()).To(Succeed())
+
+			cp := &ControlPlane{StopGracePeriod: time.Second}
+			adopted, err := cp.adoptOrCleanup(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(adopted).To(BeFalse())
+			Expect(cp.Etcd()).To(BeNil())
+			Expect(cp.APIServer()).To(BeNil())
+
+			_, err = instance.Load("")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			Expect(etcdDataDir).NotTo(BeADirectory())
+			Eventually(func() bool { return process.Alive(providerPID) }).Should(BeFalse())
+			Expect(process.Alive(reusedPID)).To(BeTrue())
+		})
+
+		It("does not adopt nor clean up an instance still run by a kBB-8 process", func() {
+			etcdPID := startProcess()
+			defer func() {
+				Expect(identify(etcdPID).Stop(time.Second)).To(Succeed())
+			}()
+
+			running := &instance.Instance{
+				ClusterName: clusterName,
+				Owner:       identify(os.Getpid()),
+				Components: []instance.Component{
+					{Name: EtcdComponentName, URL: healthServer.URL + etcdHealthPath, PID: etcdPID, Identity: identify(etcdPID)},
+				},
+			}
+			Expect(running.Save()).To(Succeed())
+
+			cp := &ControlPlane{StopGracePeriod: time.Second}
+			adopted, err := cp.adoptOrCleanup(context.Background())
+			Expect(err).To(MatchError(ContainSubstring("still run by the kBB-8 process")))
+			Expect(adopted).To(BeFalse())
+			Expect(process.Alive(etcdPID)).To(BeTrue())
+			_, err = instance.Load("")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("adopts a running and healthy control plane, stopping the other components", func() {
+			etcdPID := startProcess()
+			apiServerPID := startProcess()
+			providerPID := startProcess()
+
+			// The CA persisted by the previous API server is adopted too.
+			localPath, err := apiServerDir("")
+			Expect(err).NotTo(HaveOccurred())
+			pki, err := setupPKI(localPath, "127.0.0.1", nil, process.FileModes{})
+			Expect(err).NotTo(HaveOccurred())
+
+			previous := &instance.Instance{
+				ClusterName:       clusterName,
+				KubeConfigFile:    filepath.Join(dir, "kubeconfig"),
+				KubeConfigContext: "kBB-8-bootstrap",
+				EtcdDataDir:       filepath.Join(dir, ".tmp", "kubernetes", "etcd", "data"),
+				Owner:             deadIdentity(),
+				Components: []instance.Component{
+					{Name: EtcdComponentName, URL: healthServer.URL + etcdHealthPath, PID: etcdPID, Identity: identify(etcdPID)},
+					{Name: APIServerComponentName, URL: healthServer.URL + apiServerHealthPath, PID: apiServerPID, Identity: identify(apiServerPID), Args: []string{"--service-cluster-ip-range=10.96.0.0/12"}},
+					{Name: "CAPI", URL: healthServer.URL + "/healthz", PID: providerPID, Identity: identify(providerPID)},
+				},
+			}
+			Expect(previous.Save()).To(Succeed())
+
+			cp := &ControlPlane{StopGracePeriod: time.Second, ServiceClusterIPRange: "10.0.0.0/16"}
+			adopted, err := cp.adoptOrCleanup(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(adopted).To(BeTrue())
+			Expect(cp.KubeConfigFile).To(Equal(previous.KubeConfigFile))
+			Expect(cp.KubeConfigContext).To(Equal(previous.KubeConfigContext))
+			Expect(process.Alive(providerPID)).To(BeFalse())
+
+			etcdStatus := cp.Etcd().Status(context.Background())
+			Expect(etcdStatus.Healthy).To(BeTrue())
+			Expect(etcdStatus.PID).To(Equal(etcdPID))
+			Expect(etcdStatus.URL).To(Equal(healthServer.URL + etcdHealthPath))
+			Expect(cp.APIServer().Status(context.Background()).Healthy).To(BeTrue())
+			Expect(cp.APIServer().CA).NotTo(BeNil())
+			Expect(cp.APIServer().CA.CA.Cert.Equal(pki.ca.CA.Cert)).To(BeTrue())
+			// The args are the ones persisted by the previous instance, not the ones configured for this one.
+			Expect(cp.APIServer().EffectiveServiceClusterIPRange()).To(Equal("10.96.0.0/12"))
+			Expect(cp.Etcd().EffectiveArgs()).To(BeNil())
+
+			// A second start is a no-op, and stop terminates the adopted processes.
+			Expect(cp.Start()).To(Succeed())
+			Expect(cp.Stop()).To(Succeed())
+			Expect(process.Alive(etcdPID)).To(BeFalse())
+			Expect(process.Alive(apiServerPID)).To(BeFalse())
+		})
+
+		It("requires the CA provided by the caller for adopting an API server running with it", func() {
+			etcdPID := startProcess()
+			apiServerPID := startProcess()
+			defer func() {
+				Expect(identify(etcdPID).Stop(time.Second)).To(Succeed())
+				Expect(identify(apiServerPID).Stop(time.Second)).To(Succeed())
+			}()
+
+			ca, err := certs.NewTinyCA()
+			Expect(err).NotTo(HaveOccurred())
+			localPath, err := apiServerDir("")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = setupPKI(localPath, "127.0.0.1", ca, process.FileModes{})
+			Expect(err).NotTo(HaveOccurred())
+
+			previous := &instance.Instance{
+				ClusterName: clusterName,
+				EtcdDataDir: filepath.Join(dir, ".tmp", "kubernetes", "etcd", "data"),
+				Owner:       deadIdentity(),
+				Components: []instance.Component{
+					{Name: EtcdComponentName, URL: healthServer.URL + etcdHealthPath, PID: etcdPID, Identity: identify(etcdPID)},
+					{Name: APIServerComponentName, URL: healthServer.URL + apiServerHealthPath, PID: apiServerPID, Identity: identify(apiServerPID)},
+				},
+			}
+			Expect(previous.Save()).To(Succeed())
+
+			cp := &ControlPlane{StopGracePeriod: time.Second}
+			_, err = cp.adoptOrCleanup(context.Background())
+			Expect(err).To(MatchError(ContainSubstring("the same CA must be provided")))
+			Expect(process.Alive(apiServerPID)).To(BeTrue())
+
+			cp = &ControlPlane{StopGracePeriod: time.Second, CA: ca}
+			adopted, err := cp.adoptOrCleanup(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(adopted).To(BeTrue())
+			Expect(cp.APIServer().CA).To(BeIdenticalTo(ca))
+		})
+
+		It("ignores the instances with a different name", func() {
+			providerPID := startProcess()
+			defer func() {
+				Expect(identify(providerPID).Stop(time.Second)).To(Succeed())
+			}()
+
+			other := &instance.Instance{
+				ClusterName: clusterName,
+				Components: []instance.Component{
+					{Name: EtcdComponentName, URL: healthServer.URL + etcdHealthPath, PID: deadPID()},
+					{Name: "CAPI", URL: healthServer.URL + "/healthz", PID: providerPID},
+				},
+			}
+			Expect(other.Save()).To(Succeed())
+
+			cp := &ControlPlane{InstanceName: "e2e", StopGracePeriod: time.Second}
+			adopted, err := cp.adoptOrCleanup(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(adopted).To(BeFalse())
+			Expect(process.Alive(providerPID)).To(BeTrue())
+			_, err = instance.Load("")
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("InstanceName", func() {
+		It("keeps the files of instances with different names separated", func() {
+			dataDirs := map[string]bool{}
+			logFiles := []*os.File{}
+			for _, name := range []string{"", "one", "two"} {
+				cp := &ControlPlane{InstanceName: name}
+
+				etcd := &Etcd{Path: "etcd", InstanceName: cp.InstanceName}
+				Expect(etcd.setProcessState()).To(Succeed())
+				logFiles = append(logFiles, etcd.logFile)
+				dataDirs[etcd.DataDir()] = true
+
+				apiServer := &APIServer{Path: "kube-apiserver", InstanceName: cp.InstanceName, EtcdURL: etcd.URL}
+				Expect(apiServer.setProcessState()).To(Succeed())
+				logFiles = append(logFiles, apiServer.logFile)
+
+				instanceDir, err := instance.Dir(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(etcd.DataDir()).To(Equal(filepath.Join(instanceDir, "kubernetes", "etcd", "data")))
+				Expect(filepath.Join(instanceDir, "kubernetes", "api-server", "ca", "tls.key")).To(BeARegularFile())
+			}
+			defer func() {
+				for _, f := range logFiles {
+					Expect(f.Close()).To(Succeed())
+				}
+			}()
+			Expect(dataDirs).To(HaveLen(3))
+
+			// The unnamed instance keeps the previous layout, for compatibility.
+			Expect(dataDirs).To(HaveKey(filepath.Join(dir, ".tmp", "kubernetes", "etcd", "data")))
+			Expect(dataDirs).To(HaveKey(filepath.Join(dir, ".tmp", "one", "kubernetes", "etcd", "data")))
+		})
+
+		It("appends the instance name to the cluster name", func() {
+			Expect((&ControlPlane{}).ClusterName()).To(Equal(clusterName))
+			Expect((&ControlPlane{InstanceName: "e2e"}).ClusterName()).To(Equal(clusterName + "-e2e"))
+		})
+
+		It("rejects the cluster DNS for detached components", func() {
+			cp := &ControlPlane{EnableClusterDNS: true, Detached: true}
+			Expect(cp.Start()).To(MatchError(ContainSubstring("the cluster DNS can't be used with detached components")))
+			Expect(cp.ClusterDNS()).To(BeNil())
+		})
+
+		It("rejects invalid instance names", func() {
+			Expect((&ControlPlane{InstanceName: "../e2e"}).Start()).To(MatchError(ContainSubstring("invalid instance name")))
+		})
+
+		It("rejects an exec credential plugin that can't be found before starting etcd", func() {
+			cp := &ControlPlane{KubeConfigAuth: kubeconfig.AuthOptions{Mode: kubeconfig.ExecAuthMode, ExecCommand: "kbb8-missing-get-token"}}
+			Expect(cp.Start()).To(MatchError(ContainSubstring("invalid exec credential plugin")))
+			Expect(cp.Etcd()).To(BeNil())
+		})
+	})
+
+	Describe("RESTConfig", func() {
+		var (
+			ca  *certs.TinyCA
+			dir string
+		)
+
+		BeforeEach(func() {
+			var err error
+			ca, err = certs.NewTinyCA()
+			Expect(err).NotTo(HaveOccurred())
+			dir, err = ioutil.TempDir("", "kbb8-restconfig")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("uses the kubeconfig user", func() {
+			cp := &ControlPlane{}
+			var err error
+			cp.KubeConfigFile, cp.KubeConfigContext, err = kubeconfig.CreateOrMerge(ca, "https://127.0.0.1:6443", cp.ClusterName(), filepath.Join(dir, "config"), kubeconfig.AuthOptions{Mode: kubeconfig.TokenAuthMode, Token: "secret"})
+			Expect(err).NotTo(HaveOccurred())
+
+			config, err := cp.RESTConfig()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.BearerToken).To(Equal("secret"))
+		})
+
+		It("uses an admin client cert instead of the exec credential plugin meant for users", func() {
+			u, err := url.Parse("https://127.0.0.1:6443")
+			Expect(err).NotTo(HaveOccurred())
+			cp := &ControlPlane{}
+			cp.setAPIServer(&APIServer{URL: u, CA: ca})
+			cp.KubeConfigFile, cp.KubeConfigContext, err = kubeconfig.CreateOrMerge(ca, u.String(), cp.ClusterName(), filepath.Join(dir, "config"), kubeconfig.AuthOptions{Mode: kubeconfig.ExecAuthMode, ExecCommand: "get-token"})
+			Expect(err).NotTo(HaveOccurred())
+
+			config, err := cp.RESTConfig()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Host).To(Equal(u.String()))
+			Expect(config.ExecProvider).To(BeNil())
+			Expect(config.CertData).NotTo(BeEmpty())
+			Expect(config.KeyData).NotTo(BeEmpty())
+		})
+	})
+})
@@ -18,40 +18,214 @@ package controlplane
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/fabriziopandini/kBB-8/pkg/instance"
 	"github.com/fabriziopandini/kBB-8/pkg/process"
 	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/addr"
 )
 
+// etcdHealthPath is the path of the etcd health endpoint.
+const etcdHealthPath = "/health"
+
+// pprofPath is the path of the pprof endpoints, for both etcd and the API server.
+const pprofPath = "/debug/pprof/"
+
+const (
+	// etcdSocketName is the name of the unix socket etcd serves clients on, when using a unix socket;
+	// etcd requires a host:port form also for unix URLs, so the socket name includes a port.
+	etcdSocketName = "etcd.sock:0"
+
+	// maxUnixSocketPathLength is the maximum length of a unix socket path on all the supported platforms.
+	maxUnixSocketPathLength = 103
+)
+
+const (
+	// etcdWritableKey is the key written when checking that etcd is writable.
+	etcdWritableKey = "/kBB-8/writable"
+
+	// etcdWritableTimeout is the maximum time to wait for etcd to be writable after it is healthy.
+	etcdWritableTimeout = 20 * time.Second
+)
+
+const (
+	defaultEtcdQuotaBackendBytes       = 256 * 1024 * 1024
+	defaultEtcdAutoCompactionMode      = "periodic"
+	defaultEtcdAutoCompactionRetention = "5m"
+	defaultEtcdRevisionRetention       = "10000"
+	defaultEtcdDialTimeout             = 5 * time.Second
+)
+
+// EtcdOptions defines the etcd settings which can be configured by the user.
+type EtcdOptions struct {
+	// QuotaBackendBytes is the size limit of the etcd backend database.
+	// If left empty it will default to 256MB.
+	QuotaBackendBytes int64
+
+	// AutoCompactionMode is the etcd auto compaction mode, either periodic or revision.
+	// If left empty it will default to periodic.
+	AutoCompactionMode string
+
+	// AutoCompactionRetention is the etcd auto compaction retention, a duration for the periodic mode
+	// (or a number of hours), a number of revisions for the revision mode.
+	// If left empty it will default to 5m for the periodic mode, to 10000 revisions for the revision mode.
+	AutoCompactionRetention string
+
+	// DialTimeout is the maximum time for connecting to etcd and getting a response when kBB-8 calls etcd directly,
+	// e.g. for checking that etcd is writable; a short timeout allows failing fast when etcd is not available.
+	// If left empty it will default to 5s.
+	DialTimeout time.Duration
+
+	// UseUnixSocket makes etcd serve clients on a unix socket in the data dir instead of a TCP loopback port,
+	// e.g. for saving ephemeral ports on a single host; the API server and kBB-8 connect to etcd via the socket.
+	UseUnixSocket bool
+}
+
+// defaultAndValidate sets defaults for the etcd options, and then validates them.
+func (o *EtcdOptions) defaultAndValidate() error {
+	if o.QuotaBackendBytes == 0 {
+		o.QuotaBackendBytes = defaultEtcdQuotaBackendBytes
+	}
+	if o.AutoCompactionMode == "" {
+		o.AutoCompactionMode = defaultEtcdAutoCompactionMode
+	}
+	if o.AutoCompactionRetention == "" {
+		o.AutoCompactionRetention = defaultEtcdAutoCompactionRetention
+		if o.AutoCompactionMode == "revision" {
+			o.AutoCompactionRetention = defaultEtcdRevisionRetention
+		}
+	}
+	if o.DialTimeout == 0 {
+		o.DialTimeout = defaultEtcdDialTimeout
+	}
+
+	if o.QuotaBackendBytes < 0 {
+		return fmt.Errorf("invalid etcd quota backend bytes %d: must be greater than zero", o.QuotaBackendBytes)
+	}
+	if o.DialTimeout < 0 {
+		return fmt.Errorf("invalid etcd dial timeout %s: must be greater than zero", o.DialTimeout)
+	}
+	switch o.AutoCompactionMode {
+	case "periodic":
+		if _, err := strconv.Atoi(o.AutoCompactionRetention); err == nil {
+			break
+		}
+		if _, err := time.ParseDuration(o.AutoCompactionRetention); err != nil {
+			return fmt.Errorf("invalid etcd auto compaction retention %q: must be a duration or a number of hours for the periodic mode", o.AutoCompactionRetention)
+		}
+	case "revision":
+		if _, err := strconv.ParseInt(o.AutoCompactionRetention, 10, 64); err != nil {
+			return fmt.Errorf("invalid etcd auto compaction retention %q: must be a number of revisions for the revision mode", o.AutoCompactionRetention)
+		}
+	default:
+		return fmt.Errorf("invalid etcd auto compaction mode %q: must be one of periodic, revision", o.AutoCompactionMode)
+	}
+	return nil
+}
+
+// args returns the etcd args for the options.
+func (o *EtcdOptions) args() []string {
+	return []string{
+		fmt.Sprintf("--quota-backend-bytes=%d", o.QuotaBackendBytes),
+		fmt.Sprintf("--auto-compaction-mode=%s", o.AutoCompactionMode),
+		fmt.Sprintf("--auto-compaction-retention=%s", o.AutoCompactionRetention),
+	}
+}
+
 type Etcd struct {
 	// TODO: make private and create constructor
 	Path string
 
+	EtcdOptions
+
+	// InstanceName is the name of the kBB-8 instance etcd belongs to; the log file and the data dir are created
+	// in the instance folder, see instance.Dir.
+	InstanceName string
+
+	// StopGracePeriod is the time etcd is given to shut down cleanly before being killed;
+	// a clean shutdown avoids WAL corruption on the next start.
+	StopGracePeriod time.Duration
+
+	// Detached runs the process so it can keep running after kBB-8 exits.
+	Detached bool
+
+	// Env are additional environment variables for the process, in the key=value form, e.g. GOMAXPROCS=2.
+	Env []string
+
+	// FileModes defines the permissions of the log file, the certs and the other files created for the process.
+	FileModes process.FileModes
+
+	// LogStream, if set, gets a copy of the process output, with each line prefixed with the component name,
+	// e.g. os.Stderr for interactive debugging; it is ignored for detached processes.
+	LogStream io.Writer
+
+	// Profiling enables the etcd pprof endpoints, see PprofURL.
+	Profiling bool
+
 	// TODO: make private and create getter
 	URL     *url.URL
 	dataDir string
 
+	// unixSocket is the path of the unix socket etcd serves clients on, if UseUnixSocket is set.
+	unixSocket string
+
+	// started, if set, is called once the etcd process is started, before waiting for it to be ready.
+	started func()
+
+	// adopted identifies an etcd process adopted from a previous instance, if any.
+	adopted *process.Identity
+
+	// adoptedArgs are the args of the adopted etcd process, as persisted by the previous instance.
+	adoptedArgs []string
+
 	// processState contains the actual details about this running process
 	processState *process.State
 
 	logFile       *os.File
 	logFileWriter *bufio.Writer
+	logStream     *process.PrefixWriter
 }
 
 func (e *Etcd) Start() error {
 	if err := e.setProcessState(); err != nil {
-		return err
+		return process.NewStartupError(EtcdComponentName, process.PhaseSetup, err)
+	}
+	// Detached processes write directly to the log file, so logs keep being written after kBB-8 exits.
+	var w io.Writer = e.logFileWriter
+	if e.Detached {
+		w = e.logFile
+	} else if e.LogStream != nil {
+		e.logStream = process.NewPrefixWriter(e.LogStream, EtcdComponentName)
+		w = io.MultiWriter(e.logFileWriter, e.logStream)
 	}
-	return e.processState.Start(e.logFileWriter, e.logFileWriter)
+	return process.NewStartupError(EtcdComponentName, process.PhaseProcessStart, e.processState.Start(w, w))
 }
 
 func (e *Etcd) Stop() error {
+	if e.adopted != nil {
+		if err := e.adopted.Stop(stopGracePeriod(e.StopGracePeriod)); err != nil {
+			return err
+		}
+		e.adopted = nil
+		return os.RemoveAll(e.dataDir)
+	}
+	if e.processState == nil {
+		return nil
+	}
 	if err := e.processState.Stop(); err != nil {
 		return err
 	}
@@ -62,52 +236,272 @@ func (e *Etcd) Stop() error {
 		}
 	}
 
+	if e.logStream != nil {
+		if err := e.logStream.Flush(); err != nil {
+			return err
+		}
+	}
+
 	if e.logFile != nil {
 		if err := e.logFile.Close(); err != nil {
 			return err
 		}
 	}
 
-	// TODO: Cleanup dir? What about logs? What about idempotent restart?
+	// Only the data dir is removed; the logs in the local path outlive the process.
 	return os.RemoveAll(e.dataDir)
 }
 
+// WaitWritable waits for etcd to be writable, by writing a key and reading it back via the etcd JSON gateway;
+// etcd might report healthy before being able to serve writes, and the API server fails if it can't write to etcd.
+func (e *Etcd) WaitWritable(ctx context.Context) error {
+	dialTimeout := e.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultEtcdDialTimeout
+	}
+	return waitEtcdWritable(ctx, e.URL, etcdWritableTimeout, dialTimeout)
+}
+
+// newEtcdClient returns a client for calling etcd directly, failing calls not completed within dialTimeout.
+func newEtcdClient(dialTimeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Timeout: dialTimeout}).DialContext,
+		},
+		Timeout: dialTimeout,
+	}
+}
+
+// newEtcdClientForURL returns a client and the endpoint for calling the etcd at u directly; for unix URLs,
+// the client connects to the unix socket.
+func newEtcdClientForURL(u *url.URL, dialTimeout time.Duration) (*http.Client, *url.URL) {
+	client := newEtcdClient(dialTimeout)
+	if u.Scheme != "unix" {
+		return client, u
+	}
+	client.Transport.(*http.Transport).DialContext = process.UnixSocketDialer(u.Path, dialTimeout)
+	return client, &url.URL{Scheme: "http", Host: "localhost"}
+}
+
+// waitEtcdWritable waits up to timeout for the etcd at u to be writable, returning the last error if it isn't;
+// each check fails if etcd doesn't respond within dialTimeout.
+func waitEtcdWritable(ctx context.Context, u *url.URL, timeout, dialTimeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client, u := newEtcdClientForURL(u, dialTimeout)
+	defer client.CloseIdleConnections()
+
+	var lastErr error
+	err := process.PollWithBackoff(ctx, process.HealthCheckBackoff(), func(ctx context.Context) (bool, error) {
+		lastErr = checkEtcdWritable(ctx, client, u)
+		return lastErr == nil, nil
+	})
+	if err != nil {
+		if lastErr == nil {
+			lastErr = err
+		}
+		return fmt.Errorf("etcd is not writable after %s: %v", timeout, lastErr)
+	}
+	return nil
+}
+
+// checkEtcdWritable writes a random value to etcd and reads it back.
+func checkEtcdWritable(ctx context.Context, client *http.Client, u *url.URL) error {
+	value := strconv.FormatInt(time.Now().UnixNano(), 10)
+	key := base64.StdEncoding.EncodeToString([]byte(etcdWritableKey))
+
+	put := map[string]string{"key": key, "value": base64.StdEncoding.EncodeToString([]byte(value))}
+	if err := etcdGatewayCall(ctx, client, u, "/v3/kv/put", put, nil); err != nil {
+		return fmt.Errorf("error writing to etcd: %w", err)
+	}
+
+	rangeResp := struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}{}
+	if err := etcdGatewayCall(ctx, client, u, "/v3/kv/range", map[string]string{"key": key}, &rangeResp); err != nil {
+		return fmt.Errorf("error reading from etcd: %w", err)
+	}
+	if len(rangeResp.Kvs) != 1 {
+		return fmt.Errorf("error reading from etcd: key %s not found", etcdWritableKey)
+	}
+	if got, err := base64.StdEncoding.DecodeString(rangeResp.Kvs[0].Value); err != nil || string(got) != value {
+		return fmt.Errorf("error reading from etcd: key %s has an unexpected value", etcdWritableKey)
+	}
+	return nil
+}
+
+// etcdGatewayCall calls an endpoint of the etcd JSON gateway, decoding the response into out, if not nil.
+func etcdGatewayCall(ctx context.Context, client *http.Client, u *url.URL, path string, in interface{}, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	endpoint := *u
+	endpoint.Path = path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s returned %s: %s", path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// PprofURL returns the URL of the etcd pprof endpoints, or an empty string if Profiling is not enabled,
+// etcd is not started or it serves clients on a unix socket.
+func (e *Etcd) PprofURL() string {
+	if !e.Profiling || e.URL == nil || e.URL.Scheme == "unix" {
+		return ""
+	}
+	u := *e.URL
+	u.Path = pprofPath
+	return u.String()
+}
+
+// profilingArgs returns the args for enabling the pprof endpoints, if required.
+func (e *Etcd) profilingArgs() []string {
+	if !e.Profiling {
+		return []string{}
+	}
+	return []string{"--enable-pprof"}
+}
+
+// DataDir returns the etcd data dir.
+func (e *Etcd) DataDir() string {
+	return e.dataDir
+}
+
+// EffectiveArgs returns the args etcd runs with; for etcd adopted from a previous instance, they are the args
+// persisted by the previous instance, if any.
+func (e *Etcd) EffectiveArgs() []string {
+	if e.processState == nil {
+		if e.adoptedArgs == nil {
+			return nil
+		}
+		return append([]string{}, e.adoptedArgs...)
+	}
+	return append([]string{}, e.processState.Args...)
+}
+
+// UnixSocket returns the path of the unix socket etcd serves clients on, or an empty string if it serves
+// clients on a TCP port.
+func (e *Etcd) UnixSocket() string {
+	return e.unixSocket
+}
+
+// healthCheck returns the health check of etcd, via the unix socket if etcd serves clients on it.
+func (e *Etcd) healthCheck() process.HealthCheck {
+	hc := process.HealthCheck{URL: *e.URL}
+	if e.unixSocket != "" {
+		hc = process.HealthCheck{URL: url.URL{Scheme: "http", Host: "localhost"}, UnixSocket: e.unixSocket}
+	}
+	hc.Path = etcdHealthPath
+	return hc
+}
+
+// Status returns the observed status of the etcd process.
+func (e *Etcd) Status(ctx context.Context) process.Status {
+	if e.adopted != nil {
+		return e.adopted.Status(ctx, e.healthCheck())
+	}
+	return e.processState.Status(ctx)
+}
+
+// PID returns the pid of the etcd process, or 0 if it is not running, e.g. for supervising it externally;
+// the pid is stable for the life of the process.
+func (e *Etcd) PID() int {
+	if e.adopted != nil {
+		return e.adopted.PID
+	}
+	return e.processState.RunningPID()
+}
+
+// Killer returns the Killer for the etcd process, e.g. for killing it if stopping it takes too long; it can be
+// used concurrently with Stop.
+func (e *Etcd) Killer() process.Killer {
+	if e.adopted != nil {
+		return *e.adopted
+	}
+	return e.processState
+}
+
+// ExitInfo returns how the etcd process exited; it is empty for an adopted process.
+func (e *Etcd) ExitInfo() process.ExitInfo {
+	return e.processState.ExitInfo()
+}
+
 func (e *Etcd) setProcessState() error {
-	currentDir, err := os.Getwd()
+	if err := e.EtcdOptions.defaultAndValidate(); err != nil {
+		return err
+	}
+
+	instanceDir, err := instance.Dir(e.InstanceName)
 	if err != nil {
 		return err
 	}
 
 	// Set up the log file.
-	localPath := filepath.Join(currentDir, ".tmp", "kubernetes", "etcd")
-	if err := os.MkdirAll(localPath, 0744); err != nil {
+	localPath := filepath.Join(instanceDir, "kubernetes", "etcd")
+	if err := os.MkdirAll(localPath, e.FileModes.Dir()); err != nil {
 		return err
 	}
-	if e.logFile, err = os.OpenFile(filepath.Join(localPath, "etcd.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+	if e.logFile, err = os.OpenFile(filepath.Join(localPath, "etcd.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, e.FileModes.File()); err != nil {
 		return err
 	}
 	e.logFileWriter = bufio.NewWriter(e.logFile)
 
 	// Set up the data dir.
 	e.dataDir = filepath.Join(localPath, "data")
-	if err := os.MkdirAll(e.dataDir, 0744); err != nil {
+	if err := os.MkdirAll(e.dataDir, e.FileModes.Dir()); err != nil {
 		return err
 	}
 
-	// Set the listen url.
-	port, host, err := addr.Suggest("")
-	if err != nil {
-		return err
-	}
-	e.URL = &url.URL{
-		Scheme: "http",
-		Host:   net.JoinHostPort(host, strconv.Itoa(port)),
+	// Set the listen url; etcd doesn't accept absolute paths in unix URLs, so it runs in the data dir
+	// and listens on a socket relative to it, while clients use the absolute path of the socket.
+	listenClientURL := ""
+	if e.UseUnixSocket {
+		e.unixSocket = filepath.Join(e.dataDir, etcdSocketName)
+		if len(e.unixSocket) > maxUnixSocketPathLength {
+			return fmt.Errorf("unable to use a unix socket for etcd: the socket path %s is longer than %d characters", e.unixSocket, maxUnixSocketPathLength)
+		}
+		// Remove the socket left by an etcd that didn't shut down cleanly, if any.
+		if err := os.Remove(e.unixSocket); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		e.URL = &url.URL{Scheme: "unix", Path: e.unixSocket}
+		listenClientURL = (&url.URL{Scheme: "unix", Host: etcdSocketName}).String()
+	} else {
+		port, host, err := addr.Suggest("")
+		if err != nil {
+			return process.NewStartupError("", process.PhasePortAlloc, err)
+		}
+		e.URL = &url.URL{
+			Scheme: "http",
+			Host:   net.JoinHostPort(host, strconv.Itoa(port)),
+		}
+		listenClientURL = e.URL.String()
 	}
 
 	// Set the listen peer URL.
-	port, host, err = addr.Suggest("")
+	port, host, err := addr.Suggest("")
 	if err != nil {
-		return err
+		return process.NewStartupError("", process.PhasePortAlloc, err)
 	}
 	listenPeerURL := &url.URL{
 		Scheme: "http",
@@ -117,19 +511,27 @@ func (e *Etcd) setProcessState() error {
 	// Starts etcd.
 	args := []string{
 		// TODO: Secure ETCD
-		fmt.Sprintf("--listen-client-urls=%s", e.URL.String()),
-		fmt.Sprintf("--advertise-client-urls=%s", e.URL.String()),
+		fmt.Sprintf("--listen-client-urls=%s", listenClientURL),
+		fmt.Sprintf("--advertise-client-urls=%s", listenClientURL),
 		fmt.Sprintf("--listen-peer-urls=%s", listenPeerURL.String()),
 		fmt.Sprintf("--data-dir=%s", e.dataDir),
 	}
+	args = append(args, e.EtcdOptions.args()...)
+	args = append(args, e.profilingArgs()...)
 
 	e.processState = &process.State{
-		Path: e.Path,
-		Args: args,
+		Path:            e.Path,
+		Args:            args,
+		StopGracePeriod: e.StopGracePeriod,
+		Detached:        e.Detached,
+		Env:             e.Env,
+		Started:         e.started,
+	}
+	if e.UseUnixSocket {
+		e.processState.Dir = e.dataDir
 	}
 
-	e.processState.HealthCheck.URL = *e.URL
-	e.processState.HealthCheck.Path = "/health"
+	e.processState.HealthCheck = e.healthCheck()
 
 	if err := e.processState.Init(); err != nil {
 		return err
@@ -0,0 +1,304 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controlplane
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EtcdOptions", func() {
+	It("renders defaults", func() {
+		o := &EtcdOptions{}
+		Expect(o.defaultAndValidate()).To(Succeed())
+		Expect(o.DialTimeout).To(Equal(5 * time.Second))
+		Expect(o.args()).To(ConsistOf(
+			"--quota-backend-bytes=268435456",
+			"--auto-compaction-mode=periodic",
+			"--auto-compaction-retention=5m",
+		))
+	})
+
+	It("renders the configured values", func() {
+		o := &EtcdOptions{
+			QuotaBackendBytes:       1024,
+			AutoCompactionMode:      "revision",
+			AutoCompactionRetention: "1000",
+		}
+		Expect(o.defaultAndValidate()).To(Succeed())
+		Expect(o.args()).To(ConsistOf(
+			"--quota-backend-bytes=1024",
+			"--auto-compaction-mode=revision",
+			"--auto-compaction-retention=1000",
+		))
+	})
+
+	It("defaults the retention to a number of revisions for the revision mode", func() {
+		o := &EtcdOptions{AutoCompactionMode: "revision"}
+		Expect(o.defaultAndValidate()).To(Succeed())
+		Expect(o.args()).To(ContainElement("--auto-compaction-retention=10000"))
+	})
+
+	DescribeTable("rejects invalid values",
+		func(o EtcdOptions, expected string) {
+			Expect(o.defaultAndValidate()).To(MatchError(ContainSubstring(expected)))
+		},
+		Entry("negative quota", EtcdOptions{QuotaBackendBytes: -1}, "invalid etcd quota backend bytes"),
+		Entry("negative dial timeout", EtcdOptions{DialTimeout: -time.Second}, "invalid etcd dial timeout"),
+		Entry("unknown mode", EtcdOptions{AutoCompactionMode: "never"}, "invalid etcd auto compaction mode"),
+		Entry("invalid periodic retention", EtcdOptions{AutoCompactionRetention: "soon"}, "invalid etcd auto compaction retention"),
+		Entry("invalid revision retention", EtcdOptions{AutoCompactionMode: "revision", AutoCompactionRetention: "5m"}, "invalid etcd auto compaction retention"),
+	)
+})
+
+var _ = Describe("etcd profiling", func() {
+	It("doesn't enable pprof by default", func() {
+		e := &Etcd{URL: &url.URL{Scheme: "http", Host: "127.0.0.1:2379"}}
+		Expect(e.profilingArgs()).To(BeEmpty())
+		Expect(e.PprofURL()).To(BeEmpty())
+	})
+
+	It("enables pprof when profiling is enabled", func() {
+		e := &Etcd{URL: &url.URL{Scheme: "http", Host: "127.0.0.1:2379"}, Profiling: true}
+		Expect(e.profilingArgs()).To(Equal([]string{"--enable-pprof"}))
+		Expect(e.PprofURL()).To(Equal("http://127.0.0.1:2379/debug/pprof/"))
+	})
+})
+
+var _ = Describe("etcd unix socket", func() {
+	var dir, currentDir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "etcd-test")
+		Expect(err).NotTo(HaveOccurred())
+		currentDir, err = os.Getwd()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Chdir(dir)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.Chdir(currentDir)).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("listens on a TCP port by default", func() {
+		e := &Etcd{Path: "etcd"}
+		Expect(e.setProcessState()).To(Succeed())
+		defer e.logFile.Close()
+
+		Expect(e.URL.Scheme).To(Equal("http"))
+		Expect(e.UnixSocket()).To(BeEmpty())
+		Expect(e.processState.Dir).To(BeEmpty())
+		Expect(e.processState.Args).To(ContainElement("--listen-client-urls=" + e.URL.String()))
+	})
+
+	It("serves clients on a unix socket in the data dir, used by the API server", func() {
+		e := &Etcd{Path: "etcd", EtcdOptions: EtcdOptions{UseUnixSocket: true}}
+		Expect(e.setProcessState()).To(Succeed())
+		defer e.logFile.Close()
+
+		socket := filepath.Join(e.DataDir(), etcdSocketName)
+		Expect(e.UnixSocket()).To(Equal(socket))
+		Expect(e.URL.String()).To(Equal("unix://" + socket))
+		Expect(e.processState.Dir).To(Equal(e.DataDir()))
+		Expect(e.processState.Args).To(ContainElements(
+			"--listen-client-urls=unix://"+etcdSocketName,
+			"--advertise-client-urls=unix://"+etcdSocketName,
+		))
+
+		a := &APIServer{Path: "kube-apiserver", EtcdURL: e.URL}
+		Expect(a.setProcessState()).To(Succeed())
+		defer a.logFile.Close()
+		Expect(a.processState.Args).To(ContainElement("--etcd-servers=unix://" + socket))
+
+		// The socket etcd creates, resolved from its args and working dir, is the one the API server dials.
+		etcdSocket := etcdSocketFromArgs(e.processState.Dir, e.EffectiveArgs())
+		Expect(etcdSocket).To(Equal(apiServerEtcdSocketFromArgs(a.processState.Args)))
+
+		// Serve a fake etcd on that socket, for checking kBB-8's own clients connect through it.
+		l, err := net.Listen("unix", etcdSocket)
+		Expect(err).NotTo(HaveOccurred())
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == etcdHealthPath {
+				fmt.Fprint(w, `{"health":"true"}`)
+				return
+			}
+			fmt.Fprint(w, `{"header":{}}`)
+		}), ReadHeaderTimeout: time.Second}
+		go func() {
+			_ = server.Serve(l)
+		}()
+		defer server.Close()
+
+		Expect(e.processState.HealthCheck.Check(context.Background())).To(Succeed())
+		client, endpoint := newEtcdClientForURL(e.URL, time.Second)
+		Expect(etcdGatewayCall(context.Background(), client, endpoint, "/v3/kv/put", map[string]string{}, nil)).To(Succeed())
+	})
+
+	It("runs etcd creating the socket the API server dials", func() {
+		assets := os.Getenv("KUBEBUILDER_ASSETS")
+		if assets == "" {
+			Skip("KUBEBUILDER_ASSETS is not set, no etcd binary to test against")
+		}
+		e := &Etcd{Path: filepath.Join(assets, "etcd"), EtcdOptions: EtcdOptions{UseUnixSocket: true}}
+		Expect(e.Start()).To(Succeed())
+		defer func() {
+			Expect(e.Stop()).To(Succeed())
+		}()
+
+		a := &APIServer{Path: "kube-apiserver", EtcdURL: e.URL}
+		Expect(a.setProcessState()).To(Succeed())
+		defer a.logFile.Close()
+
+		info, err := os.Stat(apiServerEtcdSocketFromArgs(a.processState.Args))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode() & os.ModeSocket).NotTo(BeZero())
+		Expect(e.WaitWritable(context.Background())).To(Succeed())
+	})
+
+	It("rejects socket paths too long for unix sockets", func() {
+		longDir := filepath.Join(dir, strings.Repeat("a", maxUnixSocketPathLength))
+		Expect(os.MkdirAll(longDir, 0700)).To(Succeed())
+		Expect(os.Chdir(longDir)).To(Succeed())
+
+		e := &Etcd{Path: "etcd", EtcdOptions: EtcdOptions{UseUnixSocket: true}}
+		err := e.setProcessState()
+		if e.logFile != nil {
+			Expect(e.logFile.Close()).To(Succeed())
+		}
+		Expect(err).To(MatchError(ContainSubstring("unable to use a unix socket for etcd")))
+	})
+})
+
+var _ = Describe("waitEtcdWritable", func() {
+	// newFakeEtcd returns a server implementing the etcd JSON gateway put and range endpoints,
+	// failing writes until unavailableWrites writes have been attempted.
+	newFakeEtcd := func(unavailableWrites int32) (*httptest.Server, *int32) {
+		var lock sync.Mutex
+		kvs := map[string]string{}
+		writes := new(int32)
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req := map[string]string{}
+			Expect(json.NewDecoder(r.Body).Decode(&req)).To(Succeed())
+
+			lock.Lock()
+			defer lock.Unlock()
+			switch r.URL.Path {
+			case "/v3/kv/put":
+				if atomic.AddInt32(writes, 1) <= unavailableWrites {
+					http.Error(w, `{"error":"etcdserver: leader changed","code":14}`, http.StatusServiceUnavailable)
+					return
+				}
+				kvs[req["key"]] = req["value"]
+				fmt.Fprint(w, `{"header":{}}`)
+			case "/v3/kv/range":
+				value, ok := kvs[req["key"]]
+				if !ok {
+					fmt.Fprint(w, `{"header":{}}`)
+					return
+				}
+				fmt.Fprintf(w, `{"header":{},"kvs":[{"key":%q,"value":%q}],"count":"1"}`, req["key"], value)
+			default:
+				http.NotFound(w, r)
+			}
+		})), writes
+	}
+
+	It("waits for a slow etcd to be writable", func() {
+		server, writes := newFakeEtcd(3)
+		defer server.Close()
+		u, err := url.Parse(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(waitEtcdWritable(context.Background(), u, 10*time.Second, time.Second)).To(Succeed())
+		Expect(atomic.LoadInt32(writes)).To(BeEquivalentTo(4))
+	})
+
+	It("fails if etcd doesn't become writable within the timeout", func() {
+		server, _ := newFakeEtcd(math.MaxInt32)
+		defer server.Close()
+		u, err := url.Parse(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = waitEtcdWritable(context.Background(), u, 500*time.Millisecond, time.Second)
+		Expect(err).To(MatchError(ContainSubstring("etcd is not writable after 500ms: error writing to etcd")))
+		Expect(err).To(MatchError(ContainSubstring("leader changed")))
+	})
+
+	It("fails each check within the dial timeout if etcd doesn't respond", func() {
+		// The listener never accepts connections, so etcd never responds.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer l.Close()
+		u := &url.URL{Scheme: "http", Host: l.Addr().String()}
+
+		start := time.Now()
+		err = checkEtcdWritable(context.Background(), newEtcdClient(200*time.Millisecond), u)
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+		Expect(err).To(MatchError(ContainSubstring("error writing to etcd")))
+		var netErr net.Error
+		Expect(errors.As(err, &netErr) && netErr.Timeout()).To(BeTrue())
+	})
+})
+
+// etcdSocketFromArgs returns the path of the unix socket etcd listens on when run in dir with args.
+func etcdSocketFromArgs(dir string, args []string) string {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--listen-client-urls=") {
+			u, err := url.Parse(strings.TrimPrefix(arg, "--listen-client-urls="))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(u.Scheme).To(Equal("unix"))
+			// etcd listens on the host of unix URLs, relative to its working dir.
+			return filepath.Join(dir, u.Host+u.Path)
+		}
+	}
+	Fail("--listen-client-urls not found in the etcd args")
+	return ""
+}
+
+// apiServerEtcdSocketFromArgs returns the path of the unix socket the API server run with args dials for etcd.
+func apiServerEtcdSocketFromArgs(args []string) string {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--etcd-servers=") {
+			u, err := url.Parse(strings.TrimPrefix(arg, "--etcd-servers="))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(u.Scheme).To(Equal("unix"))
+			return u.Path
+		}
+	}
+	Fail("--etcd-servers not found in the API server args")
+	return ""
+}
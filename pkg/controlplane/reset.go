@@ -0,0 +1,186 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controlplane
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	_ = corev1.AddToScheme(scheme)
+	_ = apiextensionsv1.AddToScheme(scheme)
+}
+
+// systemNamespaces are namespaces whose objects are never deleted by Reset. The default namespace is not one of them,
+// because it is where users usually create their objects; like every namespace, it is never deleted itself.
+var systemNamespaces = sets.NewString("kube-system", "kube-public", "kube-node-lease")
+
+// rootCAConfigMapName is the name of the ConfigMap published in each namespace with the cluster CA, used by
+// service account tokens; kBB-8 doesn't run the controller manager, so it would not be recreated if deleted.
+const rootCAConfigMapName = "kube-root-ca.crt"
+
+// resetTimeout is the maximum time Reset waits for all the deleted objects to be gone, e.g. for providers to
+// remove their finalizers.
+const resetTimeout = 1 * time.Minute
+
+// Reset deletes all the namespaced custom resources for the installed CRDs, leaving CRDs, webhooks, and RBAC intact
+// so providers keep working; if includeCoreObjects is true, also ConfigMaps and Secrets are deleted.
+// Objects in system namespaces (kube-system, kube-public, kube-node-lease), the kube-root-ca.crt ConfigMaps and
+// the service account token Secrets are never deleted; objects in the default namespace are deleted, while
+// namespaces, including default, are kept.
+// NOTE: Reset deletes the objects of all kinds and then waits up to one minute overall for them to be gone, so
+// providers must be running for objects with finalizers to be deleted.
+func (cp *ControlPlane) Reset(ctx context.Context, includeCoreObjects bool) error {
+	restConfig, err := cp.RESTConfig()
+	if err != nil {
+		return err
+	}
+
+	c, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	return reset(ctx, c, includeCoreObjects, resetTimeout)
+}
+
+func reset(ctx context.Context, c client.Client, includeCoreObjects bool, timeout time.Duration) error {
+	crds := &apiextensionsv1.CustomResourceDefinitionList{}
+	if err := c.List(ctx, crds); err != nil {
+		return fmt.Errorf("error listing CRDs: %w", err)
+	}
+
+	gvks := []schema.GroupVersionKind{}
+	for _, crd := range crds.Items {
+		if crd.Spec.Scope != apiextensionsv1.NamespaceScoped {
+			continue
+		}
+		for _, v := range crd.Spec.Versions {
+			if v.Storage {
+				gvks = append(gvks, schema.GroupVersionKind{Group: crd.Spec.Group, Version: v.Name, Kind: crd.Spec.Names.Kind})
+			}
+		}
+	}
+	if includeCoreObjects {
+		gvks = append(gvks,
+			corev1.SchemeGroupVersion.WithKind("ConfigMap"),
+			corev1.SchemeGroupVersion.WithKind("Secret"),
+		)
+	}
+
+	// Delete the objects of all kinds first, so finalizers waiting on objects of other kinds can complete.
+	for _, gvk := range gvks {
+		objs, err := listResettable(ctx, c, gvk)
+		if err != nil {
+			return err
+		}
+		for i := range objs {
+			if err := c.Delete(ctx, &objs[i]); client.IgnoreNotFound(err) != nil {
+				return fmt.Errorf("error deleting %s %s/%s: %w", gvk.Kind, objs[i].GetNamespace(), objs[i].GetName(), err)
+			}
+		}
+	}
+	return waitForDeletion(ctx, c, gvks, timeout)
+}
+
+// preserved returns true if Reset must not delete obj.
+func preserved(obj *unstructured.Unstructured) bool {
+	if systemNamespaces.Has(obj.GetNamespace()) {
+		return true
+	}
+	switch obj.GroupVersionKind() {
+	case corev1.SchemeGroupVersion.WithKind("ConfigMap"):
+		return obj.GetName() == rootCAConfigMapName
+	case corev1.SchemeGroupVersion.WithKind("Secret"):
+		secretType, _, _ := unstructured.NestedString(obj.Object, "type")
+		return secretType == string(corev1.SecretTypeServiceAccountToken)
+	}
+	return false
+}
+
+// listResettable lists the objects of a kind that Reset deletes.
+func listResettable(ctx context.Context, c client.Client, gvk schema.GroupVersionKind) ([]unstructured.Unstructured, error) {
+	objs := &unstructured.UnstructuredList{}
+	objs.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	if err := c.List(ctx, objs); err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", gvk.Kind, err)
+	}
+
+	ret := []unstructured.Unstructured{}
+	for i := range objs.Items {
+		if preserved(&objs.Items[i]) {
+			continue
+		}
+		ret = append(ret, objs.Items[i])
+	}
+	return ret, nil
+}
+
+// waitForDeletion waits up to timeout for the objects of all the kinds to be gone; on timeout, it returns an error
+// listing the objects still present, with their finalizers.
+func waitForDeletion(ctx context.Context, c client.Client, gvks []schema.GroupVersionKind, timeout time.Duration) error {
+	pending := map[schema.GroupVersionKind][]unstructured.Unstructured{}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := wait.PollImmediateInfiniteWithContext(waitCtx, 100*time.Millisecond, func(ctx context.Context) (bool, error) {
+		pending = map[schema.GroupVersionKind][]unstructured.Unstructured{}
+		for _, gvk := range gvks {
+			objs, err := listResettable(ctx, c, gvk)
+			if err != nil {
+				return false, err
+			}
+			if len(objs) > 0 {
+				pending[gvk] = objs
+			}
+		}
+		return len(pending) == 0, nil
+	})
+	if err == nil {
+		return nil
+	}
+	if waitCtx.Err() == nil || ctx.Err() != nil {
+		return fmt.Errorf("error waiting for objects to be deleted: %w", err)
+	}
+
+	errs := []error{}
+	for _, gvk := range gvks {
+		objs, ok := pending[gvk]
+		if !ok {
+			continue
+		}
+		names := []string{}
+		for _, obj := range objs {
+			names = append(names, fmt.Sprintf("%s/%s (finalizers: %s)", obj.GetNamespace(), obj.GetName(), strings.Join(obj.GetFinalizers(), ", ")))
+		}
+		errs = append(errs, fmt.Errorf("%s still present: %s", gvk.Kind, strings.Join(names, ", ")))
+	}
+	return fmt.Errorf("timed out after %s waiting for objects to be deleted: %w", timeout, kerrors.NewAggregate(errs))
+}
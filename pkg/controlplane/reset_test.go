@@ -0,0 +1,165 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controlplane
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Reset", func() {
+	newCR := func(namespace, name string) *unstructured.Unstructured {
+		cr := &unstructured.Unstructured{}
+		cr.SetAPIVersion("example.com/v1")
+		cr.SetKind("Foo")
+		cr.SetNamespace(namespace)
+		cr.SetName(name)
+		return cr
+	}
+
+	var (
+		ctx context.Context
+		c   client.Client
+		crd *apiextensionsv1.CustomResourceDefinition
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		crd = &apiextensionsv1.CustomResourceDefinition{
+			ObjectMeta: metav1.ObjectMeta{Name: "foos.example.com"},
+			Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+				Group: "example.com",
+				Names: apiextensionsv1.CustomResourceDefinitionNames{Kind: "Foo", ListKind: "FooList", Plural: "foos"},
+				Scope: apiextensionsv1.NamespaceScoped,
+				Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+					{Name: "v1", Served: true, Storage: true},
+				},
+			},
+		}
+		c = fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			crd,
+			newCR("default", "foo1"),
+			newCR("ns1", "foo2"),
+			newCR("kube-system", "foo3"),
+			&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cm1"}},
+			&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kube-root-ca.crt"}},
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "secret1"}},
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "default-token-abcde"}, Type: corev1.SecretTypeServiceAccountToken},
+			&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "cm2"}},
+		).Build()
+	})
+
+	listCRs := func() []unstructured.Unstructured {
+		crs := &unstructured.UnstructuredList{}
+		crs.SetAPIVersion("example.com/v1")
+		crs.SetKind("FooList")
+		Expect(c.List(ctx, crs)).To(Succeed())
+		return crs.Items
+	}
+
+	It("deletes custom resources outside system namespaces while leaving CRDs intact", func() {
+		Expect(listCRs()).To(HaveLen(3))
+
+		Expect(reset(ctx, c, false, time.Minute)).To(Succeed())
+
+		crs := listCRs()
+		Expect(crs).To(HaveLen(1))
+		Expect(crs[0].GetNamespace()).To(Equal("kube-system"))
+
+		Expect(c.Get(ctx, client.ObjectKeyFromObject(crd), &apiextensionsv1.CustomResourceDefinition{})).To(Succeed())
+		Expect(c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "cm1"}, &corev1.ConfigMap{})).To(Succeed())
+	})
+
+	It("deletes core objects if requested, except the ones required by the cluster", func() {
+		Expect(reset(ctx, c, true, time.Minute)).To(Succeed())
+
+		Expect(listCRs()).To(HaveLen(1))
+		Expect(apierrors.IsNotFound(c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "cm1"}, &corev1.ConfigMap{}))).To(BeTrue())
+		Expect(apierrors.IsNotFound(c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "secret1"}, &corev1.Secret{}))).To(BeTrue())
+		Expect(c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "kube-root-ca.crt"}, &corev1.ConfigMap{})).To(Succeed())
+		Expect(c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "default-token-abcde"}, &corev1.Secret{})).To(Succeed())
+		Expect(c.Get(ctx, client.ObjectKey{Namespace: "kube-system", Name: "cm2"}, &corev1.ConfigMap{})).To(Succeed())
+	})
+
+	It("times out waiting for objects whose finalizers are not removed", func() {
+		stuck := newCR("ns1", "stuck")
+		stuck.SetFinalizers([]string{"example.com/finalizer"})
+		Expect(c.Create(ctx, stuck)).To(Succeed())
+
+		start := time.Now()
+		err := reset(ctx, c, false, 500*time.Millisecond)
+		Expect(err).To(MatchError(ContainSubstring("timed out after 500ms waiting for objects to be deleted: Foo still present: ns1/stuck (finalizers: example.com/finalizer)")))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+
+	It("waits once for all the kinds, reporting all the objects still present", func() {
+		stuck := newCR("ns1", "stuck")
+		stuck.SetFinalizers([]string{"example.com/finalizer"})
+		Expect(c.Create(ctx, stuck)).To(Succeed())
+		Expect(c.Create(ctx, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "ns1", Name: "stuck", Finalizers: []string{"example.com/finalizer"}}})).To(Succeed())
+
+		start := time.Now()
+		err := reset(ctx, c, true, 500*time.Millisecond)
+		Expect(err).To(MatchError(ContainSubstring("Foo still present: ns1/stuck (finalizers: example.com/finalizer)")))
+		Expect(err).To(MatchError(ContainSubstring("ConfigMap still present: ns1/stuck (finalizers: example.com/finalizer)")))
+		// A single timeout bounds the wait for all the kinds.
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+
+	It("deletes all the kinds before waiting, so finalizers can wait on objects of other kinds", func() {
+		// The finalizer of the custom resource is removed only once the ConfigMaps are gone, like a provider does when
+		// cleaning up the objects it owns.
+		owner := newCR("ns1", "owner")
+		owner.SetFinalizers([]string{"example.com/finalizer"})
+		Expect(c.Create(ctx, owner)).To(Succeed())
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			defer GinkgoRecover()
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(50 * time.Millisecond):
+				}
+				if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "cm1"}, &corev1.ConfigMap{}); !apierrors.IsNotFound(err) {
+					continue
+				}
+				obj := newCR("ns1", "owner")
+				if err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+					return
+				}
+				obj.SetFinalizers(nil)
+				_ = c.Update(ctx, obj)
+			}
+		}()
+
+		Expect(reset(ctx, c, true, 2*time.Second)).To(Succeed())
+		Expect(listCRs()).To(HaveLen(1))
+	})
+})
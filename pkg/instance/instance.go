@@ -0,0 +1,336 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package instance implements the persisted description of a running kBB-8 instance, the instance manifest;
+// it allows to interact with the instance from a different process, e.g. for stopping a detached instance
+// or for adopting a control plane previously started.
+package instance
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+
+	"github.com/fabriziopandini/kBB-8/pkg/kubeconfig"
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+)
+
+const fileName = "instance.yaml"
+
+// reservedNames are the names of the folders used by the unnamed instance, that can't be used as instance names.
+var reservedNames = []string{"kubernetes", "provider"}
+
+// Instance is the persisted description of a running kBB-8 instance.
+type Instance struct {
+	// Name is the name of the instance; it is empty for the unnamed instance.
+	Name string `json:"name,omitempty"`
+
+	// ClusterName is the name of the kBB-8 cluster in the kubeconfig file.
+	ClusterName string `json:"clusterName"`
+
+	// KubeConfigFile is the path of the kubeconfig file with the kBB-8 context.
+	KubeConfigFile string `json:"kubeConfigFile"`
+
+	// KubeConfigContext is the name of the kBB-8 context.
+	KubeConfigContext string `json:"kubeConfigContext"`
+
+	// EtcdDataDir is the etcd data dir, deleted when the instance is stopped.
+	EtcdDataDir string `json:"etcdDataDir,omitempty"`
+
+	// Owner is the kBB-8 process running the instance; it is not set for detached instances, that keep running
+	// after the kBB-8 process exits.
+	Owner *process.Identity `json:"owner,omitempty"`
+
+	// Components of the instance, in start order; components not running, e.g. a provider stopped
+	// with StopProvider, are not included.
+	Components []Component `json:"components"`
+
+	// HealthServer is the process serving the health of a detached instance, if any; it is stopped together
+	// with the instance.
+	HealthServer *Component `json:"healthServer,omitempty"`
+}
+
+// Component is the persisted description of a kBB-8 component.
+type Component struct {
+	Name     string `json:"name"`
+	URL      string `json:"url,omitempty"`
+	PID      int    `json:"pid,omitempty"`
+	PprofURL string `json:"pprofURL,omitempty"`
+
+	// UnixSocket is the path of the unix socket the component health check URL is served on, if any.
+	UnixSocket string `json:"unixSocket,omitempty"`
+
+	// Identity identifies the component process, so it can be safely stopped even if its pid was reused.
+	Identity *process.Identity `json:"identity,omitempty"`
+
+	// Args are the args the component runs with, so they are known when the component is adopted by
+	// a different kBB-8 process.
+	Args []string `json:"args,omitempty"`
+}
+
+// ComponentStatus describes the observed status of a kBB-8 component.
+type ComponentStatus struct {
+	// Name of the component, e.g. etcd, apiserver or the provider name.
+	Name string `json:"name"`
+
+	// Running is true if the component process is started and has not exited.
+	Running bool `json:"running"`
+
+	// Healthy is true if the component is running and its health check succeeds.
+	Healthy bool `json:"healthy"`
+
+	// URL is the health check URL of the component.
+	URL string `json:"url,omitempty"`
+
+	// PID is the process id of the component, or 0 if it was never started; it is stable for the life of the process,
+	// e.g. for supervising it externally, and it changes when the component is restarted.
+	PID int `json:"pid,omitempty"`
+
+	// PprofURL is the URL of the component pprof endpoints, if profiling is enabled.
+	PprofURL string `json:"pprofURL,omitempty"`
+
+	// LastError is the last error observed for the component, if any.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Dir returns the folder where the instance with the given name stores its manifest and the logs, data and certs
+// of its components. The unnamed instance uses the .tmp folder in the current directory, while named instances
+// use .tmp/<name>, so instances with different names can run side by side.
+func Dir(name string) (string, error) {
+	if err := ValidateName(name); err != nil {
+		return "", err
+	}
+	currentDir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(currentDir, ".tmp", name), nil
+}
+
+// ValidateName returns an error if name can't be used as an instance name; the empty name identifies
+// the unnamed instance.
+func ValidateName(name string) error {
+	if name == "" {
+		return nil
+	}
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		return fmt.Errorf("invalid instance name %q: %s", name, strings.Join(errs, ", "))
+	}
+	for _, r := range reservedNames {
+		if name == r {
+			return fmt.Errorf("invalid instance name %q: the name is reserved", name)
+		}
+	}
+	return nil
+}
+
+// Path returns the path of the manifest of the instance with the given name.
+func Path(name string) (string, error) {
+	dir, err := Dir(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fileName), nil
+}
+
+// Load reads the manifest of the instance with the given name; it returns an error satisfying os.IsNotExist
+// if there is no instance running.
+func Load(name string) (*Instance, error) {
+	instanceFile, err := Path(name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(instanceFile) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	instance := &Instance{}
+	if err := yaml.Unmarshal(b, instance); err != nil {
+		return nil, fmt.Errorf("unable to read instance file %s: %w", instanceFile, err)
+	}
+	return instance, nil
+}
+
+// Save writes the instance manifest.
+func (i *Instance) Save() error {
+	b, err := yaml.Marshal(i)
+	if err != nil {
+		return err
+	}
+
+	instanceFile, err := Path(i.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(instanceFile), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(instanceFile, b, 0600)
+}
+
+// Delete removes the manifest of the instance with the given name.
+func Delete(name string) error {
+	instanceFile, err := Path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(instanceFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Component returns the component with the given name, if any.
+func (i *Instance) Component(name string) (Component, bool) {
+	for _, c := range i.Components {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Component{}, false
+}
+
+// Status returns the status of each component of the instance, probing its health endpoint and checking its process liveness.
+func (i *Instance) Status(ctx context.Context) []ComponentStatus {
+	ret := []ComponentStatus{}
+	for _, c := range i.Components {
+		s := ComponentStatus{
+			Name:     c.Name,
+			URL:      c.URL,
+			PID:      c.PID,
+			PprofURL: c.PprofURL,
+		}
+
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			s.Running = c.alive()
+			s.LastError = err.Error()
+			ret = append(ret, s)
+			continue
+		}
+		hc := process.HealthCheck{URL: *u, UnixSocket: c.UnixSocket}
+		ps := process.PIDStatus(ctx, c.PID, hc)
+		if c.Identity != nil {
+			ps = c.Identity.Status(ctx, hc)
+		}
+		s.Running = ps.Running
+		s.Healthy = ps.Healthy
+		if ps.Err != nil {
+			s.LastError = ps.Err.Error()
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// Stop stops all the components of the instance, in reverse start order, and then cleans up
+// the kubeconfig file, the etcd data dir and the instance manifest.
+// Only processes matching the recorded identity are stopped, so unrelated processes reusing a recorded pid,
+// as well as components without a recorded identity, are left alone.
+func (i *Instance) Stop() error {
+	_, err := i.stopComponents()
+	return err
+}
+
+// alive returns true if the component process is still running; for components with a recorded identity,
+// a different process reusing the pid is not considered.
+func (c Component) alive() bool {
+	if c.Identity != nil {
+		return c.Identity.Alive()
+	}
+	return process.Alive(c.PID)
+}
+
+// Orphaned returns true if the kBB-8 process running the instance exited without stopping it,
+// e.g. because it was killed with SIGKILL; detached instances are never orphaned.
+func (i *Instance) Orphaned() bool {
+	return i.Owner != nil && !i.Owner.Alive()
+}
+
+// StopOrphans stops the components of the instance still running after the kBB-8 process running them exited
+// without stopping them, and then cleans up like Stop; it returns the names of the stopped components.
+// Only processes matching the recorded identity are stopped, so unrelated processes reusing a recorded pid,
+// as well as components without a recorded identity, are left alone.
+func (i *Instance) StopOrphans() ([]string, error) {
+	return i.stopComponents()
+}
+
+// stopComponents stops the components matching the recorded identity, in reverse start order, and then cleans
+// up the instance; it returns the names of the stopped components.
+func (i *Instance) stopComponents() ([]string, error) {
+	stopped := []string{}
+	errs := []error{}
+	if stoppedHealthServer, err := i.StopHealthServer(); err != nil {
+		errs = append(errs, err)
+	} else if stoppedHealthServer {
+		stopped = append(stopped, i.HealthServer.Name)
+	}
+	for j := len(i.Components) - 1; j >= 0; j-- {
+		c := i.Components[j]
+		if c.Identity == nil || !c.Identity.Alive() {
+			continue
+		}
+		if err := c.Identity.Stop(process.DefaultStopGracePeriod); err != nil {
+			errs = append(errs, fmt.Errorf("error stopping %s: %w", c.Name, err))
+			continue
+		}
+		stopped = append(stopped, c.Name)
+	}
+	if len(errs) > 0 {
+		// Keep the instance, so a follow-up Stop can finish the job.
+		return stopped, kerrors.NewAggregate(errs)
+	}
+	return stopped, i.cleanup()
+}
+
+// StopHealthServer stops the process serving the health of the instance, if any and if it matches the recorded
+// identity; it returns true if the process was stopped.
+func (i *Instance) StopHealthServer() (bool, error) {
+	c := i.HealthServer
+	if c == nil || c.Identity == nil || !c.Identity.Alive() {
+		return false, nil
+	}
+	if err := c.Identity.Stop(process.DefaultStopGracePeriod); err != nil {
+		return false, fmt.Errorf("error stopping %s: %w", c.Name, err)
+	}
+	return true, nil
+}
+
+// cleanup removes the kubeconfig context, the etcd data dir and the manifest of a stopped instance.
+func (i *Instance) cleanup() error {
+	errs := []error{}
+	if err := kubeconfig.Remove(i.ClusterName, ""); err != nil {
+		errs = append(errs, err)
+	}
+	if i.EtcdDataDir != "" {
+		if err := os.RemoveAll(i.EtcdDataDir); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := Delete(i.Name); err != nil {
+		errs = append(errs, err)
+	}
+	return kerrors.NewAggregate(errs)
+}
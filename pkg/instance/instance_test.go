@@ -0,0 +1,220 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package instance
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+)
+
+var _ = Describe("Instance", func() {
+	DescribeTable("ValidateName",
+		func(name string, expected string) {
+			err := ValidateName(name)
+			if expected == "" {
+				Expect(err).NotTo(HaveOccurred())
+				return
+			}
+			Expect(err).To(MatchError(ContainSubstring(expected)))
+		},
+		Entry("unnamed instance", "", ""),
+		Entry("valid name", "e2e-1", ""),
+		Entry("path separator", "../e2e", "invalid instance name"),
+		Entry("upper case", "E2E", "invalid instance name"),
+		Entry("reserved name", "kubernetes", "the name is reserved"),
+	)
+
+	Describe("Save and Load", func() {
+		var dir, currentDir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "instance-test")
+			Expect(err).NotTo(HaveOccurred())
+			currentDir, err = os.Getwd()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Chdir(dir)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.Chdir(currentDir)).To(Succeed())
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("keeps the manifests of instances with different names separated", func() {
+			Expect((&Instance{ClusterName: "bootstrap"}).Save()).To(Succeed())
+			Expect((&Instance{Name: "e2e", ClusterName: "bootstrap-e2e"}).Save()).To(Succeed())
+
+			unnamed, err := Load("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(unnamed.ClusterName).To(Equal("bootstrap"))
+			named, err := Load("e2e")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(named.ClusterName).To(Equal("bootstrap-e2e"))
+
+			// The unnamed instance manifest keeps its location, for compatibility.
+			Expect(filepath.Join(".tmp", fileName)).To(BeARegularFile())
+			Expect(filepath.Join(".tmp", "e2e", fileName)).To(BeARegularFile())
+
+			Expect(Delete("e2e")).To(Succeed())
+			_, err = Load("e2e")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			_, err = Load("")
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("Status", func() {
+		It("reports running, crashed and unhealthy components", func() {
+			healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer healthy.Close()
+			unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer unhealthy.Close()
+
+			instance := &Instance{
+				Components: []Component{
+					{Name: "etcd", URL: healthy.URL, PID: os.Getpid()},
+					{Name: "apiserver", URL: unhealthy.URL, PID: os.Getpid()},
+					{Name: "CAPI", URL: healthy.URL, PID: 0},
+				},
+			}
+
+			status := instance.Status(context.Background())
+			Expect(status).To(HaveLen(3))
+
+			Expect(status[0].Running).To(BeTrue())
+			Expect(status[0].Healthy).To(BeTrue())
+			Expect(status[0].LastError).To(BeEmpty())
+
+			Expect(status[1].Running).To(BeTrue())
+			Expect(status[1].Healthy).To(BeFalse())
+			Expect(status[1].LastError).To(ContainSubstring("503"))
+
+			Expect(status[2].Running).To(BeFalse())
+			Expect(status[2].Healthy).To(BeFalse())
+			Expect(status[2].LastError).NotTo(BeEmpty())
+		})
+	})
+
+	Describe("StopOrphans", func() {
+		var dir, currentDir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "instance-test")
+			Expect(err).NotTo(HaveOccurred())
+			currentDir, err = os.Getwd()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Chdir(dir)).To(Succeed())
+			Expect(os.Setenv("KUBECONFIG", filepath.Join(dir, "kubeconfig"))).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.Unsetenv("KUBECONFIG")).To(Succeed())
+			Expect(os.Chdir(currentDir)).To(Succeed())
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		// startProcess starts a long running process, returning a channel closed once it exits.
+		startProcess := func() (*exec.Cmd, chan struct{}) {
+			cmd := exec.Command("sleep", "60")
+			Expect(cmd.Start()).To(Succeed())
+			exited := make(chan struct{})
+			go func() {
+				_ = cmd.Wait()
+				close(exited)
+			}()
+			return cmd, exited
+		}
+
+		It("stops only the processes matching the recorded identity", func() {
+			genuine, genuineExited := startProcess()
+			lookalike, lookalikeExited := startProcess()
+			defer func() {
+				_ = lookalike.Process.Kill()
+				<-lookalikeExited
+			}()
+
+			genuineIdentity, err := process.Identify(genuine.Process.Pid)
+			Expect(err).NotTo(HaveOccurred())
+			// The lookalike reuses a recorded pid, but it was started after the recorded process.
+			lookalikeIdentity, err := process.Identify(lookalike.Process.Pid)
+			Expect(err).NotTo(HaveOccurred())
+			lookalikeIdentity.StartTime = "0"
+
+			instance := &Instance{
+				ClusterName: "bootstrap",
+				Owner:       &process.Identity{PID: lookalike.Process.Pid, Executable: "kBB-8", StartTime: "0"},
+				Components: []Component{
+					{Name: "etcd", PID: genuine.Process.Pid, Identity: &genuineIdentity},
+					{Name: "apiserver", PID: lookalike.Process.Pid, Identity: &lookalikeIdentity},
+					{Name: "CAPI", PID: lookalike.Process.Pid},
+				},
+			}
+			Expect(instance.Save()).To(Succeed())
+			Expect(instance.Orphaned()).To(BeTrue())
+
+			stopped, err := instance.StopOrphans()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stopped).To(ConsistOf("etcd"))
+			Eventually(genuineExited).Should(BeClosed())
+			Consistently(lookalikeExited, "500ms").ShouldNot(BeClosed())
+
+			_, err = Load("")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("stops the health server of the instance", func() {
+			healthServer, healthServerExited := startProcess()
+			identity, err := process.Identify(healthServer.Process.Pid)
+			Expect(err).NotTo(HaveOccurred())
+
+			instance := &Instance{
+				ClusterName:  "bootstrap",
+				HealthServer: &Component{Name: "health-server", PID: healthServer.Process.Pid, Identity: &identity},
+			}
+			Expect(instance.Save()).To(Succeed())
+
+			stopped, err := instance.StopOrphans()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stopped).To(ConsistOf("health-server"))
+			Eventually(healthServerExited).Should(BeClosed())
+		})
+
+		It("doesn't consider orphaned instances with a running owner or detached", func() {
+			owner, err := process.Identify(os.Getpid())
+			Expect(err).NotTo(HaveOccurred())
+			Expect((&Instance{Owner: &owner}).Orphaned()).To(BeFalse())
+			Expect((&Instance{}).Orphaned()).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,181 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	"github.com/fabriziopandini/kBB-8/pkg/manifest"
+)
+
+// Apply reads the objects from the given YAML files or directories and server-side applies them to the control plane
+// like ApplyObjects; objects of any kind are supported.
+func (m *Manager) Apply(ctx context.Context, manifests ...string) error {
+	restConfig, err := m.ControlPlane.RESTConfig()
+	if err != nil {
+		return err
+	}
+
+	mapper, err := m.RESTMapper()
+	if err != nil {
+		return err
+	}
+
+	c, err := client.New(restConfig, client.Options{Mapper: mapper})
+	if err != nil {
+		return err
+	}
+
+	_, err = ApplyObjects(ctx, c, manifests...)
+	return err
+}
+
+func readObjects(manifests ...string) ([]*unstructured.Unstructured, error) {
+	docs, err := manifest.ReadPaths(manifests...)
+	if err != nil {
+		return nil, err
+	}
+
+	objs := []*unstructured.Unstructured{}
+	for _, doc := range docs {
+		j, err := yaml.YAMLToJSON(doc)
+		if err != nil {
+			return nil, err
+		}
+		// Skip empty documents.
+		if len(j) == 0 || string(j) == "null" {
+			continue
+		}
+
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(j); err != nil {
+			return nil, err
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+func objectName(obj client.Object) string {
+	if obj.GetNamespace() == "" {
+		return obj.GetName()
+	}
+	return fmt.Sprintf("%s/%s", obj.GetNamespace(), obj.GetName())
+}
+
+// FieldManager is the field manager used by ApplyObjects for server-side applying objects.
+const FieldManager = "kBB-8"
+
+// Actions reported in ObjectResult.
+const (
+	ObjectCreated   = "created"
+	ObjectUpdated   = "updated"
+	ObjectUnchanged = "unchanged"
+	ObjectDeleted   = "deleted"
+	ObjectNotFound  = "not found"
+)
+
+// ObjectResult reports what ApplyObjects or DeleteObjects did to an object.
+type ObjectResult struct {
+	Kind   string
+	Name   string
+	Action string
+}
+
+func (r ObjectResult) String() string {
+	return fmt.Sprintf("%s %s %s", r.Kind, r.Name, r.Action)
+}
+
+// ApplyObjects reads the objects from the given YAML files or directories and server-side applies them
+// with the kBB-8 field manager, reporting whether each object was created, updated or left unchanged.
+func ApplyObjects(ctx context.Context, c client.Client, manifests ...string) ([]ObjectResult, error) {
+	objs, err := readObjects(manifests...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ObjectResult{}
+	errs := []error{}
+	for _, obj := range objs {
+		action, err := serverSideApply(ctx, c, obj)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		results = append(results, ObjectResult{Kind: obj.GetKind(), Name: objectName(obj), Action: action})
+	}
+	return results, kerrors.NewAggregate(errs)
+}
+
+func serverSideApply(ctx context.Context, c client.Client, obj *unstructured.Unstructured) (string, error) {
+	current := &unstructured.Unstructured{}
+	current.SetGroupVersionKind(obj.GroupVersionKind())
+	currentResourceVersion := ""
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), current); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return "", fmt.Errorf("error fetching %s %s: %w", obj.GetKind(), objectName(obj), err)
+		}
+	} else {
+		currentResourceVersion = current.GetResourceVersion()
+	}
+
+	// Apply patches must not carry a resourceVersion, or they fail on conflicts instead of merging.
+	obj.SetResourceVersion("")
+	if err := c.Patch(ctx, obj, client.Apply, client.FieldOwner(FieldManager), client.ForceOwnership); err != nil {
+		return "", fmt.Errorf("error applying %s %s: %w", obj.GetKind(), objectName(obj), err)
+	}
+
+	switch currentResourceVersion {
+	case "":
+		return ObjectCreated, nil
+	case obj.GetResourceVersion():
+		return ObjectUnchanged, nil
+	default:
+		return ObjectUpdated, nil
+	}
+}
+
+// DeleteObjects reads the objects from the given YAML files or directories and deletes them, reporting
+// objects that were already missing as not found.
+func DeleteObjects(ctx context.Context, c client.Client, manifests ...string) ([]ObjectResult, error) {
+	objs, err := readObjects(manifests...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ObjectResult{}
+	errs := []error{}
+	for _, obj := range objs {
+		action := ObjectDeleted
+		if err := c.Delete(ctx, obj); err != nil {
+			if !apierrors.IsNotFound(err) {
+				errs = append(errs, fmt.Errorf("error deleting %s %s: %w", obj.GetKind(), objectName(obj), err))
+				continue
+			}
+			action = ObjectNotFound
+		}
+		results = append(results, ObjectResult{Kind: obj.GetKind(), Name: objectName(obj), Action: action})
+	}
+	return results, kerrors.NewAggregate(errs)
+}
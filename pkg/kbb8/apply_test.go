@@ -0,0 +1,192 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+var _ = Describe("Apply", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "apply-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("reads objects of any kind from files and directories", func() {
+		Expect(ioutil.WriteFile(filepath.Join(dir, "a.yaml"), []byte(`apiVersion: v1
+kind: Namespace
+metadata:
+  name: ns1
+---
+---
+apiVersion: cluster.x-k8s.io/v1beta1
+kind: Cluster
+metadata:
+  name: cluster1
+  namespace: ns1
+`), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("not a manifest"), 0600)).To(Succeed())
+
+		objs, err := readObjects(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(objs).To(HaveLen(2))
+		Expect(objs[0].GetKind()).To(Equal("Namespace"))
+		Expect(objs[1].GetKind()).To(Equal("Cluster"))
+		Expect(objs[1].GetNamespace()).To(Equal("ns1"))
+	})
+
+	Context("against an API server", func() {
+		var env *envtest.Environment
+		var c client.Client
+
+		BeforeEach(func() {
+			// Server-side apply is implemented by the API server, and the fake client doesn't support it.
+			if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+				Skip("KUBEBUILDER_ASSETS is not set, no API server binaries to test against")
+			}
+			env = &envtest.Environment{}
+			restConfig, err := env.Start()
+			Expect(err).NotTo(HaveOccurred())
+			c, err = client.New(restConfig, client.Options{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			if env != nil {
+				Expect(env.Stop()).To(Succeed())
+			}
+		})
+
+		It("applies and deletes objects reporting the action for each object", func() {
+			// An object created by another field manager is taken over.
+			Expect(c.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "existing", Namespace: "default"},
+				Data:       map[string]string{"key": "old"},
+			})).To(Succeed())
+
+			cm := filepath.Join(dir, "cm.yaml")
+			writeConfigMaps := func(value string) {
+				Expect(ioutil.WriteFile(cm, []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: existing
+  namespace: default
+data:
+  key: `+value+`
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cm1
+  namespace: default
+data:
+  key: `+value+`
+`), 0600)).To(Succeed())
+			}
+
+			writeConfigMaps("v1")
+			results, err := ApplyObjects(context.Background(), c, cm)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(Equal([]ObjectResult{
+				{Kind: "ConfigMap", Name: "default/existing", Action: ObjectUpdated},
+				{Kind: "ConfigMap", Name: "default/cm1", Action: ObjectCreated},
+			}))
+
+			results, err = ApplyObjects(context.Background(), c, cm)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(Equal([]ObjectResult{
+				{Kind: "ConfigMap", Name: "default/existing", Action: ObjectUnchanged},
+				{Kind: "ConfigMap", Name: "default/cm1", Action: ObjectUnchanged},
+			}))
+
+			writeConfigMaps("v2")
+			results, err = ApplyObjects(context.Background(), c, cm)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(Equal([]ObjectResult{
+				{Kind: "ConfigMap", Name: "default/existing", Action: ObjectUpdated},
+				{Kind: "ConfigMap", Name: "default/cm1", Action: ObjectUpdated},
+			}))
+
+			current := &corev1.ConfigMap{}
+			Expect(c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "existing"}, current)).To(Succeed())
+			Expect(current.Data).To(HaveKeyWithValue("key", "v2"))
+			Expect(current.ManagedFields).To(ContainElement(HaveField("Manager", FieldManager)))
+
+			results, err = DeleteObjects(context.Background(), c, cm)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(Equal([]ObjectResult{
+				{Kind: "ConfigMap", Name: "default/existing", Action: ObjectDeleted},
+				{Kind: "ConfigMap", Name: "default/cm1", Action: ObjectDeleted},
+			}))
+			Expect(apierrors.IsNotFound(c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "cm1"}, current))).To(BeTrue())
+
+			results, err = DeleteObjects(context.Background(), c, cm)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(Equal([]ObjectResult{
+				{Kind: "ConfigMap", Name: "default/existing", Action: ObjectNotFound},
+				{Kind: "ConfigMap", Name: "default/cm1", Action: ObjectNotFound},
+			}))
+		})
+
+		It("aggregates per-object errors", func() {
+			Expect(ioutil.WriteFile(filepath.Join(dir, "bad.yaml"), []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bad1
+  namespace: missing1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ok
+  namespace: default
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bad2
+  namespace: missing2
+`), 0600)).To(Succeed())
+
+			results, err := ApplyObjects(context.Background(), c, dir)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("missing1/bad1"))
+			Expect(err.Error()).To(ContainSubstring("missing2/bad2"))
+			Expect(results).To(Equal([]ObjectResult{{Kind: "ConfigMap", Name: "default/ok", Action: ObjectCreated}}))
+			Expect(c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "ok"}, &corev1.ConfigMap{})).To(Succeed())
+		})
+	})
+})
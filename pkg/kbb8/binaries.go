@@ -0,0 +1,44 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+
+	"github.com/fabriziopandini/kBB-8/pkg/binaries"
+)
+
+// apiServerBinaryName is the name of the kube-apiserver binary in the Kubernetes release bucket.
+const apiServerBinaryName = "kube-apiserver"
+
+// resolveAPIServer returns the path of the kube-apiserver binary for opts.KubernetesVersion in the binaries cache,
+// downloading it if missing, or an empty string if no version is set, so the binary in the Kubernetes package is used;
+// in this case nothing is downloaded, so offline mode has no effect.
+func resolveAPIServer(ctx context.Context, opts Options) (string, error) {
+	if opts.KubernetesVersion == "" {
+		return "", nil
+	}
+	cache, err := binaries.NewCache(
+		binaries.HTTPDownload(binaries.KubernetesReleaseURL),
+		binaries.WithCacheDir(opts.BinariesCacheDir),
+		binaries.WithOffline(opts.Offline),
+	)
+	if err != nil {
+		return "", err
+	}
+	return cache.Path(ctx, binaries.Binary{Name: apiServerBinaryName, Version: opts.KubernetesVersion})
+}
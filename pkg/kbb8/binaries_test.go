@@ -0,0 +1,74 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("resolveAPIServer", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "binaries-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("uses the Kubernetes package if no version is set", func() {
+		path, err := resolveAPIServer(context.Background(), Options{BinariesCacheDir: dir})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(BeEmpty())
+	})
+
+	It("uses the Kubernetes package in offline mode if no version is set, because nothing is downloaded", func() {
+		path, err := resolveAPIServer(context.Background(), Options{BinariesCacheDir: dir, Offline: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(BeEmpty())
+	})
+
+	It("uses kube-apiserver from the binaries cache in offline mode", func() {
+		content := []byte("#!/bin/sh\n")
+		sum := sha256.Sum256(content)
+		cached := filepath.Join(dir, "v1.23.0", runtime.GOOS+"-"+runtime.GOARCH, "kube-apiserver")
+		Expect(os.MkdirAll(filepath.Dir(cached), 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(cached, content, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(cached+".sha256", []byte(hex.EncodeToString(sum[:])), 0600)).To(Succeed())
+
+		path, err := resolveAPIServer(context.Background(), Options{KubernetesVersion: "v1.23.0", BinariesCacheDir: dir, Offline: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(Equal(cached))
+	})
+
+	It("fails fast in offline mode if kube-apiserver is not cached", func() {
+		_, err := resolveAPIServer(context.Background(), Options{KubernetesVersion: "v1.23.0", BinariesCacheDir: dir, Offline: true})
+		Expect(err).To(MatchError(ContainSubstring("can't be downloaded in offline mode")))
+	})
+})
@@ -0,0 +1,104 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fabriziopandini/kBB-8/pkg/provider"
+)
+
+// RESTMapper returns a RESTMapper for the control plane; the mapper is refreshed after providers
+// install their CRDs, so it can resolve the provider's GVKs.
+func (m *Manager) RESTMapper() (meta.RESTMapper, error) {
+	m.clientsLock.Lock()
+	defer m.clientsLock.Unlock()
+
+	if m.restMapper == nil {
+		restConfig, err := m.ControlPlane.RESTConfig()
+		if err != nil {
+			return nil, err
+		}
+		dc, err := discovery.NewDiscoveryClientForConfig(restConfig)
+		if err != nil {
+			return nil, err
+		}
+		m.restMapper = restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(dc))
+	}
+	return m.restMapper, nil
+}
+
+// DynamicClient returns a dynamic client for the control plane.
+func (m *Manager) DynamicClient() (dynamic.Interface, error) {
+	m.clientsLock.Lock()
+	defer m.clientsLock.Unlock()
+
+	if m.dynamicClient == nil {
+		restConfig, err := m.ControlPlane.RESTConfig()
+		if err != nil {
+			return nil, err
+		}
+		if m.dynamicClient, err = dynamic.NewForConfig(restConfig); err != nil {
+			return nil, err
+		}
+	}
+	return m.dynamicClient, nil
+}
+
+// manifestClient returns the client shared by providers for installing the objects in their manifests.
+func (m *Manager) manifestClient() (client.Client, error) {
+	m.clientsLock.Lock()
+	providerClient := m.providerClient
+	m.clientsLock.Unlock()
+	if providerClient != nil {
+		return providerClient, nil
+	}
+
+	mapper, err := m.RESTMapper()
+	if err != nil {
+		return nil, err
+	}
+
+	m.clientsLock.Lock()
+	defer m.clientsLock.Unlock()
+
+	if m.providerClient == nil {
+		restConfig, err := m.ControlPlane.RESTConfig()
+		if err != nil {
+			return nil, err
+		}
+		if m.providerClient, err = provider.NewManifestClient(restConfig, mapper); err != nil {
+			return nil, err
+		}
+	}
+	return m.providerClient, nil
+}
+
+// invalidateRESTMapper resets the RESTMapper, so new CRDs are discovered on next use.
+func (m *Manager) invalidateRESTMapper() {
+	m.clientsLock.Lock()
+	defer m.clientsLock.Unlock()
+
+	if m.restMapper != nil {
+		m.restMapper.Reset()
+	}
+}
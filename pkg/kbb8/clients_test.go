@@ -0,0 +1,69 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery/cached/memory"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/restmapper"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+var _ = Describe("RESTMapper", func() {
+	It("resolves CRDs installed after the first use once invalidated", func() {
+		coreResources := &metav1.APIResourceList{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "configmaps", Namespaced: true, Kind: "ConfigMap"},
+			},
+		}
+		dc := &fakediscovery.FakeDiscovery{Fake: &clienttesting.Fake{Resources: []*metav1.APIResourceList{coreResources}}}
+		m := &Manager{
+			restMapper: restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(dc)),
+		}
+
+		gvk := schema.GroupVersionKind{Group: "cluster.x-k8s.io", Version: "v1beta1", Kind: "Cluster"}
+
+		mapper, err := m.RESTMapper()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		Expect(meta.IsNoMatchError(err)).To(BeTrue())
+
+		// Install the CRD.
+		dc.Resources = []*metav1.APIResourceList{
+			coreResources,
+			{
+				GroupVersion: gvk.GroupVersion().String(),
+				APIResources: []metav1.APIResource{
+					{Name: "clusters", Namespaced: true, Kind: gvk.Kind},
+				},
+			},
+		}
+		m.invalidateRESTMapper()
+
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mapping.Resource).To(Equal(gvk.GroupVersion().WithResource("clusters")))
+		Expect(mapping.Scope.Name()).To(Equal(meta.RESTScopeNameNamespace))
+	})
+})
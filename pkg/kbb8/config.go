@@ -0,0 +1,218 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/fabriziopandini/kBB-8/pkg/instance"
+)
+
+// configFileName is the name of the file the effective configuration of an instance is stored in,
+// in the instance folder.
+const configFileName = "config.yaml"
+
+// Config is the effective configuration of a kBB-8 instance, after defaults, options and the values derived from
+// the provider manifests, e.g. feature gates, are resolved; it is useful for debugging why kBB-8 behaved
+// a certain way.
+type Config struct {
+	// InstanceName is the name of the instance, empty for the unnamed instance.
+	InstanceName string `json:"instanceName,omitempty"`
+
+	// KubeConfigFile is the path of the kubeconfig file with the kBB-8 context.
+	KubeConfigFile string `json:"kubeConfigFile"`
+
+	// KubeConfigContext is the name of the kBB-8 context.
+	KubeConfigContext string `json:"kubeConfigContext"`
+
+	// ControlPlane is the configuration of the control plane.
+	ControlPlane ControlPlaneConfig `json:"controlPlane"`
+
+	// Providers are the configurations of the providers.
+	Providers []ProviderConfig `json:"providers"`
+}
+
+// ControlPlaneConfig is the effective configuration of the control plane.
+type ControlPlaneConfig struct {
+	// KubernetesPackagePath is the path of the package with the Kubernetes binaries.
+	KubernetesPackagePath string `json:"kubernetesPackagePath"`
+
+	// KubernetesVersion is the version of the API server binary, e.g. v1.23.0, if the API server is started.
+	KubernetesVersion string `json:"kubernetesVersion,omitempty"`
+
+	// ServiceClusterIPRange is the CIDR the cluster IPs of Services are allocated from, as read from the args
+	// the API server runs with; it is not set if the API server is not started.
+	ServiceClusterIPRange string `json:"serviceClusterIPRange,omitempty"`
+
+	// Etcd is the configuration of etcd, if started.
+	Etcd *ComponentConfig `json:"etcd,omitempty"`
+
+	// APIServer is the configuration of the API server, if started.
+	APIServer *ComponentConfig `json:"apiServer,omitempty"`
+}
+
+// ComponentConfig is the effective configuration of a control plane component.
+type ComponentConfig struct {
+	// Path is the path of the component binary.
+	Path string `json:"path"`
+
+	// URL is the URL the component serves clients at.
+	URL string `json:"url,omitempty"`
+
+	// Args are the args the component runs with; they are not known for components adopted from
+	// a previous kBB-8 process.
+	Args []string `json:"args,omitempty"`
+}
+
+// ProviderConfig is the effective configuration of a provider.
+type ProviderConfig struct {
+	// Name of the provider.
+	Name string `json:"name"`
+
+	// PackagePath is the path of the provider package.
+	PackagePath string `json:"packagePath"`
+
+	// Args are the args the provider manager binary runs with, including the feature gates from the provider
+	// manifest, from the provider args and from the provider options.
+	Args []string `json:"args,omitempty"`
+
+	// FeatureGates are the feature gates the provider manager binary runs with.
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+
+	// WebhookURL is the URL the provider webhooks are served at, if any.
+	WebhookURL string `json:"webhookURL,omitempty"`
+
+	// HealthURL is the URL the provider health is checked at.
+	HealthURL string `json:"healthURL,omitempty"`
+
+	// DependsOn are the providers this provider starts after.
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+// EffectiveConfig returns the effective configuration of the instance; it fails if the Manager is not started.
+func (m *Manager) EffectiveConfig() (Config, error) {
+	if !m.isStarted() {
+		return Config{}, fmt.Errorf("unable to get the effective configuration: kBB-8 is not started")
+	}
+	return m.effectiveConfig(), nil
+}
+
+// effectiveConfig returns the effective configuration of the instance, as started so far.
+func (m *Manager) effectiveConfig() Config {
+	cp := m.ControlPlane
+	c := Config{
+		InstanceName:      cp.InstanceName,
+		KubeConfigFile:    cp.KubeConfigFile,
+		KubeConfigContext: cp.KubeConfigContext,
+		ControlPlane: ControlPlaneConfig{
+			KubernetesPackagePath: cp.PackagePath,
+		},
+		Providers: []ProviderConfig{},
+	}
+	if etcd := cp.Etcd(); etcd != nil {
+		c.ControlPlane.Etcd = &ComponentConfig{Path: etcd.Path, Args: etcd.EffectiveArgs()}
+		if etcd.URL != nil {
+			c.ControlPlane.Etcd.URL = etcd.URL.String()
+		}
+	}
+	if apiServer := cp.APIServer(); apiServer != nil {
+		c.ControlPlane.APIServer = &ComponentConfig{Path: apiServer.Path, Args: apiServer.EffectiveArgs()}
+		if apiServer.URL != nil {
+			c.ControlPlane.APIServer.URL = apiServer.URL.String()
+		}
+		c.ControlPlane.ServiceClusterIPRange = apiServer.EffectiveServiceClusterIPRange()
+		// The version is best effort, e.g. the binary of an adopted API server might have been removed.
+		if version, err := apiServer.KubernetesVersion(); err == nil {
+			c.ControlPlane.KubernetesVersion = version
+		}
+	}
+	for _, p := range m.providerList() {
+		c.Providers = append(c.Providers, ProviderConfig{
+			Name:         p.Name(),
+			PackagePath:  p.PackagePath,
+			Args:         p.EffectiveArgs(),
+			FeatureGates: p.EffectiveFeatureGates(),
+			WebhookURL:   p.WebhookURL(),
+			HealthURL:    p.HealthURL(),
+			DependsOn:    p.DependsOn,
+		})
+	}
+	return c
+}
+
+// configPath returns the path of the effective configuration of the instance with the given name.
+func configPath(name string) (string, error) {
+	dir, err := instance.Dir(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, configFileName), nil
+}
+
+// writeConfig persists the effective configuration of the instance, so it can be read from a different process.
+func (m *Manager) writeConfig() error {
+	b, err := yaml.Marshal(m.effectiveConfig())
+	if err != nil {
+		return err
+	}
+	path, err := configPath(m.ControlPlane.InstanceName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// LoadConfig reads the effective configuration of the running instance with the given name; it returns an error
+// satisfying os.IsNotExist if there is no instance running.
+func LoadConfig(name string) (*Config, error) {
+	if _, err := instance.Load(name); err != nil {
+		return nil, err
+	}
+	path, err := configPath(name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("unable to read the configuration file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// deleteConfig removes the persisted effective configuration of the instance.
+func (m *Manager) deleteConfig() error {
+	path, err := configPath(m.ControlPlane.InstanceName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// providerCRDs are the CRDs declared by a provider.
+type providerCRDs struct {
+	provider string
+	crds     []*apiextensionsv1.CustomResourceDefinition
+}
+
+// reconcileCRDs merges CRDs with the same name declared by many providers, so each shared CRD is installed once,
+// by a single provider, with the union of the versions, instead of being overwritten by the last provider starting.
+func (m *Manager) reconcileCRDs() error {
+	providers := m.providerList()
+	in := make([]providerCRDs, 0, len(providers))
+	for _, p := range providers {
+		crds, err := p.CRDs()
+		if err != nil {
+			return err
+		}
+		in = append(in, providerCRDs{provider: p.Name(), crds: crds})
+	}
+
+	replacements, warnings := mergeCRDs(in)
+	for _, w := range warnings {
+		fmt.Fprintf(m.warningWriter(), "warning: %s\n", w)
+	}
+	for i, p := range providers {
+		p.SetCRDs(replacements[i])
+	}
+	return nil
+}
+
+// warningWriter returns the writer for warnings, defaulting to os.Stderr.
+func (m *Manager) warningWriter() io.Writer {
+	if m.Warnings != nil {
+		return m.Warnings
+	}
+	return os.Stderr
+}
+
+// mergeCRDs merges CRDs with the same name across providers, and returns for each provider the CRDs replacing
+// the ones in its manifest, see provider.SetCRDs, and warnings about conflicting CRDs.
+// Each shared CRD is installed by the provider declaring the newest version, with the union of the versions declared
+// by all the providers; if the same version is declared with different schemas, the one from the provider declaring
+// the newest version wins.
+func mergeCRDs(in []providerCRDs) ([]map[string]*apiextensionsv1.CustomResourceDefinition, []string) {
+	replacements := make([]map[string]*apiextensionsv1.CustomResourceDefinition, len(in))
+	warnings := []string{}
+
+	// Group CRDs by name, preserving the provider order.
+	names := []string{}
+	owners := map[string][]int{}
+	crds := map[string]map[int]*apiextensionsv1.CustomResourceDefinition{}
+	for i, p := range in {
+		for _, crd := range p.crds {
+			if _, ok := owners[crd.Name]; !ok {
+				names = append(names, crd.Name)
+				crds[crd.Name] = map[int]*apiextensionsv1.CustomResourceDefinition{}
+			}
+			owners[crd.Name] = append(owners[crd.Name], i)
+			crds[crd.Name][i] = crd
+		}
+	}
+
+	for _, name := range names {
+		if len(owners[name]) < 2 {
+			continue
+		}
+
+		owner := owners[name][0]
+		for _, i := range owners[name][1:] {
+			if version.CompareKubeAwareVersionStrings(newestVersion(crds[name][i]), newestVersion(crds[name][owner])) > 0 {
+				owner = i
+			}
+		}
+
+		merged := crds[name][owner].DeepCopy()
+		for _, i := range owners[name] {
+			if i == owner {
+				continue
+			}
+			for _, v := range crds[name][i].Spec.Versions {
+				existing := crdVersion(merged, v.Name)
+				if existing == nil {
+					v := *v.DeepCopy()
+					// The storage version is the one of the provider installing the CRD.
+					v.Storage = false
+					merged.Spec.Versions = append(merged.Spec.Versions, v)
+					continue
+				}
+				if !apiequality.Semantic.DeepEqual(existing.Schema, v.Schema) {
+					warnings = append(warnings, fmt.Sprintf("CRD %s version %s is defined with different schemas by providers %s and %s, using the one from %s",
+						name, v.Name, in[owner].provider, in[i].provider, in[owner].provider))
+				}
+			}
+		}
+
+		for _, i := range owners[name] {
+			if replacements[i] == nil {
+				replacements[i] = map[string]*apiextensionsv1.CustomResourceDefinition{}
+			}
+			replacements[i][name] = nil
+		}
+		replacements[owner][name] = merged
+	}
+	return replacements, warnings
+}
+
+// newestVersion returns the newest version of a CRD, e.g. v1beta1 is newer than v1alpha4.
+func newestVersion(crd *apiextensionsv1.CustomResourceDefinition) string {
+	newest := ""
+	for _, v := range crd.Spec.Versions {
+		if newest == "" || version.CompareKubeAwareVersionStrings(v.Name, newest) > 0 {
+			newest = v.Name
+		}
+	}
+	return newest
+}
+
+// crdVersion returns the version with the given name, or nil if the CRD doesn't define it.
+func crdVersion(crd *apiextensionsv1.CustomResourceDefinition, name string) *apiextensionsv1.CustomResourceDefinitionVersion {
+	for i := range crd.Spec.Versions {
+		if crd.Spec.Versions[i].Name == name {
+			return &crd.Spec.Versions[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"bytes"
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fabriziopandini/kBB-8/pkg/provider"
+)
+
+var _ = Describe("CRDs shared by many providers", func() {
+	newCRD := func(name string, versions ...apiextensionsv1.CustomResourceDefinitionVersion) *apiextensionsv1.CustomResourceDefinition {
+		return &apiextensionsv1.CustomResourceDefinition{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       apiextensionsv1.CustomResourceDefinitionSpec{Versions: versions},
+		}
+	}
+	newVersion := func(name string, storage bool, description string) apiextensionsv1.CustomResourceDefinitionVersion {
+		return apiextensionsv1.CustomResourceDefinitionVersion{
+			Name:    name,
+			Served:  true,
+			Storage: storage,
+			Schema: &apiextensionsv1.CustomResourceValidation{
+				OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{Type: "object", Description: description},
+			},
+		}
+	}
+	versionNames := func(crd *apiextensionsv1.CustomResourceDefinition) []string {
+		names := []string{}
+		for _, v := range crd.Spec.Versions {
+			names = append(names, v.Name)
+		}
+		return names
+	}
+
+	It("are installed once with the union of the versions", func() {
+		replacements, warnings := mergeCRDs([]providerCRDs{
+			{provider: "CAPI", crds: []*apiextensionsv1.CustomResourceDefinition{
+				newCRD("foos.example.com", newVersion("v1alpha4", false, "foo"), newVersion("v1beta1", true, "foo")),
+				newCRD("bars.example.com", newVersion("v1beta1", true, "bar")),
+			}},
+			{provider: "CAPD", crds: []*apiextensionsv1.CustomResourceDefinition{
+				newCRD("foos.example.com", newVersion("v1alpha3", false, "foo"), newVersion("v1alpha4", true, "foo")),
+			}},
+		})
+		Expect(warnings).To(BeEmpty())
+
+		// CAPI declares the newest version, so it installs the merged CRD.
+		Expect(replacements[0]).To(HaveLen(1))
+		merged := replacements[0]["foos.example.com"]
+		Expect(merged).NotTo(BeNil())
+		Expect(versionNames(merged)).To(ConsistOf("v1alpha3", "v1alpha4", "v1beta1"))
+		for _, v := range merged.Spec.Versions {
+			Expect(v.Storage).To(Equal(v.Name == "v1beta1"))
+		}
+
+		// CAPD doesn't install the shared CRD.
+		Expect(replacements[1]).To(HaveKeyWithValue("foos.example.com", BeNil()))
+	})
+
+	It("prefer the schema from the provider declaring the newest version, with a warning", func() {
+		replacements, warnings := mergeCRDs([]providerCRDs{
+			{provider: "CAPD", crds: []*apiextensionsv1.CustomResourceDefinition{
+				newCRD("foos.example.com", newVersion("v1alpha4", true, "old")),
+			}},
+			{provider: "CAPI", crds: []*apiextensionsv1.CustomResourceDefinition{
+				newCRD("foos.example.com", newVersion("v1alpha4", false, "new"), newVersion("v1beta1", true, "new")),
+			}},
+		})
+		Expect(warnings).To(ConsistOf(ContainSubstring("CRD foos.example.com version v1alpha4 is defined with different schemas by providers CAPI and CAPD")))
+
+		merged := replacements[1]["foos.example.com"]
+		Expect(versionNames(merged)).To(ConsistOf("v1alpha4", "v1beta1"))
+		Expect(merged.Spec.Versions[0].Schema.OpenAPIV3Schema.Description).To(Equal("new"))
+		Expect(replacements[0]).To(HaveKeyWithValue("foos.example.com", BeNil()))
+	})
+
+	It("are reconciled across the manager providers", func() {
+		packageFS := fstest.MapFS{
+			"capi/components.yaml": &fstest.MapFile{Data: []byte(`apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+spec:
+  group: example.com
+  versions:
+  - name: v1beta1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        description: new
+`)},
+			"capd/components.yaml": &fstest.MapFile{Data: []byte(`apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+spec:
+  group: example.com
+  versions:
+  - name: v1beta1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        description: old
+`)},
+		}
+		capi, err := provider.NewProvider("./packages/bootstrap-capi", provider.WithPackageFS(packageFS, "capi"))
+		Expect(err).NotTo(HaveOccurred())
+		capd, err := provider.NewProvider("./packages/bootstrap-capd", provider.WithPackageFS(packageFS, "capd"))
+		Expect(err).NotTo(HaveOccurred())
+
+		var warnings bytes.Buffer
+		m := &Manager{
+			Providers: []*provider.Provider{capi, capd},
+			Warnings:  &warnings,
+		}
+		Expect(m.reconcileCRDs()).To(Succeed())
+		Expect(warnings.String()).To(Equal("warning: CRD foos.example.com version v1beta1 is defined with different schemas by providers CAPI and CAPD, using the one from CAPI\n"))
+	})
+})
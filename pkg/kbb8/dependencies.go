@@ -0,0 +1,72 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fabriziopandini/kBB-8/pkg/provider"
+)
+
+// validateProviderDependencies checks that providers depend only on other providers run by the Manager,
+// and that there are no dependency cycles; names are compared case-insensitively.
+func validateProviderDependencies(providers []*provider.Provider) error {
+	byName := map[string]*provider.Provider{}
+	for _, p := range providers {
+		byName[strings.ToLower(p.Name())] = p
+	}
+	for _, p := range providers {
+		for _, d := range p.DependsOn {
+			if _, ok := byName[strings.ToLower(d)]; !ok {
+				return fmt.Errorf("provider %s depends on unknown provider %s", p.Name(), d)
+			}
+		}
+	}
+
+	// Visit the dependency graph depth first; finding a provider still on the visit path means there is a cycle.
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	var visit func(p *provider.Provider, path []string) error
+	visit = func(p *provider.Provider, path []string) error {
+		key := strings.ToLower(p.Name())
+		path = append(path, p.Name())
+		switch state[key] {
+		case visiting:
+			return fmt.Errorf("providers have a dependency cycle: %s", strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+		state[key] = visiting
+		for _, d := range p.DependsOn {
+			if err := visit(byName[strings.ToLower(d)], path); err != nil {
+				return err
+			}
+		}
+		state[key] = visited
+		return nil
+	}
+	for _, p := range providers {
+		if err := visit(p, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
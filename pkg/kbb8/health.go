@@ -0,0 +1,233 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+	"github.com/fabriziopandini/kBB-8/pkg/ui"
+)
+
+const (
+	// healthServerShutdownTimeout is the maximum time to wait for in-flight requests when stopping the health server.
+	healthServerShutdownTimeout = 5 * time.Second
+
+	// healthServerComponentName is the name of the process serving the health of a detached instance.
+	healthServerComponentName = "health-server"
+
+	// instanceHealthPollInterval is how often ServeInstanceHealth checks if the instance is still running.
+	instanceHealthPollInterval = 1 * time.Second
+)
+
+// StartHealthServer starts an HTTP server on addr, e.g. ":8080", exposing the aggregated health of the kBB-8 components:
+// - /healthz returns 200 if all the components are healthy, 503 otherwise.
+// - /readyz returns 200 if the Manager is Ready, 503 otherwise, ignoring the providers that failed to start.
+// - /components returns the status of each component as JSON.
+// The server is stopped by Shutdown.
+func (m *Manager) StartHealthServer(addr string) error {
+	if m.healthServer != nil {
+		return fmt.Errorf("health server already started on %s", m.healthListener.Addr())
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", addr, err)
+	}
+	m.healthListener = l
+	m.healthServer = &http.Server{
+		Handler:           newHealthHandler(m.Status, m.readinessStatus, m.ready),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		_ = m.healthServer.Serve(l)
+	}()
+	return nil
+}
+
+// ServeInstanceHealth serves the health of the persisted instance with the given name on addr, with the same
+// endpoints of StartHealthServer, e.g. for a detached instance, whose kBB-8 process exited after Run; the serving
+// process is recorded in the instance, so it is stopped by Down. It returns when ctx is done or when the instance
+// is stopped.
+func ServeInstanceHealth(ctx context.Context, name, addr string) error {
+	i, err := LoadInstance(name)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", addr, err)
+	}
+	c := InstanceComponent{
+		Name: healthServerComponentName,
+		URL:  fmt.Sprintf("http://%s/healthz", l.Addr()),
+		PID:  os.Getpid(),
+	}
+	if id, err := process.Identify(c.PID); err == nil {
+		c.Identity = &id
+	}
+	i.HealthServer = &c
+	if err := i.Save(); err != nil {
+		_ = l.Close()
+		return err
+	}
+
+	// The components of a persisted instance are started, and providers are ready after Run returns.
+	server := &http.Server{
+		Handler:           newHealthHandler(i.Status, i.Status, func() bool { return true }),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		_ = server.Serve(l)
+	}()
+
+	ticker := time.NewTicker(instanceHealthPollInterval)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-ctx.Done():
+			running = false
+		case <-ticker.C:
+			if _, err := LoadInstance(name); os.IsNotExist(err) {
+				running = false
+			}
+		}
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), healthServerShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error stopping the health server: %w", err)
+	}
+	return nil
+}
+
+// Ready returns true if Start completed, all the components are healthy and all the providers are ready,
+// i.e. their ReadyGracePeriod elapsed; providers that failed to start with ContinueOnProviderError, reported by
+// ProviderErrors, are not considered.
+func (m *Manager) Ready(ctx context.Context) bool {
+	if !m.ready() {
+		return false
+	}
+	for _, s := range m.readinessStatus(ctx) {
+		if !s.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// ready returns true if Start completed and all the providers, except the ones that failed to start, are ready.
+func (m *Manager) ready() bool {
+	if !m.isStarted() {
+		return false
+	}
+	failed := m.ProviderErrors()
+	for _, p := range m.providerList() {
+		if _, ok := failed[p.Name()]; ok {
+			continue
+		}
+		if !p.Ready() {
+			return false
+		}
+	}
+	return true
+}
+
+// readinessStatus returns the status of the components considered for readiness, i.e. excluding the providers
+// that failed to start with ContinueOnProviderError.
+func (m *Manager) readinessStatus(ctx context.Context) []ComponentStatus {
+	failed := m.ProviderErrors()
+	ret := []ComponentStatus{}
+	for _, s := range m.Status(ctx) {
+		if _, ok := failed[s.Name]; ok {
+			continue
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// HealthServerAddr returns the address the health server is listening on, or an empty string if not started.
+func (m *Manager) HealthServerAddr() string {
+	if m.healthListener == nil {
+		return ""
+	}
+	return m.healthListener.Addr().String()
+}
+
+// stopHealthServer stops the health server, if started.
+func (m *Manager) stopHealthServer() error {
+	if m.healthServer == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthServerShutdownTimeout)
+	defer cancel()
+	err := m.healthServer.Shutdown(ctx)
+	m.healthServer = nil
+	m.healthListener = nil
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error stopping the health server: %w", err)
+	}
+	return nil
+}
+
+// newHealthHandler returns the handler for the health server endpoints; readinessStatus returns the status of
+// the components considered by /readyz.
+func newHealthHandler(status, readinessStatus func(ctx context.Context) []ComponentStatus, started func() bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, status(r.Context()), true)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, readinessStatus(r.Context()), started())
+	})
+	mux.HandleFunc("/components", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = ui.PrintJSON(w, status(r.Context()))
+	})
+	return mux
+}
+
+// writeHealth writes 200 if started and all the components are healthy, 503 with the reason otherwise.
+func writeHealth(w http.ResponseWriter, statuses []ComponentStatus, started bool) {
+	unhealthy := []string{}
+	for _, s := range statuses {
+		if !s.Healthy {
+			unhealthy = append(unhealthy, s.Name)
+		}
+	}
+
+	switch {
+	case !started:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "kBB-8 is starting")
+	case len(unhealthy) > 0:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "unhealthy components: %s\n", strings.Join(unhealthy, ", "))
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/fabriziopandini/kBB-8/pkg/controlplane"
+)
+
+var _ = Describe("Health server", func() {
+	var statuses []ComponentStatus
+
+	BeforeEach(func() {
+		statuses = []ComponentStatus{
+			{Name: "etcd", Running: true, Healthy: true},
+			{Name: "apiserver", Running: true, Healthy: true},
+			{Name: "CAPI", Running: true, Healthy: true},
+		}
+	})
+
+	get := func(started bool, path string) *httptest.ResponseRecorder {
+		h := newHealthHandler(func(ctx context.Context) []ComponentStatus {
+			return statuses
+		}, func(ctx context.Context) []ComponentStatus {
+			// CAPI failed to start, and it is not considered for readiness.
+			if !statuses[2].Running {
+				return statuses[:2]
+			}
+			return statuses
+		}, func() bool {
+			return started
+		})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	It("reports healthy when all the components are healthy", func() {
+		rec := get(true, "/healthz")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(Equal("ok\n"))
+
+		Expect(get(true, "/readyz").Code).To(Equal(http.StatusOK))
+	})
+
+	It("reports unhealthy when a component is unhealthy", func() {
+		statuses[2].Healthy = false
+
+		rec := get(true, "/healthz")
+		Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(rec.Body.String()).To(Equal("unhealthy components: CAPI\n"))
+
+		Expect(get(true, "/readyz").Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("ignores the providers that are not considered for readiness", func() {
+		statuses[2].Running = false
+		statuses[2].Healthy = false
+
+		Expect(get(true, "/healthz").Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(get(true, "/readyz").Code).To(Equal(http.StatusOK))
+	})
+
+	It("reports not ready while starting", func() {
+		Expect(get(false, "/healthz").Code).To(Equal(http.StatusOK))
+		Expect(get(false, "/readyz").Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("returns the component statuses as JSON", func() {
+		rec := get(true, "/components")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+
+		var got []ComponentStatus
+		Expect(json.Unmarshal(rec.Body.Bytes(), &got)).To(Succeed())
+		Expect(got).To(Equal(statuses))
+	})
+
+	It("is stopped by Shutdown", func() {
+		m := &Manager{ControlPlane: &controlplane.ControlPlane{}}
+		Expect(m.StartHealthServer("127.0.0.1:0")).To(Succeed())
+		url := fmt.Sprintf("http://%s/healthz", m.HealthServerAddr())
+
+		resp, err := http.Get(url)
+		Expect(err).NotTo(HaveOccurred())
+		_ = resp.Body.Close()
+		// etcd and the API server are not running.
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+		Expect(m.Shutdown()).To(Succeed())
+		Expect(m.HealthServerAddr()).To(BeEmpty())
+		_, err = http.Get(url)
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("ServeInstanceHealth", func() {
+		var dir, currentDir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "health-test")
+			Expect(err).NotTo(HaveOccurred())
+			currentDir, err = os.Getwd()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Chdir(dir)).To(Succeed())
+			Expect(os.Setenv("KUBECONFIG", filepath.Join(dir, "kubeconfig"))).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.Unsetenv("KUBECONFIG")).To(Succeed())
+			Expect(os.Chdir(currentDir)).To(Succeed())
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("serves the health of a persisted instance until it is stopped", func() {
+			component := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer component.Close()
+			i := &Instance{
+				Name:        "e2e",
+				ClusterName: "bootstrap-e2e",
+				Components:  []InstanceComponent{{Name: "etcd", URL: component.URL, PID: os.Getpid()}},
+			}
+			Expect(i.Save()).To(Succeed())
+
+			done := make(chan error, 1)
+			go func() {
+				done <- ServeInstanceHealth(context.Background(), "e2e", "127.0.0.1:0")
+			}()
+
+			var url string
+			Eventually(func() *InstanceComponent {
+				i, err := LoadInstance("e2e")
+				Expect(err).NotTo(HaveOccurred())
+				if i.HealthServer != nil {
+					url = i.HealthServer.URL
+				}
+				return i.HealthServer
+			}).ShouldNot(BeNil())
+
+			for _, u := range []string{url, strings.TrimSuffix(url, "/healthz") + "/readyz"} {
+				resp, err := http.Get(u)
+				Expect(err).NotTo(HaveOccurred())
+				_ = resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			}
+			// Connections dialed by the client but never used would delay the server shutdown.
+			http.DefaultClient.CloseIdleConnections()
+
+			// The components and the health server run in the test process, so the instance is removed without Down.
+			Expect(os.Remove(filepath.Join(dir, ".tmp", "e2e", "instance.yaml"))).To(Succeed())
+			Eventually(done, "5s").Should(Receive(BeNil()))
+			_, err := http.Get(url)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,86 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fabriziopandini/kBB-8/pkg/controlplane"
+)
+
+// PostStartHookFunc is a function called after a component is ready.
+type PostStartHookFunc func(ctx context.Context, m *Manager) error
+
+// WithPostStartHook registers a hook to be called after a component is ready; component is one of etcd,
+// apiserver or the name of a provider, matched case-insensitively. Hooks for the same component are called
+// in registration order, each one exactly once per Start, and an error returned by a hook aborts Start.
+// There are no hooks for controller-manager, because kBB-8 doesn't run a controller manager; registering one
+// makes Start fail.
+//
+// Hooks are called according to the following ordering guarantees:
+//   - etcd hooks are called after etcd is ready and before the API server starts.
+//   - apiserver hooks are called after the API server is ready and the kubeconfig file is written,
+//     and before any provider starts.
+//   - provider hooks are called after the provider is ready; providers start concurrently, so other providers
+//     might still be starting, but all the provider hooks are completed before Start returns.
+//     Providers depending on another provider are started after its hooks are completed.
+func (m *Manager) WithPostStartHook(component string, fn PostStartHookFunc) *Manager {
+	if m.postStartHooks == nil {
+		m.postStartHooks = map[string][]PostStartHookFunc{}
+	}
+	key := hookKey(component)
+	m.postStartHooks[key] = append(m.postStartHooks[key], fn)
+	return m
+}
+
+// hookKey normalises a component name, so hooks registered e.g. for CAPI also run for the capi provider.
+func hookKey(component string) string {
+	return strings.ToLower(component)
+}
+
+// runPostStartHooks calls the hooks registered for a component.
+func (m *Manager) runPostStartHooks(ctx context.Context, component string) error {
+	for _, fn := range m.postStartHooks[hookKey(component)] {
+		if err := fn(ctx, m); err != nil {
+			return fmt.Errorf("post-start hook for %s failed: %w", component, err)
+		}
+	}
+	return nil
+}
+
+// validatePostStartHooks checks that hooks are registered only for components run by this Manager.
+func (m *Manager) validatePostStartHooks() error {
+	components := map[string]bool{
+		hookKey(controlplane.EtcdComponentName):      true,
+		hookKey(controlplane.APIServerComponentName): true,
+	}
+	for _, p := range m.providerList() {
+		components[hookKey(p.Name())] = true
+	}
+
+	for component := range m.postStartHooks {
+		if component == hookKey(controlplane.ControllerManagerComponentName) {
+			return fmt.Errorf("post-start hook registered for %s, but the control plane does not run a controller manager", component)
+		}
+		if !components[component] {
+			return fmt.Errorf("post-start hook registered for unknown component %q", component)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/fabriziopandini/kBB-8/pkg/controlplane"
+	"github.com/fabriziopandini/kBB-8/pkg/provider"
+)
+
+var _ = Describe("Post-start hooks", func() {
+	var m *Manager
+
+	BeforeEach(func() {
+		m = &Manager{
+			ControlPlane: &controlplane.ControlPlane{},
+			Providers: []*provider.Provider{
+				{PackagePath: "./packages/bootstrap-capd"},
+			},
+		}
+	})
+
+	It("runs the hooks of a component exactly once, after the hooks of the previous components", func() {
+		calls := []string{}
+		hook := func(name string) PostStartHookFunc {
+			return func(_ context.Context, hm *Manager) error {
+				Expect(hm).To(BeIdenticalTo(m))
+				calls = append(calls, name)
+				return nil
+			}
+		}
+		m.WithPostStartHook("apiserver", hook("apiserver")).
+			WithPostStartHook("etcd", hook("etcd-1")).
+			WithPostStartHook("etcd", hook("etcd-2")).
+			WithPostStartHook("CAPD", hook("CAPD"))
+		Expect(m.validatePostStartHooks()).To(Succeed())
+
+		Expect(m.runPostStartHooks(context.Background(), "etcd")).To(Succeed())
+		Expect(calls).To(Equal([]string{"etcd-1", "etcd-2"}))
+
+		Expect(m.runPostStartHooks(context.Background(), "apiserver")).To(Succeed())
+		Expect(calls).To(Equal([]string{"etcd-1", "etcd-2", "apiserver"}))
+	})
+
+	It("matches the component names case-insensitively", func() {
+		calls := []string{}
+		hook := func(name string) PostStartHookFunc {
+			return func(context.Context, *Manager) error {
+				calls = append(calls, name)
+				return nil
+			}
+		}
+		m.WithPostStartHook("Etcd", hook("Etcd")).
+			WithPostStartHook("etcd", hook("etcd")).
+			WithPostStartHook("capd", hook("capd"))
+		Expect(m.validatePostStartHooks()).To(Succeed())
+
+		Expect(m.runPostStartHooks(context.Background(), controlplane.EtcdComponentName)).To(Succeed())
+		Expect(m.runPostStartHooks(context.Background(), m.Providers[0].Name())).To(Succeed())
+		Expect(calls).To(Equal([]string{"Etcd", "etcd", "capd"}))
+	})
+
+	It("aborts on the first failing hook", func() {
+		called := false
+		m.WithPostStartHook("etcd", func(context.Context, *Manager) error {
+			return errors.New("boom")
+		}).WithPostStartHook("etcd", func(context.Context, *Manager) error {
+			called = true
+			return nil
+		})
+
+		err := m.runPostStartHooks(context.Background(), "etcd")
+		Expect(err).To(MatchError("post-start hook for etcd failed: boom"))
+		Expect(called).To(BeFalse())
+	})
+
+	It("rejects hooks for components not run by the Manager", func() {
+		m.WithPostStartHook("CAPI", func(context.Context, *Manager) error { return nil })
+		Expect(m.validatePostStartHooks()).To(MatchError(ContainSubstring(`unknown component "capi"`)))
+	})
+
+	It("rejects hooks for the controller manager", func() {
+		m.WithPostStartHook("controller-manager", func(context.Context, *Manager) error { return nil })
+		Expect(m.validatePostStartHooks()).To(MatchError(ContainSubstring("does not run a controller manager")))
+	})
+
+	It("rejects invalid hooks before starting any component", func() {
+		m.WithPostStartHook("CAPI", func(context.Context, *Manager) error { return nil })
+		Expect(m.Start(context.Background())).To(MatchError(ContainSubstring(`unknown component "capi"`)))
+		Expect(m.ControlPlane.Etcd()).To(BeNil())
+	})
+})
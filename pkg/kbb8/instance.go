@@ -0,0 +1,166 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fabriziopandini/kBB-8/pkg/controlplane"
+	"github.com/fabriziopandini/kBB-8/pkg/instance"
+	"github.com/fabriziopandini/kBB-8/pkg/kubeconfig"
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+)
+
+// Instance is the persisted description of a running kBB-8 instance; it allows
+// CLI commands to interact with the instance from a different process.
+type Instance = instance.Instance
+
+// InstanceComponent is the persisted description of a kBB-8 component.
+type InstanceComponent = instance.Component
+
+// LoadInstance reads the persisted instance with the given name, empty for the unnamed instance; it returns
+// an error satisfying os.IsNotExist if there is no instance running.
+func LoadInstance(name string) (*Instance, error) {
+	return instance.Load(name)
+}
+
+// Down stops the kBB-8 instance with the given name persisted by a detached Run.
+func Down(name string) error {
+	i, err := LoadInstance(name)
+	if err != nil {
+		return err
+	}
+	return i.Stop()
+}
+
+// ReapOrphans stops the components left running by a previous run of the instance with the given name, if the
+// kBB-8 process running it exited without stopping them, e.g. because it was killed with SIGKILL; such orphans
+// hold ports and data dirs, breaking the next start. It returns the names of the stopped components, and it is
+// a no-op if there is no instance, if the instance is detached or if its kBB-8 process is still running.
+func ReapOrphans(name string) ([]string, error) {
+	i, err := LoadInstance(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !i.Orphaned() {
+		return nil, nil
+	}
+	return i.StopOrphans()
+}
+
+// ForceDown stops the components of the instance with the given name like Down, but stopping only processes
+// matching the recorded identity, e.g. for cleaning up after a crashed run; it returns the names of the stopped
+// components.
+func ForceDown(name string) ([]string, error) {
+	i, err := LoadInstance(name)
+	if err != nil {
+		return nil, err
+	}
+	return i.StopOrphans()
+}
+
+// NewInstanceClient returns a client for the control plane of the instance, built from the
+// kubeconfig file and context persisted with it; if the kubeconfig user relies on an exec credential
+// plugin, the client uses an admin client cert issued from the instance CA instead.
+func NewInstanceClient(i *Instance) (client.Client, error) {
+	usesExec, err := kubeconfig.UsesExec(i.KubeConfigFile, i.KubeConfigContext)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the kubeconfig for the instance: %w", err)
+	}
+	if usesExec {
+		restConfig, err := controlplane.AdminRESTConfig(i)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the admin credentials for the instance: %w", err)
+		}
+		return client.New(restConfig, client.Options{})
+	}
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: i.KubeConfigFile},
+		&clientcmd.ConfigOverrides{CurrentContext: i.KubeConfigContext},
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("error loading the kubeconfig for the instance: %w", err)
+	}
+	return client.New(restConfig, client.Options{})
+}
+
+// writeInstance persists the instance description for the manager.
+func (m *Manager) writeInstance(ctx context.Context) error {
+	m.instanceLock.Lock()
+	defer m.instanceLock.Unlock()
+
+	i := &Instance{
+		Name:              m.ControlPlane.InstanceName,
+		ClusterName:       m.ControlPlane.ClusterName(),
+		KubeConfigFile:    m.ControlPlane.KubeConfigFile,
+		KubeConfigContext: m.ControlPlane.KubeConfigContext,
+	}
+	etcdSocket := ""
+	args := map[string][]string{}
+	if etcd := m.ControlPlane.Etcd(); etcd != nil {
+		i.EtcdDataDir = etcd.DataDir()
+		etcdSocket = etcd.UnixSocket()
+		args[controlplane.EtcdComponentName] = etcd.EffectiveArgs()
+	}
+	if apiServer := m.ControlPlane.APIServer(); apiServer != nil {
+		args[controlplane.APIServerComponentName] = apiServer.EffectiveArgs()
+	}
+	if !m.ControlPlane.Detached {
+		if owner, err := process.Identify(os.Getpid()); err == nil {
+			i.Owner = &owner
+		}
+	}
+	for _, s := range m.Status(ctx) {
+		if !s.Running {
+			continue
+		}
+		c := InstanceComponent{
+			Name:     s.Name,
+			URL:      s.URL,
+			PID:      s.PID,
+			PprofURL: s.PprofURL,
+			Args:     args[s.Name],
+		}
+		if s.Name == controlplane.EtcdComponentName {
+			c.UnixSocket = etcdSocket
+		}
+		if id, err := process.Identify(s.PID); err == nil {
+			c.Identity = &id
+		}
+		i.Components = append(i.Components, c)
+	}
+	if err := i.Save(); err != nil {
+		return err
+	}
+	return m.writeConfig()
+}
+
+// deleteInstance removes the persisted instance description and effective configuration.
+func (m *Manager) deleteInstance() error {
+	if err := m.deleteConfig(); err != nil {
+		return err
+	}
+	return instance.Delete(m.ControlPlane.InstanceName)
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"sigs.k8s.io/controller-runtime/pkg/envtest/printer"
+
+	"github.com/fabriziopandini/kBB-8/pkg/provider"
+)
+
+// fakeManagerBinary is the name the test binary is invoked with for acting as a provider manager.
+const fakeManagerBinary = "manager"
+
+func TestMain(m *testing.M) {
+	if filepath.Base(os.Args[0]) == fakeManagerBinary {
+		runFakeManager(os.Args[1:])
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// fakeManagerReadyDelayEnv is the env variable defining how long the fake manager waits before serving health.
+const fakeManagerReadyDelayEnv = "FAKE_MANAGER_READY_DELAY"
+
+// fakeManagerIgnoreSIGTERMEnv is the env variable making the fake manager ignore SIGTERM.
+const fakeManagerIgnoreSIGTERMEnv = "FAKE_MANAGER_IGNORE_SIGTERM"
+
+// runFakeManager serves the provider health endpoint until it gets terminated; the last line of output
+// is left incomplete, for testing that output is flushed on shutdown. If the provider has webhooks, the fake
+// manager accepts TLS connections on the webhook port. The /resolve endpoint resolves the name
+// query parameter with the cluster DNS, like a provider using it would do.
+func runFakeManager(args []string) {
+	fmt.Println("fake manager started")
+	if delay, err := time.ParseDuration(os.Getenv(fakeManagerReadyDelayEnv)); err == nil {
+		time.Sleep(delay)
+	}
+
+	webhookPort, webhookCertDir := "", ""
+	for _, a := range args {
+		switch {
+		case strings.HasPrefix(a, "--webhook-port="):
+			webhookPort = strings.TrimPrefix(a, "--webhook-port=")
+		case strings.HasPrefix(a, "--webhook-cert-dir="):
+			webhookCertDir = strings.TrimPrefix(a, "--webhook-cert-dir=")
+		}
+	}
+	if webhookPort != "" && webhookCertDir != "" {
+		go func() {
+			_ = http.ListenAndServeTLS(":"+webhookPort, filepath.Join(webhookCertDir, "tls.crt"), filepath.Join(webhookCertDir, "tls.key"), http.NotFoundHandler()) //nolint:gosec
+		}()
+	}
+
+	for _, a := range args {
+		if strings.HasPrefix(a, "--health-addr=") {
+			healthAddr := strings.TrimPrefix(a, "--health-addr=")
+			mux := http.NewServeMux()
+			mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			mux.HandleFunc("/resolve", func(w http.ResponseWriter, r *http.Request) {
+				resolver := &net.Resolver{
+					PreferGo: true,
+					Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						var d net.Dialer
+						return d.DialContext(ctx, "udp", os.Getenv(provider.ClusterDNSEnv))
+					},
+				}
+				addrs, err := resolver.LookupHost(r.Context(), r.URL.Query().Get("name"))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				fmt.Fprint(w, strings.Join(addrs, ","))
+			})
+			go func() {
+				_ = http.ListenAndServe(healthAddr, mux) //nolint:gosec
+			}()
+		}
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	<-c
+	if os.Getenv(fakeManagerIgnoreSIGTERMEnv) != "" {
+		select {}
+	}
+	fmt.Print("fake manager stopped")
+}
+
+func TestKBB8(t *testing.T) {
+	t.Parallel()
+	RegisterFailHandler(Fail)
+	suiteName := "kBB-8 Suite"
+	RunSpecsWithDefaultAndCustomReporters(t, suiteName, []Reporter{printer.NewlineReporter{}, printer.NewProwReporter(suiteName)})
+}
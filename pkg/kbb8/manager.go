@@ -0,0 +1,724 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fabriziopandini/kBB-8/pkg/controlplane"
+	"github.com/fabriziopandini/kBB-8/pkg/kubeconfig"
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+	"github.com/fabriziopandini/kBB-8/pkg/provider"
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
+)
+
+// DefaultShutdownTimeout is the default maximum time for Shutdown to stop all the components.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// shutdownKillWait is the time Shutdown waits for the stop sequence to complete after killing the components.
+const shutdownKillWait = 5 * time.Second
+
+// Manager manages a kBB-8 instance, the control plane and the providers running on top of it.
+type Manager struct {
+	// TODO: make private and create constructor
+	ControlPlane *controlplane.ControlPlane
+
+	// Providers are the providers run by the Manager; once started, they must be changed only with Reconfigure.
+	Providers []*provider.Provider
+
+	// providersLock guards Providers while Reconfigure replaces them, so they can be read concurrently,
+	// e.g. by the health server.
+	providersLock sync.Mutex
+
+	// Warnings is where warnings, e.g. about conflicting CRDs across providers, are written; it defaults to os.Stderr.
+	Warnings io.Writer
+
+	// ShutdownTimeout bounds the time Shutdown waits for all the components to stop; once elapsed, the components
+	// still running are killed. It defaults to DefaultShutdownTimeout.
+	ShutdownTimeout time.Duration
+
+	// WebhooksReachableTimeout bounds the time Start waits for the provider webhooks to be reachable, see
+	// WaitForWebhooksReachable. It defaults to DefaultWebhooksReachableTimeout.
+	WebhooksReachableTimeout time.Duration
+
+	// ContinueOnProviderError makes StartProviders stop the providers failing to start and go on with the others,
+	// instead of failing; errors are reported by ProviderErrors and in the Summary. Control plane errors are
+	// always fatal.
+	ContinueOnProviderError bool
+
+	postStartHooks map[string][]PostStartHookFunc
+
+	// providerDefaults applies the Options shared by all the providers, e.g. Env, to a provider.
+	providerDefaults func(p *provider.Provider)
+
+	// providerErrors are the errors of the providers that failed to start, keyed by provider name.
+	providerErrorsLock sync.Mutex
+	providerErrors     map[string]error
+
+	// started is true once Start completed, until Shutdown.
+	startedLock sync.Mutex
+	started     bool
+
+	// instanceLock serializes writing the instance manifest, e.g. by providers starting concurrently.
+	instanceLock sync.Mutex
+
+	healthServer   *http.Server
+	healthListener net.Listener
+
+	clientsLock   sync.Mutex
+	restMapper    *restmapper.DeferredDiscoveryRESTMapper
+	dynamicClient dynamic.Interface
+
+	// providerClient is the client shared by providers for installing the objects in their manifests.
+	providerClient client.Client
+}
+
+// Options defines the configuration for a kBB-8 instance.
+type Options struct {
+	// KubernetesPackagePath is the path of the package with the Kubernetes binaries (etcd, kube-apiserver).
+	KubernetesPackagePath string
+
+	// KubernetesVersion, if set, is the version of kube-apiserver to run, e.g. v1.23.0; the binary is read from
+	// the binaries cache, and downloaded from the Kubernetes release bucket if missing, instead of from
+	// KubernetesPackagePath. etcd is not published with Kubernetes, so it is always read from KubernetesPackagePath.
+	KubernetesVersion string
+
+	// BinariesCacheDir is the directory downloaded binaries are cached in; it defaults to kBB-8/binaries in the
+	// user cache dir.
+	BinariesCacheDir string
+
+	// Offline prevents downloading binaries, so KubernetesVersion, if set, must already be in the binaries cache,
+	// e.g. in air-gapped environments.
+	Offline bool
+
+	// Providers are the providers to run on top of the control plane.
+	Providers []*provider.Provider
+
+	// Manifests are YAML files or directories with objects to be applied after providers are ready.
+	Manifests []string
+
+	// KubeConfigAuth defines how the kBB-8 user in the kubeconfig file authenticates to the API server;
+	// it defaults to a client certificate. With an exec credential plugin, kBB-8's own clients use an admin
+	// client certificate instead.
+	KubeConfigAuth kubeconfig.AuthOptions
+
+	// CA, if set, is the CA all the serving certs are issued from, and that the kubeconfig file trusts;
+	// providers configured with their own CA keep using it. Its key is never written to disk, so the same CA
+	// must be set for adopting an instance started with it.
+	CA *certs.TinyCA
+
+	// Env are additional environment variables for all the components, in the key=value form, e.g. GOMAXPROCS=2;
+	// env variables set on a provider take precedence.
+	Env []string
+
+	// PostStartHooks are functions to be called after a component is ready, keyed by component name;
+	// see WithPostStartHook for details.
+	PostStartHooks map[string]PostStartHookFunc
+
+	// Warnings is where warnings, e.g. about conflicting CRDs across providers, are written; it defaults to os.Stderr.
+	Warnings io.Writer
+
+	// FileModes defines the permissions of the files and directories created for all the components, e.g. log files
+	// and certs; it defaults to 0600 for files and 0700 for directories. Private keys are always 0600 or stricter.
+	FileModes process.FileModes
+
+	// LogStream, if set, gets a copy of the output of all the components, with each line prefixed with the
+	// component name, e.g. os.Stderr for interactive debugging; it is ignored when Detach is set.
+	LogStream io.Writer
+
+	// ListenAddress, if set, is the address of an HTTP server exposing the aggregated health of the components,
+	// see StartHealthServer for details. The server runs in the current process, so it is stopped if the process exits,
+	// e.g. after a detached Run; use ServeInstanceHealth for serving the health of a detached instance.
+	ListenAddress string
+
+	// InstanceName, if set, is the name of the instance; the instance manifest, the logs, data and certs of
+	// the components are stored in .tmp/<InstanceName>, and the name is appended to the cluster name in the
+	// kubeconfig file, so instances with different names can run side by side in the same directory.
+	InstanceName string
+
+	// ClusterDNS enables the cluster DNS responder, see WithClusterDNS; it can't be used with Detach.
+	ClusterDNS bool
+
+	// Profiling enables the pprof endpoints of etcd and the API server, see WithProfiling.
+	Profiling bool
+
+	// ServiceClusterIPRange is the CIDR the cluster IPs of Services are allocated from; it defaults to
+	// controlplane.DefaultServiceClusterIPRange.
+	ServiceClusterIPRange string
+
+	// ServiceAccountIssuer and APIAudiences define the issuer and the audiences of service account tokens,
+	// see controlplane.APIServer for details.
+	ServiceAccountIssuer string
+	APIAudiences         []string
+
+	// APIServerReadinessPath and APIServerSkipTLSVerifyDuringStartup define how to check the API server readiness,
+	// see controlplane.APIServer for details.
+	APIServerReadinessPath              string
+	APIServerSkipTLSVerifyDuringStartup bool
+
+	// EnableAdmissionPlugins and DisableAdmissionPlugins are admission plugins to be enabled or disabled on the
+	// API server, see controlplane.APIServer for details.
+	EnableAdmissionPlugins  []string
+	DisableAdmissionPlugins []string
+
+	// EtcdOptions defines the etcd settings, e.g. the backend quota and the auto compaction.
+	EtcdOptions controlplane.EtcdOptions
+
+	// ShutdownTimeout bounds the time Shutdown waits for all the components to stop, see Manager.ShutdownTimeout.
+	ShutdownTimeout time.Duration
+
+	// WebhooksReachableTimeout bounds the time to wait for the provider webhooks to be reachable,
+	// see Manager.WebhooksReachableTimeout.
+	WebhooksReachableTimeout time.Duration
+
+	// ContinueOnProviderError tolerates providers failing to start, see Manager.ContinueOnProviderError.
+	ContinueOnProviderError bool
+
+	// Detach runs all the components so they keep running after the kBB-8 process exits;
+	// a detached instance can be stopped with Down.
+	Detach bool
+}
+
+// Run starts a kBB-8 instance, the control plane and the providers, and returns once everything is ready;
+// lifecycle control, including Shutdown, is left to the caller.
+func Run(ctx context.Context, opts Options) (*Manager, error) {
+	if err := controlplane.ValidateServiceClusterIPRange(opts.ServiceClusterIPRange); err != nil {
+		return nil, err
+	}
+	if err := opts.KubeConfigAuth.Validate(); err != nil {
+		return nil, err
+	}
+	apiServerPath, err := resolveAPIServer(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	m := newManager(opts, apiServerPath)
+
+	// Start the health server first, so it can report the startup progress.
+	if opts.ListenAddress != "" {
+		if err := m.StartHealthServer(opts.ListenAddress); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := m.Start(ctx); err != nil {
+		_ = m.Shutdown()
+		return nil, err
+	}
+
+	if len(opts.Manifests) > 0 {
+		if err := m.Apply(ctx, opts.Manifests...); err != nil {
+			_ = m.Shutdown()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// newManager returns a Manager for the control plane and the providers defined in opts.
+func newManager(opts Options, apiServerPath string) *Manager {
+	m := &Manager{
+		ControlPlane: &controlplane.ControlPlane{
+			PackagePath:    opts.KubernetesPackagePath,
+			APIServerPath:  apiServerPath,
+			InstanceName:   opts.InstanceName,
+			Detached:       opts.Detach,
+			KubeConfigAuth: opts.KubeConfigAuth,
+			Env:            opts.Env,
+			CA:             opts.CA,
+			LogStream:      opts.LogStream,
+			FileModes:      opts.FileModes,
+			Profiling:      opts.Profiling,
+
+			ServiceAccountIssuer: opts.ServiceAccountIssuer,
+			APIAudiences:         opts.APIAudiences,
+
+			APIServerReadinessPath:              opts.APIServerReadinessPath,
+			APIServerSkipTLSVerifyDuringStartup: opts.APIServerSkipTLSVerifyDuringStartup,
+
+			EnableAdmissionPlugins:  opts.EnableAdmissionPlugins,
+			DisableAdmissionPlugins: opts.DisableAdmissionPlugins,
+
+			EtcdOptions: opts.EtcdOptions,
+
+			ServiceClusterIPRange: opts.ServiceClusterIPRange,
+		},
+		Providers:                opts.Providers,
+		Warnings:                 opts.Warnings,
+		ShutdownTimeout:          opts.ShutdownTimeout,
+		WebhooksReachableTimeout: opts.WebhooksReachableTimeout,
+		ContinueOnProviderError:  opts.ContinueOnProviderError,
+	}
+	m.providerDefaults = func(p *provider.Provider) {
+		p.Detached = opts.Detach
+		provider.WithInstanceName(opts.InstanceName)(p)
+		p.Env = append(append([]string{}, opts.Env...), p.Env...)
+		if opts.CA != nil && p.CA() == nil {
+			provider.WithCA(opts.CA)(p)
+		}
+		if opts.LogStream != nil {
+			provider.WithLogStreaming(opts.LogStream)(p)
+		}
+		if opts.FileModes != (process.FileModes{}) {
+			provider.WithFileModes(opts.FileModes)(p)
+		}
+	}
+	for _, p := range m.providerList() {
+		m.providerDefaults(p)
+	}
+	if opts.ClusterDNS {
+		m.WithClusterDNS()
+	}
+	for component, fn := range opts.PostStartHooks {
+		m.WithPostStartHook(component, fn)
+	}
+	return m
+}
+
+// Start starts the control plane and then the providers, calling post-start hooks after each component is ready;
+// it returns once the webhooks installed for the providers are reachable, see WaitForWebhooksReachable.
+// The instance manifest is updated as each component starts, so the components started by a kBB-8 process
+// crashing part-way through can be cleaned up, see ReapOrphans.
+func (m *Manager) Start(ctx context.Context) error {
+	if err := validateProviderNames(m.providerList()); err != nil {
+		return err
+	}
+	if err := m.validatePostStartHooks(); err != nil {
+		return err
+	}
+
+	m.ControlPlane.PostStartHook = func(component string) error {
+		return m.runPostStartHooks(ctx, component)
+	}
+	m.ControlPlane.StartedHook = func(string) {
+		// Best effort, the instance manifest is written again once the component is ready.
+		_ = m.writeInstance(ctx)
+	}
+	if err := m.ControlPlane.Start(); err != nil {
+		return err
+	}
+	if err := m.StartProviders(ctx); err != nil {
+		return err
+	}
+	if err := m.WaitForWebhooksReachable(ctx); err != nil {
+		return err
+	}
+	if err := m.writeInstance(ctx); err != nil {
+		return err
+	}
+	m.setStarted(true)
+	return nil
+}
+
+// Shutdown stops the providers and then the control plane, waiting up to ShutdownTimeout; if the timeout elapses,
+// the components still running are killed, and the returned error wraps context.DeadlineExceeded. Components that
+// can't be stopped are recorded in the instance manifest, so Down can finish the job.
+func (m *Manager) Shutdown() error {
+	m.setStarted(false)
+
+	timeout := m.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Capture the component processes before stopping them, so they can be killed without racing with the stop sequence.
+	killers := m.componentKillers()
+	done := make(chan error, 1)
+	go func() {
+		done <- m.stop()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Stop did not complete in time, kill the components still running and give the stop sequence
+	// the chance to complete, e.g. to close log files.
+	killed := killComponents(killers)
+	select {
+	case <-done:
+	case <-time.After(shutdownKillWait):
+		// The stop sequence is stuck; the instance manifest still records the components, so Down can finish the job.
+	}
+	if len(killed) == 0 {
+		return fmt.Errorf("shutdown did not complete within %s: %w", timeout, context.DeadlineExceeded)
+	}
+	return fmt.Errorf("shutdown did not complete within %s, components killed: %s: %w", timeout, strings.Join(killed, ", "), context.DeadlineExceeded)
+}
+
+// componentKiller is the Killer for the process of a component.
+type componentKiller struct {
+	name   string
+	killer process.Killer
+}
+
+// componentKillers returns the Killers for the processes of the control plane and the providers.
+func (m *Manager) componentKillers() []componentKiller {
+	killers := []componentKiller{}
+	if etcd := m.ControlPlane.Etcd(); etcd != nil {
+		killers = append(killers, componentKiller{name: etcdComponentName, killer: etcd.Killer()})
+	}
+	if apiServer := m.ControlPlane.APIServer(); apiServer != nil {
+		killers = append(killers, componentKiller{name: apiServerComponentName, killer: apiServer.Killer()})
+	}
+	for _, p := range m.providerList() {
+		killers = append(killers, componentKiller{name: p.Name(), killer: p.Killer()})
+	}
+	return killers
+}
+
+// killComponents kills the components still running, returning their names.
+func killComponents(killers []componentKiller) []string {
+	killed := []string{}
+	for _, k := range killers {
+		if running, err := k.killer.Kill(); running && err == nil {
+			killed = append(killed, k.name)
+		}
+	}
+	return killed
+}
+
+// stop stops the providers and then the control plane, and deletes the instance manifest.
+func (m *Manager) stop() error {
+	errs := []error{}
+	if err := m.stopHealthServer(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := m.StopProviders(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := m.ControlPlane.Stop(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := m.deleteInstance(); err != nil {
+		errs = append(errs, err)
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+func (m *Manager) setStarted(started bool) {
+	m.startedLock.Lock()
+	defer m.startedLock.Unlock()
+	m.started = started
+}
+
+func (m *Manager) isStarted() bool {
+	m.startedLock.Lock()
+	defer m.startedLock.Unlock()
+	return m.started
+}
+
+// StartProviders starts all the providers concurrently, and waits for all of them to be ready
+// and for their post-start hooks to complete; providers declaring dependencies are started once all
+// their dependencies are ready and their post-start hooks are completed, and they are not started if
+// a dependency fails.
+func (m *Manager) StartProviders(ctx context.Context) error {
+	return m.startProviders(ctx, nil)
+}
+
+// startProviders starts the providers in subset, keyed by lowercase name, or all the providers if subset is nil;
+// providers not in subset are considered already started when waiting for dependencies.
+func (m *Manager) startProviders(ctx context.Context, subset map[string]bool) error {
+	providers := m.providerList()
+	if err := validateProviderNames(providers); err != nil {
+		return err
+	}
+	if err := validateProviderDependencies(providers); err != nil {
+		return err
+	}
+	if err := m.reconcileCRDs(); err != nil {
+		return err
+	}
+	// If the shared client can't be created, providers fall back to a client built from the kubeconfig file,
+	// that reports the error if they have objects to install.
+	manifestClient, _ := m.manifestClient()
+
+	// done is closed when a provider is started, or failed to start; failed records providers failing to start.
+	done := map[string]chan struct{}{}
+	for _, p := range providers {
+		done[strings.ToLower(p.Name())] = make(chan struct{})
+		if subset != nil && !subset[strings.ToLower(p.Name())] {
+			close(done[strings.ToLower(p.Name())])
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	errs := []error{}
+	failed := map[string]bool{}
+	for i := range providers {
+		p := providers[i]
+		if subset != nil && !subset[strings.ToLower(p.Name())] {
+			continue
+		}
+		p.APIServerCA = m.apiServerCA()
+		p.APIServerHost = m.apiServerHost()
+		p.ClusterDNSAddress = m.clusterDNSAddress()
+		p.ManifestClient = manifestClient
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[strings.ToLower(p.Name())])
+
+			err := waitProviderDependencies(p, done, func(name string) bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return failed[strings.ToLower(name)]
+			})
+			if err == nil {
+				err = p.Start(ctx, m.ControlPlane.KubeConfigFile)
+				if err != nil {
+					err = fmt.Errorf("error starting provider %s: %w", p.Name(), err)
+				} else {
+					m.registerClusterDNS(p)
+					err = m.writeInstance(ctx)
+					if err == nil {
+						err = m.runPostStartHooks(ctx, p.Name())
+					}
+				}
+			}
+			if err != nil && m.ContinueOnProviderError {
+				if stopErr := m.stopProvider(p); stopErr != nil {
+					err = kerrors.NewAggregate([]error{err, fmt.Errorf("error stopping provider %s: %w", p.Name(), stopErr)})
+				}
+				// The provider is not running, so requests must not be routed to its webhooks.
+				if removeErr := p.RemoveWebhooks(ctx, m.ControlPlane.KubeConfigFile); removeErr != nil {
+					err = kerrors.NewAggregate([]error{err, fmt.Errorf("error removing the webhooks of provider %s: %w", p.Name(), removeErr)})
+				}
+			}
+			m.setProviderError(p.Name(), err)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				failed[strings.ToLower(p.Name())] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Providers installed new CRDs, so the RESTMapper must discover them again.
+	m.invalidateRESTMapper()
+	if m.ContinueOnProviderError {
+		return nil
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// ProviderErrors returns the errors of the providers that failed to start, keyed by provider name; it is
+// useful with ContinueOnProviderError, when StartProviders doesn't fail for provider errors.
+func (m *Manager) ProviderErrors() map[string]error {
+	m.providerErrorsLock.Lock()
+	defer m.providerErrorsLock.Unlock()
+
+	ret := map[string]error{}
+	for name, err := range m.providerErrors {
+		ret[name] = err
+	}
+	return ret
+}
+
+// setProviderError records the error of a provider failing to start, or clears it if err is nil.
+func (m *Manager) setProviderError(name string, err error) {
+	m.providerErrorsLock.Lock()
+	defer m.providerErrorsLock.Unlock()
+
+	if err == nil {
+		delete(m.providerErrors, name)
+		return
+	}
+	if m.providerErrors == nil {
+		m.providerErrors = map[string]error{}
+	}
+	m.providerErrors[name] = err
+}
+
+// waitProviderDependencies waits for the dependencies of p to be started, returning an error if any of them failed.
+func waitProviderDependencies(p *provider.Provider, done map[string]chan struct{}, failed func(name string) bool) error {
+	for _, d := range p.DependsOn {
+		<-done[strings.ToLower(d)]
+		if failed(d) {
+			return fmt.Errorf("provider %s not started because its dependency %s failed to start", p.Name(), d)
+		}
+	}
+	return nil
+}
+
+// StopProviders stops all the providers.
+func (m *Manager) StopProviders() error {
+	errs := []error{}
+	for _, p := range m.providerList() {
+		if err := m.stopProvider(p); err != nil {
+			errs = append(errs, fmt.Errorf("error stopping provider %s: %w", p.Name(), err))
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// stopProvider stops a provider, removing its Services from the cluster DNS, if enabled.
+func (m *Manager) stopProvider(p *provider.Provider) error {
+	m.deregisterClusterDNS(p)
+	return p.Stop()
+}
+
+// StopProvider stops a single provider by name, leaving the control plane and the other providers running.
+func (m *Manager) StopProvider(name string) error {
+	p, err := m.provider(name)
+	if err != nil {
+		return err
+	}
+
+	if err := m.stopProvider(p); err != nil {
+		return fmt.Errorf("error stopping provider %s: %w", p.Name(), err)
+	}
+	return m.writeInstance(context.Background())
+}
+
+// StartProvider starts a single provider by name, e.g. after StopProvider; the provider reuses the ports and
+// the PKI of the previous run, if any. Post-start hooks are not called.
+func (m *Manager) StartProvider(ctx context.Context, name string) error {
+	p, err := m.provider(name)
+	if err != nil {
+		return err
+	}
+	if p.Status(ctx).Running {
+		return fmt.Errorf("provider %s is already running", p.Name())
+	}
+
+	manifestClient, _ := m.manifestClient()
+	p.APIServerCA = m.apiServerCA()
+	p.APIServerHost = m.apiServerHost()
+	p.ClusterDNSAddress = m.clusterDNSAddress()
+	p.ManifestClient = manifestClient
+	if err := p.Start(ctx, m.ControlPlane.KubeConfigFile); err != nil {
+		return fmt.Errorf("error starting provider %s: %w", p.Name(), err)
+	}
+	m.registerClusterDNS(p)
+
+	// The provider might have installed new CRDs, so the RESTMapper must discover them again.
+	m.invalidateRESTMapper()
+	return m.writeInstance(ctx)
+}
+
+// WithClusterDNS enables the cluster DNS responder, answering the cluster-internal names of the Services
+// rewritten by providers, e.g. <service>.<namespace>.svc, with the host serving the provider webhooks;
+// see controlplane.ControlPlane.ClusterDNS.
+func (m *Manager) WithClusterDNS() *Manager {
+	m.ControlPlane.EnableClusterDNS = true
+	return m
+}
+
+// WithProfiling enables or disables the pprof endpoints of etcd and the API server, e.g. for investigating the
+// control plane performance under provider load; the pprof URLs are reported by Status. It must be called before Start.
+func (m *Manager) WithProfiling(enabled bool) *Manager {
+	m.ControlPlane.Profiling = enabled
+	return m
+}
+
+// registerClusterDNS registers the Services rewritten by a provider in the cluster DNS, if enabled.
+func (m *Manager) registerClusterDNS(p *provider.Provider) {
+	dns := m.ControlPlane.ClusterDNS()
+	if dns == nil {
+		return
+	}
+	ip := net.IPv4(127, 0, 0, 1)
+	if u, err := url.Parse(p.WebhookURL()); err == nil {
+		if hostIP := net.ParseIP(u.Hostname()); hostIP != nil {
+			ip = hostIP
+		}
+	}
+	for _, svc := range p.Services() {
+		dns.AddService(svc, ip)
+	}
+}
+
+// deregisterClusterDNS removes the Services rewritten by a provider from the cluster DNS, if enabled.
+func (m *Manager) deregisterClusterDNS(p *provider.Provider) {
+	dns := m.ControlPlane.ClusterDNS()
+	if dns == nil {
+		return
+	}
+	for _, svc := range p.Services() {
+		dns.RemoveService(svc)
+	}
+}
+
+// clusterDNSAddress returns the address of the cluster DNS responder, or an empty string if it is not enabled.
+func (m *Manager) clusterDNSAddress() string {
+	if dns := m.ControlPlane.ClusterDNS(); dns != nil {
+		return dns.Addr()
+	}
+	return ""
+}
+
+// apiServerCA returns the CA of the API server, if known; it is not known e.g. for an adopted control plane.
+func (m *Manager) apiServerCA() *certs.TinyCA {
+	if apiServer := m.ControlPlane.APIServer(); apiServer != nil {
+		return apiServer.CA
+	}
+	return nil
+}
+
+// apiServerHost returns the host the API server listens on, if known.
+func (m *Manager) apiServerHost() string {
+	if apiServer := m.ControlPlane.APIServer(); apiServer != nil && apiServer.URL != nil {
+		return apiServer.URL.Hostname()
+	}
+	return ""
+}
+
+// provider returns the provider with the given name; names are compared case-insensitively.
+func (m *Manager) provider(name string) (*provider.Provider, error) {
+	for _, p := range m.providerList() {
+		if strings.EqualFold(p.Name(), name) {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("provider %s not found", name)
+}
+
+// validateProviderNames checks that provider names are unique; names are compared case-insensitively
+// because they are used to derive the provider's local path.
+func validateProviderNames(providers []*provider.Provider) error {
+	seen := map[string]string{}
+	for _, p := range providers {
+		key := strings.ToLower(p.Name())
+		if other, ok := seen[key]; ok {
+			return fmt.Errorf("providers %s and %s have the same name %q, use an explicit name to disambiguate them", other, p.PackagePath, p.Name())
+		}
+		seen[key] = p.PackagePath
+	}
+	return nil
+}
@@ -0,0 +1,597 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+
+	"github.com/fabriziopandini/kBB-8/pkg/controlplane"
+	"github.com/fabriziopandini/kBB-8/pkg/kubeconfig"
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+	"github.com/fabriziopandini/kBB-8/pkg/provider"
+)
+
+var _ = Describe("Manager", func() {
+	Describe("StartProviders", func() {
+		It("fails when two providers derive the same name", func() {
+			m := &Manager{
+				Providers: []*provider.Provider{
+					{PackagePath: "./packages/bootstrap-capd"},
+					{PackagePath: "./other/capd"},
+				},
+			}
+
+			err := m.StartProviders(context.Background())
+			Expect(err).To(MatchError(ContainSubstring(`have the same name "CAPD"`)))
+			Expect(err.Error()).To(ContainSubstring("./packages/bootstrap-capd"))
+			Expect(err.Error()).To(ContainSubstring("./other/capd"))
+		})
+
+		It("accepts providers disambiguated by an explicit name", func() {
+			capdDev := &provider.Provider{PackagePath: "./other/capd"}
+			provider.WithName("CAPD-DEV")(capdDev)
+			providers := []*provider.Provider{
+				{PackagePath: "./packages/bootstrap-capd"},
+				capdDev,
+			}
+
+			Expect(validateProviderNames(providers)).To(Succeed())
+		})
+
+		It("fails when providers have a dependency cycle", func() {
+			m := &Manager{
+				Providers: []*provider.Provider{
+					{PackagePath: "./packages/bootstrap-capi", DependsOn: []string{"capd"}},
+					{PackagePath: "./packages/bootstrap-cabpk", DependsOn: []string{"CAPI"}},
+					{PackagePath: "./packages/bootstrap-capd", DependsOn: []string{"CABPK"}},
+				},
+			}
+
+			Expect(m.StartProviders(context.Background())).To(MatchError("providers have a dependency cycle: CAPI -> CAPD -> CABPK -> CAPI"))
+		})
+
+		It("fails when a provider depends on an unknown provider", func() {
+			capi := &provider.Provider{PackagePath: "./packages/bootstrap-capi", DependsOn: []string{"capz"}}
+			m := &Manager{Providers: []*provider.Provider{capi}}
+
+			Expect(m.StartProviders(context.Background())).To(MatchError("provider CAPI depends on unknown provider capz"))
+		})
+	})
+
+	Describe("Provider lifecycle", func() {
+		var (
+			dir        string
+			currentDir string
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "manager-test")
+			Expect(err).NotTo(HaveOccurred())
+
+			currentDir, err = os.Getwd()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Chdir(dir)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.Chdir(currentDir)).To(Succeed())
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		// newFakeProvider returns a provider running the test binary as a fake manager, with an empty manifest.
+		newFakeProvider := func(name string) *provider.Provider {
+			testBinary, err := os.Executable()
+			Expect(err).NotTo(HaveOccurred())
+
+			packagePath := filepath.Join(dir, "packages", "bootstrap-"+name)
+			Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+			Expect(os.Symlink(testBinary, filepath.Join(packagePath, fakeManagerBinary))).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(packagePath, "components.yaml"), nil, 0600)).To(Succeed())
+
+			// The manifest is empty, so NewProvider returns a warning.
+			p, err := provider.NewProvider(packagePath)
+			Expect(provider.IsWarning(err)).To(BeTrue())
+			p.StopGracePeriod = 5 * time.Second
+			return p
+		}
+
+		providerStatus := func(m *Manager, name string) ComponentStatus {
+			for _, s := range m.Status(context.Background()) {
+				if s.Name == name {
+					return s
+				}
+			}
+			Fail("missing status for " + name)
+			return ComponentStatus{}
+		}
+
+		instanceComponents := func() []string {
+			instance, err := LoadInstance("")
+			Expect(err).NotTo(HaveOccurred())
+			names := []string{}
+			for _, c := range instance.Components {
+				names = append(names, c.Name)
+			}
+			return names
+		}
+
+		It("kills components ignoring SIGTERM once the shutdown timeout elapses", func() {
+			// Use a kubeconfig file in the test folder, so the user's kubeconfig file is not modified.
+			kubeConfig := os.Getenv("KUBECONFIG")
+			Expect(os.Setenv("KUBECONFIG", filepath.Join(dir, "kubeconfig"))).To(Succeed())
+			defer os.Setenv("KUBECONFIG", kubeConfig)
+
+			ctx := context.Background()
+			capi := newFakeProvider("capi")
+			capi.Env = append(capi.Env, fakeManagerIgnoreSIGTERMEnv+"=true")
+			capi.StopGracePeriod = time.Minute
+			m := &Manager{
+				ControlPlane:    &controlplane.ControlPlane{},
+				Providers:       []*provider.Provider{capi},
+				ShutdownTimeout: 2 * time.Second,
+			}
+			Expect(m.StartProviders(ctx)).To(Succeed())
+			Expect(m.writeInstance(ctx)).To(Succeed())
+			pid := providerStatus(m, "CAPI").PID
+
+			start := time.Now()
+			err := m.Shutdown()
+			Expect(time.Since(start)).To(BeNumerically("<", 10*time.Second))
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+			Expect(err).To(MatchError(ContainSubstring("components killed: CAPI")))
+
+			Expect(process.Alive(pid)).To(BeFalse())
+			Expect(capi.ExitInfo().Signal).To(Equal(syscall.SIGKILL))
+			// The provider was killed by kBB-8, so it is not reported as killed by the OOM killer.
+			Expect(capi.ExitInfo().OOMKilled).To(BeFalse())
+			// The stop sequence completed after killing the provider, so the instance manifest is deleted.
+			_, err = LoadInstance("")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("passes the cluster DNS address to providers, deregistering their Services when they stop", func() {
+			capi := newFakeProvider("capi")
+			Expect(ioutil.WriteFile(filepath.Join(capi.PackagePath, "components.yaml"), []byte(`apiVersion: admissionregistration.k8s.io/v1
+kind: MutatingWebhookConfiguration
+metadata:
+  name: capi-mutating-webhook-configuration
+webhooks:
+- name: default.cluster.cluster.x-k8s.io
+  admissionReviewVersions: ["v1"]
+  sideEffects: None
+  clientConfig:
+    service:
+      name: capi-webhook-service
+      namespace: capi-system
+      path: /mutate-cluster
+`), 0600)).To(Succeed())
+
+			m := &Manager{
+				ControlPlane: &controlplane.ControlPlane{EnableClusterDNS: true},
+				Providers:    []*provider.Provider{capi},
+				// The control plane is not running, so the manifest objects are installed with a fake client.
+				providerClient: fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build(),
+			}
+			Expect(m.ControlPlane.StartClusterDNS()).To(Succeed())
+			defer func() {
+				Expect(m.ControlPlane.ClusterDNS().Stop()).To(Succeed())
+			}()
+			Expect(m.StartProviders(context.Background())).To(Succeed())
+
+			// The provider resolves the Service name with the cluster DNS.
+			healthURL, err := url.Parse(capi.HealthURL())
+			Expect(err).NotTo(HaveOccurred())
+			healthURL.Path = "/resolve"
+			healthURL.RawQuery = "name=capi-webhook-service.capi-system.svc"
+			res, err := http.Get(healthURL.String()) //nolint:gosec
+			Expect(err).NotTo(HaveOccurred())
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Body.Close()).To(Succeed())
+			Expect(res.StatusCode).To(Equal(http.StatusOK), string(body))
+			webhookURL, err := url.Parse(capi.WebhookURL())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal(webhookURL.Hostname()))
+
+			// Once the provider is stopped, its Services are not resolved anymore.
+			Expect(m.StopProvider("capi")).To(Succeed())
+			resolver := &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "udp", m.ControlPlane.ClusterDNS().Addr())
+				},
+			}
+			_, err = resolver.LookupHost(context.Background(), "capi-webhook-service.capi-system.svc")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("stops and restarts one provider without affecting the others", func() {
+			ctx := context.Background()
+			m := &Manager{
+				ControlPlane: &controlplane.ControlPlane{},
+				Providers:    []*provider.Provider{newFakeProvider("capi"), newFakeProvider("capd")},
+			}
+			defer func() {
+				Expect(m.StopProviders()).To(Succeed())
+			}()
+
+			Expect(m.StartProviders(ctx)).To(Succeed())
+			Expect(m.writeInstance(ctx)).To(Succeed())
+			// Fake providers don't serve webhooks, so they are started without a webhook port.
+			Expect(m.Providers[0].WebhookURL()).To(BeEmpty())
+			capiPID := providerStatus(m, "CAPI").PID
+			capdURL := providerStatus(m, "CAPD").URL
+
+			capdPID := m.Providers[1].PID()
+			Expect(capdPID).To(Equal(providerStatus(m, "CAPD").PID))
+			Expect(process.Alive(capdPID)).To(BeTrue())
+
+			Expect(m.StopProvider("capd")).To(Succeed())
+			Expect(m.Providers[1].PID()).To(BeZero())
+			Expect(process.Alive(capdPID)).To(BeFalse())
+			Expect(providerStatus(m, "CAPD").Running).To(BeFalse())
+			Expect(providerStatus(m, "CAPI").Running).To(BeTrue())
+			Expect(providerStatus(m, "CAPI").PID).To(Equal(capiPID))
+			Expect(instanceComponents()).To(Equal([]string{"CAPI"}))
+
+			Expect(m.StartProvider(ctx, "capd")).To(Succeed())
+			Expect(providerStatus(m, "CAPD").Healthy).To(BeTrue())
+			Expect(m.Providers[1].PID()).To(Equal(providerStatus(m, "CAPD").PID))
+			Expect(providerStatus(m, "CAPD").URL).To(Equal(capdURL))
+			Expect(providerStatus(m, "CAPI").PID).To(Equal(capiPID))
+			Expect(instanceComponents()).To(Equal([]string{"CAPI", "CAPD"}))
+		})
+
+		It("reconfigures providers restarting only the changed ones", func() {
+			ctx := context.Background()
+			capi := newFakeProvider("capi")
+			capd := newFakeProvider("capd")
+			m := &Manager{
+				ControlPlane: &controlplane.ControlPlane{},
+				Providers:    []*provider.Provider{capi, capd},
+			}
+			defer func() {
+				Expect(m.StopProviders()).To(Succeed())
+			}()
+
+			Expect(m.StartProviders(ctx)).To(Succeed())
+			capiPID := providerStatus(m, "CAPI").PID
+			capdPID := providerStatus(m, "CAPD").PID
+			capdURL := providerStatus(m, "CAPD").URL
+
+			// Same configuration for CAPI, new args for CAPD, and a new provider replacing none.
+			newCAPI, err := provider.NewProvider(capi.PackagePath)
+			Expect(provider.IsWarning(err)).To(BeTrue())
+			newCAPI.StopGracePeriod = capi.StopGracePeriod
+			newCAPD, err := provider.NewProvider(capd.PackagePath, provider.WithArgs("--foo"))
+			Expect(provider.IsWarning(err)).To(BeTrue())
+			newCAPD.StopGracePeriod = capd.StopGracePeriod
+			cabpk := newFakeProvider("cabpk")
+
+			Expect(m.Reconfigure(ctx, []*provider.Provider{newCAPI, newCAPD, cabpk}, ReconfigureOptions{})).To(Succeed())
+			Expect(m.Providers).To(Equal([]*provider.Provider{capi, newCAPD, cabpk}))
+			Expect(providerStatus(m, "CAPI").PID).To(Equal(capiPID))
+			Expect(providerStatus(m, "CAPD").Healthy).To(BeTrue())
+			Expect(providerStatus(m, "CAPD").PID).NotTo(Equal(capdPID))
+			Expect(providerStatus(m, "CAPD").URL).To(Equal(capdURL))
+			Expect(capd.Status(ctx).Running).To(BeFalse())
+			Expect(providerStatus(m, "CABPK").Healthy).To(BeTrue())
+			Expect(instanceComponents()).To(Equal([]string{"CAPI", "CAPD", "CABPK"}))
+
+			// Removing a provider stops it, leaving the others running.
+			Expect(m.Reconfigure(ctx, []*provider.Provider{newCAPI, cabpk}, ReconfigureOptions{})).To(Succeed())
+			Expect(newCAPD.Status(ctx).Running).To(BeFalse())
+			Expect(providerStatus(m, "CAPI").PID).To(Equal(capiPID))
+			Expect(instanceComponents()).To(Equal([]string{"CAPI", "CABPK"}))
+		})
+
+		It("streams the provider output, flushing it on shutdown", func() {
+			stream := &bytes.Buffer{}
+			p := newFakeProvider("capi")
+			provider.WithLogStreaming(stream)(p)
+			m := &Manager{
+				ControlPlane: &controlplane.ControlPlane{},
+				Providers:    []*provider.Provider{p},
+			}
+
+			Expect(m.StartProviders(context.Background())).To(Succeed())
+			Expect(m.StopProviders()).To(Succeed())
+			Expect(stream.String()).To(Equal("[CAPI] fake manager started\n[CAPI] fake manager stopped\n"))
+		})
+
+		It("starts providers after their dependencies are ready", func() {
+			// CAPI is slow to become ready, so without the dependency CABPK would be ready first.
+			capi := newFakeProvider("capi")
+			provider.WithEnv(fakeManagerReadyDelayEnv + "=1s")(capi)
+			cabpk := newFakeProvider("cabpk")
+			provider.WithDependsOn("capi")(cabpk)
+
+			m := &Manager{
+				ControlPlane: &controlplane.ControlPlane{},
+				Providers:    []*provider.Provider{cabpk, capi},
+			}
+			defer func() {
+				Expect(m.StopProviders()).To(Succeed())
+			}()
+
+			var order []string
+			var capiReadyWhenCABPKStarted bool
+			m.WithPostStartHook("CAPI", func(ctx context.Context, m *Manager) error {
+				order = append(order, "CAPI")
+				return nil
+			})
+			m.WithPostStartHook("CABPK", func(ctx context.Context, m *Manager) error {
+				order = append(order, "CABPK")
+				capiReadyWhenCABPKStarted = capi.Status(ctx).Healthy
+				return nil
+			})
+
+			Expect(m.StartProviders(context.Background())).To(Succeed())
+			Expect(order).To(Equal([]string{"CAPI", "CABPK"}))
+			Expect(capiReadyWhenCABPKStarted).To(BeTrue())
+		})
+
+		It("records each provider in the instance manifest as soon as it starts", func() {
+			capi := newFakeProvider("capi")
+			cabpk := newFakeProvider("cabpk")
+			provider.WithDependsOn("capi")(cabpk)
+
+			m := &Manager{
+				ControlPlane: &controlplane.ControlPlane{},
+				Providers:    []*provider.Provider{cabpk, capi},
+			}
+			defer func() {
+				Expect(m.StopProviders()).To(Succeed())
+			}()
+
+			var recordedWhenCAPIReady []string
+			m.WithPostStartHook("CAPI", func(ctx context.Context, m *Manager) error {
+				recordedWhenCAPIReady = instanceComponents()
+				return nil
+			})
+
+			Expect(m.StartProviders(context.Background())).To(Succeed())
+			Expect(recordedWhenCAPIReady).To(Equal([]string{"CAPI"}))
+			Expect(instanceComponents()).To(ConsistOf("CAPI", "CABPK"))
+		})
+
+		It("does not start providers whose dependencies failed", func() {
+			capi := newFakeProvider("capi")
+			cabpk := newFakeProvider("cabpk")
+			provider.WithDependsOn("capi")(cabpk)
+
+			m := &Manager{
+				ControlPlane: &controlplane.ControlPlane{},
+				Providers:    []*provider.Provider{capi, cabpk},
+			}
+			defer func() {
+				Expect(m.StopProviders()).To(Succeed())
+			}()
+			m.WithPostStartHook("CAPI", func(ctx context.Context, m *Manager) error {
+				return errors.New("boom")
+			})
+
+			err := m.StartProviders(context.Background())
+			Expect(err).To(MatchError(ContainSubstring("post-start hook for CAPI failed: boom")))
+			Expect(err).To(MatchError(ContainSubstring("provider CABPK not started because its dependency capi failed to start")))
+			Expect(cabpk.Status(context.Background()).Running).To(BeFalse())
+		})
+
+		It("waits for the ready grace period before declaring providers ready", func() {
+			capi := newFakeProvider("capi")
+			provider.WithReadyGracePeriod(time.Second)(capi)
+			m := &Manager{
+				ControlPlane: &controlplane.ControlPlane{},
+				Providers:    []*provider.Provider{capi},
+			}
+			defer func() {
+				Expect(m.StopProviders()).To(Succeed())
+			}()
+			m.setStarted(true)
+
+			started := time.Now()
+			done := make(chan error, 1)
+			go func() {
+				done <- m.StartProviders(context.Background())
+			}()
+
+			// The provider gets healthy, but it is not ready until the grace period elapses.
+			Eventually(func() bool {
+				return capi.Status(context.Background()).Healthy
+			}, "5s").Should(BeTrue())
+			Expect(capi.Ready()).To(BeFalse())
+			Expect(m.ready()).To(BeFalse())
+
+			Eventually(done, "5s").Should(Receive(BeNil()))
+			Expect(time.Since(started)).To(BeNumerically(">=", time.Second))
+			Expect(capi.Ready()).To(BeTrue())
+			// The control plane is not running in this test, so only the providers contribute to readiness.
+			Expect(m.ready()).To(BeTrue())
+		})
+
+		It("keeps going when a provider fails to start, if configured to", func() {
+			capi := newFakeProvider("capi")
+			capd := newFakeProvider("capd")
+			broken := newFakeProvider("broken")
+			Expect(os.Remove(filepath.Join(broken.PackagePath, fakeManagerBinary))).To(Succeed())
+			cabpk := newFakeProvider("cabpk")
+			provider.WithDependsOn("broken")(cabpk)
+
+			m := &Manager{
+				ControlPlane:            &controlplane.ControlPlane{},
+				Providers:               []*provider.Provider{capi, broken, cabpk, capd},
+				ContinueOnProviderError: true,
+			}
+			defer func() {
+				Expect(m.StopProviders()).To(Succeed())
+			}()
+
+			Expect(m.StartProviders(context.Background())).To(Succeed())
+			Expect(capi.Ready()).To(BeTrue())
+			Expect(capd.Ready()).To(BeTrue())
+			Expect(broken.Ready()).To(BeFalse())
+			Expect(cabpk.Ready()).To(BeFalse())
+			Expect(providerStatus(m, "BROKEN").Running).To(BeFalse())
+
+			providerErrors := m.ProviderErrors()
+			Expect(providerErrors).To(HaveLen(2))
+			Expect(providerErrors["BROKEN"]).To(MatchError(ContainSubstring("error starting provider BROKEN")))
+			Expect(providerErrors["CABPK"]).To(MatchError(ContainSubstring("provider CABPK not started because its dependency broken failed to start")))
+
+			// The failed providers are not considered for readiness.
+			m.setStarted(true)
+			defer m.setStarted(false)
+			Expect(m.ready()).To(BeTrue())
+			names := []string{}
+			for _, s := range m.readinessStatus(context.Background()) {
+				names = append(names, s.Name)
+			}
+			Expect(names).To(ContainElements("CAPI", "CAPD"))
+			Expect(names).NotTo(ContainElements("BROKEN"))
+			Expect(names).NotTo(ContainElements("CABPK"))
+
+			summary := m.Summary(context.Background())
+			for _, p := range summary.Providers {
+				switch p.Name {
+				case "CAPI", "CAPD":
+					Expect(p.Healthy).To(BeTrue())
+					Expect(p.Error).To(BeEmpty())
+				default:
+					Expect(p.Healthy).To(BeFalse())
+					Expect(p.Error).NotTo(BeEmpty())
+				}
+			}
+		})
+
+		It("dumps the effective configuration, with the feature gates from the manifest", func() {
+			ctx := context.Background()
+			capi := newFakeProvider("capi")
+			Expect(ioutil.WriteFile(filepath.Join(capi.PackagePath, "components.yaml"), []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: capi-controller-manager
+  namespace: capi-system
+spec:
+  template:
+    spec:
+      containers:
+      - name: manager
+        args:
+        - --feature-gates=MachinePool=${EXP_MACHINE_POOL:=true}
+`), 0600)).To(Succeed())
+			m := &Manager{
+				ControlPlane: &controlplane.ControlPlane{ServiceClusterIPRange: "10.96.0.0/12"},
+				Providers:    []*provider.Provider{capi},
+			}
+			defer func() {
+				Expect(m.StopProviders()).To(Succeed())
+			}()
+
+			_, err := m.EffectiveConfig()
+			Expect(err).To(MatchError(ContainSubstring("kBB-8 is not started")))
+
+			Expect(m.StartProviders(ctx)).To(Succeed())
+			Expect(m.writeInstance(ctx)).To(Succeed())
+			m.setStarted(true)
+
+			c, err := m.EffectiveConfig()
+			Expect(err).NotTo(HaveOccurred())
+			// The service cluster IP range is read from the API server args, and the API server is not running
+			// in this test, so the configured value is not reported.
+			Expect(c.ControlPlane.ServiceClusterIPRange).To(BeEmpty())
+			Expect(c.ControlPlane.KubernetesVersion).To(BeEmpty())
+			Expect(c.Providers).To(HaveLen(1))
+			Expect(c.Providers[0].Args).To(ContainElement("--feature-gates=MachinePool=true"))
+			Expect(c.Providers[0].FeatureGates).To(Equal(map[string]bool{"MachinePool": true}))
+			Expect(c.Providers[0].HealthURL).NotTo(BeEmpty())
+
+			// The configuration is persisted, so it can be dumped from a different process.
+			loaded, err := LoadConfig("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*loaded).To(Equal(c))
+			dump, err := yaml.Marshal(loaded)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(dump)).NotTo(ContainSubstring("serviceClusterIPRange"))
+			Expect(string(dump)).To(ContainSubstring("MachinePool: true"))
+		})
+
+		It("passes the control plane options to the control plane", func() {
+			m := newManager(Options{
+				ServiceAccountIssuer: "https://issuer.example.com",
+				APIAudiences:         []string{"kbb8", "vault"},
+
+				APIServerReadinessPath:              "/livez",
+				APIServerSkipTLSVerifyDuringStartup: true,
+
+				EnableAdmissionPlugins:  []string{"AlwaysPullImages"},
+				DisableAdmissionPlugins: []string{"ServiceAccount"},
+
+				EtcdOptions: controlplane.EtcdOptions{QuotaBackendBytes: 1024, UseUnixSocket: true},
+			}, "kube-apiserver")
+			Expect(m.ControlPlane.APIServerPath).To(Equal("kube-apiserver"))
+			Expect(m.ControlPlane.ServiceAccountIssuer).To(Equal("https://issuer.example.com"))
+			Expect(m.ControlPlane.APIAudiences).To(Equal([]string{"kbb8", "vault"}))
+			Expect(m.ControlPlane.APIServerReadinessPath).To(Equal("/livez"))
+			Expect(m.ControlPlane.APIServerSkipTLSVerifyDuringStartup).To(BeTrue())
+			Expect(m.ControlPlane.EnableAdmissionPlugins).To(Equal([]string{"AlwaysPullImages"}))
+			Expect(m.ControlPlane.DisableAdmissionPlugins).To(Equal([]string{"ServiceAccount"}))
+			Expect(m.ControlPlane.EtcdOptions).To(Equal(controlplane.EtcdOptions{QuotaBackendBytes: 1024, UseUnixSocket: true}))
+		})
+
+		It("fails before starting anything for an invalid service cluster IP range", func() {
+			capi := newFakeProvider("capi")
+			_, err := Run(context.Background(), Options{ServiceClusterIPRange: "10.96.0.0", Providers: []*provider.Provider{capi}})
+			Expect(err).To(MatchError(ContainSubstring(`invalid service cluster IP range "10.96.0.0"`)))
+			Expect(capi.Status(context.Background()).Running).To(BeFalse())
+		})
+
+		It("fails before starting anything for an exec credential plugin that can't be found", func() {
+			capi := newFakeProvider("capi")
+			auth := kubeconfig.AuthOptions{Mode: kubeconfig.ExecAuthMode, ExecCommand: "kbb8-missing-get-token"}
+			_, err := Run(context.Background(), Options{KubeConfigAuth: auth, Providers: []*provider.Provider{capi}})
+			Expect(err).To(MatchError(ContainSubstring("invalid exec credential plugin")))
+			Expect(capi.Status(context.Background()).Running).To(BeFalse())
+		})
+
+		It("fails for unknown providers", func() {
+			m := &Manager{
+				ControlPlane: &controlplane.ControlPlane{},
+				Providers:    []*provider.Provider{newFakeProvider("capi")},
+			}
+			Expect(m.StopProvider("capd")).To(MatchError("provider capd not found"))
+			Expect(m.StartProvider(context.Background(), "capd")).To(MatchError("provider capd not found"))
+		})
+	})
+})
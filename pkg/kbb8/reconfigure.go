@@ -0,0 +1,139 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/fabriziopandini/kBB-8/pkg/provider"
+)
+
+// ReconfigureOptions defines how Reconfigure handles the providers being removed.
+type ReconfigureOptions struct {
+	// Prune deletes the objects installed by the removed providers: the CRDs, and with them all the custom resources,
+	// the webhook configurations and the APIServices; CRDs declared also by the remaining providers are kept.
+	Prune bool
+}
+
+// Reconfigure changes the providers run by the Manager to the given ones, matching them by name, and restarts
+// only the providers whose configuration changed, e.g. args or env, see provider.Provider.ConfigEqual.
+// Changed providers reuse the ports and the PKI of the previous run, so the objects already installed in the
+// API server keep working; added providers are started, and removed providers are stopped. The control plane
+// and the unchanged providers keep running. Post-start hooks are called for changed and added providers.
+func (m *Manager) Reconfigure(ctx context.Context, providers []*provider.Provider, opts ReconfigureOptions) error {
+	if err := validateProviderNames(providers); err != nil {
+		return err
+	}
+	if err := validateProviderDependencies(providers); err != nil {
+		return err
+	}
+
+	previous := m.providerList()
+	current := map[string]*provider.Provider{}
+	for _, p := range previous {
+		current[strings.ToLower(p.Name())] = p
+	}
+
+	next := make([]*provider.Provider, 0, len(providers))
+	toStop := []*provider.Provider{}
+	toStart := map[string]bool{}
+	for _, p := range providers {
+		if m.providerDefaults != nil {
+			m.providerDefaults(p)
+		}
+		key := strings.ToLower(p.Name())
+		old, ok := current[key]
+		delete(current, key)
+		switch {
+		case !ok:
+			toStart[key] = true
+			next = append(next, p)
+		case old.ConfigEqual(p):
+			next = append(next, old)
+		default:
+			p.ReuseEndpoints(old)
+			toStop = append(toStop, old)
+			toStart[key] = true
+			next = append(next, p)
+		}
+	}
+	removed := []*provider.Provider{}
+	for _, p := range previous {
+		if _, ok := current[strings.ToLower(p.Name())]; ok {
+			removed = append(removed, p)
+		}
+	}
+
+	errs := []error{}
+	for _, p := range append(toStop, removed...) {
+		if err := m.stopProvider(p); err != nil {
+			errs = append(errs, fmt.Errorf("error stopping provider %s: %w", p.Name(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return kerrors.NewAggregate(errs)
+	}
+
+	if opts.Prune && len(removed) > 0 {
+		if err := m.pruneProviders(ctx, removed, next); err != nil {
+			return err
+		}
+	}
+
+	m.providersLock.Lock()
+	m.Providers = next
+	m.providersLock.Unlock()
+	if err := m.startProviders(ctx, toStart); err != nil {
+		errs = append(errs, err)
+	}
+	if err := m.writeInstance(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// pruneProviders deletes the objects installed by the removed providers, keeping the CRDs declared also by
+// the remaining providers.
+func (m *Manager) pruneProviders(ctx context.Context, removed, remaining []*provider.Provider) error {
+	keep := map[string]*apiextensionsv1.CustomResourceDefinition{}
+	for _, p := range remaining {
+		crds, err := p.CRDs()
+		if err != nil {
+			return err
+		}
+		for _, crd := range crds {
+			keep[crd.Name] = nil
+		}
+	}
+
+	errs := []error{}
+	for _, p := range removed {
+		p.SetCRDs(keep)
+		if err := p.DeleteObjects(ctx, m.ControlPlane.KubeConfigFile); err != nil {
+			errs = append(errs, fmt.Errorf("error pruning provider %s: %w", p.Name(), err))
+		}
+	}
+
+	// Deleted CRDs must be forgotten by the RESTMapper.
+	m.invalidateRESTMapper()
+	return kerrors.NewAggregate(errs)
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+
+	"github.com/fabriziopandini/kBB-8/pkg/controlplane"
+	"github.com/fabriziopandini/kBB-8/pkg/instance"
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+	"github.com/fabriziopandini/kBB-8/pkg/provider"
+)
+
+const (
+	etcdComponentName      = controlplane.EtcdComponentName
+	apiServerComponentName = controlplane.APIServerComponentName
+)
+
+// ComponentStatus describes the observed status of a kBB-8 component.
+type ComponentStatus = instance.ComponentStatus
+
+// Status returns the status of each component, probing its health endpoint and checking its process liveness;
+// components not started yet or crashed are reported as not running.
+func (m *Manager) Status(ctx context.Context) []ComponentStatus {
+	ret := []ComponentStatus{}
+
+	etcdStatus := process.Status{}
+	etcdPprofURL := ""
+	if etcd := m.ControlPlane.Etcd(); etcd != nil {
+		etcdStatus = etcd.Status(ctx)
+		etcdPprofURL = etcd.PprofURL()
+	}
+	s := newComponentStatus(etcdComponentName, etcdStatus)
+	s.PprofURL = etcdPprofURL
+	ret = append(ret, s)
+
+	apiServerStatus := process.Status{}
+	apiServerPprofURL := ""
+	if apiServer := m.ControlPlane.APIServer(); apiServer != nil {
+		apiServerStatus = apiServer.Status(ctx)
+		apiServerPprofURL = apiServer.PprofURL()
+	}
+	s = newComponentStatus(apiServerComponentName, apiServerStatus)
+	s.PprofURL = apiServerPprofURL
+	ret = append(ret, s)
+
+	for _, p := range m.providerList() {
+		ret = append(ret, newComponentStatus(p.Name(), p.Status(ctx)))
+	}
+	return ret
+}
+
+// providerList returns a copy of Providers, that can be used concurrently with Reconfigure.
+func (m *Manager) providerList() []*provider.Provider {
+	m.providersLock.Lock()
+	defer m.providersLock.Unlock()
+	return append([]*provider.Provider{}, m.Providers...)
+}
+
+func newComponentStatus(name string, s process.Status) ComponentStatus {
+	ret := ComponentStatus{
+		Name:    name,
+		Running: s.Running,
+		Healthy: s.Healthy,
+		URL:     s.URL,
+		PID:     s.PID,
+	}
+	if s.Err != nil {
+		ret.LastError = s.Err.Error()
+	}
+	return ret
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+)
+
+// Summary is the machine-readable description of a kBB-8 instance, e.g. for automation wrapping the kBB-8 CLI.
+type Summary struct {
+	// KubeConfigFile is the path of the kubeconfig file with the kBB-8 context.
+	KubeConfigFile string `json:"kubeConfigFile"`
+
+	// KubeConfigContext is the name of the kBB-8 context.
+	KubeConfigContext string `json:"kubeConfigContext"`
+
+	// ControlPlaneURL is the URL of the API server.
+	ControlPlaneURL string `json:"controlPlaneURL"`
+
+	// Providers are the providers running on top of the control plane.
+	Providers []ProviderSummary `json:"providers"`
+}
+
+// ProviderSummary is the machine-readable description of a provider.
+type ProviderSummary struct {
+	// Name of the provider.
+	Name string `json:"name"`
+
+	// Healthy is true if the provider is running and its health check succeeds.
+	Healthy bool `json:"healthy"`
+
+	// WebhookURL is the URL the provider webhooks are served at, if the provider was started.
+	WebhookURL string `json:"webhookURL,omitempty"`
+
+	// Error is the error of the provider if it failed to start, see Manager.ContinueOnProviderError.
+	Error string `json:"error,omitempty"`
+}
+
+// Summary returns the machine-readable description of the instance, probing the health of each provider.
+func (m *Manager) Summary(ctx context.Context) Summary {
+	s := Summary{
+		KubeConfigFile:    m.ControlPlane.KubeConfigFile,
+		KubeConfigContext: m.ControlPlane.KubeConfigContext,
+		Providers:         []ProviderSummary{},
+	}
+	if apiServer := m.ControlPlane.APIServer(); apiServer != nil && apiServer.URL != nil {
+		s.ControlPlaneURL = apiServer.URL.String()
+	}
+	providerErrors := m.ProviderErrors()
+	for _, p := range m.providerList() {
+		ps := ProviderSummary{
+			Name:       p.Name(),
+			Healthy:    p.Status(ctx).Healthy,
+			WebhookURL: p.WebhookURL(),
+		}
+		if err := providerErrors[p.Name()]; err != nil {
+			ps.Error = err.Error()
+		}
+		s.Providers = append(s.Providers, ps)
+	}
+	return s
+}
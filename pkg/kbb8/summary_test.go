@@ -0,0 +1,54 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/fabriziopandini/kBB-8/pkg/controlplane"
+	"github.com/fabriziopandini/kBB-8/pkg/provider"
+)
+
+var _ = Describe("Summary", func() {
+	It("is a valid JSON document with the expected fields", func() {
+		m := &Manager{
+			ControlPlane: &controlplane.ControlPlane{
+				KubeConfigFile:    "/home/user/.kube/config",
+				KubeConfigContext: "kBB-8-bootstrap",
+			},
+			Providers: []*provider.Provider{
+				{PackagePath: "./packages/bootstrap-capi"},
+			},
+		}
+
+		data, err := json.Marshal(m.Summary(context.Background()))
+		Expect(err).NotTo(HaveOccurred())
+
+		var summary map[string]interface{}
+		Expect(json.Unmarshal(data, &summary)).To(Succeed())
+		Expect(summary).To(HaveKeyWithValue("kubeConfigFile", "/home/user/.kube/config"))
+		Expect(summary).To(HaveKeyWithValue("kubeConfigContext", "kBB-8-bootstrap"))
+		Expect(summary).To(HaveKey("controlPlaneURL"))
+		Expect(summary).To(HaveKeyWithValue("providers", ConsistOf(
+			map[string]interface{}{"name": "CAPI", "healthy": false},
+		)))
+	})
+})
@@ -0,0 +1,90 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+	"github.com/fabriziopandini/kBB-8/pkg/provider"
+)
+
+// DefaultWebhooksReachableTimeout is the default maximum time for WaitForWebhooksReachable to wait for webhooks.
+const DefaultWebhooksReachableTimeout = 30 * time.Second
+
+// WaitForWebhooksReachable waits up to WebhooksReachableTimeout for all the conversion, mutating and validating
+// webhooks installed for the providers to be reachable, running a TLS handshake with each webhook URL and verifying
+// the serving certificate with the webhook CABundle, like the API server does; it returns an error naming
+// the webhooks still unreachable. Providers that failed to start are ignored.
+func (m *Manager) WaitForWebhooksReachable(ctx context.Context) error {
+	timeout := m.WebhooksReachableTimeout
+	if timeout <= 0 {
+		timeout = DefaultWebhooksReachableTimeout
+	}
+	return waitForWebhooks(ctx, m.installedWebhooks(), timeout)
+}
+
+// installedWebhooks returns the webhook endpoints installed for the providers started successfully.
+func (m *Manager) installedWebhooks() []provider.WebhookEndpoint {
+	failed := m.ProviderErrors()
+	ret := []provider.WebhookEndpoint{}
+	for _, p := range m.providerList() {
+		if failed[p.Name()] != nil {
+			continue
+		}
+		ret = append(ret, p.WebhookEndpoints()...)
+	}
+	return ret
+}
+
+// waitForWebhooks waits up to timeout for all the webhook endpoints to be reachable, polling with the same backoff
+// used for the components health checks.
+func waitForWebhooks(ctx context.Context, endpoints []provider.WebhookEndpoint, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// pending are the endpoints not reachable yet, with the error of the last attempt.
+	pending := map[int]error{}
+	for i := range endpoints {
+		pending[i] = nil
+	}
+	_ = process.PollWithBackoff(ctx, process.HealthCheckBackoff(), func(ctx context.Context) (bool, error) {
+		for i := range pending {
+			if err := provider.CheckWebhookEndpoint(ctx, endpoints[i]); err != nil {
+				pending[i] = err
+				continue
+			}
+			delete(pending, i)
+		}
+		return len(pending) == 0, nil
+	})
+
+	errs := []error{}
+	for i, e := range endpoints {
+		if err, ok := pending[i]; ok {
+			if err == nil {
+				err = ctx.Err()
+			}
+			errs = append(errs, fmt.Errorf("%s at %s is not reachable: %w", e.Name, e.URL, err))
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kbb8
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/fabriziopandini/kBB-8/pkg/provider"
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
+)
+
+var _ = Describe("WaitForWebhooksReachable", func() {
+	var ca *certs.TinyCA
+	var tlsConfig *tls.Config
+
+	BeforeEach(func() {
+		var err error
+		ca, err = certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+		servingCert, err := ca.NewServingCert("127.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		certData, keyData, err := servingCert.AsBytes()
+		Expect(err).NotTo(HaveOccurred())
+		tlsCert, err := tls.X509KeyPair(certData, keyData)
+		Expect(err).NotTo(HaveOccurred())
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{tlsCert}, MinVersion: tls.VersionTLS12}
+	})
+
+	It("waits for a webhook becoming reachable late", func() {
+		// Reserve an address, and start serving the webhook on it only after a while.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		addr := l.Addr().String()
+		Expect(l.Close()).To(Succeed())
+
+		server := &http.Server{Handler: http.NewServeMux(), TLSConfig: tlsConfig, ReadHeaderTimeout: time.Second}
+		defer server.Close()
+		go func() {
+			time.Sleep(time.Second)
+			l, err := tls.Listen("tcp", addr, tlsConfig)
+			if err != nil {
+				return
+			}
+			_ = server.Serve(l)
+		}()
+
+		webhooks := []provider.WebhookEndpoint{{Name: "late webhook", URL: "https://" + addr + "/mutate", CABundle: ca.CA.CertBytes()}}
+		start := time.Now()
+		Expect(waitForWebhooks(context.Background(), webhooks, 10*time.Second)).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+	})
+
+	It("names the webhooks not reachable before the timeout", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		addr := l.Addr().String()
+		Expect(l.Close()).To(Succeed())
+
+		webhooks := []provider.WebhookEndpoint{{Name: "unreachable webhook", URL: "https://" + addr + "/validate", CABundle: ca.CA.CertBytes()}}
+		err = waitForWebhooks(context.Background(), webhooks, time.Second)
+		Expect(err).To(MatchError(ContainSubstring("unreachable webhook at https://" + addr + "/validate is not reachable")))
+	})
+
+	It("succeeds without installed webhooks", func() {
+		m := &Manager{}
+		Expect(m.WaitForWebhooksReachable(context.Background())).To(Succeed())
+	})
+})
@@ -17,8 +17,12 @@ limitations under the License.
 package kubeconfig
 
 import (
+	"fmt"
 	"os"
+	"os/exec"
+	"time"
 
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 
@@ -27,10 +31,104 @@ import (
 
 const (
 	systemPrivilegedGroup = "system:masters"
+
+	// lockTimeout is the maximum time to wait for acquiring the lock on the kubeconfig file.
+	lockTimeout = 30 * time.Second
+
+	// lockRetryInterval is the interval between attempts to acquire the lock on the kubeconfig file.
+	lockRetryInterval = 100 * time.Millisecond
+
+	// execAPIVersion is the client authentication API version used for exec credential plugins.
+	execAPIVersion = "client.authentication.k8s.io/v1beta1"
 )
 
-func CreateOrMerge(ca *certs.TinyCA, url string, clusterName string, explicitPath string) (string, string, error) {
+// AuthMode defines how the kBB-8 user authenticates to the API server.
+type AuthMode string
+
+const (
+	// ClientCertAuthMode authenticates with a client certificate signed by the API server CA.
+	ClientCertAuthMode AuthMode = "ClientCert"
+
+	// TokenAuthMode authenticates with a static bearer token; the same token must be registered
+	// with the API server via --token-auth-file.
+	TokenAuthMode AuthMode = "Token"
+
+	// ExecAuthMode authenticates with the credentials returned by a user-provided exec credential plugin.
+	ExecAuthMode AuthMode = "Exec"
+)
+
+// AuthOptions defines how the kBB-8 user in the kubeconfig file authenticates to the API server.
+type AuthOptions struct {
+	// Mode is the authentication mode; it defaults to ClientCertAuthMode.
+	Mode AuthMode
+
+	// Token is the static bearer token used by TokenAuthMode.
+	Token string
+
+	// ExecCommand and ExecArgs define the exec credential plugin used by ExecAuthMode.
+	ExecCommand string
+	ExecArgs    []string
+}
+
+// Validate returns an error if the auth options can't be used for creating the kubeconfig file, e.g. because
+// the exec credential plugin can't be found; it allows failing before starting the control plane.
+func (o AuthOptions) Validate() error {
+	switch o.Mode {
+	case "", ClientCertAuthMode, TokenAuthMode:
+		return nil
+	case ExecAuthMode:
+		if o.ExecCommand == "" {
+			return fmt.Errorf("auth mode %s requires a command", o.Mode)
+		}
+		if _, err := exec.LookPath(o.ExecCommand); err != nil {
+			return fmt.Errorf("invalid exec credential plugin for auth mode %s: %w", o.Mode, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown auth mode %q", o.Mode)
+	}
+}
+
+// AdminRESTConfig returns a rest.Config authenticating with a client certificate in the system:masters group issued
+// from ca, e.g. for kBB-8's own clients when the kubeconfig file relies on an exec credential plugin, whose
+// credentials are meant for users and might not be accepted by the API server.
+func AdminRESTConfig(ca *certs.TinyCA, url string, clusterName string) (*rest.Config, error) {
+	config, err := create(ca, clusterName, url, AuthOptions{Mode: ClientCertAuthMode})
+	if err != nil {
+		return nil, err
+	}
+	return clientcmd.NewNonInteractiveClientConfig(*config, contextKey(clusterName), &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+}
+
+// UsesExec returns true if the user of the given context in the kubeconfig file authenticates with an exec
+// credential plugin.
+func UsesExec(path string, context string) (bool, error) {
+	config, err := clientcmd.LoadFromFile(path)
+	if err != nil {
+		return false, err
+	}
+	if context == "" {
+		context = config.CurrentContext
+	}
+	c, ok := config.Contexts[context]
+	if !ok {
+		return false, fmt.Errorf("context %q not found in %s", context, path)
+	}
+	authInfo, ok := config.AuthInfos[c.AuthInfo]
+	return ok && authInfo.Exec != nil, nil
+}
+
+func CreateOrMerge(ca *certs.TinyCA, url string, clusterName string, explicitPath string, auth AuthOptions) (string, string, error) {
 	rules := getConfigLoadingRules(explicitPath)
+	kubeConfigPath := rules.GetDefaultFilename()
+
+	// Lock the kubeconfig file, so concurrent kBB-8 instances can't clobber each other's entries.
+	unlock, err := lockFile(kubeConfigPath, lockTimeout)
+	if err != nil {
+		return "", "", err
+	}
+	defer unlock()
+
 	existingConfig, err := rules.Load()
 	if err != nil {
 		if !(explicitPath != "" && os.IsNotExist(err)) {
@@ -39,14 +137,15 @@ func CreateOrMerge(ca *certs.TinyCA, url string, clusterName string, explicitPat
 		existingConfig = clientcmdapi.NewConfig()
 	}
 
-	newConfig, err := create(ca, clusterName, url)
+	newConfig, err := create(ca, clusterName, url, auth)
+	if err != nil {
+		return "", "", err
+	}
 
 	if err := merge(newConfig, existingConfig); err != nil {
 		return "", "", err
 	}
 
-	kubeConfigPath := rules.GetDefaultFilename()
-
 	if err := clientcmd.WriteToFile(*existingConfig, kubeConfigPath); err != nil {
 		return "", "", err
 	}
@@ -54,17 +153,70 @@ func CreateOrMerge(ca *certs.TinyCA, url string, clusterName string, explicitPat
 	return kubeConfigPath, existingConfig.CurrentContext, nil
 }
 
+// CreateForUser writes a standalone kubeconfig file at path for a user authenticating with a client cert issued by ca,
+// e.g. for running a provider with its own identity and permissions instead of as a cluster admin.
+func CreateForUser(ca *certs.TinyCA, url string, clusterName string, user certs.ClientInfo, path string) error {
+	clientCert, err := ca.NewClientCert(user)
+	if err != nil {
+		return err
+	}
+	certBytes, keyBytes, err := clientCert.AsBytes()
+	if err != nil {
+		return err
+	}
+
+	config := &clientcmdapi.Config{
+		Clusters: map[string]*clientcmdapi.Cluster{
+			clusterKey(clusterName): {
+				Server:                   url,
+				CertificateAuthorityData: ca.CA.CertBytes(),
+			},
+		},
+		AuthInfos: map[string]*clientcmdapi.AuthInfo{
+			user.Name: {
+				ClientKeyData:         keyBytes,
+				ClientCertificateData: certBytes,
+			},
+		},
+		Contexts: map[string]*clientcmdapi.Context{
+			contextKey(clusterName): {
+				Cluster:  clusterKey(clusterName),
+				AuthInfo: user.Name,
+			},
+		},
+		CurrentContext: contextKey(clusterName),
+	}
+	return clientcmd.WriteToFile(*config, path)
+}
+
 func Remove(clusterName string, explicitPath string) error {
 	rules := getConfigLoadingRules(explicitPath)
 	for _, kubeConfigPath := range rules.GetLoadingPrecedence() {
-		existingConfig, err := clientcmd.LoadFromFile(kubeConfigPath)
-		if err != nil {
+		if err := removeFromFile(clusterName, kubeConfigPath); err != nil {
 			return err
 		}
-		if remove(clusterName, existingConfig) {
-			if err := clientcmd.WriteToFile(*existingConfig, kubeConfigPath); err != nil {
-				return err
-			}
+	}
+	return nil
+}
+
+func removeFromFile(clusterName string, kubeConfigPath string) error {
+	if _, err := os.Stat(kubeConfigPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	unlock, err := lockFile(kubeConfigPath, lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	existingConfig, err := clientcmd.LoadFromFile(kubeConfigPath)
+	if err != nil {
+		return err
+	}
+	if remove(clusterName, existingConfig) {
+		if err := clientcmd.WriteToFile(*existingConfig, kubeConfigPath); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -79,16 +231,8 @@ func getConfigLoadingRules(explicitPath string) *clientcmd.ClientConfigLoadingRu
 	return rules
 }
 
-func create(ca *certs.TinyCA, clusterName string, url string) (*clientcmdapi.Config, error) {
-	clientCert, err := ca.NewClientCert(certs.ClientInfo{
-		Name:   userKey(clusterName),
-		Groups: []string{systemPrivilegedGroup},
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	certBytes, keyBytes, err := clientCert.AsBytes()
+func create(ca *certs.TinyCA, clusterName string, url string, auth AuthOptions) (*clientcmdapi.Config, error) {
+	authInfo, err := createAuthInfo(ca, clusterName, auth)
 	if err != nil {
 		return nil, err
 	}
@@ -101,10 +245,7 @@ func create(ca *certs.TinyCA, clusterName string, url string) (*clientcmdapi.Con
 			},
 		},
 		AuthInfos: map[string]*clientcmdapi.AuthInfo{
-			userKey(clusterName): {
-				ClientKeyData:         keyBytes,
-				ClientCertificateData: certBytes,
-			},
+			userKey(clusterName): authInfo,
 		},
 		Contexts: map[string]*clientcmdapi.Context{
 			contextKey(clusterName): {
@@ -117,6 +258,49 @@ func create(ca *certs.TinyCA, clusterName string, url string) (*clientcmdapi.Con
 	return config, nil
 }
 
+func createAuthInfo(ca *certs.TinyCA, clusterName string, auth AuthOptions) (*clientcmdapi.AuthInfo, error) {
+	switch auth.Mode {
+	case "", ClientCertAuthMode:
+		clientCert, err := ca.NewClientCert(certs.ClientInfo{
+			Name:   userKey(clusterName),
+			Groups: []string{systemPrivilegedGroup},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		certBytes, keyBytes, err := clientCert.AsBytes()
+		if err != nil {
+			return nil, err
+		}
+		return &clientcmdapi.AuthInfo{
+			ClientKeyData:         keyBytes,
+			ClientCertificateData: certBytes,
+		}, nil
+	case TokenAuthMode:
+		if auth.Token == "" {
+			return nil, fmt.Errorf("auth mode %s requires a token", auth.Mode)
+		}
+		return &clientcmdapi.AuthInfo{
+			Token: auth.Token,
+		}, nil
+	case ExecAuthMode:
+		if auth.ExecCommand == "" {
+			return nil, fmt.Errorf("auth mode %s requires a command", auth.Mode)
+		}
+		return &clientcmdapi.AuthInfo{
+			Exec: &clientcmdapi.ExecConfig{
+				APIVersion:      execAPIVersion,
+				Command:         auth.ExecCommand,
+				Args:            auth.ExecArgs,
+				InteractiveMode: clientcmdapi.IfAvailableExecInteractiveMode,
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth mode %q", auth.Mode)
+	}
+}
+
 // TODO: make prefix configurable
 // TODO: make user name / groups configurable with defaults for admin
 
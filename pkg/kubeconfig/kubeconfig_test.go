@@ -0,0 +1,192 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubeconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
+)
+
+var _ = Describe("KubeConfig", func() {
+	var (
+		dir string
+		ca  *certs.TinyCA
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "kubeconfig-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		ca, err = certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("merges concurrent changes to the same file", func() {
+		kubeConfigPath := filepath.Join(dir, "config")
+
+		const clusters = 50
+		var wg sync.WaitGroup
+		for i := 0; i < clusters; i++ {
+			clusterName := fmt.Sprintf("cluster%d", i)
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				_, _, err := CreateOrMerge(ca, "https://127.0.0.1:6443", clusterName, kubeConfigPath, AuthOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			}()
+		}
+		wg.Wait()
+
+		config, err := clientcmd.LoadFromFile(kubeConfigPath)
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < clusters; i++ {
+			clusterName := fmt.Sprintf("cluster%d", i)
+			Expect(config.Clusters).To(HaveKey(clusterKey(clusterName)))
+			Expect(config.AuthInfos).To(HaveKey(userKey(clusterName)))
+			Expect(config.Contexts).To(HaveKey(contextKey(clusterName)))
+		}
+	})
+
+	It("removes a cluster", func() {
+		kubeConfigPath := filepath.Join(dir, "config")
+
+		_, _, err := CreateOrMerge(ca, "https://127.0.0.1:6443", "cluster1", kubeConfigPath, AuthOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = CreateOrMerge(ca, "https://127.0.0.1:6444", "cluster2", kubeConfigPath, AuthOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(Remove("cluster2", kubeConfigPath)).To(Succeed())
+
+		config, err := clientcmd.LoadFromFile(kubeConfigPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Clusters).To(HaveKey(clusterKey("cluster1")))
+		Expect(config.Clusters).NotTo(HaveKey(clusterKey("cluster2")))
+		Expect(config.CurrentContext).To(BeEmpty())
+	})
+
+	It("releases the lock on error", func() {
+		kubeConfigPath := filepath.Join(dir, "config")
+		Expect(ioutil.WriteFile(kubeConfigPath, []byte("invalid"), 0600)).To(Succeed())
+
+		_, _, err := CreateOrMerge(ca, "https://127.0.0.1:6443", "cluster1", kubeConfigPath, AuthOptions{})
+		Expect(err).To(HaveOccurred())
+
+		unlock, err := lockFile(kubeConfigPath, 0)
+		Expect(err).NotTo(HaveOccurred())
+		unlock()
+	})
+
+	DescribeTable("creates the AuthInfo for the selected auth mode",
+		func(auth AuthOptions, assertAuthInfo func(authInfo *clientcmdapi.AuthInfo)) {
+			kubeConfigPath := filepath.Join(dir, "config")
+
+			_, _, err := CreateOrMerge(ca, "https://127.0.0.1:6443", "cluster1", kubeConfigPath, auth)
+			Expect(err).NotTo(HaveOccurred())
+
+			config, err := clientcmd.LoadFromFile(kubeConfigPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.AuthInfos).To(HaveKey(userKey("cluster1")))
+			assertAuthInfo(config.AuthInfos[userKey("cluster1")])
+		},
+		Entry("client cert by default", AuthOptions{}, func(authInfo *clientcmdapi.AuthInfo) {
+			Expect(authInfo.ClientCertificateData).NotTo(BeEmpty())
+			Expect(authInfo.ClientKeyData).NotTo(BeEmpty())
+			Expect(authInfo.Token).To(BeEmpty())
+			Expect(authInfo.Exec).To(BeNil())
+		}),
+		Entry("token", AuthOptions{Mode: TokenAuthMode, Token: "secret"}, func(authInfo *clientcmdapi.AuthInfo) {
+			Expect(authInfo.Token).To(Equal("secret"))
+			Expect(authInfo.ClientCertificateData).To(BeEmpty())
+			Expect(authInfo.Exec).To(BeNil())
+		}),
+		Entry("exec", AuthOptions{Mode: ExecAuthMode, ExecCommand: "get-token", ExecArgs: []string{"--cluster", "cluster1"}}, func(authInfo *clientcmdapi.AuthInfo) {
+			Expect(authInfo.Exec).NotTo(BeNil())
+			Expect(authInfo.Exec.APIVersion).To(Equal(execAPIVersion))
+			Expect(authInfo.Exec.Command).To(Equal("get-token"))
+			Expect(authInfo.Exec.Args).To(Equal([]string{"--cluster", "cluster1"}))
+			Expect(authInfo.ClientCertificateData).To(BeEmpty())
+			Expect(authInfo.Token).To(BeEmpty())
+		}),
+	)
+
+	DescribeTable("fails for invalid auth options",
+		func(auth AuthOptions) {
+			_, _, err := CreateOrMerge(ca, "https://127.0.0.1:6443", "cluster1", filepath.Join(dir, "config"), auth)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("token without a token", AuthOptions{Mode: TokenAuthMode}),
+		Entry("exec without a command", AuthOptions{Mode: ExecAuthMode}),
+		Entry("unknown mode", AuthOptions{Mode: "Unknown"}),
+	)
+
+	DescribeTable("validates the auth options",
+		func(auth AuthOptions, expected string) {
+			err := auth.Validate()
+			if expected == "" {
+				Expect(err).NotTo(HaveOccurred())
+				return
+			}
+			Expect(err).To(MatchError(ContainSubstring(expected)))
+		},
+		Entry("client cert by default", AuthOptions{}, ""),
+		Entry("token", AuthOptions{Mode: TokenAuthMode}, ""),
+		Entry("exec with a command in the PATH", AuthOptions{Mode: ExecAuthMode, ExecCommand: "sh"}, ""),
+		Entry("exec without a command", AuthOptions{Mode: ExecAuthMode}, "requires a command"),
+		Entry("exec with a missing command", AuthOptions{Mode: ExecAuthMode, ExecCommand: "kbb8-missing-get-token"}, "invalid exec credential plugin"),
+		Entry("unknown mode", AuthOptions{Mode: "Unknown"}, "unknown auth mode"),
+	)
+
+	It("detects a kubeconfig user authenticating with an exec credential plugin", func() {
+		kubeConfigPath := filepath.Join(dir, "config")
+		_, context, err := CreateOrMerge(ca, "https://127.0.0.1:6443", "cluster1", kubeConfigPath, AuthOptions{Mode: ExecAuthMode, ExecCommand: "get-token"})
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = CreateOrMerge(ca, "https://127.0.0.1:6443", "cluster2", kubeConfigPath, AuthOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(UsesExec(kubeConfigPath, context)).To(BeTrue())
+		Expect(UsesExec(kubeConfigPath, contextKey("cluster2"))).To(BeFalse())
+	})
+
+	It("creates an admin rest.Config authenticating with a client cert", func() {
+		config, err := AdminRESTConfig(ca, "https://127.0.0.1:6443", "cluster1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.Host).To(Equal("https://127.0.0.1:6443"))
+		Expect(config.CAData).To(Equal(ca.CA.CertBytes()))
+		Expect(config.CertData).NotTo(BeEmpty())
+		Expect(config.KeyData).NotTo(BeEmpty())
+		Expect(config.ExecProvider).To(BeNil())
+	})
+})
@@ -0,0 +1,102 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubeconfig
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	certutil "k8s.io/client-go/util/cert"
+
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
+)
+
+// renewThreshold is the fraction of the client cert lifetime remaining below which the client cert is renewed.
+const renewThreshold = 0.2
+
+// ClientCertExpiry returns the expiry of the client cert of the kBB-8 user for clusterName.
+func ClientCertExpiry(clusterName string, explicitPath string) (time.Time, error) {
+	config, err := clientcmd.LoadFromFile(getConfigLoadingRules(explicitPath).GetDefaultFilename())
+	if err != nil {
+		return time.Time{}, err
+	}
+	cert, err := clientCert(config, clusterName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// RenewIfNeeded re-issues the client cert of the kBB-8 user for clusterName from ca if less than 20% of its lifetime
+// is remaining, and rewrites the kubeconfig file in place preserving all the other entries; it returns true if the
+// client cert was renewed. Users authenticating with a token or an exec credential plugin are left untouched.
+func RenewIfNeeded(ca *certs.TinyCA, clusterName string, explicitPath string) (bool, error) {
+	kubeConfigPath := getConfigLoadingRules(explicitPath).GetDefaultFilename()
+
+	unlock, err := lockFile(kubeConfigPath, lockTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	config, err := clientcmd.LoadFromFile(kubeConfigPath)
+	if err != nil {
+		return false, err
+	}
+	if authInfo, ok := config.AuthInfos[userKey(clusterName)]; ok && len(authInfo.ClientCertificateData) == 0 {
+		return false, nil
+	}
+	cert, err := clientCert(config, clusterName)
+	if err != nil {
+		return false, err
+	}
+
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	if time.Until(cert.NotAfter) > time.Duration(float64(lifetime)*renewThreshold) {
+		return false, nil
+	}
+
+	authInfo, err := createAuthInfo(ca, clusterName, AuthOptions{Mode: ClientCertAuthMode})
+	if err != nil {
+		return false, err
+	}
+	config.AuthInfos[userKey(clusterName)].ClientCertificateData = authInfo.ClientCertificateData
+	config.AuthInfos[userKey(clusterName)].ClientKeyData = authInfo.ClientKeyData
+	if err := clientcmd.WriteToFile(*config, kubeConfigPath); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// clientCert returns the client cert of the kBB-8 user for clusterName.
+func clientCert(config *clientcmdapi.Config, clusterName string) (*x509.Certificate, error) {
+	authInfo, ok := config.AuthInfos[userKey(clusterName)]
+	if !ok {
+		return nil, fmt.Errorf("user %s not found in the kubeconfig file", userKey(clusterName))
+	}
+	if len(authInfo.ClientCertificateData) == 0 {
+		return nil, fmt.Errorf("user %s does not use a client certificate", userKey(clusterName))
+	}
+	clientCerts, err := certutil.ParseCertsPEM(authInfo.ClientCertificateData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the client certificate of user %s: %v", userKey(clusterName), err)
+	}
+	return clientCerts[0], nil
+}
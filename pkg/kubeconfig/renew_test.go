@@ -0,0 +1,132 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kubeconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
+)
+
+var _ = Describe("RenewIfNeeded", func() {
+	var (
+		dir            string
+		kubeConfigPath string
+		ca             *certs.TinyCA
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "kubeconfig-test")
+		Expect(err).NotTo(HaveOccurred())
+		kubeConfigPath = filepath.Join(dir, "config")
+
+		ca, err = certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	// setShortLivedClientCert replaces the client cert of the kBB-8 user for cluster1 with a cert
+	// that is about to expire.
+	setShortLivedClientCert := func() []byte {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		template := &x509.Certificate{
+			Subject:      pkix.Name{CommonName: userKey("cluster1"), Organization: []string{systemPrivilegedGroup}},
+			SerialNumber: big.NewInt(1000),
+			KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Minute),
+		}
+		certRaw, err := x509.CreateCertificate(crand.Reader, template, ca.CA.Cert, key.Public(), ca.CA.Key)
+		Expect(err).NotTo(HaveOccurred())
+		certData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certRaw})
+
+		config, err := clientcmd.LoadFromFile(kubeConfigPath)
+		Expect(err).NotTo(HaveOccurred())
+		config.AuthInfos[userKey("cluster1")].ClientCertificateData = certData
+		Expect(clientcmd.WriteToFile(*config, kubeConfigPath)).To(Succeed())
+		return certData
+	}
+
+	It("renews a client cert about to expire, preserving other entries", func() {
+		_, _, err := CreateOrMerge(ca, "https://127.0.0.1:6443", "cluster1", kubeConfigPath, AuthOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = CreateOrMerge(ca, "https://127.0.0.1:6444", "cluster2", kubeConfigPath, AuthOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		shortLivedCert := setShortLivedClientCert()
+
+		expiry, err := ClientCertExpiry("cluster1", kubeConfigPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expiry).To(BeTemporally("<", time.Now().Add(2*time.Minute)))
+
+		renewed, err := RenewIfNeeded(ca, "cluster1", kubeConfigPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(renewed).To(BeTrue())
+
+		config, err := clientcmd.LoadFromFile(kubeConfigPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.AuthInfos[userKey("cluster1")].ClientCertificateData).NotTo(Equal(shortLivedCert))
+		Expect(config.Clusters).To(HaveKey(clusterKey("cluster2")))
+		Expect(config.AuthInfos).To(HaveKey(userKey("cluster2")))
+		Expect(config.CurrentContext).To(Equal(contextKey("cluster2")))
+
+		expiry, err = ClientCertExpiry("cluster1", kubeConfigPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expiry).To(BeTemporally(">", time.Now().Add(24*time.Hour)))
+	})
+
+	It("doesn't renew a client cert far from expiring", func() {
+		_, _, err := CreateOrMerge(ca, "https://127.0.0.1:6443", "cluster1", kubeConfigPath, AuthOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		renewed, err := RenewIfNeeded(ca, "cluster1", kubeConfigPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(renewed).To(BeFalse())
+	})
+
+	It("doesn't renew users not authenticating with a client cert", func() {
+		_, _, err := CreateOrMerge(ca, "https://127.0.0.1:6443", "cluster1", kubeConfigPath, AuthOptions{Mode: TokenAuthMode, Token: "secret"})
+		Expect(err).NotTo(HaveOccurred())
+
+		renewed, err := RenewIfNeeded(ca, "cluster1", kubeConfigPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(renewed).To(BeFalse())
+
+		_, err = ClientCertExpiry("cluster1", kubeConfigPath)
+		Expect(err).To(MatchError(ContainSubstring("does not use a client certificate")))
+	})
+})
@@ -0,0 +1,140 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manifest
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// SkipRemaining can be returned by the visit function passed to VisitDocuments for stopping the visit
+// without an error, e.g. once the document looked for is found.
+var SkipRemaining = errors.New("skip remaining documents")
+
+// ReadDocuments reads a YAML file and splits it into documents.
+func ReadDocuments(fp string) ([][]byte, error) {
+	f, err := os.Open(fp) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readDocuments(f)
+}
+
+// ReadDocumentsFS reads a YAML file from a filesystem, e.g. an embed.FS, and splits it into documents.
+func ReadDocumentsFS(fsys fs.FS, name string) ([][]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readDocuments(f)
+}
+
+// readDocuments reads YAML data and splits it into documents.
+func readDocuments(r io.Reader) ([][]byte, error) {
+	docs := [][]byte{}
+	err := VisitDocuments(r, func(doc []byte) error {
+		docs = append(docs, doc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// VisitDocumentsFS streams a YAML file from a filesystem, e.g. an embed.FS, calling visit for each document;
+// see VisitDocuments.
+func VisitDocumentsFS(fsys fs.FS, name string, visit func(doc []byte) error) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return VisitDocuments(f, visit)
+}
+
+// VisitDocuments reads YAML data and calls visit for each document as soon as it is read, so the whole data is
+// never kept in memory; the visit stops at the first error, that is returned, unless it is SkipRemaining.
+func VisitDocuments(r io.Reader, visit func(doc []byte) error) error {
+	reader := k8syaml.NewYAMLReader(bufio.NewReader(r))
+	for {
+		doc, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if err := visit(doc); err != nil {
+			if err == SkipRemaining {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// ReadPaths reads YAML documents from a list of files or directories;
+// for directories, all the .yaml, .yml and .json files directly inside the directory are read in lexical order.
+func ReadPaths(paths ...string) ([][]byte, error) {
+	docs := [][]byte{}
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+
+		files := []string{p}
+		if info.IsDir() {
+			entries, err := ioutil.ReadDir(p)
+			if err != nil {
+				return nil, err
+			}
+			files = []string{}
+			for _, e := range entries {
+				if e.IsDir() {
+					continue
+				}
+				switch filepath.Ext(e.Name()) {
+				case ".yaml", ".yml", ".json":
+					files = append(files, filepath.Join(p, e.Name()))
+				}
+			}
+			sort.Strings(files)
+		}
+
+		for _, f := range files {
+			fileDocs, err := ReadDocuments(f)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, fileDocs...)
+		}
+	}
+	return docs, nil
+}
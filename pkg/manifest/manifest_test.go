@@ -0,0 +1,87 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// writeLargeManifest writes a manifest with many documents, like the ones concatenating the manifests of many providers.
+func writeLargeManifest(b *testing.B) string {
+	var sb strings.Builder
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&sb, "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm%d\ndata:\n  key: %s\n", i, strings.Repeat("x", 16*1024))
+	}
+	fp := filepath.Join(b.TempDir(), "components.yaml")
+	if err := ioutil.WriteFile(fp, []byte(sb.String()), 0600); err != nil {
+		b.Fatal(err)
+	}
+	return fp
+}
+
+// BenchmarkVisitDocuments measures streaming a large manifest, one document at a time.
+func BenchmarkVisitDocuments(b *testing.B) {
+	fp := writeLargeManifest(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := os.Open(fp) //nolint:gosec
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := VisitDocuments(f, func(doc []byte) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+		_ = f.Close()
+	}
+}
+
+// BenchmarkReadAndSplitDocuments measures loading a large manifest as a whole and then splitting it into documents,
+// as a baseline for BenchmarkVisitDocuments.
+func BenchmarkReadAndSplitDocuments(b *testing.B) {
+	fp := writeLargeManifest(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := ioutil.ReadFile(fp) //nolint:gosec
+		if err != nil {
+			b.Fatal(err)
+		}
+		docs := [][]byte{}
+		reader := k8syaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+		for {
+			doc, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			docs = append(docs, doc)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// healthCheckInitialInterval is the initial interval between health checks.
+	healthCheckInitialInterval = 100 * time.Millisecond
+
+	// healthCheckMaxInterval is the maximum interval between health checks.
+	healthCheckMaxInterval = 2 * time.Second
+)
+
+// HealthCheckBackoff returns the backoff used when polling for a component to be ready: the interval starts
+// at 100ms and doubles at every attempt up to 2s, with some jitter so concurrent pollers are not in lockstep.
+// This reduces the load on components that are slow to become ready, while still reacting quickly
+// to components that are ready immediately.
+func HealthCheckBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: healthCheckInitialInterval,
+		Factor:   2,
+		Jitter:   0.2,
+		Steps:    math.MaxInt32,
+		Cap:      healthCheckMaxInterval,
+	}
+}
+
+// PollWithBackoff calls condition until it returns true or an error, waiting between attempts as defined by backoff;
+// it returns ctx.Err() if ctx is done before.
+// NOTE: differently from wait.ExponentialBackoffWithContext, polling does not stop once the backoff reaches its cap,
+// so the total time is bounded by ctx only.
+func PollWithBackoff(ctx context.Context, backoff wait.Backoff, condition wait.ConditionWithContextFunc) error {
+	for {
+		if ok, err := condition(ctx); err != nil || ok {
+			return err
+		}
+
+		t := time.NewTimer(backoff.Step())
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
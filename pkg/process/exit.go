@@ -0,0 +1,122 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// logTailLines is the number of process output lines kept for reporting processes exiting before being ready.
+const logTailLines = 10
+
+// ExitInfo describes how a process exited.
+type ExitInfo struct {
+	// Exited is true if the process was started and has exited.
+	Exited bool
+
+	// ExitCode is the exit code of the process, or -1 if it was terminated by a signal.
+	ExitCode int
+
+	// Signal is the signal that terminated the process, if any.
+	Signal syscall.Signal
+
+	// OOMKilled is true if the process was killed with SIGKILL not sent by kBB-8, which usually means
+	// it was killed by the kernel OOM killer.
+	OOMKilled bool
+}
+
+// String returns a human readable description of how the process exited.
+func (e ExitInfo) String() string {
+	switch {
+	case !e.Exited:
+		return "not exited"
+	case e.OOMKilled:
+		return fmt.Sprintf("killed by signal %q, possibly out of memory", e.Signal)
+	case e.Signal != 0:
+		return fmt.Sprintf("killed by signal %q", e.Signal)
+	default:
+		return fmt.Sprintf("exit code %d", e.ExitCode)
+	}
+}
+
+// newExitInfo returns the ExitInfo for a process state as returned by Cmd.Wait; killed is true if
+// kBB-8 sent SIGKILL to the process.
+func newExitInfo(state *os.ProcessState, killed bool) ExitInfo {
+	if state == nil {
+		return ExitInfo{}
+	}
+	info := ExitInfo{
+		Exited:   true,
+		ExitCode: state.ExitCode(),
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		info.Signal = status.Signal()
+		info.OOMKilled = info.Signal == syscall.SIGKILL && !killed
+	}
+	return info
+}
+
+// tailWriter is an io.Writer keeping the last lines written to it.
+type tailWriter struct {
+	lock    sync.Mutex
+	maxLine int
+	lines   []string
+	partial []byte
+}
+
+func newTailWriter(maxLines int) *tailWriter {
+	return &tailWriter{maxLine: maxLines}
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.lines = append(t.lines, string(t.partial[:i]))
+		t.partial = t.partial[i+1:]
+	}
+	if len(t.lines) > t.maxLine {
+		t.lines = t.lines[len(t.lines)-t.maxLine:]
+	}
+	return len(p), nil
+}
+
+// String returns the last lines written, including a last line not terminated by a newline.
+func (t *tailWriter) String() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	lines := t.lines
+	if len(t.partial) > 0 {
+		lines = append(append([]string{}, lines...), string(t.partial))
+		if len(lines) > t.maxLine {
+			lines = lines[len(lines)-t.maxLine:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
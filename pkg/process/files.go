@@ -0,0 +1,55 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import "os"
+
+const (
+	// DefaultDirMode is the default permission of the directories created for a component.
+	DefaultDirMode os.FileMode = 0700
+
+	// DefaultFileMode is the default permission of the files created for a component.
+	DefaultFileMode os.FileMode = 0600
+)
+
+// FileModes defines the permissions of the files and directories created for a component, e.g. log files,
+// certs and data dirs; zero values default to DefaultFileMode and DefaultDirMode.
+type FileModes struct {
+	FileMode os.FileMode
+	DirMode  os.FileMode
+}
+
+// File returns the permission for files.
+func (m FileModes) File() os.FileMode {
+	if m.FileMode == 0 {
+		return DefaultFileMode
+	}
+	return m.FileMode
+}
+
+// Key returns the permission for private keys, which are never readable by group or others, whatever FileMode is.
+func (m FileModes) Key() os.FileMode {
+	return m.File() & 0600
+}
+
+// Dir returns the permission for directories.
+func (m FileModes) Dir() os.FileMode {
+	if m.DirMode == 0 {
+		return DefaultDirMode
+	}
+	return m.DirMode
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// Identity identifies a process across pid reuse, by its pid, the path of its executable and its start time;
+// it allows to safely signal a process recorded by another kBB-8 process, e.g. one that crashed.
+type Identity struct {
+	PID        int    `json:"pid"`
+	Executable string `json:"executable"`
+	StartTime  string `json:"startTime"`
+}
+
+// Identify returns the identity of the running process with the given pid.
+func Identify(pid int) (Identity, error) {
+	executable, startTime, err := processInfo(pid)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{PID: pid, Executable: executable, StartTime: startTime}, nil
+}
+
+// Alive returns true if the process is still running, i.e. there is a running process with the same pid,
+// executable and start time; a different process reusing the pid is not considered.
+func (id Identity) Alive() bool {
+	if !Alive(id.PID) {
+		return false
+	}
+	current, err := Identify(id.PID)
+	if err != nil {
+		return false
+	}
+	return current == id
+}
+
+// Status returns the observed status of the process, probing hc only if the process is still running.
+func (id Identity) Status(ctx context.Context, hc HealthCheck) Status {
+	if !id.Alive() {
+		return Status{
+			PID: id.PID,
+			URL: hc.URL.String(),
+			Err: fmt.Errorf("process %d is not running", id.PID),
+		}
+	}
+	return PIDStatus(ctx, id.PID, hc)
+}
+
+// Stop stops the process, e.g. a process started by another kBB-8 process; it sends SIGTERM, and escalates
+// to SIGKILL if the process is still running after gracePeriod. The identity is checked before each signal,
+// so a different process reusing the pid is never signaled.
+func (id Identity) Stop(gracePeriod time.Duration) error {
+	if !id.Alive() {
+		return nil
+	}
+	if err := signalPID(id.PID, syscall.SIGTERM); err != nil {
+		return fmt.Errorf("unable to signal for process %d to stop: %w", id.PID, err)
+	}
+	if waitNotAlive(id.PID, gracePeriod) {
+		return nil
+	}
+
+	// The process did not shut down in the grace period, escalate to SIGKILL.
+	if _, err := id.Kill(); err != nil {
+		return err
+	}
+	if !waitNotAlive(id.PID, 5*time.Second) {
+		return fmt.Errorf("timeout waiting for process %d to stop", id.PID)
+	}
+	return nil
+}
+
+// Kill kills the process with SIGKILL, if it is still running, without waiting for its termination;
+// it returns false if the process is not running.
+func (id Identity) Kill() (bool, error) {
+	if !id.Alive() {
+		return false, nil
+	}
+	if err := signalPID(id.PID, syscall.SIGKILL); err != nil && id.Alive() {
+		return true, fmt.Errorf("unable to kill process %d: %w", id.PID, err)
+	}
+	return true, nil
+}
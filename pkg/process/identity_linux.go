@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// processInfo returns the executable and the start time, in clock ticks after boot, of the process with the given pid.
+func processInfo(pid int) (string, string, error) {
+	executable, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return "", "", err
+	}
+
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", "", err
+	}
+	// The process name, in the second field, is in parentheses and it can contain spaces, so fields are
+	// counted after it; the start time is the 22nd field.
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return "", "", fmt.Errorf("unable to parse the stat of process %d", pid)
+	}
+	fields := strings.Fields(string(stat)[i+1:])
+	if len(fields) < 20 {
+		return "", "", fmt.Errorf("unable to parse the stat of process %d", pid)
+	}
+	return executable, fields[19], nil
+}
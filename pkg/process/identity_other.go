@@ -0,0 +1,47 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// processInfo returns the executable and the start time of the process with the given pid, as reported by ps.
+func processInfo(pid int) (string, string, error) {
+	executable, err := psField(pid, "comm=")
+	if err != nil {
+		return "", "", err
+	}
+	startTime, err := psField(pid, "lstart=")
+	if err != nil {
+		return "", "", err
+	}
+	return executable, startTime, nil
+}
+
+func psField(pid int, field string) (string, error) {
+	out, err := exec.Command("ps", "-p", fmt.Sprintf("%d", pid), "-o", field).Output() //nolint:gosec
+	if err != nil {
+		return "", fmt.Errorf("unable to get the %s of process %d: %w", strings.TrimSuffix(field, "="), pid, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,30 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"fmt"
+)
+
+// processInfo is not supported on windows, where there is no ps to report the executable and the start time
+// of a process; identities can't be recorded, so processes of a previous kBB-8 process are never signaled.
+func processInfo(pid int) (string, string, error) {
+	return "", "", fmt.Errorf("unable to identify process %d: process identities are not supported on windows", pid)
+}
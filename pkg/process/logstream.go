@@ -0,0 +1,95 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// streamLock serializes writes of all the PrefixWriters, so lines from concurrent components are not interleaved
+// when streamed to the same writer.
+var streamLock sync.Mutex
+
+// PrefixWriter writes the output of a component to a stream shared with other components, e.g. os.Stderr,
+// prefixing each line with the component name; incomplete lines are buffered until they are completed or
+// until Flush is called.
+type PrefixWriter struct {
+	w      io.Writer
+	prefix []byte
+
+	lock sync.Mutex
+	buf  []byte
+}
+
+// NewPrefixWriter returns a PrefixWriter writing to w the lines prefixed with "[name] ".
+func NewPrefixWriter(w io.Writer, name string) *PrefixWriter {
+	return &PrefixWriter{
+		w:      w,
+		prefix: []byte("[" + name + "] "),
+	}
+}
+
+// Write writes the complete lines in p, buffering the last line if incomplete.
+func (pw *PrefixWriter) Write(p []byte) (int, error) {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+
+	pw.buf = append(pw.buf, p...)
+	i := bytes.LastIndexByte(pw.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	lines := pw.buf[:i+1]
+	if err := pw.writeLines(lines); err != nil {
+		return 0, err
+	}
+	pw.buf = append(pw.buf[:0], pw.buf[i+1:]...)
+	return len(p), nil
+}
+
+// Flush writes the buffered incomplete line, if any, so nothing is lost when the component stops.
+func (pw *PrefixWriter) Flush() error {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+
+	if len(pw.buf) == 0 {
+		return nil
+	}
+	if err := pw.writeLines(append(pw.buf, '\n')); err != nil {
+		return err
+	}
+	pw.buf = pw.buf[:0]
+	return nil
+}
+
+// writeLines writes newline terminated lines to the stream, all at once.
+func (pw *PrefixWriter) writeLines(lines []byte) error {
+	out := make([]byte, 0, len(lines)+bytes.Count(lines, []byte{'\n'})*len(pw.prefix))
+	for len(lines) > 0 {
+		i := bytes.IndexByte(lines, '\n')
+		out = append(out, pw.prefix...)
+		out = append(out, lines[:i+1]...)
+		lines = lines[i+1:]
+	}
+
+	streamLock.Lock()
+	defer streamLock.Unlock()
+	_, err := pw.w.Write(out)
+	return err
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+)
+
+var _ = Describe("PrefixWriter", func() {
+	It("prefixes each line with the component name", func() {
+		out := &bytes.Buffer{}
+		w := process.NewPrefixWriter(out, "etcd")
+
+		_, err := w.Write([]byte("first\nsecond\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out.String()).To(Equal("[etcd] first\n[etcd] second\n"))
+	})
+
+	It("buffers incomplete lines until they are completed or flushed", func() {
+		out := &bytes.Buffer{}
+		w := process.NewPrefixWriter(out, "apiserver")
+
+		_, err := w.Write([]byte("hel"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out.String()).To(BeEmpty())
+
+		_, err = w.Write([]byte("lo\nwor"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out.String()).To(Equal("[apiserver] hello\n"))
+
+		Expect(w.Flush()).To(Succeed())
+		Expect(out.String()).To(Equal("[apiserver] hello\n[apiserver] wor\n"))
+
+		Expect(w.Flush()).To(Succeed())
+		Expect(out.String()).To(Equal("[apiserver] hello\n[apiserver] wor\n"))
+	})
+
+	It("doesn't interleave lines from concurrent components", func() {
+		out := &bytes.Buffer{}
+		var wg sync.WaitGroup
+		for _, name := range []string{"etcd", "apiserver", "capi"} {
+			w := process.NewPrefixWriter(out, name)
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					_, _ = fmt.Fprintf(w, "line %d from %s\n", i, name)
+				}
+			}(name)
+		}
+		wg.Wait()
+
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		Expect(lines).To(HaveLen(300))
+		for _, l := range lines {
+			Expect(l).To(MatchRegexp(`^\[(\w+)\] line \d+ from (\w+)$`))
+			name := strings.TrimPrefix(strings.SplitN(l, "]", 2)[0], "[")
+			Expect(l).To(HaveSuffix(" from " + name))
+		}
+	})
+})
@@ -17,17 +17,23 @@ limitations under the License.
 package process
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 // ListenAddr represents some listening address and port.
@@ -58,17 +64,103 @@ type HealthCheck struct {
 	// HealthCheckPollInterval is the interval which will be used for polling the
 	// endpoint described by Host, Port, and Path.
 	//
-	// If left empty it will default to 100 Milliseconds.
+	// If left empty the endpoint is polled with an exponential backoff, see HealthCheckBackoff.
 	PollInterval time.Duration
+
+	// RootCAs, if set, are used for verifying the serving cert of https endpoints;
+	// if left empty the serving cert is not verified.
+	RootCAs *x509.CertPool
+
+	// UnixSocket, if set, is the path of the unix socket the endpoint is served on; the URL host is ignored.
+	UnixSocket string
+}
+
+// client returns the http client for probing the health check endpoint.
+func (h *HealthCheck) client() *http.Client {
+	if h.RootCAs == nil && h.UnixSocket == "" {
+		return healthCheckClient
+	}
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+	}
+	if h.RootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    h.RootCAs,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+	if h.UnixSocket != "" {
+		transport.DialContext = UnixSocketDialer(h.UnixSocket, healthCheckClient.Timeout)
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   healthCheckClient.Timeout,
+	}
+}
+
+// UnixSocketDialer returns a dial function connecting to the unix socket at path whatever the address,
+// e.g. for an http.Transport calling a server listening on a unix socket.
+func UnixSocketDialer(path string, timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+}
+
+// Check probes the health check endpoint once, returning an error if it does not respond with http.StatusOK.
+func (h *HealthCheck) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := h.client().Do(req)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check %s returned %d", h.URL.String(), res.StatusCode)
+	}
+	return nil
 }
 
+// Status describes the observed status of a process.
+type Status struct {
+	// Running is true if the process is started and has not exited.
+	Running bool
+
+	// Healthy is true if the process is running and its health check succeeds.
+	Healthy bool
+
+	// PID is the process id, or 0 if the process was never started.
+	PID int
+
+	// URL is the health check URL of the process.
+	URL string
+
+	// Err is the last error observed for the process, either its exit error or the health check error.
+	Err error
+}
+
+// DefaultStopGracePeriod is the default time processes are given to shut down cleanly before being killed.
+const DefaultStopGracePeriod = 10 * time.Second
+
 // State define the state of the process.
 type State struct {
+	// Cmd is the command of the process, set by Start; it is guarded by errMu, so it can be read concurrently,
+	// e.g. by Status, while the process is starting.
 	Cmd *exec.Cmd
 
 	Args []string
 	Path string
 
+	// Env are additional environment variables for the process, in the key=value form, e.g. GOMAXPROCS=2;
+	// the process inherits the environment of the parent, with Env taking precedence.
+	Env []string
+
+	// Dir is the working directory of the process; if left empty the process runs in the current directory.
+	Dir string
+
 	// HealthCheck describes how to check if this process is up.  If we get an http.StatusOK,
 	// we assume the process is ready to operate.
 	//
@@ -78,6 +170,21 @@ type State struct {
 	StopTimeout  time.Duration
 	StartTimeout time.Duration
 
+	// Detached runs the process in its own process group, so it is not affected by signals sent
+	// to the parent's process group and it can keep running after the parent exits.
+	// NOTE: detached processes should write to files, not to pipes owned by the parent.
+	Detached bool
+
+	// StopGracePeriod is the time the process is given to shut down cleanly after SIGTERM;
+	// once elapsed, the process is killed with SIGKILL.
+	//
+	// If left empty it will default to 10 Seconds.
+	StopGracePeriod time.Duration
+
+	// Started, if set, is called once the process is started, before waiting for it to be ready;
+	// e.g. for recording the process, so it can be cleaned up even if the caller crashes while waiting.
+	Started func()
+
 	// ready holds wether the process is currently in ready state (hit the ready condition) or not.
 	// It will be set to true on a successful `Start()` and set to false on a successful `Stop()`
 	ready bool
@@ -88,6 +195,11 @@ type State struct {
 	errMu    sync.Mutex
 	exitErr  error
 	exited   bool
+	exitInfo ExitInfo
+	// killed is true if the process was killed with SIGKILL by Stop.
+	killed bool
+	// logTail keeps the last lines of the process output, if not detached.
+	logTail *tailWriter
 }
 
 // Init sets up this process, initializing temporary directories, etc.
@@ -105,6 +217,10 @@ func (ps *State) Init() error {
 	if ps.StopTimeout == 0 {
 		ps.StopTimeout = 20 * time.Second
 	}
+
+	if ps.StopGracePeriod == 0 {
+		ps.StopGracePeriod = DefaultStopGracePeriod
+	}
 	return nil
 }
 
@@ -117,32 +233,62 @@ func (ps *State) Start(stdout, stderr io.Writer) (err error) {
 		return nil
 	}
 
-	ps.Cmd = exec.Command(ps.Path, ps.Args...)
-	ps.Cmd.Stdout = stdout
-	ps.Cmd.Stderr = stderr
+	cmdPath := ps.Path
+	if ps.Dir != "" {
+		// A relative path would be resolved from Dir.
+		if cmdPath, err = filepath.Abs(ps.Path); err != nil {
+			return err
+		}
+	}
+	cmd := exec.Command(cmdPath, ps.Args...)
+	cmd.Dir = ps.Dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	ps.logTail = nil
+	if !ps.Detached {
+		// Detached processes must write to files directly, so their output can't be captured.
+		ps.logTail = newTailWriter(logTailLines)
+		cmd.Stdout = io.MultiWriter(stdout, ps.logTail)
+		cmd.Stderr = io.MultiWriter(stderr, ps.logTail)
+	}
+	if len(ps.Env) > 0 {
+		cmd.Env = append(os.Environ(), ps.Env...)
+	}
+	if ps.Detached {
+		cmd.SysProcAttr = detachedSysProcAttr()
+	}
 
 	ready := make(chan bool)
 	timedOut := time.After(ps.StartTimeout)
 	pollerStopCh := make(stopChannel)
-	go pollURLUntilOK(ps.HealthCheck.URL, ps.HealthCheck.PollInterval, ready, pollerStopCh)
+	go pollUntilOK(ps.HealthCheck, ready, pollerStopCh)
 
 	ps.waitDone = make(chan struct{})
 
-	if err := ps.Cmd.Start(); err != nil {
+	// Cmd is set only once started, so concurrent readers never see the command while it is being started.
+	if err := cmd.Start(); err != nil {
 		ps.errMu.Lock()
 		defer ps.errMu.Unlock()
+		ps.Cmd = cmd
 		ps.exited = true
-		return err
+		return NewStartupError("", PhaseProcessStart, err)
 	}
+	ps.errMu.Lock()
+	ps.Cmd = cmd
+	ps.errMu.Unlock()
 	go func() {
 		defer close(ps.waitDone)
-		err := ps.Cmd.Wait()
+		err := cmd.Wait()
 
 		ps.errMu.Lock()
 		defer ps.errMu.Unlock()
 		ps.exitErr = err
 		ps.exited = true
+		ps.exitInfo = newExitInfo(cmd.ProcessState, ps.killed)
 	}()
+	if ps.Started != nil {
+		ps.Started()
+	}
 
 	select {
 	case <-ready:
@@ -152,25 +298,193 @@ func (ps *State) Start(stdout, stderr io.Writer) (err error) {
 		if pollerStopCh != nil {
 			close(pollerStopCh)
 		}
-		return fmt.Errorf("timeout waiting for process %s to start successfully "+
-			"(it may have failed to start, or stopped unexpectedly before becoming ready)",
-			path.Base(ps.Path))
+		return NewStartupError("", PhaseReadiness, ps.exitedBeforeReadyError())
 	case <-timedOut:
 		if pollerStopCh != nil {
 			close(pollerStopCh)
 		}
-		if ps.Cmd != nil {
-			// intentionally ignore this -- we might've crashed, failed to start, etc
-			ps.Cmd.Process.Signal(syscall.SIGTERM) //nolint:errcheck
+		// intentionally ignore this -- we might've crashed, failed to start, etc
+		cmd.Process.Signal(syscall.SIGTERM) //nolint:errcheck
+		return NewStartupError("", PhaseReadiness, fmt.Errorf("timeout waiting for process %s to start", path.Base(ps.Path)))
+	}
+}
+
+// exitedBeforeReadyError returns the error for a process that exited before becoming ready, reporting
+// how it exited and its last output lines.
+func (ps *State) exitedBeforeReadyError() error {
+	err := fmt.Errorf("process %s exited before becoming ready (%s)", path.Base(ps.Path), ps.ExitInfo())
+	if ps.logTail != nil {
+		if tail := ps.logTail.String(); tail != "" {
+			err = fmt.Errorf("%v, last log lines:\n%s", err, tail)
 		}
-		return fmt.Errorf("timeout waiting for process %s to start", path.Base(ps.Path))
 	}
+	return err
 }
 
 func (ps *State) Ready() bool {
 	return ps.ready
 }
 
+// PID returns the process id, or 0 if the process was never started.
+func (ps *State) PID() int {
+	p := ps.process()
+	if p == nil {
+		return 0
+	}
+	return p.Pid
+}
+
+// process returns the started process, or nil if the process was never started.
+func (ps *State) process() *os.Process {
+	if ps == nil {
+		return nil
+	}
+	ps.errMu.Lock()
+	defer ps.errMu.Unlock()
+	if ps.Cmd == nil {
+		return nil
+	}
+	return ps.Cmd.Process
+}
+
+// RunningPID returns the process id while the process is running, or 0 if it was never started or it exited;
+// the process id is stable for the life of the process.
+func (ps *State) RunningPID() int {
+	if ps == nil {
+		return 0
+	}
+	if exited, _ := ps.Exited(); exited {
+		return 0
+	}
+	return ps.PID()
+}
+
+// Status returns the observed status of the process, probing its health check.
+// A process that exited is reported as not running, with the exit error if any.
+func (ps *State) Status(ctx context.Context) Status {
+	if ps == nil {
+		return Status{}
+	}
+
+	status := Status{
+		PID: ps.PID(),
+		URL: ps.HealthCheck.URL.String(),
+	}
+	if status.PID == 0 {
+		return status
+	}
+
+	if exited, err := ps.Exited(); exited {
+		status.Err = err
+		if status.Err == nil {
+			status.Err = fmt.Errorf("process %s exited", path.Base(ps.Path))
+		}
+		return status
+	}
+	status.Running = true
+
+	if err := ps.HealthCheck.Check(ctx); err != nil {
+		status.Err = err
+		return status
+	}
+	status.Healthy = true
+	return status
+}
+
+// PIDStatus returns the observed status of the process with the given pid, e.g. a process started by another
+// kBB-8 process, probing its health check.
+func PIDStatus(ctx context.Context, pid int, hc HealthCheck) Status {
+	status := Status{
+		PID: pid,
+		URL: hc.URL.String(),
+	}
+	if !Alive(pid) {
+		status.Err = fmt.Errorf("process %d is not running", pid)
+		return status
+	}
+	status.Running = true
+
+	if err := hc.Check(ctx); err != nil {
+		status.Err = err
+		return status
+	}
+	status.Healthy = true
+	return status
+}
+
+func waitNotAlive(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for Alive(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// StartDetached starts cmd in its own process group, like the processes of a Detached State, so it keeps running
+// after the current process exits.
+func StartDetached(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = detachedSysProcAttr()
+	return cmd.Start()
+}
+
+// Alive returns true if a process with the given pid exists.
+func Alive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	return pidExists(pid)
+}
+
+// Killer kills a process, e.g. when stopping it takes too long.
+type Killer interface {
+	// Kill kills the process with SIGKILL, without waiting for its termination; it returns false if the process
+	// is not running.
+	Kill() (bool, error)
+}
+
+// Kill kills the process with SIGKILL, without waiting for its termination, e.g. when Stop takes too long;
+// it returns false if the process is not running. Detached processes are killed together with their process group,
+// so their children don't outlive them. It is safe to call concurrently with Stop.
+func (ps *State) Kill() (bool, error) {
+	p := ps.process()
+	if p == nil {
+		return false, nil
+	}
+	if done, _ := ps.Exited(); done {
+		return false, nil
+	}
+
+	ps.errMu.Lock()
+	ps.killed = true
+	ps.errMu.Unlock()
+	var err error
+	if ps.Detached {
+		err = signalGroup(p.Pid, syscall.SIGKILL)
+	} else {
+		err = p.Signal(syscall.SIGKILL)
+	}
+	if err != nil {
+		if done, _ := ps.Exited(); !done {
+			return true, fmt.Errorf("unable to kill process %s: %w", ps.Path, err)
+		}
+	}
+	return true, nil
+}
+
+// ExitInfo returns how the process exited; ExitInfo.Exited is false if the process was never started or
+// is still running.
+func (ps *State) ExitInfo() ExitInfo {
+	if ps == nil {
+		return ExitInfo{}
+	}
+	ps.errMu.Lock()
+	defer ps.errMu.Unlock()
+	return ps.exitInfo
+}
+
 // Exited returns true if the process exited, and may also
 // return an error (as per Cmd.Wait) if the process did not
 // exit with error code 0.
@@ -180,22 +494,26 @@ func (ps *State) Exited() (bool, error) {
 	return ps.exited, ps.exitErr
 }
 
-func pollURLUntilOK(url url.URL, interval time.Duration, ready chan bool, stopCh stopChannel) {
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				// there's probably certs *somewhere*,
-				// but it's fine to just skip validating
-				// them for health checks during testing
-				InsecureSkipVerify: true, //nolint:gosec
-			},
+var healthCheckClient = &http.Client{
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			// there's probably certs *somewhere*,
+			// but it's fine to just skip validating
+			// them for health checks during testing
+			InsecureSkipVerify: true, //nolint:gosec
 		},
-	}
-	if interval <= 0 {
-		interval = 100 * time.Millisecond
+	},
+	Timeout: 5 * time.Second,
+}
+
+func pollUntilOK(hc HealthCheck, ready chan bool, stopCh stopChannel) {
+	client := hc.client()
+	backoff := HealthCheckBackoff()
+	if hc.PollInterval > 0 {
+		backoff = wait.Backoff{Duration: hc.PollInterval}
 	}
 	for {
-		res, err := client.Get(url.String())
+		res, err := client.Get(hc.URL.String())
 		if err == nil {
 			_ = res.Body.Close()
 			if res.StatusCode == http.StatusOK {
@@ -207,25 +525,44 @@ func pollURLUntilOK(url url.URL, interval time.Duration, ready chan bool, stopCh
 		select {
 		case <-stopCh:
 			return
-		default:
-			time.Sleep(interval)
+		case <-time.After(backoff.Step()):
 		}
 	}
 }
 
 // Stop stops this process gracefully, waits for its termination, and cleans up
 // the CertDir if necessary.
+// The process is first asked to terminate with SIGTERM; if it is still running after
+// StopGracePeriod, it gets killed with SIGKILL.
 func (ps *State) Stop() error {
-	if ps.Cmd == nil {
+	p := ps.process()
+	if p == nil {
 		return nil
 	}
 	if done, _ := ps.Exited(); done {
 		return nil
 	}
-	if err := ps.Cmd.Process.Signal(syscall.SIGTERM); err != nil {
+	if err := p.Signal(syscall.SIGTERM); err != nil {
 		return fmt.Errorf("unable to signal for process %s to stop: %w", ps.Path, err)
 	}
 
+	select {
+	case <-ps.waitDone:
+		ps.ready = false
+		return nil
+	case <-time.After(ps.StopGracePeriod):
+	}
+
+	// The process did not shut down in the grace period, escalate to SIGKILL.
+	ps.errMu.Lock()
+	ps.killed = true
+	ps.errMu.Unlock()
+	if err := p.Signal(syscall.SIGKILL); err != nil {
+		if done, _ := ps.Exited(); !done {
+			return fmt.Errorf("unable to kill process %s: %w", ps.Path, err)
+		}
+	}
+
 	timedOut := time.After(ps.StopTimeout)
 
 	select {
@@ -0,0 +1,354 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+)
+
+var _ = Describe("State", func() {
+	var (
+		dir          string
+		healthServer *httptest.Server
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "process-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		// The stub process reports itself healthy by creating the ready file.
+		healthServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := os.Stat(filepath.Join(dir, "ready")); err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+	})
+
+	AfterEach(func() {
+		healthServer.Close()
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	newState := func(script string) *process.State {
+		healthURL, err := url.Parse(healthServer.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		ps := &process.State{
+			Path:            "/bin/sh",
+			Args:            []string{"-c", fmt.Sprintf("%s; touch %s; while true; do sleep 0.1; done", script, filepath.Join(dir, "ready"))},
+			StopGracePeriod: 500 * time.Millisecond,
+		}
+		ps.HealthCheck.URL = *healthURL
+		Expect(ps.Init()).To(Succeed())
+		return ps
+	}
+
+	Describe("Stop", func() {
+		It("terminates a process that handles SIGTERM within the grace period", func() {
+			ps := newState("true")
+			Expect(ps.Start(ioutil.Discard, ioutil.Discard)).To(Succeed())
+
+			start := time.Now()
+			Expect(ps.Stop()).To(Succeed())
+			Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+			Expect(ps.Ready()).To(BeFalse())
+		})
+
+		It("kills a process ignoring SIGTERM after the grace period", func() {
+			ps := newState("trap '' TERM")
+			Expect(ps.Start(ioutil.Discard, ioutil.Discard)).To(Succeed())
+
+			start := time.Now()
+			Expect(ps.Stop()).To(Succeed())
+			Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+
+			exited, err := ps.Exited()
+			Expect(exited).To(BeTrue())
+			Expect(err).To(MatchError(ContainSubstring("killed")))
+
+			// SIGKILL was sent by Stop, so the process is not reported as OOM killed.
+			info := ps.ExitInfo()
+			Expect(info.Signal).To(Equal(syscall.SIGKILL))
+			Expect(info.OOMKilled).To(BeFalse())
+		})
+	})
+	Describe("RunningPID", func() {
+		It("returns the pid while the process is running", func() {
+			ps := newState("true")
+			Expect(ps.RunningPID()).To(BeZero())
+
+			Expect(ps.Start(ioutil.Discard, ioutil.Discard)).To(Succeed())
+			pid := ps.RunningPID()
+			Expect(pid).NotTo(BeZero())
+			Expect(process.Alive(pid)).To(BeTrue())
+
+			Expect(ps.Stop()).To(Succeed())
+			Expect(ps.RunningPID()).To(BeZero())
+			// The pid of the exited process is still reported by Status.
+			Expect(ps.PID()).To(Equal(pid))
+		})
+	})
+
+	Describe("ExitInfo", func() {
+		It("is empty for a running process", func() {
+			ps := newState("true")
+			Expect(ps.Start(ioutil.Discard, ioutil.Discard)).To(Succeed())
+			defer func() {
+				Expect(ps.Stop()).To(Succeed())
+			}()
+
+			Expect(ps.ExitInfo()).To(Equal(process.ExitInfo{}))
+		})
+
+		It("reports a process killed with SIGKILL by someone else as possibly OOM killed", func() {
+			ps := newState("true")
+			Expect(ps.Start(ioutil.Discard, ioutil.Discard)).To(Succeed())
+			Expect(ps.Cmd.Process.Kill()).To(Succeed())
+			Eventually(func() bool {
+				return ps.ExitInfo().Exited
+			}).Should(BeTrue())
+
+			info := ps.ExitInfo()
+			Expect(info.Signal).To(Equal(syscall.SIGKILL))
+			Expect(info.OOMKilled).To(BeTrue())
+			Expect(info.String()).To(ContainSubstring("possibly out of memory"))
+		})
+	})
+	Describe("Status", func() {
+		It("reports a healthy running process", func() {
+			ps := newState("true")
+			Expect(ps.Start(ioutil.Discard, ioutil.Discard)).To(Succeed())
+			defer func() {
+				Expect(ps.Stop()).To(Succeed())
+			}()
+
+			status := ps.Status(context.Background())
+			Expect(status.Running).To(BeTrue())
+			Expect(status.Healthy).To(BeTrue())
+			Expect(status.PID).To(Equal(ps.Cmd.Process.Pid))
+			Expect(status.Err).NotTo(HaveOccurred())
+		})
+
+		It("reports a crashed process as not running", func() {
+			ps := newState("true")
+			Expect(ps.Start(ioutil.Discard, ioutil.Discard)).To(Succeed())
+			Expect(ps.Cmd.Process.Kill()).To(Succeed())
+			Eventually(func() bool {
+				exited, _ := ps.Exited()
+				return exited
+			}).Should(BeTrue())
+
+			status := ps.Status(context.Background())
+			Expect(status.Running).To(BeFalse())
+			Expect(status.Healthy).To(BeFalse())
+			Expect(status.Err).To(MatchError(ContainSubstring("killed")))
+		})
+
+		It("reports a process never started", func() {
+			var ps *process.State
+			Expect(ps.Status(context.Background())).To(Equal(process.Status{}))
+		})
+	})
+	Describe("Start", func() {
+		It("polls the health check with a backoff", func() {
+			// A health check never reporting ready, counting probes.
+			var probes int32
+			notReadyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&probes, 1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer notReadyServer.Close()
+
+			ps := newState("true")
+			healthURL, err := url.Parse(notReadyServer.URL)
+			Expect(err).NotTo(HaveOccurred())
+			ps.HealthCheck.URL = *healthURL
+			ps.StartTimeout = 3 * time.Second
+
+			// On timeout, the process is terminated.
+			Expect(ps.Start(ioutil.Discard, ioutil.Discard)).To(MatchError(ContainSubstring("timeout waiting for process")))
+			Eventually(func() bool {
+				exited, _ := ps.Exited()
+				return exited
+			}).Should(BeTrue())
+
+			// Polling at a fixed 100ms interval would probe ~30 times in 3s.
+			Expect(atomic.LoadInt32(&probes)).To(BeNumerically("<=", 8))
+		})
+
+		It("reports the exit code and the last log lines of a process exiting before being ready", func() {
+			ps := newState("echo starting; echo 'invalid flag --foo' >&2; exit 3")
+
+			err := ps.Start(ioutil.Discard, ioutil.Discard)
+			Expect(err).To(MatchError(ContainSubstring("process sh exited before becoming ready (exit code 3)")))
+			Expect(err).To(MatchError(ContainSubstring("invalid flag --foo")))
+			var startupErr *process.StartupError
+			Expect(errors.As(err, &startupErr)).To(BeTrue())
+			Expect(startupErr.Phase).To(Equal(process.PhaseReadiness))
+
+			info := ps.ExitInfo()
+			Expect(info.Exited).To(BeTrue())
+			Expect(info.ExitCode).To(Equal(3))
+			Expect(info.OOMKilled).To(BeFalse())
+		})
+	})
+	Describe("Env", func() {
+		It("sets additional env vars on top of the inherited environment", func() {
+			Expect(os.Setenv("KBB8_TEST_INHERITED", "inherited")).To(Succeed())
+			defer os.Unsetenv("KBB8_TEST_INHERITED")
+
+			envFile := filepath.Join(dir, "env")
+			ps := newState(fmt.Sprintf("echo \"$GOMAXPROCS $KBB8_TEST_INHERITED\" > %s", envFile))
+			ps.Env = []string{"GOMAXPROCS=2"}
+			Expect(ps.Start(ioutil.Discard, ioutil.Discard)).To(Succeed())
+			defer func() {
+				Expect(ps.Stop()).To(Succeed())
+			}()
+
+			env, err := ioutil.ReadFile(envFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(env)).To(Equal("2 inherited\n"))
+		})
+	})
+	Describe("Kill", func() {
+		It("kills a process while it is being stopped, recording that kBB-8 killed it", func() {
+			ps := newState("trap '' TERM")
+			ps.StopGracePeriod = time.Minute
+			Expect(ps.Start(ioutil.Discard, ioutil.Discard)).To(Succeed())
+
+			stopped := make(chan error, 1)
+			go func() {
+				stopped <- ps.Stop()
+			}()
+			// Give Stop the time to send SIGTERM.
+			time.Sleep(200 * time.Millisecond)
+
+			running, err := ps.Kill()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(running).To(BeTrue())
+			Eventually(stopped, 5*time.Second).Should(Receive(BeNil()))
+
+			info := ps.ExitInfo()
+			Expect(info.Signal).To(Equal(syscall.SIGKILL))
+			Expect(info.OOMKilled).To(BeFalse())
+
+			running, err = ps.Kill()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(running).To(BeFalse())
+		})
+	})
+
+	Describe("Started", func() {
+		It("is called once the process is started, before it is ready", func() {
+			ps := newState("true")
+			calls := 0
+			var pid int
+			var ready bool
+			ps.Started = func() {
+				calls++
+				pid = ps.PID()
+				ready = ps.Ready()
+			}
+			Expect(ps.Start(ioutil.Discard, ioutil.Discard)).To(Succeed())
+			defer func() {
+				Expect(ps.Stop()).To(Succeed())
+			}()
+
+			Expect(calls).To(Equal(1))
+			Expect(pid).To(Equal(ps.PID()))
+			Expect(pid).NotTo(BeZero())
+			Expect(ready).To(BeFalse())
+		})
+	})
+
+	Describe("Detached", func() {
+		It("runs the process in its own process group", func() {
+			ps := newState("true")
+			ps.Detached = true
+			Expect(ps.Start(ioutil.Discard, ioutil.Discard)).To(Succeed())
+			defer func() {
+				Expect(ps.Stop()).To(Succeed())
+			}()
+
+			pgid, err := syscall.Getpgid(ps.PID())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pgid).To(Equal(ps.PID()))
+			Expect(pgid).NotTo(Equal(syscall.Getpgrp()))
+		})
+	})
+
+	Describe("Identity.Stop", func() {
+		It("kills a process ignoring SIGTERM after the grace period", func() {
+			cmd := exec.Command("/bin/sh", "-c", fmt.Sprintf("trap '' TERM; touch %s; while true; do sleep 0.1; done", filepath.Join(dir, "ready")))
+			Expect(cmd.Start()).To(Succeed())
+			// Reap the process once terminated, like init does for processes of a kBB-8 instance started by another process.
+			go func() {
+				_ = cmd.Wait()
+			}()
+			Eventually(func() error {
+				_, err := os.Stat(filepath.Join(dir, "ready"))
+				return err
+			}).Should(Succeed())
+
+			id, err := process.Identify(cmd.Process.Pid)
+			Expect(err).NotTo(HaveOccurred())
+			start := time.Now()
+			Expect(id.Stop(500 * time.Millisecond)).To(Succeed())
+			Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+			Expect(process.Alive(cmd.Process.Pid)).To(BeFalse())
+		})
+
+		It("is a no-op for processes not running", func() {
+			Expect(process.Identity{}.Stop(time.Second)).To(Succeed())
+		})
+
+		It("does not signal a different process reusing the pid", func() {
+			cmd := exec.Command("/bin/sh", "-c", "while true; do sleep 0.1; done")
+			Expect(cmd.Start()).To(Succeed())
+			defer func() {
+				_ = cmd.Process.Kill()
+				_ = cmd.Wait()
+			}()
+
+			id, err := process.Identify(cmd.Process.Pid)
+			Expect(err).NotTo(HaveOccurred())
+			id.StartTime = "0"
+			Expect(id.Stop(time.Second)).To(Succeed())
+			Expect(process.Alive(cmd.Process.Pid)).To(BeTrue())
+		})
+	})
+})
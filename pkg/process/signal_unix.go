@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import "syscall"
+
+// detachedSysProcAttr returns the SysProcAttr for a process that must outlive kBB-8; the process
+// is started in its own process group, so it does not get signals sent to the kBB-8 terminal.
+func detachedSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalPID sends sig to the process with the given pid.
+func signalPID(pid int, sig syscall.Signal) error {
+	return syscall.Kill(pid, sig)
+}
+
+// signalGroup sends sig to the process group led by the process with the given pid.
+func signalGroup(pid int, sig syscall.Signal) error {
+	return syscall.Kill(-pid, sig)
+}
+
+// pidExists returns true if a process with the given pid exists.
+func pidExists(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
@@ -0,0 +1,56 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"os"
+	"syscall"
+)
+
+// detachedSysProcAttr returns the SysProcAttr for a process that must outlive kBB-8; the process
+// is started in a new process group, so it does not get console signals sent to kBB-8.
+func detachedSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// signalPID terminates the process with the given pid; windows cannot deliver SIGTERM to another
+// process, so every signal is a kill.
+func signalPID(pid int, _ syscall.Signal) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+// signalGroup terminates the process with the given pid; its children are not terminated.
+func signalGroup(pid int, sig syscall.Signal) error {
+	return signalPID(pid, sig)
+}
+
+// pidExists returns true if a process with the given pid exists.
+func pidExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+	return true
+}
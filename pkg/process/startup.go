@@ -0,0 +1,84 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package process
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Phases of a component startup, see StartupError.
+const (
+	// PhaseSetup is the setup of the component configuration, log files and data dirs.
+	PhaseSetup = "setup"
+
+	// PhasePortAlloc is the allocation of the ports the component listens on.
+	PhasePortAlloc = "port-alloc"
+
+	// PhasePKI is the setup of the certs the component uses.
+	PhasePKI = "pki"
+
+	// PhaseManifestApply is the installation of the objects from the provider manifest, e.g. CRDs and webhooks.
+	PhaseManifestApply = "manifest-apply"
+
+	// PhaseProcessStart is the start of the component process.
+	PhaseProcessStart = "process-start"
+
+	// PhaseReadiness is the wait for the component to be ready.
+	PhaseReadiness = "readiness"
+)
+
+// StartupError is an error starting a kBB-8 component, identifying the component and the phase that failed,
+// e.g. for telling etcd failing to become ready from a provider CRD failing to be established with errors.As.
+type StartupError struct {
+	// Component is the name of the component, e.g. etcd, apiserver or the provider name.
+	Component string
+
+	// Phase is the startup phase that failed, e.g. PhaseReadiness.
+	Phase string
+
+	// Err is the cause of the failure.
+	Err error
+}
+
+func (e *StartupError) Error() string {
+	if e.Component == "" {
+		return fmt.Sprintf("failed during %s: %v", e.Phase, e.Err)
+	}
+	return fmt.Sprintf("%s failed during %s: %v", e.Component, e.Phase, e.Err)
+}
+
+func (e *StartupError) Unwrap() error {
+	return e.Err
+}
+
+// NewStartupError returns a StartupError for the component and the phase, wrapping err, or nil if err is nil.
+// If err already is a StartupError, e.g. returned by a step of the given phase, its phase is preserved, and
+// the component is set if empty.
+func NewStartupError(component, phase string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var startupErr *StartupError
+	if errors.As(err, &startupErr) {
+		if startupErr.Component == "" {
+			startupErr.Component = component
+		}
+		return err
+	}
+	return &StartupError{Component: component, Phase: phase, Err: err}
+}
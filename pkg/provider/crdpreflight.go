@@ -0,0 +1,67 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// preflightCRDs checks that the schemas of the CRDs are structural, like the API server does when creating CRDs,
+// returning an error naming each invalid CRD and the offending schema paths.
+func preflightCRDs(crds []*apiextensionsv1.CustomResourceDefinition) error {
+	errs := []error{}
+	for _, crd := range crds {
+		if crd == nil {
+			continue
+		}
+		if allErrs := validateCRDSchemas(crd); len(allErrs) > 0 {
+			errs = append(errs, fmt.Errorf("CustomResourceDefinition %s has an invalid schema: %w", crd.Name, allErrs.ToAggregate()))
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// validateCRDSchemas returns the errors of the schemas of all the versions of a CRD.
+func validateCRDSchemas(crd *apiextensionsv1.CustomResourceDefinition) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for i, version := range crd.Spec.Versions {
+		fldPath := field.NewPath("spec", "versions").Index(i).Child("schema", "openAPIV3Schema")
+		if version.Schema == nil || version.Schema.OpenAPIV3Schema == nil {
+			allErrs = append(allErrs, field.Required(fldPath, "schemas are required"))
+			continue
+		}
+
+		internal := &apiextensions.JSONSchemaProps{}
+		if err := apiextensionsv1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(version.Schema.OpenAPIV3Schema, internal, nil); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath, "", err.Error()))
+			continue
+		}
+		s, err := schema.NewStructural(internal)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath, "", err.Error()))
+			continue
+		}
+		allErrs = append(allErrs, schema.ValidateStructural(fldPath, s)...)
+	}
+	return allErrs
+}
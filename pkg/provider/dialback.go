@@ -0,0 +1,76 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// webhookDialBackTimeout is the maximum time to wait for the webhook server to accept TLS connections
+// after the provider is ready.
+const webhookDialBackTimeout = 10 * time.Second
+
+// checkWebhookHost returns an error if the API server listening on apiServerHost might not be able to call webhooks
+// served on webhookHost, i.e. if they are on addresses of different IP families, e.g. ::1 and 127.0.0.1, which happens
+// when localhost resolves to different addresses. Hosts which are not IP addresses are not checked.
+func checkWebhookHost(apiServerHost, webhookHost string) error {
+	apiServerIP := net.ParseIP(apiServerHost)
+	webhookIP := net.ParseIP(webhookHost)
+	if apiServerIP == nil || webhookIP == nil {
+		return nil
+	}
+	if (apiServerIP.To4() == nil) != (webhookIP.To4() == nil) {
+		return fmt.Errorf("the API server listens on %s while webhooks would be served on %s, and the API server might not be able to call them; "+
+			"check that localhost resolves to a single address on this machine", apiServerHost, webhookHost)
+	}
+	return nil
+}
+
+// dialBackWebhooks checks that the webhook server at hostPort accepts TLS connections, like the API server
+// does before calling webhooks, retrying until timeout; the serving certificate is not verified here,
+// see WithWebhookSelfTest for checking it against the injected CABundle.
+func dialBackWebhooks(ctx context.Context, hostPort string, timeout time.Duration) error {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 5 * time.Second},
+		Config: &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec
+			MinVersion:         tls.VersionTLS12,
+		},
+	}
+
+	var lastErr error
+	if err := wait.PollImmediate(webhookSelfTestInterval, timeout, func() (bool, error) {
+		conn, err := dialer.DialContext(ctx, "tcp", hostPort)
+		if err != nil {
+			lastErr = err
+			return false, nil
+		}
+		return true, conn.Close()
+	}); err != nil {
+		if lastErr == nil {
+			lastErr = err
+		}
+		return fmt.Errorf("webhooks are not reachable at %s: %w", hostPort, lastErr)
+	}
+	return nil
+}
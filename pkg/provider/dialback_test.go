@@ -0,0 +1,74 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Webhook dial-back", func() {
+	DescribeTable("checkWebhookHost",
+		func(apiServerHost, webhookHost string, wantErr bool) {
+			err := checkWebhookHost(apiServerHost, webhookHost)
+			if wantErr {
+				Expect(err).To(MatchError(ContainSubstring("the API server listens on %s while webhooks would be served on %s", apiServerHost, webhookHost)))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+		},
+		Entry("IPv6 API server and IPv4 webhooks", "::1", "127.0.0.1", true),
+		Entry("IPv4 API server and IPv6 webhooks", "127.0.0.1", "::1", true),
+		Entry("both IPv4", "127.0.0.1", "127.0.0.1", false),
+		Entry("both IPv6", "::1", "::1", false),
+		Entry("hostnames are not checked", "localhost", "127.0.0.1", false),
+		Entry("unknown API server host", "", "127.0.0.1", false),
+	)
+
+	It("succeeds when the webhook server completes the TLS handshake", func() {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+		defer server.Close()
+
+		Expect(dialBackWebhooks(context.Background(), strings.TrimPrefix(server.URL, "https://"), time.Second)).To(Succeed())
+	})
+
+	It("fails when nothing listens on the webhook port", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		hostPort := l.Addr().String()
+		Expect(l.Close()).To(Succeed())
+
+		err = dialBackWebhooks(context.Background(), hostPort, time.Second)
+		Expect(err).To(MatchError(ContainSubstring("webhooks are not reachable at %s", hostPort)))
+	})
+
+	It("fails when the webhook server doesn't speak TLS", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+		defer server.Close()
+
+		hostPort := strings.TrimPrefix(server.URL, "http://")
+		Expect(dialBackWebhooks(context.Background(), hostPort, time.Second)).To(MatchError(ContainSubstring("webhooks are not reachable at %s", hostPort)))
+	})
+})
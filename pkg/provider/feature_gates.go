@@ -0,0 +1,125 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const featureGatesFlag = "--feature-gates"
+
+// variableRegexp matches a variable in the ${VAR} or ${VAR:=default} form, like the ones used
+// in the provider manifests for defining feature gates values.
+var variableRegexp = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)(:=(.*))?\}$`)
+
+// parseFeatureGates parses a feature gates flag value in the Key1=true,Key2=false form;
+// values defined as variables are resolved from the environment or from their default, and
+// gates with variables that cannot be resolved are ignored.
+func parseFeatureGates(value string) (map[string]bool, error) {
+	ret := map[string]bool{}
+	for _, gate := range strings.Split(value, ",") {
+		gate = strings.TrimSpace(gate)
+		if gate == "" {
+			continue
+		}
+		kv := strings.SplitN(gate, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid feature gate %q, expected key=value", gate)
+		}
+		key, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		if m := variableRegexp.FindStringSubmatch(v); m != nil {
+			envValue, ok := os.LookupEnv(m[1])
+			switch {
+			case ok:
+				v = envValue
+			case m[2] != "":
+				v = m[3]
+			default:
+				continue
+			}
+		}
+
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for feature gate %q: %w", key, err)
+		}
+		ret[key] = enabled
+	}
+	return ret, nil
+}
+
+// extractFeatureGates parses the feature gates defined in a list of args, both in the
+// --feature-gates=value and in the --feature-gates value form, and returns them together with
+// the remaining args.
+func extractFeatureGates(args []string) (map[string]bool, []string, error) {
+	gates := map[string]bool{}
+	others := []string{}
+	for i := 0; i < len(args); i++ {
+		var value string
+		switch {
+		case strings.HasPrefix(args[i], featureGatesFlag+"="):
+			value = strings.TrimPrefix(args[i], featureGatesFlag+"=")
+		case args[i] == featureGatesFlag && i+1 < len(args):
+			i++
+			value = args[i]
+		default:
+			others = append(others, args[i])
+			continue
+		}
+
+		g, err := parseFeatureGates(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		for k, v := range g {
+			gates[k] = v
+		}
+	}
+	return gates, others, nil
+}
+
+// mergeFeatureGates merges feature gates, with later ones taking precedence in case of conflicting keys.
+func mergeFeatureGates(gates ...map[string]bool) map[string]bool {
+	ret := map[string]bool{}
+	for _, g := range gates {
+		for k, v := range g {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// featureGatesArg renders feature gates as a single --feature-gates flag, with keys sorted alphabetically.
+func featureGatesArg(gates map[string]bool) string {
+	keys := make([]string, 0, len(gates))
+	for k := range gates {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values = append(values, fmt.Sprintf("%s=%t", k, gates[k]))
+	}
+	return fmt.Sprintf("%s=%s", featureGatesFlag, strings.Join(values, ","))
+}
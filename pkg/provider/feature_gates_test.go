@@ -0,0 +1,47 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Feature gates", func() {
+	It("parses feature gates resolving variables from the environment or their defaults", func() {
+		Expect(os.Setenv("KBB8_TEST_FEATURE_GATE", "true")).To(Succeed())
+		defer os.Unsetenv("KBB8_TEST_FEATURE_GATE")
+
+		gates, err := parseFeatureGates("A=true, B=${KBB8_TEST_FEATURE_GATE:=false},C=${KBB8_TEST_UNSET:=false},D=${KBB8_TEST_UNSET}")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gates).To(Equal(map[string]bool{"A": true, "B": true, "C": false}))
+	})
+
+	It("fails for invalid feature gates", func() {
+		_, err := parseFeatureGates("A=maybe")
+		Expect(err).To(MatchError(ContainSubstring(`invalid value for feature gate "A"`)))
+	})
+
+	It("extracts feature gates from args", func() {
+		gates, others, err := extractFeatureGates([]string{"--feature-gates=A=true,B=true", "--v=2", "--feature-gates", "B=false"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gates).To(Equal(map[string]bool{"A": true, "B": false}))
+		Expect(others).To(Equal([]string{"--v=2"}))
+	})
+})
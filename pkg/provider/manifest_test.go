@@ -0,0 +1,596 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	admissionv1 "k8s.io/api/admissionregistration/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+)
+
+var _ = Describe("readAndAdaptManifestObjects", func() {
+	var (
+		dir string
+		pki *providerPKI
+		u   *providerURL
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "provider-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		pki = &providerPKI{dir: dir, caData: []byte("ca")}
+		u = &providerURL{host: "127.0.0.1", webhookPort: 9443, healthPort: 9440}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	writeManifest := func(data string) {
+		Expect(ioutil.WriteFile(filepath.Join(dir, manifestName), []byte(data), 0600)).To(Succeed())
+	}
+
+	It("preserves the conversion review versions declared by the CRD", func() {
+		writeManifest(`apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+spec:
+  group: example.com
+  conversion:
+    strategy: Webhook
+    webhook:
+      conversionReviewVersions:
+      - v1
+      clientConfig:
+        service:
+          name: webhook-service
+          namespace: system
+          path: /convert
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: bars.example.com
+spec:
+  group: example.com
+`)
+
+		objs, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(objs.crds).To(HaveLen(2))
+
+		Expect(objs.crds[0].Spec.Conversion.Webhook.ConversionReviewVersions).To(Equal([]string{"v1"}))
+		Expect(*objs.crds[0].Spec.Conversion.Webhook.ClientConfig.URL).To(Equal("https://127.0.0.1:9443/convert"))
+
+		Expect(objs.crds[1].Spec.Conversion.Webhook.ConversionReviewVersions).To(Equal([]string{"v1", "v1beta1"}))
+	})
+	It("replaces CRDs set with SetCRDs", func() {
+		writeManifest(`apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+spec:
+  group: example.com
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: bars.example.com
+spec:
+  group: example.com
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: bazs.example.com
+spec:
+  group: example.com
+`)
+		p := &Provider{}
+		p.SetCRDs(map[string]*apiextensionsv1.CustomResourceDefinition{
+			"foos.example.com": {
+				ObjectMeta: metav1.ObjectMeta{Name: "foos.example.com"},
+				Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+					Group:    "example.com",
+					Versions: []apiextensionsv1.CustomResourceDefinitionVersion{{Name: "v1beta1"}, {Name: "v1alpha4"}},
+				},
+			},
+			"bars.example.com": nil,
+		})
+
+		objs, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{crds: p.crds})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(objs.crds).To(HaveLen(2))
+		Expect(objs.crds[0].Name).To(Equal("foos.example.com"))
+		Expect(objs.crds[0].Spec.Versions).To(HaveLen(2))
+		Expect(*objs.crds[0].Spec.Conversion.Webhook.ClientConfig.URL).To(Equal("https://127.0.0.1:9443/convert"))
+		Expect(objs.crds[1].Name).To(Equal("bazs.example.com"))
+	})
+
+	It("adapts APIServices to target the local serving port", func() {
+		writeManifest(`apiVersion: apiregistration.k8s.io/v1
+kind: APIService
+metadata:
+  name: v1alpha1.metrics.example.com
+spec:
+  group: metrics.example.com
+  version: v1alpha1
+  groupPriorityMinimum: 100
+  versionPriority: 100
+  insecureSkipTLSVerify: true
+  service:
+    name: metrics-service
+    namespace: example-system
+    port: 443
+`)
+
+		objs, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(objs.apiServices).To(HaveLen(1))
+
+		apiService := objs.apiServices[0]
+		Expect(apiService.Spec.Service.Name).To(Equal("metrics-service"))
+		Expect(apiService.Spec.Service.Namespace).To(Equal("example-system"))
+		Expect(*apiService.Spec.Service.Port).To(BeEquivalentTo(9443))
+		Expect(apiService.Spec.CABundle).To(Equal(pki.caData))
+		Expect(apiService.Spec.InsecureSkipTLSVerify).To(BeFalse())
+
+		Expect(objs.services).To(HaveLen(1))
+		svc := objs.services[0]
+		Expect(svc.Name).To(Equal("metrics-service"))
+		Expect(svc.Namespace).To(Equal("example-system"))
+		Expect(svc.Spec.Type).To(BeEquivalentTo("ExternalName"))
+		Expect(svc.Spec.ExternalName).To(Equal("127.0.0.1"))
+		Expect(svc.Spec.Ports).To(HaveLen(1))
+		Expect(svc.Spec.Ports[0].Port).To(BeEquivalentTo(9443))
+		Expect(objs.rewrittenServices).To(ConsistOf(types.NamespacedName{Namespace: "example-system", Name: "metrics-service"}))
+		Expect(objs.apiServiceHosts()).To(Equal([]string{"metrics-service.example-system.svc"}))
+	})
+
+	Describe("webhook selectors", func() {
+		const webhooks = `apiVersion: admissionregistration.k8s.io/v1
+kind: MutatingWebhookConfiguration
+metadata:
+  name: mutating-webhook-configuration
+webhooks:
+- name: default.foo.example.com
+  clientConfig:
+    service:
+      name: webhook-service
+      namespace: system
+      path: /mutate-foo
+  namespaceSelector:
+    matchLabels:
+      cluster.x-k8s.io/watch-filter: foo
+  objectSelector:
+    matchLabels:
+      foo: bar
+---
+apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingWebhookConfiguration
+metadata:
+  name: validating-webhook-configuration
+webhooks:
+- name: validation.foo.example.com
+  clientConfig:
+    service:
+      name: webhook-service
+      namespace: system
+      path: /validate-foo
+  namespaceSelector:
+    matchLabels:
+      cluster.x-k8s.io/watch-filter: foo
+  objectSelector:
+    matchLabels:
+      foo: bar
+`
+
+		It("records the Services rewritten to the local serving URL once", func() {
+			writeManifest(webhooks)
+			objs, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(objs.rewrittenServices).To(ConsistOf(types.NamespacedName{Namespace: "system", Name: "webhook-service"}))
+		})
+
+		It("preserves selectors by default", func() {
+			writeManifest(webhooks)
+			objs, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(objs.mutHooks).To(HaveLen(1))
+			Expect(objs.valHooks).To(HaveLen(1))
+
+			Expect(objs.mutHooks[0].Webhooks[0].NamespaceSelector.MatchLabels).To(HaveKeyWithValue("cluster.x-k8s.io/watch-filter", "foo"))
+			Expect(objs.mutHooks[0].Webhooks[0].ObjectSelector.MatchLabels).To(HaveKeyWithValue("foo", "bar"))
+			Expect(objs.valHooks[0].Webhooks[0].NamespaceSelector.MatchLabels).To(HaveKeyWithValue("cluster.x-k8s.io/watch-filter", "foo"))
+			Expect(objs.valHooks[0].Webhooks[0].ObjectSelector.MatchLabels).To(HaveKeyWithValue("foo", "bar"))
+		})
+
+		It("removes selectors when passthrough is disabled", func() {
+			p := &Provider{}
+			WithWebhookSelectorPassthrough(false)(p)
+			writeManifest(webhooks)
+			objs, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{stripWebhookSelectors: p.stripWebhookSelectors})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(objs.mutHooks).To(HaveLen(1))
+			Expect(objs.valHooks).To(HaveLen(1))
+
+			Expect(objs.mutHooks[0].Webhooks[0].NamespaceSelector).To(BeNil())
+			Expect(objs.mutHooks[0].Webhooks[0].ObjectSelector).To(BeNil())
+			Expect(objs.valHooks[0].Webhooks[0].NamespaceSelector).To(BeNil())
+			Expect(objs.valHooks[0].Webhooks[0].ObjectSelector).To(BeNil())
+		})
+	})
+	It("records the provider namespaces, from Namespaces and the provider ServiceAccount", func() {
+		writeManifest(`apiVersion: v1
+kind: Namespace
+metadata:
+  name: capi-system
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: capi-webhooks
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: capi-controller-manager
+  namespace: capi-manager
+spec:
+  template:
+    spec:
+      containers:
+      - name: manager
+`)
+
+		objs, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(objs.providerNamespaces()).To(Equal([]string{"capi-system", "capi-webhooks", "capi-manager"}))
+		Expect(objs.empty()).To(BeTrue())
+
+		objs.namespaceDefaults = []string{"apiVersion: v1\nkind: LimitRange\n"}
+		Expect(objs.empty()).To(BeFalse())
+	})
+
+	It("reads the objects inside a List", func() {
+		writeManifest(`apiVersion: v1
+kind: List
+items:
+- apiVersion: apiextensions.k8s.io/v1
+  kind: CustomResourceDefinition
+  metadata:
+    name: foos.example.com
+  spec:
+    group: example.com
+- apiVersion: admissionregistration.k8s.io/v1
+  kind: ValidatingWebhookConfiguration
+  metadata:
+    name: validating-webhook-configuration
+  webhooks:
+  - name: validation.foo.example.com
+    clientConfig:
+      service:
+        name: webhook-service
+        namespace: system
+        path: /validate-foo
+`)
+
+		objs, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(objs.crds).To(HaveLen(1))
+		Expect(objs.crds[0].Name).To(Equal("foos.example.com"))
+		Expect(*objs.crds[0].Spec.Conversion.Webhook.ClientConfig.URL).To(Equal("https://127.0.0.1:9443/convert"))
+
+		Expect(objs.valHooks).To(HaveLen(1))
+		Expect(objs.valHooks[0].Name).To(Equal("validating-webhook-configuration"))
+		Expect(objs.valHooks[0].Webhooks[0].ClientConfig.Service).To(BeNil())
+		Expect(*objs.valHooks[0].Webhooks[0].ClientConfig.URL).To(HavePrefix("https://127.0.0.1:9443/"))
+		Expect(*objs.valHooks[0].Webhooks[0].ClientConfig.URL).To(HaveSuffix("/validate-foo"))
+		Expect(objs.valHooks[0].Webhooks[0].ClientConfig.CABundle).To(Equal([]byte("ca")))
+	})
+
+	Describe("webhook Service ports", func() {
+		const webhooks = `apiVersion: admissionregistration.k8s.io/v1
+kind: MutatingWebhookConfiguration
+metadata:
+  name: mutating-webhook-configuration
+webhooks:
+- name: default.foo.example.com
+  clientConfig:
+    service:
+      name: webhook-service
+      namespace: system
+      path: /mutate-foo
+---
+apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingWebhookConfiguration
+metadata:
+  name: validating-webhook-configuration
+webhooks:
+- name: validation.foo.example.com
+  clientConfig:
+    service:
+      name: %s
+      namespace: system
+      path: /validate-foo
+      port: %d
+`
+
+		It("accepts webhooks using the same Service port, defaulting to 443", func() {
+			writeManifest(fmt.Sprintf(webhooks, "webhook-service", 443))
+			objs, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(objs.valHooks[0].Webhooks[0].ClientConfig.URL).NotTo(BeNil())
+		})
+
+		It("rejects webhooks served on different Service ports", func() {
+			writeManifest(fmt.Sprintf(webhooks, "other-webhook-service", 9444))
+			_, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{})
+			Expect(err).To(MatchError(ContainSubstring("webhooks are served on 2 different Service ports, but multi-port webhook providers are not supported yet")))
+			Expect(err).To(MatchError(ContainSubstring("MutatingWebhookConfiguration mutating-webhook-configuration (Service system/webhook-service:443)")))
+			Expect(err).To(MatchError(ContainSubstring("ValidatingWebhookConfiguration validating-webhook-configuration (Service system/other-webhook-service:9444)")))
+		})
+	})
+
+	Describe("unknown fields", func() {
+		const crdWithTypo = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+spec:
+  group: example.com
+  versons:
+  - name: v1beta1
+`
+
+		It("rejects unknown fields, naming the object and the field", func() {
+			writeManifest(crdWithTypo)
+			_, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{})
+			Expect(err).To(MatchError(ContainSubstring("invalid CustomResourceDefinition foos.example.com")))
+			Expect(err).To(MatchError(ContainSubstring(`unknown field "versons"`)))
+		})
+
+		It("rejects unknown fields in webhook configurations", func() {
+			writeManifest(`apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingWebhookConfiguration
+metadata:
+  name: validating-webhook-configuration
+webhooks:
+- name: validation.foo.example.com
+  clientConfig:
+    service:
+      name: webhook-service
+      namespace: system
+      path: /validate-foo
+  failurPolicy: Fail
+`)
+			_, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{})
+			Expect(err).To(MatchError(ContainSubstring("invalid ValidatingWebhookConfiguration validating-webhook-configuration")))
+			Expect(err).To(MatchError(ContainSubstring(`unknown field "failurPolicy"`)))
+		})
+
+		It("ignores unknown fields with lenient decoding", func() {
+			writeManifest(crdWithTypo)
+			objs, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{lenientDecoding: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(objs.crds).To(HaveLen(1))
+			Expect(objs.crds[0].Spec.Versions).To(BeEmpty())
+		})
+
+		It("reports the manifest path for providers", func() {
+			writeManifest(crdWithTypo)
+			p := &Provider{PackagePath: dir}
+			_, err := p.CRDs()
+			Expect(err).To(MatchError(ContainSubstring("unable to read the manifest for provider %s at %s", p.Name(), filepath.Join(dir, manifestName))))
+
+			WithLenientDecoding()(p)
+			crds, err := p.CRDs()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(crds).To(HaveLen(1))
+		})
+	})
+
+	Describe("CRD preflight", func() {
+		It("rejects CRDs with non-structural schemas, naming the CRD and the schema path", func() {
+			writeManifest(nonStructuralCRD)
+			_, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{crdPreflight: true})
+			Expect(err).To(MatchError(ContainSubstring("CustomResourceDefinition foos.example.com has an invalid schema")))
+			Expect(err).To(MatchError(ContainSubstring("spec.versions[0].schema.openAPIV3Schema.properties[spec].type")))
+		})
+
+		It("accepts CRDs with structural schemas", func() {
+			writeManifest(`apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+spec:
+  group: example.com
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+`)
+			_, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{crdPreflight: true})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("is disabled by default", func() {
+			writeManifest(nonStructuralCRD)
+			_, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+})
+
+// nonStructuralCRD is a CRD with a schema the API server rejects, because a property has no type.
+const nonStructuralCRD = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+spec:
+  group: example.com
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            description: the spec without a type
+`
+
+// deletedCRDClient is a client simulating CRDs being deleted before being established.
+type deletedCRDClient struct {
+	client.Client
+}
+
+func (c deletedCRDClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if _, ok := obj.(*apiextensionsv1.CustomResourceDefinition); ok {
+		return apierrors.NewNotFound(apiextensionsv1.Resource("customresourcedefinitions"), key.Name)
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+var _ = Describe("applyManifestObjects", func() {
+	It("returns a StartupError identifying the provider and the phase when a CRD fails to be established", func() {
+		objs := &manifestObjects{
+			crds: []*apiextensionsv1.CustomResourceDefinition{
+				{ObjectMeta: metav1.ObjectMeta{Name: "foos.example.com"}},
+			},
+		}
+		c := deletedCRDClient{Client: fake.NewClientBuilder().WithScheme(scheme).Build()}
+
+		err := applyManifestObjects(context.Background(), c, "CAPI", objs)
+		var startupErr *process.StartupError
+		Expect(errors.As(err, &startupErr)).To(BeTrue())
+		Expect(startupErr.Component).To(Equal("CAPI"))
+		Expect(startupErr.Phase).To(Equal(process.PhaseManifestApply))
+		Expect(err).To(MatchError("CAPI failed during manifest-apply: error starting CRD foos.example.com: CRD foos.example.com was deleted before being established"))
+	})
+
+	It("retries updates failing because of conflicts", func() {
+		sideEffects := admissionv1.SideEffectClassNone
+		mutHook := &admissionv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "capi-mutating-webhook-configuration"},
+			Webhooks:   []admissionv1.MutatingWebhook{{Name: "default.cluster.cluster.x-k8s.io", SideEffects: &sideEffects, AdmissionReviewVersions: []string{"v1"}}},
+		}
+		valHook := &admissionv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "capi-validating-webhook-configuration"},
+			Webhooks:   []admissionv1.ValidatingWebhook{{Name: "validation.cluster.cluster.x-k8s.io", SideEffects: &sideEffects, AdmissionReviewVersions: []string{"v1"}}},
+		}
+		c := &conflictOnceClient{
+			Client:    fake.NewClientBuilder().WithScheme(scheme).WithObjects(mutHook.DeepCopy(), valHook.DeepCopy()).Build(),
+			conflicts: map[string]bool{},
+		}
+
+		mutHook.Labels = map[string]string{"updated": "true"}
+		valHook.Labels = map[string]string{"updated": "true"}
+		objs := &manifestObjects{
+			mutHooks: []*admissionv1.MutatingWebhookConfiguration{mutHook},
+			valHooks: []*admissionv1.ValidatingWebhookConfiguration{valHook},
+		}
+
+		Expect(applyManifestObjects(context.Background(), c, "CAPI", objs)).To(Succeed())
+		Expect(c.updates).To(Equal(4))
+
+		actualMutHook := &admissionv1.MutatingWebhookConfiguration{}
+		Expect(c.Get(context.Background(), client.ObjectKeyFromObject(mutHook), actualMutHook)).To(Succeed())
+		Expect(actualMutHook.Labels).To(HaveKeyWithValue("updated", "true"))
+		actualValHook := &admissionv1.ValidatingWebhookConfiguration{}
+		Expect(c.Get(context.Background(), client.ObjectKeyFromObject(valHook), actualValHook)).To(Succeed())
+		Expect(actualValHook.Labels).To(HaveKeyWithValue("updated", "true"))
+	})
+
+	It("retries creates failing because the object was created concurrently", func() {
+		crd := &apiextensionsv1.CustomResourceDefinition{
+			ObjectMeta: metav1.ObjectMeta{Name: "foos.example.com", Labels: map[string]string{"updated": "true"}},
+		}
+		c := &createdConcurrentlyClient{
+			Client: establishingClient{Client: fake.NewClientBuilder().WithScheme(scheme).Build()},
+			racing: &apiextensionsv1.CustomResourceDefinition{ObjectMeta: metav1.ObjectMeta{Name: "foos.example.com"}},
+		}
+
+		Expect(applyManifestObjects(context.Background(), c, "CAPI", &manifestObjects{crds: []*apiextensionsv1.CustomResourceDefinition{crd}})).To(Succeed())
+
+		actualCRD := &apiextensionsv1.CustomResourceDefinition{}
+		Expect(c.Get(context.Background(), client.ObjectKeyFromObject(crd), actualCRD)).To(Succeed())
+		Expect(actualCRD.Labels).To(HaveKeyWithValue("updated", "true"))
+	})
+})
+
+// createdConcurrentlyClient is a client creating the racing object right before the first create, like when another actor
+// creates the object between the get and the create.
+type createdConcurrentlyClient struct {
+	client.Client
+	racing client.Object
+}
+
+func (c *createdConcurrentlyClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if c.racing != nil {
+		racing := c.racing
+		c.racing = nil
+		if err := c.Client.Create(ctx, racing); err != nil {
+			return err
+		}
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+// conflictOnceClient is a client failing the first update of each object with a conflict, like when another actor
+// modifies the object between the get and the update.
+type conflictOnceClient struct {
+	client.Client
+	conflicts map[string]bool
+	updates   int
+}
+
+func (c *conflictOnceClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	c.updates++
+	if !c.conflicts[obj.GetName()] {
+		c.conflicts[obj.GetName()] = true
+		return apierrors.NewConflict(admissionv1.Resource("webhookconfigurations"), obj.GetName(), errors.New("the object has been modified"))
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
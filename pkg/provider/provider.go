@@ -18,32 +18,46 @@ package provider
 
 import (
 	"bufio"
-	"bytes"
 	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"net"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/addr"
 	admissionv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	crdhelpers "k8s.io/apiextensions-apiserver/pkg/apihelpers"
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/util/wait"
-	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
 	"k8s.io/utils/pointer"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/yaml"
 
+	"github.com/fabriziopandini/kBB-8/pkg/instance"
+	"github.com/fabriziopandini/kBB-8/pkg/manifest"
 	"github.com/fabriziopandini/kBB-8/pkg/process"
 	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
 )
@@ -51,24 +65,423 @@ import (
 var scheme = runtime.NewScheme()
 
 func init() {
+	_ = corev1.AddToScheme(scheme)
 	_ = apiextensionsv1.AddToScheme(scheme)
 	_ = admissionv1.AddToScheme(scheme)
+	_ = apiregistrationv1.AddToScheme(scheme)
+	_ = rbacv1.AddToScheme(scheme)
 }
 
 const (
 	binaryName   = "manager"
 	manifestName = "components.yaml"
+
+	defaultHealthScheme = "http"
+	defaultHealthPath   = "/healthz"
 )
 
+// ClusterDNSEnv is the env variable the address of the cluster DNS responder is passed to provider processes in,
+// e.g. 127.0.0.1:53535; providers can use it for resolving the Service names rewritten by kBB-8, e.g. with a
+// net.Resolver dialing it.
+const ClusterDNSEnv = "KBB8_CLUSTER_DNS"
+
+// defaultConversionReviewVersions are the conversion review versions used for CRDs not declaring them.
+var defaultConversionReviewVersions = []string{"v1", "v1beta1"}
+
 type Provider struct {
-	// TODO: make private and create constructor
+	// TODO: make private
 	PackagePath string
 	Args        []string
 
-	processState *process.State
+	// FeatureGates are merged with the feature gates defined in the provider manifest and in Args,
+	// taking precedence in case of conflicting keys.
+	FeatureGates map[string]bool
+
+	// DependsOn are the names of the providers that must be ready before this provider starts,
+	// e.g. because its objects reference types defined by the CRDs of another provider.
+	DependsOn []string
+
+	// name overrides the name derived from PackagePath.
+	name string
+
+	// instanceName is the name of the kBB-8 instance the provider belongs to, see WithInstanceName.
+	instanceName string
+
+	// packageFS and packageRoot, if set, define the filesystem the provider manifest is read from, see WithPackageFS.
+	packageFS   fs.FS
+	packageRoot string
+
+	// StopGracePeriod is the time the provider is given to shut down cleanly before being killed.
+	StopGracePeriod time.Duration
+
+	// ReadyGracePeriod is the time Start waits after all the readiness checks pass, before returning; it is
+	// a pragmatic workaround for controllers needing some time to populate their informer caches before reconciling
+	// reliably, e.g. for tests creating objects right after start. It defaults to 0.
+	ReadyGracePeriod time.Duration
+
+	// Detached runs the process so it can keep running after kBB-8 exits.
+	Detached bool
+
+	// Env are additional environment variables for the process, in the key=value form, e.g. GOMAXPROCS=2.
+	Env []string
+
+	// HealthScheme and HealthPath define the endpoint the provider health is checked on, defaulting to http and
+	// /healthz; the scheme and the path of the readiness or liveness probe of the provider Deployment, if any,
+	// take precedence. With https, the serving cert is verified against the provider CA.
+	HealthScheme string
+	HealthPath   string
+
+	// fileModes defines the permissions of the files and directories created for the provider, see WithFileModes.
+	fileModes process.FileModes
+
+	// logStream, if set, gets a copy of the provider output, see WithLogStreaming.
+	logStream io.Writer
+
+	// stripWebhookSelectors removes namespaceSelector and objectSelector from webhooks, see WithWebhookSelectorPassthrough.
+	stripWebhookSelectors bool
+
+	// lenientDecoding ignores unknown fields in the objects of the provider manifest, see WithLenientDecoding.
+	lenientDecoding bool
+
+	// crdPreflight validates the schemas of the CRDs in the provider manifest before installing them, see WithCRDPreflight.
+	crdPreflight bool
+
+	// webhookSelfTest enables checking that webhooks are reachable with the injected CABundle after start.
+	webhookSelfTest bool
+
+	// webhookEndpoints are the endpoints of the webhooks defined in the provider manifest.
+	webhookEndpoints []WebhookEndpoint
+
+	// services are the Services rewritten to the local webhook URL, see Services.
+	services []types.NamespacedName
+
+	// installed are the objects from the provider manifest installed by the last start, see InstalledObjects.
+	installed *manifestObjects
+
+	// crds, if not nil, replaces the CRDs in the provider manifest, see SetCRDs.
+	crds map[string]*apiextensionsv1.CustomResourceDefinition
+
+	// ca, if set, is the CA the webhook serving cert is issued from, see WithCA.
+	ca *certs.TinyCA
+
+	// scopedRBAC runs the provider with a kubeconfig bound to its ServiceAccount, see WithScopedRBAC.
+	scopedRBAC bool
+
+	// trustedCAs are additional CAs trusted by the provider, see WithTrustedCAs.
+	trustedCAs [][]byte
+
+	// namespaceDefaults are the LimitRange and ResourceQuota templates created in the provider namespaces,
+	// see WithNamespaceDefaults.
+	namespaceDefaults []string
+
+	// APIServerCA is the CA the API server trusts for client certs, used for issuing the scoped kubeconfig
+	// client cert; it is set by the Manager.
+	APIServerCA *certs.TinyCA
+
+	// APIServerHost is the host the API server listens on, used for checking that the API server can call the
+	// provider webhooks; it is set by the Manager.
+	APIServerHost string
+
+	// ClusterDNSAddress is the address of the cluster DNS responder, if enabled; it is passed to the provider process
+	// in the ClusterDNSEnv env variable, so the provider can resolve the Service names rewritten by kBB-8.
+	// It is set by the Manager.
+	ClusterDNSAddress string
+
+	// ManifestClient, if set, is used for installing the objects in the provider manifest instead of a client built
+	// from the kubeconfig file, so providers starting concurrently share the control plane client; it must be
+	// created with NewManifestClient. It is set by the Manager.
+	ManifestClient client.Client
+
+	// url and pki are set up on the first start, and reused when the provider is restarted.
+	url *providerURL
+	pki *providerPKI
+
+	// processState is the state of the provider process, replaced on each start; it is guarded by processStateLock,
+	// so it can be read concurrently, e.g. by Status, while the provider is starting.
+	processStateLock sync.Mutex
+	processState     *process.State
+
+	// ready is true once Start completed, including the ReadyGracePeriod, and until Stop.
+	readyLock sync.Mutex
+	ready     bool
+
+	logFile         *os.File
+	logFileWriter   *bufio.Writer
+	logStreamWriter *process.PrefixWriter
+}
+
+// Option configures a Provider.
+type Option func(*Provider)
+
+// WithName sets an explicit name for the provider, overriding the one derived from the package path;
+// this can be used to disambiguate providers deriving the same name.
+func WithName(name string) Option {
+	return func(p *Provider) {
+		p.name = name
+	}
+}
+
+// WithInstanceName sets the name of the kBB-8 instance the provider belongs to; the provider log file and certs
+// are created in the instance folder, see instance.Dir. It defaults to the unnamed instance.
+func WithInstanceName(name string) Option {
+	return func(p *Provider) {
+		p.instanceName = name
+	}
+}
+
+// WithArgs sets additional args for the provider manager binary.
+func WithArgs(args ...string) Option {
+	return func(p *Provider) {
+		p.Args = append(p.Args, args...)
+	}
+}
+
+// WithDependsOn declares the providers that must be ready before this provider starts.
+func WithDependsOn(names ...string) Option {
+	return func(p *Provider) {
+		p.DependsOn = append(p.DependsOn, names...)
+	}
+}
+
+// WithFeatureGates sets feature gates for the provider manager binary; they are merged with the feature gates
+// defined in the provider manifest and in args, and rendered as a single --feature-gates flag.
+func WithFeatureGates(gates map[string]bool) Option {
+	return func(p *Provider) {
+		p.FeatureGates = mergeFeatureGates(p.FeatureGates, gates)
+	}
+}
+
+// WithWebhookSelectorPassthrough defines if the namespaceSelector and the objectSelector of the provider webhooks
+// are kept as defined in the provider manifest (default true). When false, selectors are removed so every matching
+// object triggers the webhook, e.g. in a local-dev context where namespaces lack the labels expected by the selectors.
+func WithWebhookSelectorPassthrough(passthrough bool) Option {
+	return func(p *Provider) {
+		p.stripWebhookSelectors = !passthrough
+	}
+}
+
+// WithLenientDecoding ignores unknown fields in the CRDs, webhook configurations and APIServices of the provider
+// manifest, e.g. for manifests intentionally carrying extra fields; by default unknown fields are rejected, because
+// they are usually typos that would silently change the installed objects.
+func WithLenientDecoding() Option {
+	return func(p *Provider) {
+		p.lenientDecoding = true
+	}
+}
+
+// WithCRDPreflight validates the schemas of the CRDs in the provider manifest before installing them, like the API server
+// does, e.g. for getting an error naming the CRD and the schema path for CRDs rejected by newer API servers.
+func WithCRDPreflight() Option {
+	return func(p *Provider) {
+		p.crdPreflight = true
+	}
+}
+
+// WithWebhookSelfTest enables a self-test after the provider is ready, checking that each webhook is reachable
+// and that its serving certificate is trusted by the CABundle injected in the webhook configuration;
+// this surfaces misconfigurations that otherwise would make every create or update of the provider's objects fail.
+func WithWebhookSelfTest() Option {
+	return func(p *Provider) {
+		p.webhookSelfTest = true
+	}
+}
+
+// WithEnv sets additional environment variables for the provider manager binary, in the key=value form,
+// e.g. GOMAXPROCS=2; the process inherits the environment of kBB-8, with these variables taking precedence.
+func WithEnv(env ...string) Option {
+	return func(p *Provider) {
+		p.Env = append(p.Env, env...)
+	}
+}
+
+// WithHealthEndpoint sets the scheme, http or https, and the path the provider serves health on, e.g. for providers
+// not using the controller-runtime defaults; see HealthScheme and HealthPath.
+func WithHealthEndpoint(scheme, path string) Option {
+	return func(p *Provider) {
+		p.HealthScheme = scheme
+		p.HealthPath = path
+	}
+}
+
+// WithReadyGracePeriod sets the time Start waits after the provider passes the readiness checks, see ReadyGracePeriod.
+func WithReadyGracePeriod(d time.Duration) Option {
+	return func(p *Provider) {
+		p.ReadyGracePeriod = d
+	}
+}
+
+// WithPackageFS reads the provider manifest from root in fsys instead of from PackagePath, e.g. for embedding
+// provider packages in a test binary via go:embed. Only the manifest can be read from fsys, while the manager
+// binary must still exist in PackagePath on disk in order to be executed.
+func WithPackageFS(fsys fs.FS, root string) Option {
+	return func(p *Provider) {
+		p.packageFS = fsys
+		p.packageRoot = root
+	}
+}
+
+// WithCA issues the webhook serving cert from ca instead of from a new CA, e.g. to make the provider webhooks
+// trusted by tools already trusting ca; ca is then the CABundle injected in webhooks, CRD conversions and APIServices.
+func WithCA(ca *certs.TinyCA) Option {
+	return func(p *Provider) {
+		p.ca = ca
+	}
+}
+
+// WithTrustedCAs sets additional CAs, in PEM format, trusted by the provider, e.g. for calling external services
+// over TLS. kBB-8 writes a CA bundle combining the system CAs, these CAs and the API server CA, and points
+// the provider to it with the SSL_CERT_FILE env variable.
+func WithTrustedCAs(caBundle []byte) Option {
+	return func(p *Provider) {
+		p.trustedCAs = append(p.trustedCAs, caBundle)
+	}
+}
+
+// WithNamespaceDefaults sets LimitRange and ResourceQuota templates, in YAML, created in each namespace kBB-8 creates
+// for the provider, including the Namespaces in the manifest and the namespace of the provider Deployment, e.g. for
+// realistic testing of providers creating pods; "${namespace}" in templates is replaced with the namespace name.
+func WithNamespaceDefaults(templates ...string) Option {
+	return func(p *Provider) {
+		p.namespaceDefaults = append(p.namespaceDefaults, templates...)
+	}
+}
+
+// WithScopedRBAC runs the provider with a dedicated kubeconfig, authenticating as the ServiceAccount of the
+// provider Deployment instead of as a cluster admin, so the provider runs with the permissions it is granted in
+// production; the ClusterRoles, Roles and bindings in the provider manifest are installed for this purpose.
+// By default providers use the kBB-8 admin kubeconfig.
+func WithScopedRBAC() Option {
+	return func(p *Provider) {
+		p.scopedRBAC = true
+	}
+}
+
+// WithFileModes sets the permissions of the log file, the webhook certs and the other files and directories
+// created for the provider; private keys are never readable by group or others.
+func WithFileModes(modes process.FileModes) Option {
+	return func(p *Provider) {
+		p.fileModes = modes
+	}
+}
+
+// WithLogStreaming copies the provider output to w, e.g. os.Stderr for interactive debugging, in addition to the
+// log file; each line is prefixed with the provider name. It is ignored for detached providers.
+func WithLogStreaming(w io.Writer) Option {
+	return func(p *Provider) {
+		p.logStream = w
+	}
+}
+
+// NewProvider returns a Provider for the package at packagePath, failing fast if the provider manifest is missing.
+// If the manifest doesn't contain any object kBB-8 installs, e.g. because of an empty or misformatted package,
+// NewProvider returns both the Provider and a *ManifestWarning; use IsWarning for checking for this case.
+func NewProvider(packagePath string, opts ...Option) (*Provider, error) {
+	p := &Provider{
+		PackagePath: packagePath,
+	}
+	for _, o := range opts {
+		o(p)
+	}
+
+	if err := p.checkManifest(); err != nil {
+		if IsWarning(err) {
+			return p, err
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// ManifestWarning is a warning-level error reporting a provider manifest without any object kBB-8 installs
+// (CustomResourceDefinitions, webhook configurations, APIServices); the provider can be started anyway,
+// but most probably the provider package is empty or misformatted.
+type ManifestWarning struct {
+	// Provider is the name of the provider.
+	Provider string
+
+	// Path is the path of the provider manifest.
+	Path string
+}
+
+func (w *ManifestWarning) Error() string {
+	return fmt.Sprintf("the manifest for provider %s at %s does not contain any CustomResourceDefinition, webhook configuration or APIService", w.Provider, w.Path)
+}
+
+// IsWarning returns true if err is a warning-level error, like *ManifestWarning.
+func IsWarning(err error) bool {
+	var w *ManifestWarning
+	return errors.As(err, &w)
+}
+
+// manifestPath returns the path of the provider manifest, either on disk or in the package filesystem.
+func (p *Provider) manifestPath() string {
+	if p.packageFS != nil {
+		return path.Join(p.packageRoot, manifestName)
+	}
+	return filepath.Join(p.PackagePath, manifestName)
+}
+
+// manifestFS returns the filesystem the provider manifest is read from, and the name of the manifest in it.
+func (p *Provider) manifestFS() (fs.FS, string) {
+	if p.packageFS != nil {
+		return p.packageFS, path.Join(p.packageRoot, manifestName)
+	}
+	return os.DirFS(filepath.Clean(p.PackagePath)), manifestName
+}
+
+// manifestError wraps an error reading the provider manifest, naming the provider and the expected manifest location.
+func (p *Provider) manifestError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("manifest for provider %s not found, expected at %s: %w", p.Name(), p.manifestPath(), err)
+	}
+	return fmt.Errorf("unable to read the manifest for provider %s at %s: %w", p.Name(), p.manifestPath(), err)
+}
+
+// checkManifest checks that the provider manifest exists and that it contains objects kBB-8 installs.
+func (p *Provider) checkManifest() error {
+	fsys, name := p.manifestFS()
+	found := false
+	err := manifest.VisitDocumentsFS(fsys, name, func(doc []byte) error {
+		installable, err := hasInstallableObjects(doc)
+		if err != nil {
+			return err
+		}
+		if installable {
+			found = true
+			return manifest.SkipRemaining
+		}
+		return nil
+	})
+	if err != nil {
+		return p.manifestError(err)
+	}
+	if found {
+		return nil
+	}
+	return &ManifestWarning{Provider: p.Name(), Path: p.manifestPath()}
+}
 
-	logFile       *os.File
-	logFileWriter *bufio.Writer
+// hasInstallableObjects returns true if doc is, or is a List containing, an object kBB-8 installs.
+func hasInstallableObjects(doc []byte) (bool, error) {
+	var generic metav1.PartialObjectMetadata
+	if err := yaml.Unmarshal(doc, &generic); err != nil {
+		return false, err
+	}
+	switch generic.Kind {
+	case "CustomResourceDefinition", "MutatingWebhookConfiguration", "ValidatingWebhookConfiguration", "APIService":
+		return true, nil
+	case "List":
+		items, err := listItems(generic, doc)
+		if err != nil {
+			return false, err
+		}
+		for _, item := range items {
+			if installable, err := hasInstallableObjects(item); err != nil || installable {
+				return installable, err
+			}
+		}
+	}
+	return false, nil
 }
 
 type providerURL struct {
@@ -91,29 +504,165 @@ type providerPKI struct {
 }
 
 func (p *Provider) Name() string {
+	if p.name != "" {
+		return p.name
+	}
 	// TODO: check if there is a more straight forward/explicit way to get the provider name.
 	return strings.ToUpper(strings.TrimPrefix(filepath.Base(p.PackagePath), "bootstrap-"))
 }
 
+// CRDs returns the CustomResourceDefinitions in the provider manifest, as defined in the manifest.
+func (p *Provider) CRDs() ([]*apiextensionsv1.CustomResourceDefinition, error) {
+	fsys, name := p.manifestFS()
+	objs, err := readManifestObjects(fsys, name, p.lenientDecoding)
+	if err != nil {
+		return nil, p.manifestError(err)
+	}
+	return objs.crds, nil
+}
+
+// SetCRDs replaces the CustomResourceDefinitions in the provider manifest with the ones in crds with the same name,
+// e.g. after merging CRDs shared by many providers; CRDs replaced with nil are not installed by this provider.
+// Replacement CRDs are adapted to work in kBB-8 like the CRDs in the manifest.
+func (p *Provider) SetCRDs(crds map[string]*apiextensionsv1.CustomResourceDefinition) {
+	p.crds = crds
+}
+
+// WebhookURL returns the URL the provider webhooks are served at, or an empty string if the provider was never started.
+func (p *Provider) WebhookURL() string {
+	if p.url == nil || p.url.webhookPort == 0 {
+		return ""
+	}
+	return (&url.URL{Scheme: "https", Host: p.url.webhookHostPort()}).String()
+}
+
+// HealthURL returns the URL the provider health is checked at, or an empty string if the provider was never started.
+func (p *Provider) HealthURL() string {
+	ps := p.state()
+	if ps == nil {
+		return ""
+	}
+	return ps.HealthCheck.URL.String()
+}
+
+// EffectiveArgs returns the args the provider manager binary runs with, after merging the feature gates from the
+// provider manifest, from Args and from FeatureGates, or nil if the provider was never started.
+func (p *Provider) EffectiveArgs() []string {
+	ps := p.state()
+	if ps == nil {
+		return nil
+	}
+	return append([]string{}, ps.Args...)
+}
+
+// EffectiveFeatureGates returns the feature gates the provider manager binary runs with, see EffectiveArgs.
+func (p *Provider) EffectiveFeatureGates() map[string]bool {
+	gates, _, err := extractFeatureGates(p.EffectiveArgs())
+	if err != nil {
+		return nil
+	}
+	return gates
+}
+
+// Services returns the Services referenced by the provider webhooks, CRD conversions and APIServices, that kBB-8
+// rewrites to the local webhook URL; they are known once the provider is started.
+func (p *Provider) Services() []types.NamespacedName {
+	return p.services
+}
+
+// InstalledObjects returns the CRDs and the webhook configurations from the provider manifest as installed by kBB-8,
+// i.e. adapted to work with kBB-8, e.g. with webhooks pointing to the local webhook URL; they are known once
+// the provider is started. The returned objects are copies, so they can be modified by the caller.
+func (p *Provider) InstalledObjects() (crds []*apiextensionsv1.CustomResourceDefinition, mutHooks []*admissionv1.MutatingWebhookConfiguration, valHooks []*admissionv1.ValidatingWebhookConfiguration) {
+	if p.installed == nil {
+		return nil, nil, nil
+	}
+	for _, crd := range p.installed.crds {
+		crds = append(crds, crd.DeepCopy())
+	}
+	for _, hook := range p.installed.mutHooks {
+		mutHooks = append(mutHooks, hook.DeepCopy())
+	}
+	for _, hook := range p.installed.valHooks {
+		valHooks = append(valHooks, hook.DeepCopy())
+	}
+	return crds, mutHooks, valHooks
+}
+
+// CA returns the CA set with WithCA, if any.
+func (p *Provider) CA() *certs.TinyCA {
+	return p.ca
+}
+
 func (p *Provider) Start(ctx context.Context, kubeConfig string) error {
 	if err := p.setProcessState(ctx, kubeConfig); err != nil {
-		return err
+		return process.NewStartupError(p.Name(), process.PhaseSetup, err)
 	}
 
-	if err := p.processState.Start(p.logFileWriter, p.logFileWriter); err != nil {
-		return err
+	// Detached processes write directly to the log file, so logs keep being written after kBB-8 exits.
+	var w io.Writer = p.logFileWriter
+	if p.Detached {
+		w = p.logFile
+	} else if p.logStream != nil {
+		p.logStreamWriter = process.NewPrefixWriter(p.logStream, p.Name())
+		w = io.MultiWriter(p.logFileWriter, p.logStreamWriter)
+	}
+	ps := p.state()
+	if err := ps.Start(w, w); err != nil {
+		return process.NewStartupError(p.Name(), process.PhaseProcessStart, err)
 	}
 
-	if err := wait.PollImmediateInfiniteWithContext(ctx, 100*time.Millisecond, func(ctx context.Context) (bool, error) {
-		return p.processState.Ready(), nil
+	if err := process.PollWithBackoff(ctx, process.HealthCheckBackoff(), func(ctx context.Context) (bool, error) {
+		return ps.Ready(), nil
 	}); err != nil {
-		return fmt.Errorf("error starting %s: %w", p.PackagePath, err)
+		return process.NewStartupError(p.Name(), process.PhaseReadiness, fmt.Errorf("error starting %s: %w", p.PackagePath, err))
+	}
+
+	// The API server calls webhooks as soon as they are installed, so they must be reachable once the provider is ready.
+	if p.pki != nil {
+		if err := dialBackWebhooks(ctx, p.url.webhookHostPort(), webhookDialBackTimeout); err != nil {
+			return process.NewStartupError(p.Name(), process.PhaseReadiness, err)
+		}
 	}
+
+	if p.webhookSelfTest {
+		if err := selfTestWebhooks(ctx, p.webhookEndpoints, webhookSelfTestTimeout); err != nil {
+			return process.NewStartupError(p.Name(), process.PhaseReadiness, err)
+		}
+	}
+
+	if p.ReadyGracePeriod > 0 {
+		select {
+		case <-ctx.Done():
+			return process.NewStartupError(p.Name(), process.PhaseReadiness, fmt.Errorf("error waiting for the ready grace period: %w", ctx.Err()))
+		case <-time.After(p.ReadyGracePeriod):
+		}
+	}
+	p.setReady(true)
 	return nil
 }
 
+// Ready returns true once Start completed, including the ReadyGracePeriod, and until Stop; use Status for
+// checking the provider health.
+func (p *Provider) Ready() bool {
+	p.readyLock.Lock()
+	defer p.readyLock.Unlock()
+	return p.ready
+}
+
+func (p *Provider) setReady(ready bool) {
+	p.readyLock.Lock()
+	defer p.readyLock.Unlock()
+	p.ready = ready
+}
+
 func (p *Provider) Stop() error {
-	if err := p.processState.Stop(); err != nil {
+	p.setReady(false)
+	ps := p.state()
+	if ps == nil {
+		return nil
+	}
+	if err := ps.Stop(); err != nil {
 		return err
 	}
 
@@ -121,101 +670,266 @@ func (p *Provider) Stop() error {
 		if err := p.logFileWriter.Flush(); err != nil {
 			return err
 		}
+		p.logFileWriter = nil
+	}
+
+	if p.logStreamWriter != nil {
+		if err := p.logStreamWriter.Flush(); err != nil {
+			return err
+		}
+		p.logStreamWriter = nil
 	}
 
 	if p.logFile != nil {
 		if err := p.logFile.Close(); err != nil {
 			return err
 		}
+		p.logFile = nil
 	}
 
-	// TODO: Cleanup dir? What about logs? What about idempotent restart?
+	// The local path is kept: the logs outlive the process, and a restarted provider reuses the PKI.
 	return nil
 }
 
+// Status returns the observed status of the provider process.
+func (p *Provider) Status(ctx context.Context) process.Status {
+	return p.state().Status(ctx)
+}
+
+// PID returns the pid of the provider process, or 0 if it is not running, e.g. for supervising it externally;
+// the pid is stable for the life of the process, and it changes when the provider is restarted.
+func (p *Provider) PID() int {
+	return p.state().RunningPID()
+}
+
+// Killer returns the Killer for the provider process, e.g. for killing it if stopping it takes too long; it can be
+// used concurrently with Stop.
+func (p *Provider) Killer() process.Killer {
+	return p.state()
+}
+
+// ExitInfo returns how the provider process exited.
+func (p *Provider) ExitInfo() process.ExitInfo {
+	return p.state().ExitInfo()
+}
+
+// state returns the state of the provider process, or nil if the provider was never started.
+func (p *Provider) state() *process.State {
+	p.processStateLock.Lock()
+	defer p.processStateLock.Unlock()
+	return p.processState
+}
+
 func (p *Provider) setProcessState(ctx context.Context, kubeConfig string) error {
-	currentDir, err := os.Getwd()
+	// Set up the log file.
+	instanceDir, err := instance.Dir(p.instanceName)
 	if err != nil {
 		return err
 	}
-
-	// Set up the log file.
-	localPath := filepath.Join(currentDir, ".tmp", "provider", strings.ToLower(p.Name()))
-	if err := os.MkdirAll(localPath, 0744); err != nil {
+	localPath := filepath.Join(instanceDir, "provider", strings.ToLower(p.Name()))
+	if err := os.MkdirAll(localPath, p.fileModes.Dir()); err != nil {
 		return err
 	}
 
-	if p.logFile, err = os.OpenFile(filepath.Join(localPath, "manager.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+	if p.logFile, err = os.OpenFile(filepath.Join(localPath, "manager.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, p.fileModes.File()); err != nil {
 		return err
 	}
 	p.logFileWriter = bufio.NewWriter(p.logFile)
 
-	// Set up the webhook url.
-	pURL := &providerURL{}
-	pURL.webhookPort, pURL.host, err = addr.Suggest("")
+	// Read the provider manifest.
+	opts := manifestOptions{
+		stripWebhookSelectors: p.stripWebhookSelectors,
+		crds:                  p.crds,
+		scopedRBAC:            p.scopedRBAC,
+		lenientDecoding:       p.lenientDecoding,
+		crdPreflight:          p.crdPreflight,
+	}
+	fsys, name := p.manifestFS()
+	objs, err := readManifestObjectsWithOptions(fsys, name, opts)
 	if err != nil {
-		return fmt.Errorf("unable to grab random port for serving webhooks on: %v", err)
+		return p.manifestError(err)
+	}
+	servesWebhooks := objs.servesWebhooks()
+
+	// Set up the webhook and the health url, and the PKI; on restart, reuse the ones from the previous run,
+	// so the webhook configurations installed in the API server keep working.
+	// Providers not serving webhooks get only the health url.
+	// The host is resolved once, and the webhook port is allocated on the same host as the health port, so the
+	// webhook and the health URLs, as well as the webhook serving cert, agree on the host.
+	if p.url == nil {
+		pURL := &providerURL{}
+		pURL.healthPort, pURL.host, err = addr.Suggest("")
+		if err != nil {
+			return process.NewStartupError("", process.PhasePortAlloc, fmt.Errorf("unable to grab random port for serving health on: %v", err))
+		}
+		if servesWebhooks {
+			pURL.webhookPort, _, err = addr.Suggest(pURL.host)
+			if err != nil {
+				return process.NewStartupError("", process.PhasePortAlloc, fmt.Errorf("unable to grab random port for serving webhooks on: %v", err))
+			}
+		}
+		p.url = pURL
+	}
+	pURL := p.url
+	if servesWebhooks {
+		if err := checkWebhookHost(p.APIServerHost, pURL.host); err != nil {
+			return err
+		}
 	}
 
-	// Set up the health url.
-	pURL.healthPort, _, err = addr.Suggest("")
-	if err != nil {
-		return fmt.Errorf("unable to grab random port for serving health on: %v", err)
+	if p.pki == nil && servesWebhooks {
+		if p.pki, err = setupPKI(localPath, pURL, p.ca, p.fileModes, objs.apiServiceHosts()...); err != nil {
+			return process.NewStartupError("", process.PhasePKI, err)
+		}
 	}
+	pki := p.pki
 
-	// Set up the PKI.
-	pki, err := setupPKI(localPath, pURL)
-	if err != nil {
+	// Make the objects in the provider manifest ready to work with kBB-8.
+	adaptManifestObjects(objs, pki, pURL, opts)
+
+	// Create a subset of objects from the provider manifest (CRDs, WebhookConfigurations).
+	objs.namespaceDefaults = p.namespaceDefaults
+	if err := createManifestObjects(ctx, p.Name(), p.ManifestClient, kubeConfig, objs); err != nil {
 		return err
 	}
+	p.webhookEndpoints = objs.webhookEndpoints()
+	p.services = objs.rewrittenServices
+	p.installed = objs
+
+	// Use a kubeconfig bound to the provider ServiceAccount, if required.
+	providerKubeConfig := kubeConfig
+	if p.scopedRBAC {
+		if providerKubeConfig, err = writeScopedKubeConfig(localPath, kubeConfig, strings.ToLower(p.Name()), p.APIServerCA, objs.serviceAccount); err != nil {
+			return process.NewStartupError("", process.PhasePKI, err)
+		}
+	}
 
-	// Create a subset of objects from the provider manifest (CRDs, WebhookConfigurations).
-	manifestPath := filepath.Join(p.PackagePath, manifestName)
-	if err := createManifestObjects(ctx, manifestPath, kubeConfig, pki, pURL); err != nil {
+	// Trust additional CAs, if required.
+	env := p.Env
+	if len(p.trustedCAs) > 0 {
+		bundleFile, err := writeTrustedCABundle(localPath, p.trustedCAs, p.APIServerCA, p.fileModes)
+		if err != nil {
+			return process.NewStartupError("", process.PhasePKI, err)
+		}
+		env = append(append([]string{}, p.Env...), fmt.Sprintf("%s=%s", sslCertFileEnv, bundleFile))
+	}
+	if p.ClusterDNSAddress != "" {
+		env = append(append([]string{}, env...), fmt.Sprintf("%s=%s", ClusterDNSEnv, p.ClusterDNSAddress))
+	}
+
+	// Merge feature gates from the provider manifest, from args and from the FeatureGates option.
+	argsFeatureGates, args, err := extractFeatureGates(p.Args)
+	if err != nil {
 		return err
 	}
+	if featureGates := mergeFeatureGates(objs.featureGates, argsFeatureGates, p.FeatureGates); len(featureGates) > 0 {
+		args = append(args, featureGatesArg(featureGates))
+	}
 
 	// Starts the provider.
-	args := append(p.Args,
-		fmt.Sprintf("--kubeconfig=%s", kubeConfig),
-		fmt.Sprintf("--webhook-cert-dir=%s", pki.dir),
-		fmt.Sprintf("--webhook-port=%d", pURL.webhookPort),
+	args = append(args, fmt.Sprintf("--kubeconfig=%s", providerKubeConfig))
+	if pki != nil {
+		args = append(args,
+			fmt.Sprintf("--webhook-cert-dir=%s", pki.dir),
+			fmt.Sprintf("--webhook-port=%d", pURL.webhookPort),
+		)
+	}
+	args = append(args,
 		fmt.Sprintf("--health-addr=:%d", pURL.healthPort), // TODO: add host
 		"--metrics-bind-addr=0",
 	)
 
-	p.processState = &process.State{
-		Args: args,
-		Path: filepath.Join(p.PackagePath, binaryName),
+	ps := &process.State{
+		Args:            args,
+		Path:            filepath.Join(p.PackagePath, binaryName),
+		StopGracePeriod: p.StopGracePeriod,
+		Detached:        p.Detached,
+		Env:             env,
 	}
 
-	p.processState.HealthCheck.URL = url.URL{
-		Scheme: "http",
+	healthScheme, healthPath := p.healthEndpoint(objs.healthProbe)
+	ps.HealthCheck.URL = url.URL{
+		Scheme: healthScheme,
 		Host:   net.JoinHostPort(pURL.host, fmt.Sprintf("%d", pURL.healthPort)),
 	}
-	p.processState.HealthCheck.Path = "/healthz"
+	ps.HealthCheck.Path = healthPath
+	if healthScheme == "https" {
+		if ps.HealthCheck.RootCAs, err = p.healthRootCAs(); err != nil {
+			return err
+		}
+	}
 
-	if err := p.processState.Init(); err != nil {
+	if err := ps.Init(); err != nil {
 		return err
 	}
+
+	// Publish the process state only once fully set up, so concurrent readers never see it half-configured.
+	p.processStateLock.Lock()
+	p.processState = ps
+	p.processStateLock.Unlock()
 	return nil
 }
 
-func setupPKI(localPath string, u *providerURL) (*providerPKI, error) {
-	// TODO: Skip create if pki already exists for idempotent restart?
+// healthEndpoint returns the scheme and the path the provider serves health on, reading them from probe,
+// if not nil, and falling back to HealthScheme and HealthPath.
+func (p *Provider) healthEndpoint(probe *corev1.HTTPGetAction) (string, string) {
+	scheme, path := strings.ToLower(p.HealthScheme), p.HealthPath
+	if probe != nil {
+		if probe.Scheme != "" {
+			scheme = strings.ToLower(string(probe.Scheme))
+		}
+		if probe.Path != "" {
+			path = probe.Path
+		}
+	}
+	if scheme == "" {
+		scheme = defaultHealthScheme
+	}
+	if path == "" {
+		path = defaultHealthPath
+	}
+	return scheme, path
+}
+
+// healthRootCAs returns the pool for verifying the cert the provider serves health with, i.e. the CA of the
+// webhook serving cert, or the CA set with WithCA for providers not serving webhooks; it returns nil if there
+// is no CA for the provider, and the serving cert is not verified.
+func (p *Provider) healthRootCAs() (*x509.CertPool, error) {
+	var caData []byte
+	switch {
+	case p.pki != nil:
+		caData = p.pki.caData
+	case p.ca != nil:
+		caData = p.ca.CA.CertBytes()
+	default:
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("invalid CA for the %s health check", p.Name())
+	}
+	return pool, nil
+}
 
+// setupPKI sets up the webhook serving cert, issuing it from ca, if not nil, or from a new CA; the cert is valid
+// for the serving host and for serviceHosts, e.g. the Service hostnames of APIServices.
+func setupPKI(localPath string, u *providerURL, ca *certs.TinyCA, modes process.FileModes, serviceHosts ...string) (*providerPKI, error) {
 	localServingCertDir := filepath.Join(localPath, "ca")
-	if err := os.MkdirAll(localServingCertDir, 0744); err != nil {
+	if err := os.MkdirAll(localServingCertDir, modes.Dir()); err != nil {
 		return nil, fmt.Errorf("unable to create directory for webhook serving certs: %v", err)
 	}
 
-	hookCA, err := certs.NewTinyCA()
-	if err != nil {
-		return nil, fmt.Errorf("unable to create webhook CA: %v", err)
+	if ca == nil {
+		var err error
+		if ca, err = certs.NewTinyCA(); err != nil {
+			return nil, fmt.Errorf("unable to create webhook CA: %v", err)
+		}
+	} else if err := ca.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid webhook CA: %v", err)
 	}
 
-	names := []string{"localhost", u.host}
-	hookCert, err := hookCA.NewServingCert(names...)
+	// Service hostnames are not resolvable outside of the cluster, so they are added to the cert as they are.
+	hookCert, err := ca.NewServingCertWithDNSNames([]string{"localhost", u.host}, serviceHosts)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create webhook serving certs: %v", err)
 	}
@@ -225,42 +939,56 @@ func setupPKI(localPath string, u *providerURL) (*providerPKI, error) {
 		return nil, fmt.Errorf("unable to marshal webhook serving certs to bytes: %v", err)
 	}
 
-	if err := ioutil.WriteFile(filepath.Join(localServingCertDir, "tls.crt"), certData, 0640); err != nil { //nolint:gosec
+	if err := ioutil.WriteFile(filepath.Join(localServingCertDir, "tls.crt"), certData, modes.File()); err != nil {
 		return nil, fmt.Errorf("unable to write webhook serving cert to disk: %v", err)
 	}
-	if err := ioutil.WriteFile(filepath.Join(localServingCertDir, "tls.key"), keyData, 0640); err != nil { //nolint:gosec
+	if err := ioutil.WriteFile(filepath.Join(localServingCertDir, "tls.key"), keyData, modes.Key()); err != nil {
 		return nil, fmt.Errorf("unable to write webhook serving cert key to disk: %v", err)
 	}
 
 	return &providerPKI{
 		dir:    localServingCertDir,
-		caData: certData,
+		caData: ca.CA.CertBytes(),
 	}, nil
 }
 
-func createManifestObjects(ctx context.Context, manifestPath string, kubeConfig string, pki *providerPKI, u *providerURL) error {
-	// Create the client
-	config, err := clientcmd.LoadFromFile(kubeConfig)
-	if err != nil {
-		panic(err)
+func createManifestObjects(ctx context.Context, component string, c client.Client, kubeConfig string, objs *manifestObjects) error {
+	if objs.empty() {
+		return nil
 	}
 
-	restConfig, err := clientcmd.NewDefaultClientConfig(*config, &clientcmd.ConfigOverrides{}).ClientConfig()
-	if err != nil {
-		panic(err)
+	if c == nil {
+		var err error
+		if c, err = newManifestClientFromKubeConfig(kubeConfig); err != nil {
+			return process.NewStartupError(component, process.PhaseManifestApply, err)
+		}
 	}
+	return applyManifestObjects(ctx, c, component, objs)
+}
 
-	c, err := client.New(restConfig, client.Options{Scheme: scheme})
+// NewManifestClient returns a client for the objects in provider manifests, e.g. for sharing it among providers
+// with ManifestClient; mapper can be nil, and in this case the client discovers the API server resources.
+func NewManifestClient(restConfig *rest.Config, mapper meta.RESTMapper) (client.Client, error) {
+	return client.New(restConfig, client.Options{Scheme: scheme, Mapper: mapper})
+}
+
+// newManifestClientFromKubeConfig returns a client for the objects in provider manifests, using the kubeconfig file.
+func newManifestClientFromKubeConfig(kubeConfig string) (client.Client, error) {
+	config, err := clientcmd.LoadFromFile(kubeConfig)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	// Read the provider manifest and make it ready to work with kBB-8.
-	objs, err := readAndAdaptManifestObjects(manifestPath, pki, u)
+	restConfig, err := clientcmd.NewDefaultClientConfig(*config, &clientcmd.ConfigOverrides{}).ClientConfig()
 	if err != nil {
-		return fmt.Errorf("unable to get provider crds: %w", err)
+		return nil, err
 	}
+	return NewManifestClient(restConfig, nil)
+}
 
+// applyManifestObjects creates or updates the objects from the provider manifest, waiting for CRDs to be established;
+// errors are StartupErrors for the component in the manifest-apply phase. Objects might be modified concurrently,
+// e.g. CRDs shared by many providers, so updates are retried on conflicts with the latest resourceVersion.
+func applyManifestObjects(ctx context.Context, c client.Client, component string, objs *manifestObjects) error {
 	fns := []func() error{}
 
 	// Create CRDs
@@ -268,23 +996,11 @@ func createManifestObjects(ctx context.Context, manifestPath string, kubeConfig
 		crd := objs.crds[i].DeepCopy()
 
 		fns = append(fns, func() error {
-			crdResource := &apiextensionsv1.CustomResourceDefinition{}
-			if err := c.Get(ctx, client.ObjectKeyFromObject(crd), crdResource); err != nil {
-				if apierrors.IsNotFound(err) {
-					if err := c.Create(ctx, crd); err != nil {
-						return fmt.Errorf("error creating CRD %s: %w", crd.Name, err)
-					}
-				} else {
-					return fmt.Errorf("error fetching CRD %s: %w", crd.Name, err)
-				}
-			} else {
-				crd.ResourceVersion = crdResource.ResourceVersion
-				if err = c.Update(ctx, crd); err != nil {
-					return fmt.Errorf("error updating CRD %s: %w", crd.Name, err)
-				}
+			if err := createOrUpdate(ctx, c, crd); err != nil {
+				return err
 			}
 
-			if err := wait.PollImmediateInfiniteWithContext(ctx, 100*time.Millisecond, func(ctx context.Context) (bool, error) {
+			if err := process.PollWithBackoff(ctx, process.HealthCheckBackoff(), func(ctx context.Context) (bool, error) {
 				actualCRD := &apiextensionsv1.CustomResourceDefinition{}
 				if err := c.Get(ctx, client.ObjectKeyFromObject(crd), actualCRD); err != nil {
 					if apierrors.IsNotFound(err) {
@@ -301,78 +1017,88 @@ func createManifestObjects(ctx context.Context, manifestPath string, kubeConfig
 		})
 	}
 
-	// Create mutating web hooks
-	for i := range objs.mutHooks {
-		hook := objs.mutHooks[i].DeepCopy()
+	// Create mutating and validating web hooks
+	hooks := []client.Object{}
+	for _, hook := range objs.mutHooks {
+		hooks = append(hooks, hook.DeepCopy())
+	}
+	for _, hook := range objs.valHooks {
+		hooks = append(hooks, hook.DeepCopy())
+	}
+	for i := range hooks {
+		hook := hooks[i]
 
 		fns = append(fns, func() error {
-			hookResource := &admissionv1.MutatingWebhookConfiguration{}
-			if err := c.Get(ctx, client.ObjectKeyFromObject(hook), hookResource); err != nil {
-				if apierrors.IsNotFound(err) {
-					if err := c.Create(ctx, hook); err != nil {
-						return fmt.Errorf("error creating MutatingWebhookConfiguration %s: %w", hook.Name, err)
-					}
-				} else {
-					return fmt.Errorf("error fetching MutatingWebhookConfiguration %s: %w", hook.Name, err)
-				}
-			} else {
-				hook.ResourceVersion = hookResource.ResourceVersion
-				if err = c.Update(ctx, hook); err != nil {
-					return fmt.Errorf("error updating MutatingWebhookConfiguration %s: %w", hook.Name, err)
-				}
+			if err := createOrUpdate(ctx, c, hook); err != nil {
+				return err
 			}
+			return waitForObject(ctx, c, hook)
+		})
+	}
 
-			if err := wait.PollImmediateInfiniteWithContext(ctx, 100*time.Millisecond, func(ctx context.Context) (bool, error) {
-				actualHook := &admissionv1.MutatingWebhookConfiguration{}
-				if err := c.Get(ctx, client.ObjectKeyFromObject(hook), actualHook); err != nil {
-					if apierrors.IsNotFound(err) {
-						return false, fmt.Errorf("MutatingWebhookConfiguration %s was deleted before being established", hook.Name)
-					}
-					return false, fmt.Errorf("error fetching MutatingWebhookConfiguration %s: %w", hook.Name, err)
-				}
-				return true, nil
-			}); err != nil {
-				return fmt.Errorf("error starting MutatingWebhookConfiguration %s: %w", hook.Name, err)
-			}
+	// Create the provider namespaces, i.e. the namespaces defined in the manifest and the namespace of the provider
+	// ServiceAccount, so the namespace defaults are applied to them too.
+	for _, name := range objs.providerNamespaces() {
+		name := name
 
-			return nil
+		fns = append(fns, func() error {
+			return createNamespace(ctx, c, name, objs.namespaceDefaults)
 		})
 	}
 
-	// Create validation web hooks
-	for i := range objs.valHooks {
-		hook := objs.valHooks[i].DeepCopy()
+	// Create APIServices, and the Services they are pointing to
+	for i := range objs.services {
+		svc := objs.services[i].DeepCopy()
 
 		fns = append(fns, func() error {
-			hookResource := &admissionv1.ValidatingWebhookConfiguration{}
-			if err := c.Get(ctx, client.ObjectKeyFromObject(hook), hookResource); err != nil {
-				if apierrors.IsNotFound(err) {
-					if err := c.Create(ctx, hook); err != nil {
-						return fmt.Errorf("error creating ValidatingWebhookConfiguration %s: %w", hook.Name, err)
-					}
-				} else {
-					return fmt.Errorf("error fetching ValidatingWebhookConfiguration %s: %w", hook.Name, err)
-				}
-			} else {
-				hook.ResourceVersion = hookResource.ResourceVersion
-				if err = c.Update(ctx, hook); err != nil {
-					return fmt.Errorf("error updating ValidatingWebhookConfiguration %s: %w", hook.Name, err)
-				}
+			if err := createNamespace(ctx, c, svc.Namespace, objs.namespaceDefaults); err != nil {
+				return err
 			}
+			return createOrUpdate(ctx, c, svc)
+		})
+	}
 
-			if err := wait.PollImmediateInfiniteWithContext(ctx, 100*time.Millisecond, func(ctx context.Context) (bool, error) {
-				actualHook := &admissionv1.ValidatingWebhookConfiguration{}
-				if err := c.Get(ctx, client.ObjectKeyFromObject(hook), actualHook); err != nil {
-					if apierrors.IsNotFound(err) {
-						return false, fmt.Errorf("ValidatingWebhookConfiguration %s was deleted before being established", hook.Name)
-					}
-					return false, fmt.Errorf("error fetching ValidatingWebhookConfiguration %s: %w", hook.Name, err)
-				}
-				return true, nil
-			}); err != nil {
-				return fmt.Errorf("error starting ValidatingWebhookConfiguration %s: %w", hook.Name, err)
-			}
-			return nil
+	for i := range objs.apiServices {
+		apiService := objs.apiServices[i].DeepCopy()
+
+		fns = append(fns, func() error {
+			return createOrUpdate(ctx, c, apiService)
+		})
+	}
+
+	// Create the RBAC rules for the provider ServiceAccount, and the namespaces of Roles and RoleBindings.
+	namespaces := map[string]bool{}
+	for _, role := range objs.rbac.roles {
+		namespaces[role.Namespace] = true
+	}
+	for _, binding := range objs.rbac.roleBindings {
+		namespaces[binding.Namespace] = true
+	}
+	for name := range namespaces {
+		name := name
+
+		fns = append(fns, func() error {
+			return createNamespace(ctx, c, name, objs.namespaceDefaults)
+		})
+	}
+	rbacObjs := []client.Object{}
+	for _, o := range objs.rbac.clusterRoles {
+		rbacObjs = append(rbacObjs, o.DeepCopy())
+	}
+	for _, o := range objs.rbac.clusterRoleBindings {
+		rbacObjs = append(rbacObjs, o.DeepCopy())
+	}
+	for _, o := range objs.rbac.roles {
+		rbacObjs = append(rbacObjs, o.DeepCopy())
+	}
+	for _, o := range objs.rbac.roleBindings {
+		rbacObjs = append(rbacObjs, o.DeepCopy())
+	}
+	for i := range rbacObjs {
+		obj := rbacObjs[i]
+
+		fns = append(fns, func() error {
+			return createOrUpdate(ctx, c, obj)
 		})
 	}
 
@@ -381,67 +1107,520 @@ func createManifestObjects(ctx context.Context, manifestPath string, kubeConfig
 		f := fns[i]
 
 		if err := f(); err != nil {
-			panic(err)
+			return process.NewStartupError(component, process.PhaseManifestApply, err)
 		}
 	}
 
 	return nil
 }
 
+// createNamespace creates a namespace, if it doesn't exist, and then the objects rendered from defaults in it,
+// see WithNamespaceDefaults.
+func createNamespace(ctx context.Context, c client.Client, name string, defaults []string) error {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if err := c.Create(ctx, ns); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("error creating Namespace %s: %w", ns.Name, err)
+	}
+
+	for _, tmpl := range defaults {
+		obj, err := renderNamespaceDefault(tmpl, name)
+		if err != nil {
+			return err
+		}
+		if err := createOrUpdate(ctx, c, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderNamespaceDefault returns the LimitRange or the ResourceQuota defined by tmpl for the given namespace.
+func renderNamespaceDefault(tmpl, namespace string) (client.Object, error) {
+	doc := []byte(strings.ReplaceAll(tmpl, "${namespace}", namespace))
+	generic := metav1.PartialObjectMetadata{}
+	if err := yaml.Unmarshal(doc, &generic); err != nil {
+		return nil, fmt.Errorf("invalid namespace defaults template: %w", err)
+	}
+
+	var obj client.Object
+	switch {
+	case generic.APIVersion == "v1" && generic.Kind == "LimitRange":
+		obj = &corev1.LimitRange{}
+	case generic.APIVersion == "v1" && generic.Kind == "ResourceQuota":
+		obj = &corev1.ResourceQuota{}
+	default:
+		return nil, fmt.Errorf("invalid namespace defaults template: only v1 LimitRange and ResourceQuota are supported, got %s %s", generic.APIVersion, generic.Kind)
+	}
+	if err := yaml.UnmarshalStrict(doc, obj); err != nil {
+		return nil, fmt.Errorf("invalid namespace defaults template for %s %s: %w", generic.Kind, generic.Name, err)
+	}
+	obj.SetNamespace(namespace)
+	return obj, nil
+}
+
+// createOrUpdate creates an object, or updates it if it already exists, retrying on conflicts and when the object
+// is created concurrently, e.g. by another actor, between the get and the create.
+func createOrUpdate(ctx context.Context, c client.Client, obj client.Object) error {
+	kind := objectKind(obj)
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		current := obj.DeepCopyObject().(client.Object)
+		if err := c.Get(ctx, client.ObjectKeyFromObject(obj), current); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return fmt.Errorf("error fetching %s %s: %w", kind, obj.GetName(), err)
+			}
+			obj.SetResourceVersion("")
+			if err := c.Create(ctx, obj); err != nil {
+				return fmt.Errorf("error creating %s %s: %w", kind, obj.GetName(), err)
+			}
+			return nil
+		}
+
+		obj.SetResourceVersion(current.GetResourceVersion())
+		if err := c.Update(ctx, obj); err != nil {
+			return fmt.Errorf("error updating %s %s: %w", kind, obj.GetName(), err)
+		}
+		return nil
+	})
+}
+
+// waitForObject waits for an object to be readable after it is created or updated.
+func waitForObject(ctx context.Context, c client.Client, obj client.Object) error {
+	kind := objectKind(obj)
+	if err := process.PollWithBackoff(ctx, process.HealthCheckBackoff(), func(ctx context.Context) (bool, error) {
+		actual := obj.DeepCopyObject().(client.Object)
+		if err := c.Get(ctx, client.ObjectKeyFromObject(obj), actual); err != nil {
+			if apierrors.IsNotFound(err) {
+				return false, fmt.Errorf("%s %s was deleted before being established", kind, obj.GetName())
+			}
+			return false, fmt.Errorf("error fetching %s %s: %w", kind, obj.GetName(), err)
+		}
+		return true, nil
+	}); err != nil {
+		return fmt.Errorf("error starting %s %s: %w", kind, obj.GetName(), err)
+	}
+	return nil
+}
+
+// objectKind returns the kind of a typed object, e.g. for error messages.
+func objectKind(obj client.Object) string {
+	return reflect.Indirect(reflect.ValueOf(obj)).Type().Name()
+}
+
 type manifestObjects struct {
-	crds     []*apiextensionsv1.CustomResourceDefinition
-	mutHooks []*admissionv1.MutatingWebhookConfiguration
-	valHooks []*admissionv1.ValidatingWebhookConfiguration
+	crds        []*apiextensionsv1.CustomResourceDefinition
+	mutHooks    []*admissionv1.MutatingWebhookConfiguration
+	valHooks    []*admissionv1.ValidatingWebhookConfiguration
+	apiServices []*apiregistrationv1.APIService
+
+	// services are the Services backing APIServices, pointing to the local serving URL.
+	services []*corev1.Service
+
+	// rewrittenServices are the Services referenced by webhooks, CRD conversions and APIServices, that are
+	// rewritten to the local serving URL.
+	rewrittenServices []types.NamespacedName
+
+	// featureGates are the feature gates defined in the args of the provider Deployment.
+	featureGates map[string]bool
+
+	// rbac are the RBAC rules for the provider; they are read only when using scoped RBAC.
+	rbac rbacObjects
+
+	// serviceAccount is the ServiceAccount of the provider Deployment.
+	serviceAccount types.NamespacedName
+
+	// namespaces are the names of the Namespaces defined in the provider manifest.
+	namespaces []string
+
+	// namespaceDefaults are the templates of the objects created in each namespace created for the provider.
+	namespaceDefaults []string
+
+	// healthProbe is the readiness probe, or the liveness probe, of the provider Deployment, if any.
+	healthProbe *corev1.HTTPGetAction
+
+	// lenient ignores unknown fields when decoding the objects kBB-8 installs.
+	lenient bool
 }
 
-func readAndAdaptManifestObjects(manifestPath string, pki *providerPKI, u *providerURL) (*manifestObjects, error) {
-	ret := &manifestObjects{}
+// addRewrittenService records a Service rewritten to the local serving URL, if not already recorded.
+func (o *manifestObjects) addRewrittenService(namespace, name string) {
+	svc := types.NamespacedName{Namespace: namespace, Name: name}
+	for _, s := range o.rewrittenServices {
+		if s == svc {
+			return
+		}
+	}
+	o.rewrittenServices = append(o.rewrittenServices, svc)
+}
+
+// providerNamespaces returns the namespaces defined in the provider manifest and the namespace of the provider
+// ServiceAccount, if any.
+func (o *manifestObjects) providerNamespaces() []string {
+	ret := append([]string{}, o.namespaces...)
+	if ns := o.serviceAccount.Namespace; ns != "" && !containsString(ret, ns) {
+		ret = append(ret, ns)
+	}
+	return ret
+}
+
+// apiServiceHosts returns the <service>.<namespace>.svc hostnames the aggregator verifies the serving cert against,
+// for the Services referenced by APIServices.
+func (o *manifestObjects) apiServiceHosts() []string {
+	ret := []string{}
+	for _, apiService := range o.apiServices {
+		if svc := apiService.Spec.Service; svc != nil {
+			if host := fmt.Sprintf("%s.%s.svc", svc.Name, svc.Namespace); !containsString(ret, host) {
+				ret = append(ret, host)
+			}
+		}
+	}
+	return ret
+}
+
+// containsString returns true if s is in list.
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
 
-	// Unmarshal doc fragments from the provider manifest
-	docs, err := readDocuments(manifestPath)
+// empty returns true if there are no objects to be created; the provider namespaces are created only if
+// there are other objects to be created, or namespace defaults to be applied to them.
+func (o *manifestObjects) empty() bool {
+	if len(o.namespaceDefaults) > 0 && len(o.providerNamespaces()) > 0 {
+		return false
+	}
+	return len(o.crds) == 0 && len(o.mutHooks) == 0 && len(o.valHooks) == 0 && len(o.apiServices) == 0 && len(o.services) == 0 && o.rbac.empty()
+}
+
+// manifestOptions defines how to adapt the objects in the provider manifest.
+type manifestOptions struct {
+	// stripWebhookSelectors removes namespaceSelector and objectSelector from webhooks.
+	stripWebhookSelectors bool
+
+	// crds, if not nil, replaces the CRDs in the provider manifest, see SetCRDs.
+	crds map[string]*apiextensionsv1.CustomResourceDefinition
+
+	// scopedRBAC keeps the RBAC rules from the provider manifest, see WithScopedRBAC.
+	scopedRBAC bool
+
+	// lenientDecoding ignores unknown fields, see WithLenientDecoding.
+	lenientDecoding bool
+
+	// crdPreflight validates the CRD schemas, see WithCRDPreflight.
+	crdPreflight bool
+}
+
+func readAndAdaptManifestObjects(fsys fs.FS, name string, pki *providerPKI, u *providerURL, opts manifestOptions) (*manifestObjects, error) {
+	ret, err := readManifestObjectsWithOptions(fsys, name, opts)
 	if err != nil {
 		return nil, err
 	}
+	adaptManifestObjects(ret, pki, u, opts)
+	return ret, nil
+}
 
-	// Converts the doc fragment we care about into Kubernetes manifestObjects (CRD, Webhooks)
-	for _, doc := range docs {
-		var generic metav1.PartialObjectMetadata
-		if err = yaml.Unmarshal(doc, &generic); err != nil {
+// readManifestObjectsWithOptions reads the objects kBB-8 cares about from the provider manifest, replacing CRDs
+// and dropping RBAC rules according to opts.
+func readManifestObjectsWithOptions(fsys fs.FS, name string, opts manifestOptions) (*manifestObjects, error) {
+	ret, err := readManifestObjects(fsys, name, opts.lenientDecoding)
+	if err != nil {
+		return nil, err
+	}
+	// Check the provider's own webhooks, before CRDs are replaced with the ones from other providers.
+	if err := ret.checkWebhookServicePorts(); err != nil {
+		return nil, err
+	}
+	if opts.crds != nil {
+		ret.crds = replaceCRDs(ret.crds, opts.crds)
+	}
+	if opts.crdPreflight {
+		if err := preflightCRDs(ret.crds); err != nil {
 			return nil, err
 		}
+	}
+	if !opts.scopedRBAC {
+		ret.rbac = rbacObjects{}
+	}
+	return ret, nil
+}
 
-		switch {
-		case generic.Kind == "CustomResourceDefinition":
-			if generic.APIVersion != "apiextensions.k8s.io/v1" {
-				return nil, fmt.Errorf("only v1 is supported right now for CustomResourceDefinition (name: %s)", generic.Name)
-			}
-			crd := &apiextensionsv1.CustomResourceDefinition{}
-			if err = yaml.Unmarshal(doc, crd); err != nil {
-				return nil, err
+// servesWebhooks returns true if the provider serves webhooks, i.e. if the provider manifest defines webhook
+// configurations, CRDs with conversion webhooks or APIServices backed by the provider.
+func (o *manifestObjects) servesWebhooks() bool {
+	if len(o.mutHooks) > 0 || len(o.valHooks) > 0 {
+		return true
+	}
+	for _, crd := range o.crds {
+		if crd.Spec.Conversion != nil && crd.Spec.Conversion.Strategy == apiextensionsv1.WebhookConverter {
+			return true
+		}
+	}
+	for _, apiService := range o.apiServices {
+		if apiService.Spec.Service != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultServicePort is the port used by webhooks and APIServices referencing a Service without a port.
+const defaultServicePort = 443
+
+// checkWebhookServicePorts returns an error if webhooks, CRD conversions and APIServices reference Service ports
+// with different values; kBB-8 serves all of them on a single local port, so providers running many webhook servers,
+// each one behind a different Service port, are not supported yet.
+func (o *manifestObjects) checkWebhookServicePorts() error {
+	ports := []int32{}
+	refs := map[int32][]string{}
+	add := func(kind, name, namespace, service string, port *int32) {
+		p := int32(defaultServicePort)
+		if port != nil {
+			p = *port
+		}
+		if _, ok := refs[p]; !ok {
+			ports = append(ports, p)
+		}
+		refs[p] = append(refs[p], fmt.Sprintf("%s %s (Service %s/%s:%d)", kind, name, namespace, service, p))
+	}
+
+	for _, crd := range o.crds {
+		if crd.Spec.Conversion == nil || crd.Spec.Conversion.Webhook == nil || crd.Spec.Conversion.Webhook.ClientConfig == nil {
+			continue
+		}
+		if svc := crd.Spec.Conversion.Webhook.ClientConfig.Service; svc != nil {
+			add("CustomResourceDefinition", crd.Name, svc.Namespace, svc.Name, svc.Port)
+		}
+	}
+	for _, hook := range o.mutHooks {
+		for _, w := range hook.Webhooks {
+			if svc := w.ClientConfig.Service; svc != nil {
+				add("MutatingWebhookConfiguration", hook.Name, svc.Namespace, svc.Name, svc.Port)
 			}
-			ret.crds = append(ret.crds, crd)
-		case generic.Kind == "MutatingWebhookConfiguration":
-			if generic.APIVersion != "admissionregistration.k8s.io/v1" {
-				return nil, fmt.Errorf("only v1 is supported right now for MutatingWebhookConfiguration (name: %s)", generic.Name)
+		}
+	}
+	for _, hook := range o.valHooks {
+		for _, w := range hook.Webhooks {
+			if svc := w.ClientConfig.Service; svc != nil {
+				add("ValidatingWebhookConfiguration", hook.Name, svc.Namespace, svc.Name, svc.Port)
 			}
-			hook := &admissionv1.MutatingWebhookConfiguration{}
-			if err := yaml.Unmarshal(doc, hook); err != nil {
-				return nil, err
+		}
+	}
+	for _, apiService := range o.apiServices {
+		if svc := apiService.Spec.Service; svc != nil {
+			add("APIService", apiService.Name, svc.Namespace, svc.Name, svc.Port)
+		}
+	}
+
+	if len(ports) < 2 {
+		return nil
+	}
+	examples := make([]string, 0, len(ports))
+	for _, p := range ports {
+		examples = append(examples, refs[p][0])
+	}
+	return fmt.Errorf("webhooks are served on %d different Service ports, but multi-port webhook providers are not supported yet: %s", len(ports), strings.Join(examples, ", "))
+}
+
+// replaceCRDs replaces crds with the CRDs with the same name in replacements; CRDs replaced with nil are dropped.
+func replaceCRDs(crds []*apiextensionsv1.CustomResourceDefinition, replacements map[string]*apiextensionsv1.CustomResourceDefinition) []*apiextensionsv1.CustomResourceDefinition {
+	ret := []*apiextensionsv1.CustomResourceDefinition{}
+	for _, crd := range crds {
+		replacement, ok := replacements[crd.Name]
+		if !ok {
+			ret = append(ret, crd)
+			continue
+		}
+		if replacement != nil {
+			ret = append(ret, replacement.DeepCopy())
+		}
+	}
+	return ret
+}
+
+// readManifestObjects reads the objects kBB-8 cares about from the provider manifest; unknown fields in the objects
+// kBB-8 installs are rejected, unless lenient.
+func readManifestObjects(fsys fs.FS, name string, lenient bool) (*manifestObjects, error) {
+	ret := &manifestObjects{
+		featureGates: map[string]bool{},
+		lenient:      lenient,
+	}
+
+	// Converts the doc fragments we care about into Kubernetes manifestObjects (CRD, Webhooks) while streaming
+	// the provider manifest, so large manifests are never kept in memory as a whole.
+	if err := manifest.VisitDocumentsFS(fsys, name, ret.read); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// read adds the object in doc to the manifest objects, if it is an object kBB-8 cares about;
+// the items of a List are read one by one.
+func (o *manifestObjects) read(doc []byte) error {
+	var generic metav1.PartialObjectMetadata
+	if err := yaml.Unmarshal(doc, &generic); err != nil {
+		return err
+	}
+
+	switch {
+	case generic.Kind == "List":
+		items, err := listItems(generic, doc)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := o.read(item); err != nil {
+				return err
 			}
-			ret.mutHooks = append(ret.mutHooks, hook)
-		case generic.Kind == "ValidatingWebhookConfiguration":
-			if generic.APIVersion != "admissionregistration.k8s.io/v1" {
-				return nil, fmt.Errorf("only v1 is supported right now for ValidatingWebhookConfiguration (name: %s)", generic.Name)
+		}
+	case generic.Kind == "CustomResourceDefinition":
+		if generic.APIVersion != "apiextensions.k8s.io/v1" {
+			return fmt.Errorf("only v1 is supported right now for CustomResourceDefinition (name: %s)", generic.Name)
+		}
+		crd := &apiextensionsv1.CustomResourceDefinition{}
+		if err := o.decode(generic, doc, crd); err != nil {
+			return err
+		}
+		o.crds = append(o.crds, crd)
+	case generic.Kind == "MutatingWebhookConfiguration":
+		if generic.APIVersion != "admissionregistration.k8s.io/v1" {
+			return fmt.Errorf("only v1 is supported right now for MutatingWebhookConfiguration (name: %s)", generic.Name)
+		}
+		hook := &admissionv1.MutatingWebhookConfiguration{}
+		if err := o.decode(generic, doc, hook); err != nil {
+			return err
+		}
+		o.mutHooks = append(o.mutHooks, hook)
+	case generic.Kind == "ValidatingWebhookConfiguration":
+		if generic.APIVersion != "admissionregistration.k8s.io/v1" {
+			return fmt.Errorf("only v1 is supported right now for ValidatingWebhookConfiguration (name: %s)", generic.Name)
+		}
+		hook := &admissionv1.ValidatingWebhookConfiguration{}
+		if err := o.decode(generic, doc, hook); err != nil {
+			return err
+		}
+		o.valHooks = append(o.valHooks, hook)
+	case generic.Kind == "APIService":
+		if generic.APIVersion != "apiregistration.k8s.io/v1" {
+			return fmt.Errorf("only v1 is supported right now for APIService (name: %s)", generic.Name)
+		}
+		apiService := &apiregistrationv1.APIService{}
+		if err := o.decode(generic, doc, apiService); err != nil {
+			return err
+		}
+		o.apiServices = append(o.apiServices, apiService)
+	case generic.Kind == "Namespace" && generic.APIVersion == "v1":
+		if !containsString(o.namespaces, generic.Name) {
+			o.namespaces = append(o.namespaces, generic.Name)
+		}
+	case generic.Kind == "Deployment":
+		if generic.APIVersion != "apps/v1" {
+			return fmt.Errorf("only v1 is supported right now for Deployment (name: %s)", generic.Name)
+		}
+		deployment := &appsv1.Deployment{}
+		if err := yaml.Unmarshal(doc, deployment); err != nil {
+			return err
+		}
+		c, err := managerContainer(deployment)
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			featureGates, _, err := extractFeatureGates(c.Args)
+			if err != nil {
+				return fmt.Errorf("invalid args for container %s in Deployment %s: %w", c.Name, deployment.Name, err)
 			}
-			hook := &admissionv1.ValidatingWebhookConfiguration{}
-			if err := yaml.Unmarshal(doc, hook); err != nil {
-				return nil, err
+			o.featureGates = mergeFeatureGates(o.featureGates, featureGates)
+			if o.healthProbe == nil {
+				o.healthProbe = httpGetProbe(c.ReadinessProbe, c.LivenessProbe)
 			}
-			ret.valHooks = append(ret.valHooks, hook)
-		default:
-			continue
+		}
+		o.serviceAccount = types.NamespacedName{
+			Namespace: deployment.Namespace,
+			Name:      deployment.Spec.Template.Spec.ServiceAccountName,
+		}
+		if o.serviceAccount.Name == "" {
+			o.serviceAccount.Name = defaultServiceAccountName
+		}
+	default:
+		if _, err := o.rbac.read(generic, doc); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// managerContainer returns the container running the provider manager binary in the Deployment, i.e. the
+// container named manager or the only container, so sidecars like kube-rbac-proxy are ignored; it returns
+// nil if the Deployment has no containers.
+func managerContainer(deployment *appsv1.Deployment) (*corev1.Container, error) {
+	containers := deployment.Spec.Template.Spec.Containers
+	for i := range containers {
+		if containers[i].Name == binaryName {
+			return &containers[i], nil
+		}
+	}
+	switch len(containers) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &containers[0], nil
+	default:
+		return nil, fmt.Errorf("unable to find the %s container in Deployment %s: none of its %d containers is named %s", binaryName, deployment.Name, len(containers), binaryName)
+	}
+}
+
+// httpGetProbe returns the HTTPGet action of the first probe defining one, or nil.
+func httpGetProbe(probes ...*corev1.Probe) *corev1.HTTPGetAction {
+	for _, probe := range probes {
+		if probe != nil && probe.HTTPGet != nil {
+			return probe.HTTPGet
+		}
+	}
+	return nil
+}
+
+// decode unmarshals doc into obj, an object kBB-8 installs; unknown fields are rejected unless lenient,
+// and the error names the offending object.
+func (o *manifestObjects) decode(generic metav1.PartialObjectMetadata, doc []byte, obj interface{}) error {
+	unmarshal := yaml.UnmarshalStrict
+	if o.lenient {
+		unmarshal = yaml.Unmarshal
+	}
+	if err := unmarshal(doc, obj); err != nil {
+		return fmt.Errorf("invalid %s %s: %w", generic.Kind, generic.Name, err)
+	}
+	return nil
+}
+
+// listItems returns the items of a List, e.g. from kustomize or kubectl output, as separate documents.
+func listItems(generic metav1.PartialObjectMetadata, doc []byte) ([][]byte, error) {
+	if generic.APIVersion != "v1" {
+		return nil, fmt.Errorf("only v1 is supported right now for List")
+	}
+	list := struct {
+		Items []json.RawMessage `json:"items"`
+	}{}
+	if err := yaml.Unmarshal(doc, &list); err != nil {
+		return nil, err
+	}
+	items := make([][]byte, 0, len(list.Items))
+	for _, item := range list.Items {
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// adaptManifestObjects adapts the objects from the provider manifest to work in kBB-8, e.g. by making webhooks
+// point to the local serving URL; pki is nil for providers not serving webhooks, and objects are left as they are.
+func adaptManifestObjects(ret *manifestObjects, pki *providerPKI, u *providerURL, opts manifestOptions) {
+	if pki == nil {
+		return
+	}
 
 	localServingUrl := &url.URL{
 		Scheme: "https",
@@ -455,8 +1634,17 @@ func readAndAdaptManifestObjects(manifestPath string, pki *providerPKI, u *provi
 				Webhook: &apiextensionsv1.WebhookConversion{},
 			}
 		}
+		if ret.crds[i].Spec.Conversion.Webhook == nil {
+			ret.crds[i].Spec.Conversion.Webhook = &apiextensionsv1.WebhookConversion{}
+		}
+		if cc := ret.crds[i].Spec.Conversion.Webhook.ClientConfig; cc != nil && cc.Service != nil {
+			ret.addRewrittenService(cc.Service.Namespace, cc.Service.Name)
+		}
 		ret.crds[i].Spec.Conversion.Strategy = apiextensionsv1.WebhookConverter
-		ret.crds[i].Spec.Conversion.Webhook.ConversionReviewVersions = []string{"v1", "v1beta1"}
+		// Honor the conversion review versions declared by the provider, if any.
+		if len(ret.crds[i].Spec.Conversion.Webhook.ConversionReviewVersions) == 0 {
+			ret.crds[i].Spec.Conversion.Webhook.ConversionReviewVersions = append([]string{}, defaultConversionReviewVersions...)
+		}
 		ret.crds[i].Spec.Conversion.Webhook.ClientConfig = &apiextensionsv1.WebhookClientConfig{
 			Service:  nil,
 			URL:      pointer.StringPtr(fmt.Sprintf("%s/convert", localServingUrl.String())),
@@ -467,49 +1655,73 @@ func readAndAdaptManifestObjects(manifestPath string, pki *providerPKI, u *provi
 	// Adapt MutatingWebhookConfiguration to work in kBB-8 (fixup ClientConfig)
 	for i := range ret.mutHooks {
 		for j := range ret.mutHooks[i].Webhooks {
+			svc := ret.mutHooks[i].Webhooks[j].ClientConfig.Service
+			ret.addRewrittenService(svc.Namespace, svc.Name)
 			ret.mutHooks[i].Webhooks[j].ClientConfig = admissionv1.WebhookClientConfig{
 				Service:  nil,
 				URL:      pointer.StringPtr(fmt.Sprintf("%s/%s", localServingUrl.String(), *ret.mutHooks[i].Webhooks[j].ClientConfig.Service.Path)),
 				CABundle: pki.caData,
 			}
+			if opts.stripWebhookSelectors {
+				ret.mutHooks[i].Webhooks[j].NamespaceSelector = nil
+				ret.mutHooks[i].Webhooks[j].ObjectSelector = nil
+			}
 		}
 	}
 
 	// Adapt ValidatingWebhookConfiguration to work in kBB-8 (fixup ClientConfig)
 	for i := range ret.valHooks {
 		for j := range ret.valHooks[i].Webhooks {
+			svc := ret.valHooks[i].Webhooks[j].ClientConfig.Service
+			ret.addRewrittenService(svc.Namespace, svc.Name)
 			ret.valHooks[i].Webhooks[j].ClientConfig = admissionv1.WebhookClientConfig{
 				Service:  nil,
 				URL:      pointer.StringPtr(fmt.Sprintf("%s/%s", localServingUrl.String(), *ret.valHooks[i].Webhooks[j].ClientConfig.Service.Path)),
 				CABundle: pki.caData,
 			}
+			if opts.stripWebhookSelectors {
+				ret.valHooks[i].Webhooks[j].NamespaceSelector = nil
+				ret.valHooks[i].Webhooks[j].ObjectSelector = nil
+			}
 		}
 	}
 
-	return ret, nil
-}
-
-func readDocuments(fp string) ([][]byte, error) {
-	b, err := ioutil.ReadFile(fp) //nolint:gosec
-	if err != nil {
-		return nil, err
-	}
-
-	docs := [][]byte{}
-	reader := k8syaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(b)))
-	for {
-		// Read document
-		doc, err := reader.Read()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-
-			return nil, err
+	// Adapt APIService to work in kBB-8 (fixup the Service reference and the CABundle).
+	// NOTE: APIService can only reference Services, so kBB-8 creates an ExternalName Service
+	// resolving to the local serving host, and uses it for routing requests to the provider; the aggregator
+	// verifies the serving cert against <service>.<namespace>.svc, see apiServiceHosts.
+	services := map[string]bool{}
+	for i := range ret.apiServices {
+		svcRef := ret.apiServices[i].Spec.Service
+		if svcRef == nil {
+			// Local APIService, served by the API server itself.
+			continue
 		}
+		ret.addRewrittenService(svcRef.Namespace, svcRef.Name)
+		svcRef.Port = pointer.Int32Ptr(int32(u.webhookPort))
+		ret.apiServices[i].Spec.CABundle = pki.caData
+		ret.apiServices[i].Spec.InsecureSkipTLSVerify = false
 
-		docs = append(docs, doc)
+		key := fmt.Sprintf("%s/%s", svcRef.Namespace, svcRef.Name)
+		if services[key] {
+			continue
+		}
+		services[key] = true
+		ret.services = append(ret.services, &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      svcRef.Name,
+				Namespace: svcRef.Namespace,
+			},
+			Spec: corev1.ServiceSpec{
+				Type:         corev1.ServiceTypeExternalName,
+				ExternalName: u.host,
+				Ports: []corev1.ServicePort{
+					{
+						Name: "https",
+						Port: int32(u.webhookPort),
+					},
+				},
+			},
+		})
 	}
-
-	return docs, nil
 }
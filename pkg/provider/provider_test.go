@@ -0,0 +1,814 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	certutil "k8s.io/client-go/util/cert"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
+)
+
+var _ = Describe("NewProvider", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "provider-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	writeManifest := func(data string) string {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(data), 0600)).To(Succeed())
+		return packagePath
+	}
+
+	It("fails fast naming the provider and the expected manifest location when the manifest is missing", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+
+		p, err := NewProvider(packagePath)
+		Expect(p).To(BeNil())
+		Expect(err).To(MatchError(ContainSubstring("manifest for provider CAPI not found, expected at %s", filepath.Join(packagePath, manifestName))))
+		Expect(IsWarning(err)).To(BeFalse())
+	})
+
+	It("returns a warning when the manifest doesn't contain any object kBB-8 installs", func() {
+		packagePath := writeManifest(`apiVersion: v1
+kind: Namespace
+metadata:
+  name: capi-system
+`)
+
+		p, err := NewProvider(packagePath)
+		Expect(p).NotTo(BeNil())
+		Expect(IsWarning(err)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("the manifest for provider CAPI")))
+	})
+
+	It("returns a warning when the manifest is empty", func() {
+		p, err := NewProvider(writeManifest(""))
+		Expect(p).NotTo(BeNil())
+		Expect(IsWarning(err)).To(BeTrue())
+	})
+
+	It("accepts a manifest with CRDs", func() {
+		p, err := NewProvider(writeManifest(`apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Name()).To(Equal("CAPI"))
+	})
+
+	It("accepts a manifest with CRDs inside a List", func() {
+		_, err := NewProvider(writeManifest(`apiVersion: v1
+kind: List
+items:
+- apiVersion: apiextensions.k8s.io/v1
+  kind: CustomResourceDefinition
+  metadata:
+    name: foos.example.com
+`))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Describe("WithPackageFS", func() {
+		packageFS := fstest.MapFS{
+			"packages/bootstrap-capi/components.yaml": &fstest.MapFile{Data: []byte(`apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+spec:
+  group: example.com
+`)},
+		}
+
+		It("reads the manifest from the package filesystem", func() {
+			p, err := NewProvider("./bootstrap-capi", WithPackageFS(packageFS, "packages/bootstrap-capi"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Name()).To(Equal("CAPI"))
+
+			fsys, name := p.manifestFS()
+			objs, err := readAndAdaptManifestObjects(fsys, name, &providerPKI{dir: dir, caData: []byte("ca")}, &providerURL{host: "127.0.0.1", webhookPort: 9443, healthPort: 9440}, manifestOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(objs.crds).To(HaveLen(1))
+			Expect(objs.crds[0].Name).To(Equal("foos.example.com"))
+		})
+
+		It("fails fast when the manifest is missing in the package filesystem", func() {
+			p, err := NewProvider("./bootstrap-capd", WithPackageFS(packageFS, "packages/bootstrap-capd"))
+			Expect(p).To(BeNil())
+			Expect(err).To(MatchError(ContainSubstring("manifest for provider CAPD not found, expected at packages/bootstrap-capd/components.yaml")))
+		})
+	})
+})
+
+var _ = Describe("setupPKI", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "provider-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("issues the webhook serving cert from the CA set with WithCA", func() {
+		ca, err := certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+		p := &Provider{}
+		WithCA(ca)(p)
+
+		pki, err := setupPKI(dir, &providerURL{host: "127.0.0.1", webhookPort: 9443, healthPort: 9440}, p.CA(), process.FileModes{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pki.caData).To(Equal(ca.CA.CertBytes()))
+
+		servingCerts, err := certutil.CertsFromFile(filepath.Join(pki.dir, "tls.crt"))
+		Expect(err).NotTo(HaveOccurred())
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.CA.Cert)
+		_, err = servingCerts[0].Verify(x509.VerifyOptions{Roots: roots, DNSName: "127.0.0.1"})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("issues a serving cert valid for the Service hostnames verified by the aggregator", func() {
+		ca, err := certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+
+		pki, err := setupPKI(dir, &providerURL{host: "127.0.0.1", webhookPort: 9443, healthPort: 9440}, ca, process.FileModes{}, "metrics-service.example-system.svc")
+		Expect(err).NotTo(HaveOccurred())
+
+		servingCerts, err := certutil.CertsFromFile(filepath.Join(pki.dir, "tls.crt"))
+		Expect(err).NotTo(HaveOccurred())
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.CA.Cert)
+		for _, host := range []string{"127.0.0.1", "metrics-service.example-system.svc"} {
+			_, err = servingCerts[0].Verify(x509.VerifyOptions{Roots: roots, DNSName: host})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		_, err = servingCerts[0].Verify(x509.VerifyOptions{Roots: roots, DNSName: "other-service.example-system.svc"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("writes the serving cert key readable only by the owner", func() {
+		pki, err := setupPKI(dir, &providerURL{host: "127.0.0.1", webhookPort: 9443, healthPort: 9440}, nil, process.FileModes{})
+		Expect(err).NotTo(HaveOccurred())
+
+		info, err := os.Stat(filepath.Join(pki.dir, "tls.key"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		info, err = os.Stat(pki.dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0700)))
+	})
+
+	It("rejects a CA not usable for signing", func() {
+		_, err := setupPKI(dir, &providerURL{host: "127.0.0.1", webhookPort: 9443, healthPort: 9440}, &certs.TinyCA{}, process.FileModes{})
+		Expect(err).To(MatchError(ContainSubstring("invalid webhook CA")))
+	})
+})
+
+var _ = Describe("setProcessState", func() {
+	var dir, currentDir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "provider-test")
+		Expect(err).NotTo(HaveOccurred())
+		currentDir, err = os.Getwd()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Chdir(dir)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.Chdir(currentDir)).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("skips the webhook port and the PKI for providers not serving webhooks", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: capi-controller-manager
+  namespace: capi-system
+spec:
+  template:
+    spec:
+      containers:
+      - name: manager
+`), 0600)).To(Succeed())
+
+		p, err := NewProvider(packagePath)
+		Expect(IsWarning(err)).To(BeTrue())
+
+		// There are no objects to be created, so the API server is not called.
+		Expect(p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+		defer func() {
+			Expect(p.logFile.Close()).To(Succeed())
+		}()
+
+		Expect(p.pki).To(BeNil())
+		Expect(p.url.webhookPort).To(BeZero())
+		Expect(p.url.healthPort).NotTo(BeZero())
+		Expect(p.WebhookURL()).To(BeEmpty())
+		for _, a := range p.processState.Args {
+			Expect(a).NotTo(HavePrefix("--webhook-"))
+		}
+		Expect(p.processState.Args).To(ContainElement(fmt.Sprintf("--health-addr=:%d", p.url.healthPort)))
+		Expect(filepath.Join(dir, ".tmp", "provider", "capi", "ca")).NotTo(BeADirectory())
+	})
+
+	It("points the provider to a CA bundle with the trusted CAs and the API server CA", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(""), 0600)).To(Succeed())
+
+		trustedCA, err := certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+		apiServerCA, err := certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+
+		p, err := NewProvider(packagePath, WithTrustedCAs(trustedCA.CA.CertBytes()), WithEnv("FOO=bar"))
+		Expect(IsWarning(err)).To(BeTrue())
+		p.APIServerCA = apiServerCA
+
+		Expect(p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+		defer func() {
+			Expect(p.logFile.Close()).To(Succeed())
+		}()
+
+		bundleFile := filepath.Join(dir, ".tmp", "provider", "capi", trustedCABundleName)
+		Expect(p.processState.Env).To(ConsistOf("FOO=bar", sslCertFileEnv+"="+bundleFile))
+		Expect(p.Env).To(ConsistOf("FOO=bar"))
+
+		bundle, err := ioutil.ReadFile(bundleFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(bundle)).To(ContainSubstring(string(trustedCA.CA.CertBytes())))
+		Expect(string(bundle)).To(ContainSubstring(string(apiServerCA.CA.CertBytes())))
+		bundleCerts, err := certutil.ParseCertsPEM(bundle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(bundleCerts)).To(BeNumerically(">=", 2))
+	})
+
+	It("checks the health on the endpoint of the Deployment probe, verifying the serving cert with the provider CA", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: capi-controller-manager
+  namespace: capi-system
+spec:
+  template:
+    spec:
+      containers:
+      - name: manager
+        livenessProbe:
+          httpGet:
+            path: /livez
+            port: healthz
+            scheme: HTTPS
+`), 0600)).To(Succeed())
+
+		ca, err := certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+		p, err := NewProvider(packagePath, WithCA(ca), WithHealthEndpoint("http", "/ignored"))
+		Expect(IsWarning(err)).To(BeTrue())
+
+		Expect(p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+		defer func() {
+			Expect(p.logFile.Close()).To(Succeed())
+		}()
+
+		hc := p.processState.HealthCheck
+		Expect(hc.Scheme).To(Equal("https"))
+		Expect(hc.Path).To(Equal("/livez"))
+
+		// Serve health on https at /livez with a cert issued by the provider CA.
+		servingCert, err := ca.NewServingCert("127.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		certData, keyData, err := servingCert.AsBytes()
+		Expect(err).NotTo(HaveOccurred())
+		tlsCert, err := tls.X509KeyPair(certData, keyData)
+		Expect(err).NotTo(HaveOccurred())
+		mux := http.NewServeMux()
+		mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		server := httptest.NewUnstartedServer(mux)
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{tlsCert}, MinVersion: tls.VersionTLS12}
+		server.StartTLS()
+		defer server.Close()
+
+		serverURL, err := url.Parse(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		hc.Host = serverURL.Host
+		Expect(hc.Check(context.Background())).To(Succeed())
+
+		// A serving cert not issued by the provider CA is rejected.
+		otherCA, err := certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(otherCA.CA.CertBytes())
+		hc.RootCAs = pool
+		Expect(hc.Check(context.Background())).NotTo(Succeed())
+	})
+
+	It("merges feature gates from the manager container and from the user, ignoring sidecars", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(sidecarManifest), 0600)).To(Succeed())
+
+		p, err := NewProvider(packagePath,
+			WithArgs("--feature-gates=ClusterResourceSet=true"),
+			WithFeatureGates(map[string]bool{"MachinePool": true}),
+		)
+		Expect(IsWarning(err)).To(BeTrue())
+
+		Expect(p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+		defer func() {
+			Expect(p.logFile.Close()).To(Succeed())
+		}()
+
+		Expect(p.EffectiveArgs()).To(ContainElement("--feature-gates=ClusterResourceSet=true,ClusterTopology=false,MachinePool=true"))
+		Expect(p.EffectiveFeatureGates()).NotTo(HaveKey("ProxyOnly"))
+	})
+
+	It("checks the health on the endpoint of the manager container probe, ignoring sidecars", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(sidecarManifest), 0600)).To(Succeed())
+
+		p, err := NewProvider(packagePath)
+		Expect(IsWarning(err)).To(BeTrue())
+
+		Expect(p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+		defer func() {
+			Expect(p.logFile.Close()).To(Succeed())
+		}()
+
+		hc := p.processState.HealthCheck
+		Expect(hc.Scheme).To(Equal("http"))
+		Expect(hc.Path).To(Equal("/readyz"))
+	})
+
+	It("fails when the manager container can't be told apart from sidecars", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(strings.Replace(sidecarManifest, "name: manager", "name: controller", 1)), 0600)).To(Succeed())
+
+		p, err := NewProvider(packagePath)
+		Expect(IsWarning(err)).To(BeTrue())
+
+		err = p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))
+		Expect(err).To(MatchError(ContainSubstring("unable to find the manager container in Deployment capi-controller-manager")))
+	})
+
+	It("falls back to the configured health endpoint when the Deployment has no probes", func() {
+		p := &Provider{}
+		scheme, path := p.healthEndpoint(nil)
+		Expect(scheme).To(Equal("http"))
+		Expect(path).To(Equal("/healthz"))
+
+		p = &Provider{HealthScheme: "HTTPS", HealthPath: "/livez"}
+		scheme, path = p.healthEndpoint(nil)
+		Expect(scheme).To(Equal("https"))
+		Expect(path).To(Equal("/livez"))
+	})
+
+	It("installs the manifest objects with the injected client", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(webhookManifest), 0600)).To(Succeed())
+
+		p, err := NewProvider(packagePath)
+		Expect(err).NotTo(HaveOccurred())
+		c := &countingClient{Client: fake.NewClientBuilder().WithScheme(scheme).Build()}
+		p.ManifestClient = c
+
+		// The kubeconfig file doesn't exist, so the objects can be installed only with the injected client.
+		Expect(p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+		defer func() {
+			Expect(p.logFile.Close()).To(Succeed())
+		}()
+
+		Expect(c.creates).To(Equal(1))
+		Expect(c.Get(context.Background(), client.ObjectKey{Name: "capi-mutating-webhook-configuration"}, &admissionv1.MutatingWebhookConfiguration{})).To(Succeed())
+	})
+
+	It("exposes copies of the installed objects, with webhooks pointing to the local webhook URL", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(webhookManifest), 0600)).To(Succeed())
+
+		p, err := NewProvider(packagePath)
+		Expect(err).NotTo(HaveOccurred())
+		p.ManifestClient = fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		crds, mutHooks, valHooks := p.InstalledObjects()
+		Expect(crds).To(BeEmpty())
+		Expect(mutHooks).To(BeEmpty())
+		Expect(valHooks).To(BeEmpty())
+
+		Expect(p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+		defer func() {
+			Expect(p.logFile.Close()).To(Succeed())
+		}()
+
+		_, mutHooks, _ = p.InstalledObjects()
+		Expect(mutHooks).To(HaveLen(1))
+		Expect(mutHooks[0].Webhooks).To(HaveLen(1))
+		clientConfig := mutHooks[0].Webhooks[0].ClientConfig
+		Expect(clientConfig.Service).To(BeNil())
+		Expect(clientConfig.URL).NotTo(BeNil())
+		hookURL, err := url.Parse(*clientConfig.URL)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hookURL.Scheme).To(Equal("https"))
+		Expect(hookURL.Host).To(Equal(net.JoinHostPort(p.url.host, fmt.Sprintf("%d", p.url.webhookPort))))
+		Expect(hookURL.Path).To(HaveSuffix("/mutate-cluster"))
+
+		// Changes to the returned objects don't affect the provider.
+		mutHooks[0].Webhooks[0].ClientConfig.URL = nil
+		_, mutHooks, _ = p.InstalledObjects()
+		Expect(mutHooks[0].Webhooks[0].ClientConfig.URL).NotTo(BeNil())
+	})
+
+	It("removes the installed webhooks and conversion webhooks with RemoveWebhooks", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(`apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: clusters.cluster.x-k8s.io
+spec:
+  group: cluster.x-k8s.io
+  conversion:
+    strategy: Webhook
+    webhook:
+      conversionReviewVersions:
+      - v1
+      clientConfig:
+        service:
+          name: capi-webhook-service
+          namespace: capi-system
+          path: /convert
+---
+`+webhookManifest), 0600)).To(Succeed())
+
+		p, err := NewProvider(packagePath)
+		Expect(err).NotTo(HaveOccurred())
+		c := establishingClient{Client: fake.NewClientBuilder().WithScheme(scheme).Build()}
+		p.ManifestClient = c
+
+		// Nothing to remove before the manifest is installed.
+		Expect(p.RemoveWebhooks(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+
+		Expect(p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+		defer func() {
+			Expect(p.logFile.Close()).To(Succeed())
+		}()
+		crd := &apiextensionsv1.CustomResourceDefinition{}
+		Expect(c.Get(context.Background(), client.ObjectKey{Name: "clusters.cluster.x-k8s.io"}, crd)).To(Succeed())
+		Expect(crd.Spec.Conversion.Strategy).To(Equal(apiextensionsv1.WebhookConverter))
+
+		Expect(p.RemoveWebhooks(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+
+		err = c.Get(context.Background(), client.ObjectKey{Name: "capi-mutating-webhook-configuration"}, &admissionv1.MutatingWebhookConfiguration{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		Expect(c.Get(context.Background(), client.ObjectKey{Name: "clusters.cluster.x-k8s.io"}, crd)).To(Succeed())
+		Expect(crd.Spec.Conversion.Strategy).To(Equal(apiextensionsv1.NoneConverter))
+		Expect(crd.Spec.Conversion.Webhook).To(BeNil())
+
+		// Removing again is a no-op.
+		Expect(p.RemoveWebhooks(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+	})
+
+	It("serves webhooks and health on the same host, with a webhook serving cert valid for it", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(webhookManifest), 0600)).To(Succeed())
+
+		p, err := NewProvider(packagePath)
+		Expect(err).NotTo(HaveOccurred())
+		p.ManifestClient = fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		Expect(p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+		defer func() {
+			Expect(p.logFile.Close()).To(Succeed())
+		}()
+
+		webhookURL, err := url.Parse(p.WebhookURL())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(webhookURL.Hostname()).To(Equal(p.url.host))
+		Expect(p.processState.HealthCheck.Hostname()).To(Equal(p.url.host))
+		Expect(webhookURL.Port()).NotTo(Equal(p.processState.HealthCheck.Port()))
+
+		certData, err := ioutil.ReadFile(filepath.Join(p.pki.dir, "tls.crt"))
+		Expect(err).NotTo(HaveOccurred())
+		servingCerts, err := certutil.ParseCertsPEM(certData)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(servingCerts[0].VerifyHostname(p.url.host)).To(Succeed())
+	})
+
+	It("creates the namespace defaults in the namespace of a plain provider manifest", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(`apiVersion: v1
+kind: Namespace
+metadata:
+  name: capi-system
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: capi-controller-manager
+  namespace: capi-system
+spec:
+  template:
+    spec:
+      serviceAccountName: capi-manager
+      containers:
+      - name: manager
+        image: capi-controller:dev
+`), 0600)).To(Succeed())
+
+		p, err := NewProvider(packagePath, WithNamespaceDefaults(`apiVersion: v1
+kind: ResourceQuota
+metadata:
+  name: ${namespace}-quota
+spec:
+  hard:
+    pods: "10"
+`))
+		// The manifest doesn't contain objects kBB-8 installs, but the provider namespace is created anyway.
+		Expect(IsWarning(err)).To(BeTrue())
+		c := fake.NewClientBuilder().WithScheme(scheme).Build()
+		p.ManifestClient = c
+
+		Expect(p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+		defer func() {
+			Expect(p.logFile.Close()).To(Succeed())
+		}()
+
+		Expect(c.Get(context.Background(), client.ObjectKey{Name: "capi-system"}, &corev1.Namespace{})).To(Succeed())
+		quota := &corev1.ResourceQuota{}
+		Expect(c.Get(context.Background(), client.ObjectKey{Namespace: "capi-system", Name: "capi-system-quota"}, quota)).To(Succeed())
+		Expect(quota.Spec.Hard.Pods().String()).To(Equal("10"))
+	})
+
+	It("serves APIServices with a cert the aggregator verifies against the Service hostname", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(`apiVersion: apiregistration.k8s.io/v1
+kind: APIService
+metadata:
+  name: v1alpha1.metrics.example.com
+spec:
+  group: metrics.example.com
+  version: v1alpha1
+  groupPriorityMinimum: 100
+  versionPriority: 100
+  service:
+    name: metrics-service
+    namespace: example-system
+    port: 443
+`), 0600)).To(Succeed())
+
+		p, err := NewProvider(packagePath)
+		Expect(err).NotTo(HaveOccurred())
+		p.ManifestClient = fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		Expect(p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+		defer func() {
+			Expect(p.logFile.Close()).To(Succeed())
+		}()
+
+		// Serve with the provider serving cert, and connect like the aggregator does, trusting the APIService
+		// CABundle and verifying the cert against <service>.<namespace>.svc.
+		servingCert, err := tls.LoadX509KeyPair(filepath.Join(p.pki.dir, "tls.crt"), filepath.Join(p.pki.dir, "tls.key"))
+		Expect(err).NotTo(HaveOccurred())
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{servingCert}}
+		server.StartTLS()
+		defer server.Close()
+
+		apiService := &apiregistrationv1.APIService{}
+		Expect(p.ManifestClient.Get(context.Background(), client.ObjectKey{Name: "v1alpha1.metrics.example.com"}, apiService)).To(Succeed())
+		roots := x509.NewCertPool()
+		Expect(roots.AppendCertsFromPEM(apiService.Spec.CABundle)).To(BeTrue())
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "metrics-service.example-system.svc"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.Close()).To(Succeed())
+	})
+
+	It("creates the namespace defaults in the provider namespaces", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(`apiVersion: apiregistration.k8s.io/v1
+kind: APIService
+metadata:
+  name: v1alpha1.metrics.example.com
+spec:
+  group: metrics.example.com
+  version: v1alpha1
+  groupPriorityMinimum: 100
+  versionPriority: 100
+  service:
+    name: metrics-service
+    namespace: example-system
+    port: 443
+`), 0600)).To(Succeed())
+
+		p, err := NewProvider(packagePath, WithNamespaceDefaults(`apiVersion: v1
+kind: LimitRange
+metadata:
+  name: ${namespace}-limits
+spec:
+  limits:
+  - type: Container
+    default:
+      cpu: 500m
+`))
+		Expect(err).NotTo(HaveOccurred())
+		c := fake.NewClientBuilder().WithScheme(scheme).Build()
+		p.ManifestClient = c
+
+		Expect(p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+		defer func() {
+			Expect(p.logFile.Close()).To(Succeed())
+		}()
+
+		limitRange := &corev1.LimitRange{}
+		Expect(c.Get(context.Background(), client.ObjectKey{Namespace: "example-system", Name: "example-system-limits"}, limitRange)).To(Succeed())
+		Expect(limitRange.Spec.Limits).To(HaveLen(1))
+		Expect(limitRange.Spec.Limits[0].Default.Cpu().String()).To(Equal("500m"))
+	})
+
+	It("fails the CRD preflight before installing any object", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(nonStructuralCRD+"---\n"+webhookManifest), 0600)).To(Succeed())
+
+		p, err := NewProvider(packagePath, WithCRDPreflight())
+		Expect(err).NotTo(HaveOccurred())
+		c := &countingClient{Client: fake.NewClientBuilder().WithScheme(scheme).Build()}
+		p.ManifestClient = c
+
+		err = p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))
+		if p.logFile != nil {
+			Expect(p.logFile.Close()).To(Succeed())
+		}
+		Expect(err).To(MatchError(ContainSubstring("CustomResourceDefinition foos.example.com has an invalid schema")))
+		Expect(c.creates).To(Equal(0))
+	})
+
+	It("rejects namespace defaults other than LimitRange and ResourceQuota", func() {
+		_, err := renderNamespaceDefault("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: test\n", "example-system")
+		Expect(err).To(MatchError(ContainSubstring("only v1 LimitRange and ResourceQuota are supported")))
+	})
+
+	It("rejects invalid trusted CAs", func() {
+		_, err := writeTrustedCABundle(dir, [][]byte{[]byte("not a cert")}, nil, process.FileModes{})
+		Expect(err).To(MatchError(ContainSubstring("invalid trusted CA")))
+	})
+
+	It("creates the provider files in the instance folder", func() {
+		packagePath := filepath.Join(dir, "bootstrap-capi")
+		Expect(os.MkdirAll(packagePath, 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(packagePath, manifestName), []byte(""), 0600)).To(Succeed())
+
+		for _, name := range []string{"one", "two"} {
+			p, err := NewProvider(packagePath, WithInstanceName(name))
+			Expect(IsWarning(err)).To(BeTrue())
+
+			Expect(p.setProcessState(context.Background(), filepath.Join(dir, "kubeconfig"))).To(Succeed())
+			Expect(p.logFile.Name()).To(Equal(filepath.Join(dir, ".tmp", name, "provider", "capi", "manager.log")))
+			Expect(p.logFile.Close()).To(Succeed())
+		}
+	})
+})
+
+// sidecarManifest is a provider manifest with a kube-rbac-proxy sidecar listed before the manager container.
+const sidecarManifest = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: capi-controller-manager
+  namespace: capi-system
+spec:
+  template:
+    spec:
+      containers:
+      - name: kube-rbac-proxy
+        args:
+        - --feature-gates=ProxyOnly=true
+        livenessProbe:
+          httpGet:
+            path: /proxy-healthz
+            port: 8443
+            scheme: HTTPS
+      - name: manager
+        args:
+        - --leader-elect
+        - --feature-gates=MachinePool=${EXP_MACHINE_POOL:=false},ClusterTopology=${CLUSTER_TOPOLOGY:=false}
+        readinessProbe:
+          httpGet:
+            path: /readyz
+            port: healthz
+`
+
+// webhookManifest is a provider manifest with a webhook.
+const webhookManifest = `apiVersion: admissionregistration.k8s.io/v1
+kind: MutatingWebhookConfiguration
+metadata:
+  name: capi-mutating-webhook-configuration
+webhooks:
+- name: default.cluster.cluster.x-k8s.io
+  admissionReviewVersions: ["v1"]
+  sideEffects: None
+  clientConfig:
+    service:
+      name: capi-webhook-service
+      namespace: capi-system
+      path: /mutate-cluster
+`
+
+// establishingClient is a client setting CRDs as established when creating or updating them, like the API server.
+type establishingClient struct {
+	client.Client
+}
+
+func (c establishingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	establish(obj)
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c establishingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	establish(obj)
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func establish(obj client.Object) {
+	if crd, ok := obj.(*apiextensionsv1.CustomResourceDefinition); ok {
+		crd.Status.Conditions = []apiextensionsv1.CustomResourceDefinitionCondition{{Type: apiextensionsv1.Established, Status: apiextensionsv1.ConditionTrue}}
+	}
+}
+
+// countingClient is a client counting Create calls.
+type countingClient struct {
+	client.Client
+	creates int
+}
+
+func (c *countingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.creates++
+	return c.Client.Create(ctx, obj, opts...)
+}
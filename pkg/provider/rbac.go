@@ -0,0 +1,131 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"path/filepath"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+
+	"github.com/fabriziopandini/kBB-8/pkg/kubeconfig"
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
+)
+
+const (
+	// scopedKubeConfigName is the name of the kubeconfig file generated for a provider using scoped RBAC.
+	scopedKubeConfigName = "kubeconfig"
+
+	// defaultServiceAccountName is the ServiceAccount used by Deployments not declaring one.
+	defaultServiceAccountName = "default"
+)
+
+// rbacObjects are the RBAC rules defined in the provider manifest.
+type rbacObjects struct {
+	clusterRoles        []*rbacv1.ClusterRole
+	clusterRoleBindings []*rbacv1.ClusterRoleBinding
+	roles               []*rbacv1.Role
+	roleBindings        []*rbacv1.RoleBinding
+}
+
+// empty returns true if there are no RBAC rules.
+func (o *rbacObjects) empty() bool {
+	return len(o.clusterRoles) == 0 && len(o.clusterRoleBindings) == 0 && len(o.roles) == 0 && len(o.roleBindings) == 0
+}
+
+// read adds the RBAC object in doc to the RBAC rules; it returns false if doc is not an RBAC object.
+func (o *rbacObjects) read(generic metav1.PartialObjectMetadata, doc []byte) (bool, error) {
+	switch generic.Kind {
+	case "ClusterRole", "ClusterRoleBinding", "Role", "RoleBinding":
+	default:
+		return false, nil
+	}
+	if generic.APIVersion != "rbac.authorization.k8s.io/v1" {
+		return false, fmt.Errorf("only v1 is supported right now for %s (name: %s)", generic.Kind, generic.Name)
+	}
+
+	switch generic.Kind {
+	case "ClusterRole":
+		role := &rbacv1.ClusterRole{}
+		if err := yaml.Unmarshal(doc, role); err != nil {
+			return false, err
+		}
+		o.clusterRoles = append(o.clusterRoles, role)
+	case "ClusterRoleBinding":
+		binding := &rbacv1.ClusterRoleBinding{}
+		if err := yaml.Unmarshal(doc, binding); err != nil {
+			return false, err
+		}
+		o.clusterRoleBindings = append(o.clusterRoleBindings, binding)
+	case "Role":
+		role := &rbacv1.Role{}
+		if err := yaml.Unmarshal(doc, role); err != nil {
+			return false, err
+		}
+		o.roles = append(o.roles, role)
+	case "RoleBinding":
+		binding := &rbacv1.RoleBinding{}
+		if err := yaml.Unmarshal(doc, binding); err != nil {
+			return false, err
+		}
+		o.roleBindings = append(o.roleBindings, binding)
+	}
+	return true, nil
+}
+
+// serviceAccountUser returns the user a client cert must be issued to for authenticating as the ServiceAccount sa,
+// so the RBAC rules bound to the ServiceAccount, or to its groups, apply.
+func serviceAccountUser(sa types.NamespacedName) certs.ClientInfo {
+	return certs.ClientInfo{
+		Name:   fmt.Sprintf("system:serviceaccount:%s:%s", sa.Namespace, sa.Name),
+		Groups: []string{"system:serviceaccounts", fmt.Sprintf("system:serviceaccounts:%s", sa.Namespace)},
+	}
+}
+
+// writeScopedKubeConfig writes a kubeconfig file in localPath for authenticating to the API server in kubeConfig
+// as the provider ServiceAccount sa, with a client cert issued by ca; it returns the path of the file.
+func writeScopedKubeConfig(localPath string, kubeConfig string, clusterName string, ca *certs.TinyCA, sa types.NamespacedName) (string, error) {
+	if ca == nil {
+		return "", fmt.Errorf("unable to create a scoped kubeconfig: the API server CA is not known")
+	}
+	if sa.Name == "" {
+		return "", fmt.Errorf("unable to create a scoped kubeconfig: the provider manifest does not define a Deployment")
+	}
+
+	config, err := clientcmd.LoadFromFile(kubeConfig)
+	if err != nil {
+		return "", err
+	}
+	context, ok := config.Contexts[config.CurrentContext]
+	if !ok {
+		return "", fmt.Errorf("unable to create a scoped kubeconfig: context %q not found in %s", config.CurrentContext, kubeConfig)
+	}
+	cluster, ok := config.Clusters[context.Cluster]
+	if !ok {
+		return "", fmt.Errorf("unable to create a scoped kubeconfig: cluster %q not found in %s", context.Cluster, kubeConfig)
+	}
+
+	path := filepath.Join(localPath, scopedKubeConfigName)
+	if err := kubeconfig.CreateForUser(ca, cluster.Server, clusterName, serviceAccountUser(sa), path); err != nil {
+		return "", fmt.Errorf("unable to create a scoped kubeconfig: %v", err)
+	}
+	return path, nil
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fabriziopandini/kBB-8/pkg/controlplane"
+	"github.com/fabriziopandini/kBB-8/pkg/kubeconfig"
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
+)
+
+const rbacManifest = `apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: capi-manager-role
+rules:
+- apiGroups: ["cluster.x-k8s.io"]
+  resources: ["clusters"]
+  verbs: ["get", "list", "watch"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: capi-manager-rolebinding
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: capi-manager-role
+subjects:
+- kind: ServiceAccount
+  name: capi-manager
+  namespace: capi-system
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: capi-leader-election-role
+  namespace: capi-system
+rules:
+- apiGroups: ["coordination.k8s.io"]
+  resources: ["leases"]
+  verbs: ["*"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: capi-leader-election-rolebinding
+  namespace: capi-system
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: capi-leader-election-role
+subjects:
+- kind: ServiceAccount
+  name: capi-manager
+  namespace: capi-system
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: capi-controller-manager
+  namespace: capi-system
+spec:
+  template:
+    spec:
+      serviceAccountName: capi-manager
+      containers:
+      - name: manager
+`
+
+var _ = Describe("Scoped RBAC", func() {
+	var (
+		dir string
+		pki *providerPKI
+		u   *providerURL
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "provider-test")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, manifestName), []byte(rbacManifest), 0600)).To(Succeed())
+
+		pki = &providerPKI{dir: dir, caData: []byte("ca")}
+		u = &providerURL{host: "127.0.0.1", webhookPort: 9443, healthPort: 9440}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("reads the RBAC rules and the ServiceAccount of the provider", func() {
+		objs, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{scopedRBAC: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(objs.rbac.clusterRoles).To(HaveLen(1))
+		Expect(objs.rbac.clusterRoleBindings).To(HaveLen(1))
+		Expect(objs.rbac.roles).To(HaveLen(1))
+		Expect(objs.rbac.roleBindings).To(HaveLen(1))
+		Expect(objs.rbac.clusterRoles[0].Rules[0].Resources).To(Equal([]string{"clusters"}))
+		Expect(objs.serviceAccount).To(Equal(types.NamespacedName{Namespace: "capi-system", Name: "capi-manager"}))
+		Expect(objs.empty()).To(BeFalse())
+	})
+	It("ignores the RBAC rules when not using scoped RBAC", func() {
+		objs, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(objs.rbac.empty()).To(BeTrue())
+		Expect(objs.empty()).To(BeTrue())
+	})
+	It("rejects unsupported RBAC API versions", func() {
+		Expect(ioutil.WriteFile(filepath.Join(dir, manifestName), []byte(`apiVersion: rbac.authorization.k8s.io/v1beta1
+kind: ClusterRole
+metadata:
+  name: capi-manager-role
+`), 0600)).To(Succeed())
+
+		_, err := readAndAdaptManifestObjects(os.DirFS(dir), manifestName, pki, u, manifestOptions{scopedRBAC: true})
+		Expect(err).To(MatchError("only v1 is supported right now for ClusterRole (name: capi-manager-role)"))
+	})
+
+	Describe("writeScopedKubeConfig", func() {
+		var (
+			ca         *certs.TinyCA
+			kubeConfig string
+		)
+
+		BeforeEach(func() {
+			var err error
+			ca, err = certs.NewTinyCA()
+			Expect(err).NotTo(HaveOccurred())
+
+			kubeConfig = filepath.Join(dir, "admin.kubeconfig")
+			Expect(kubeconfig.CreateForUser(ca, "https://127.0.0.1:6443", "bootstrap", certs.ClientInfo{Name: "kBB-8", Groups: []string{"system:masters"}}, kubeConfig)).To(Succeed())
+		})
+
+		It("authenticates as the provider ServiceAccount, without admin permissions", func() {
+			path, err := writeScopedKubeConfig(dir, kubeConfig, "capi", ca, types.NamespacedName{Namespace: "capi-system", Name: "capi-manager"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path).To(Equal(filepath.Join(dir, scopedKubeConfigName)))
+
+			config, err := clientcmd.LoadFromFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			context := config.Contexts[config.CurrentContext]
+			Expect(context).NotTo(BeNil())
+			Expect(config.Clusters[context.Cluster].Server).To(Equal("https://127.0.0.1:6443"))
+			Expect(config.Clusters[context.Cluster].CertificateAuthorityData).To(Equal(ca.CA.CertBytes()))
+
+			block, _ := pem.Decode(config.AuthInfos[context.AuthInfo].ClientCertificateData)
+			Expect(block).NotTo(BeNil())
+			cert, err := x509.ParseCertificate(block.Bytes)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cert.Subject.CommonName).To(Equal("system:serviceaccount:capi-system:capi-manager"))
+			Expect(cert.Subject.Organization).To(ConsistOf("system:serviceaccounts", "system:serviceaccounts:capi-system"))
+			Expect(cert.Subject.Organization).NotTo(ContainElement("system:masters"))
+			Expect(cert.CheckSignatureFrom(ca.CA.Cert)).To(Succeed())
+		})
+
+		It("fails if the API server CA is not known", func() {
+			_, err := writeScopedKubeConfig(dir, kubeConfig, "capi", nil, types.NamespacedName{Namespace: "capi-system", Name: "capi-manager"})
+			Expect(err).To(MatchError("unable to create a scoped kubeconfig: the API server CA is not known"))
+		})
+	})
+
+	Context("against an API server", func() {
+		var (
+			cp                     *controlplane.ControlPlane
+			currentDir, kubeConfig string
+		)
+
+		BeforeEach(func() {
+			// The test runs etcd and the API server from the envtest binaries, with the kBB-8 PKI and RBAC authorization.
+			cp = nil
+			assets := os.Getenv("KUBEBUILDER_ASSETS")
+			if assets == "" {
+				Skip("KUBEBUILDER_ASSETS is not set, no API server binaries to test against")
+			}
+			var err error
+			currentDir, err = os.Getwd()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Chdir(dir)).To(Succeed())
+			kubeConfig = os.Getenv("KUBECONFIG")
+			Expect(os.Setenv("KUBECONFIG", filepath.Join(dir, "admin.kubeconfig"))).To(Succeed())
+
+			cp = &controlplane.ControlPlane{PackagePath: assets, InstanceName: "rbac-test"}
+			Expect(cp.Start()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			if cp == nil {
+				return
+			}
+			Expect(cp.Stop()).To(Succeed())
+			Expect(os.Setenv("KUBECONFIG", kubeConfig)).To(Succeed())
+			Expect(os.Chdir(currentDir)).To(Succeed())
+		})
+
+		It("is denied the operations outside of the provider RBAC", func() {
+			ctx := context.Background()
+			sa := types.NamespacedName{Namespace: "capi-system", Name: "capi-manager"}
+
+			// Allow the provider ServiceAccount to read ConfigMaps in its own namespace only.
+			adminConfig, err := cp.RESTConfig()
+			Expect(err).NotTo(HaveOccurred())
+			admin, err := client.New(adminConfig, client.Options{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(admin.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: sa.Namespace}})).To(Succeed())
+			Expect(admin.Create(ctx, &rbacv1.Role{
+				ObjectMeta: metav1.ObjectMeta{Namespace: sa.Namespace, Name: "capi-manager-role"},
+				Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get", "list"}}},
+			})).To(Succeed())
+			Expect(admin.Create(ctx, &rbacv1.RoleBinding{
+				ObjectMeta: metav1.ObjectMeta{Namespace: sa.Namespace, Name: "capi-manager-rolebinding"},
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "capi-manager-role"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Namespace: sa.Namespace, Name: sa.Name}},
+			})).To(Succeed())
+
+			path, err := writeScopedKubeConfig(dir, cp.KubeConfigFile, "capi", cp.APIServer().CA, sa)
+			Expect(err).NotTo(HaveOccurred())
+			scopedConfig, err := clientcmd.BuildConfigFromFlags("", path)
+			Expect(err).NotTo(HaveOccurred())
+			scoped, err := client.New(scopedConfig, client.Options{})
+			Expect(err).NotTo(HaveOccurred())
+
+			// RBAC takes effect asynchronously, so wait for the allowed operation to succeed first.
+			Eventually(func() error {
+				return scoped.List(ctx, &corev1.ConfigMapList{}, client.InNamespace(sa.Namespace))
+			}, 10*time.Second, 100*time.Millisecond).Should(Succeed())
+
+			err = scoped.List(ctx, &corev1.SecretList{}, client.InNamespace(sa.Namespace))
+			Expect(apierrors.IsForbidden(err)).To(BeTrue(), "expected forbidden, got %v", err)
+			err = scoped.List(ctx, &corev1.ConfigMapList{}, client.InNamespace(metav1.NamespaceDefault))
+			Expect(apierrors.IsForbidden(err)).To(BeTrue(), "expected forbidden, got %v", err)
+			err = scoped.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}})
+			Expect(apierrors.IsForbidden(err)).To(BeTrue(), "expected forbidden, got %v", err)
+		})
+	})
+})
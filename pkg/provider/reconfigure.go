@@ -0,0 +1,214 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"reflect"
+	"time"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
+)
+
+// providerConfig is the configuration of a provider, i.e. what is set by the user with fields and options,
+// excluding the state kBB-8 sets while running it.
+type providerConfig struct {
+	packagePath  string
+	args         []string
+	featureGates map[string]bool
+	dependsOn    []string
+	env          []string
+	healthScheme string
+	healthPath   string
+
+	stopGracePeriod  time.Duration
+	readyGracePeriod time.Duration
+	detached         bool
+
+	name         string
+	instanceName string
+	packageFS    fs.FS
+	packageRoot  string
+	fileModes    process.FileModes
+	logStream    io.Writer
+	ca           *certs.TinyCA
+	trustedCAs   [][]byte
+
+	namespaceDefaults []string
+
+	stripWebhookSelectors bool
+	lenientDecoding       bool
+	crdPreflight          bool
+	webhookSelfTest       bool
+	scopedRBAC            bool
+}
+
+func (p *Provider) config() providerConfig {
+	return providerConfig{
+		packagePath:           p.PackagePath,
+		args:                  p.Args,
+		featureGates:          p.FeatureGates,
+		dependsOn:             p.DependsOn,
+		env:                   p.Env,
+		healthScheme:          p.HealthScheme,
+		healthPath:            p.HealthPath,
+		stopGracePeriod:       p.StopGracePeriod,
+		readyGracePeriod:      p.ReadyGracePeriod,
+		detached:              p.Detached,
+		name:                  p.name,
+		instanceName:          p.instanceName,
+		packageFS:             p.packageFS,
+		packageRoot:           p.packageRoot,
+		fileModes:             p.fileModes,
+		logStream:             p.logStream,
+		ca:                    p.ca,
+		trustedCAs:            p.trustedCAs,
+		namespaceDefaults:     p.namespaceDefaults,
+		stripWebhookSelectors: p.stripWebhookSelectors,
+		lenientDecoding:       p.lenientDecoding,
+		crdPreflight:          p.crdPreflight,
+		webhookSelfTest:       p.webhookSelfTest,
+		scopedRBAC:            p.scopedRBAC,
+	}
+}
+
+// ConfigEqual returns true if p and other have the same configuration, e.g. package path, args, feature gates,
+// env and options; the state kBB-8 sets while running a provider, e.g. the CRDs set with SetCRDs, is ignored.
+func (p *Provider) ConfigEqual(other *Provider) bool {
+	return reflect.DeepEqual(p.config(), other.config())
+}
+
+// ReuseEndpoints makes p reuse the ports and the PKI of old, e.g. when replacing a running provider with
+// a reconfigured one, so the webhook URLs and the CABundles installed in the API server don't change;
+// old must be stopped before p starts.
+func (p *Provider) ReuseEndpoints(old *Provider) {
+	p.url = old.url
+	p.pki = old.pki
+}
+
+// Restart stops the provider and starts it again, reusing its ports and PKI.
+func (p *Provider) Restart(ctx context.Context, kubeConfig string) error {
+	if err := p.Stop(); err != nil {
+		return err
+	}
+	return p.Start(ctx, kubeConfig)
+}
+
+// DeleteObjects deletes the objects kBB-8 installed for the provider: the CRDs, and with them all the custom
+// resources, the webhook configurations, the APIServices and the Services backing them. CRDs set to nil with
+// SetCRDs, e.g. because installed by another provider, are not deleted. RBAC rules are left in place.
+func (p *Provider) DeleteObjects(ctx context.Context, kubeConfig string) error {
+	opts := manifestOptions{
+		crds:            p.crds,
+		lenientDecoding: p.lenientDecoding,
+	}
+	fsys, name := p.manifestFS()
+	objs, err := readManifestObjectsWithOptions(fsys, name, opts)
+	if err != nil {
+		return p.manifestError(err)
+	}
+	if p.url != nil {
+		adaptManifestObjects(objs, p.pki, p.url, opts)
+	}
+
+	c := p.ManifestClient
+	if c == nil {
+		if c, err = newManifestClientFromKubeConfig(kubeConfig); err != nil {
+			return err
+		}
+	}
+
+	toDelete := []client.Object{}
+	for _, o := range objs.mutHooks {
+		toDelete = append(toDelete, o)
+	}
+	for _, o := range objs.valHooks {
+		toDelete = append(toDelete, o)
+	}
+	for _, o := range objs.apiServices {
+		toDelete = append(toDelete, o)
+	}
+	for _, o := range objs.services {
+		toDelete = append(toDelete, o)
+	}
+	for _, o := range objs.crds {
+		toDelete = append(toDelete, o)
+	}
+
+	errs := []error{}
+	for _, o := range toDelete {
+		if err := c.Delete(ctx, o); client.IgnoreNotFound(err) != nil {
+			kind := reflect.Indirect(reflect.ValueOf(o)).Type().Name()
+			errs = append(errs, fmt.Errorf("error deleting %s %s: %w", kind, o.GetName(), err))
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// RemoveWebhooks removes the webhook configurations and the CRD conversion webhooks kBB-8 installed for the provider,
+// e.g. because the provider failed to start and it is not running, so requests to the API server are not routed to
+// the provider anymore; the CRDs and the custom resources are kept.
+func (p *Provider) RemoveWebhooks(ctx context.Context, kubeConfig string) error {
+	if p.installed == nil {
+		return nil
+	}
+
+	c := p.ManifestClient
+	if c == nil {
+		var err error
+		if c, err = newManifestClientFromKubeConfig(kubeConfig); err != nil {
+			return err
+		}
+	}
+
+	errs := []error{}
+	for _, o := range p.installed.mutHooks {
+		if err := c.Delete(ctx, o.DeepCopy()); client.IgnoreNotFound(err) != nil {
+			errs = append(errs, fmt.Errorf("error deleting MutatingWebhookConfiguration %s: %w", o.GetName(), err))
+		}
+	}
+	for _, o := range p.installed.valHooks {
+		if err := c.Delete(ctx, o.DeepCopy()); client.IgnoreNotFound(err) != nil {
+			errs = append(errs, fmt.Errorf("error deleting ValidatingWebhookConfiguration %s: %w", o.GetName(), err))
+		}
+	}
+	for _, o := range p.installed.crds {
+		if o.Spec.Conversion == nil || o.Spec.Conversion.Strategy != apiextensionsv1.WebhookConverter {
+			continue
+		}
+		if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			crd := &apiextensionsv1.CustomResourceDefinition{}
+			if err := c.Get(ctx, client.ObjectKey{Name: o.Name}, crd); err != nil {
+				return err
+			}
+			crd.Spec.Conversion = &apiextensionsv1.CustomResourceConversion{Strategy: apiextensionsv1.NoneConverter}
+			return c.Update(ctx, crd)
+		}); client.IgnoreNotFound(err) != nil {
+			errs = append(errs, fmt.Errorf("error removing the conversion webhook of CustomResourceDefinition %s: %w", o.Name, err))
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
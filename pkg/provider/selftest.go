@@ -0,0 +1,144 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// webhookSelfTestTimeout is the maximum time to wait for a webhook endpoint to pass the self-test.
+	webhookSelfTestTimeout = 10 * time.Second
+
+	// webhookSelfTestInterval is the interval between attempts to self-test a webhook endpoint.
+	webhookSelfTestInterval = 200 * time.Millisecond
+)
+
+// WebhookEndpoint is an endpoint the API server calls for a webhook served by the provider.
+type WebhookEndpoint struct {
+	// Name identifies the webhook in error messages.
+	Name string
+
+	// URL is the URL the API server calls the webhook at.
+	URL string
+
+	// CABundle is the CA bundle the API server verifies the webhook serving certificate with.
+	CABundle []byte
+}
+
+// webhookEndpoints returns the endpoints of the conversion, mutating and validating webhooks
+// defined in the provider manifest.
+func (o *manifestObjects) webhookEndpoints() []WebhookEndpoint {
+	ret := []WebhookEndpoint{}
+	for _, crd := range o.crds {
+		if crd.Spec.Conversion == nil || crd.Spec.Conversion.Webhook == nil || crd.Spec.Conversion.Webhook.ClientConfig == nil || crd.Spec.Conversion.Webhook.ClientConfig.URL == nil {
+			continue
+		}
+		ret = append(ret, WebhookEndpoint{
+			Name:     fmt.Sprintf("conversion webhook for CustomResourceDefinition %s", crd.Name),
+			URL:      *crd.Spec.Conversion.Webhook.ClientConfig.URL,
+			CABundle: crd.Spec.Conversion.Webhook.ClientConfig.CABundle,
+		})
+	}
+	for _, hook := range o.mutHooks {
+		for _, w := range hook.Webhooks {
+			if w.ClientConfig.URL == nil {
+				continue
+			}
+			ret = append(ret, WebhookEndpoint{
+				Name:     fmt.Sprintf("webhook %s in MutatingWebhookConfiguration %s", w.Name, hook.Name),
+				URL:      *w.ClientConfig.URL,
+				CABundle: w.ClientConfig.CABundle,
+			})
+		}
+	}
+	for _, hook := range o.valHooks {
+		for _, w := range hook.Webhooks {
+			if w.ClientConfig.URL == nil {
+				continue
+			}
+			ret = append(ret, WebhookEndpoint{
+				Name:     fmt.Sprintf("webhook %s in ValidatingWebhookConfiguration %s", w.Name, hook.Name),
+				URL:      *w.ClientConfig.URL,
+				CABundle: w.ClientConfig.CABundle,
+			})
+		}
+	}
+	return ret
+}
+
+// selfTestWebhooks checks that each webhook endpoint is reachable and that its serving certificate
+// is trusted by the injected CABundle, like the API server does when calling the webhook.
+func selfTestWebhooks(ctx context.Context, endpoints []WebhookEndpoint, timeout time.Duration) error {
+	errs := []error{}
+	for _, e := range endpoints {
+		var lastErr error
+		if err := wait.PollImmediate(webhookSelfTestInterval, timeout, func() (bool, error) {
+			lastErr = CheckWebhookEndpoint(ctx, e)
+			return lastErr == nil, nil
+		}); err != nil {
+			if lastErr == nil {
+				lastErr = err
+			}
+			errs = append(errs, fmt.Errorf("self-test of %s at %s failed: %w", e.Name, e.URL, lastErr))
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// CheckWebhookEndpoint runs a TLS handshake against the webhook endpoint, verifying the serving
+// certificate with the webhook CABundle, like the API server does when calling the webhook.
+func CheckWebhookEndpoint(ctx context.Context, e WebhookEndpoint) error {
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(e.CABundle) {
+		return fmt.Errorf("invalid CABundle")
+	}
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 5 * time.Second},
+		Config: &tls.Config{
+			RootCAs:    pool,
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// WebhookEndpoints returns the endpoints of the conversion, mutating and validating webhooks installed by the last
+// start of the provider.
+func (p *Provider) WebhookEndpoints() []WebhookEndpoint {
+	return append([]WebhookEndpoint{}, p.webhookEndpoints...)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	admissionv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
+)
+
+var _ = Describe("Webhook self-test", func() {
+	var (
+		server *httptest.Server
+		ca     *certs.TinyCA
+	)
+
+	BeforeEach(func() {
+		var err error
+		ca, err = certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+
+		servingCert, err := ca.NewServingCert("127.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		certData, keyData, err := servingCert.AsBytes()
+		Expect(err).NotTo(HaveOccurred())
+		cert, err := tls.X509KeyPair(certData, keyData)
+		Expect(err).NotTo(HaveOccurred())
+
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		server.StartTLS()
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	webhookConfiguration := func(caBundle []byte) *manifestObjects {
+		return &manifestObjects{
+			valHooks: []*admissionv1.ValidatingWebhookConfiguration{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "validating-webhook-configuration"},
+					Webhooks: []admissionv1.ValidatingWebhook{
+						{
+							Name: "validation.foo.example.com",
+							ClientConfig: admissionv1.WebhookClientConfig{
+								URL:      pointer.StringPtr(server.URL + "/validate-foo"),
+								CABundle: caBundle,
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	It("passes when the webhook is reachable with the injected CABundle", func() {
+		endpoints := webhookConfiguration(ca.CA.CertBytes()).webhookEndpoints()
+		Expect(endpoints).To(HaveLen(1))
+
+		Expect(selfTestWebhooks(context.Background(), endpoints, time.Second)).To(Succeed())
+	})
+
+	It("fails naming the webhook when the injected CABundle doesn't match the serving certificate", func() {
+		otherCA, err := certs.NewTinyCA()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = selfTestWebhooks(context.Background(), webhookConfiguration(otherCA.CA.CertBytes()).webhookEndpoints(), time.Second)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("webhook validation.foo.example.com in ValidatingWebhookConfiguration validating-webhook-configuration"))
+		Expect(err.Error()).To(ContainSubstring("certificate signed by unknown authority"))
+	})
+})
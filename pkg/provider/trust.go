@@ -0,0 +1,88 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	certutil "k8s.io/client-go/util/cert"
+
+	"github.com/fabriziopandini/kBB-8/pkg/process"
+	"github.com/fabriziopandini/kBB-8/third_party/controller-runtime/certs"
+)
+
+const (
+	// trustedCABundleName is the name of the CA bundle file generated for a provider with trusted CAs.
+	trustedCABundleName = "trusted-ca-bundle.crt"
+
+	// sslCertFileEnv is the env variable Go programs, and OpenSSL based tools, read the trusted CAs from.
+	sslCertFileEnv = "SSL_CERT_FILE"
+)
+
+// systemCABundleFiles are the well-known locations of the system CA bundle, in order of preference;
+// SSL_CERT_FILE replaces the system bundle, so it is copied into the generated bundle.
+var systemCABundleFiles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian/Ubuntu/Gentoo etc.
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora/RHEL 6
+	"/etc/ssl/ca-bundle.pem",                            // OpenSUSE
+	"/etc/pki/tls/cacert.pem",                           // OpenELEC
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS/RHEL 7
+	"/etc/ssl/cert.pem",                                 // Alpine Linux, macOS
+}
+
+// systemCABundle returns the content of the system CA bundle, or nil if it can't be found.
+func systemCABundle() []byte {
+	for _, f := range systemCABundleFiles {
+		if data, err := ioutil.ReadFile(f); err == nil { //nolint:gosec
+			return data
+		}
+	}
+	return nil
+}
+
+// writeTrustedCABundle writes the CA bundle for a provider, combining the system CAs, the trusted CAs and the
+// API server CA, if known, and returns its path.
+func writeTrustedCABundle(localPath string, trustedCAs [][]byte, apiServerCA *certs.TinyCA, modes process.FileModes) (string, error) {
+	bundle := &bytes.Buffer{}
+	bundle.Write(systemCABundle())
+	for _, ca := range trustedCAs {
+		if _, err := certutil.ParseCertsPEM(ca); err != nil {
+			return "", fmt.Errorf("invalid trusted CA: %w", err)
+		}
+		appendPEM(bundle, ca)
+	}
+	if apiServerCA != nil {
+		appendPEM(bundle, apiServerCA.CA.CertBytes())
+	}
+
+	bundleFile := filepath.Join(localPath, trustedCABundleName)
+	if err := ioutil.WriteFile(bundleFile, bundle.Bytes(), modes.File()); err != nil {
+		return "", err
+	}
+	return bundleFile, nil
+}
+
+// appendPEM appends PEM data to the bundle, making sure PEM blocks are separated by a newline.
+func appendPEM(bundle *bytes.Buffer, data []byte) {
+	if bundle.Len() > 0 && !bytes.HasSuffix(bundle.Bytes(), []byte("\n")) {
+		bundle.WriteByte('\n')
+	}
+	bundle.Write(data)
+}
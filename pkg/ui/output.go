@@ -0,0 +1,53 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// OutputFormat defines how commands print their results.
+type OutputFormat string
+
+const (
+	// TextOutput prints results in a human-readable form.
+	TextOutput OutputFormat = "text"
+
+	// JSONOutput prints results as a JSON document, e.g. for automation wrapping kBB-8.
+	JSONOutput OutputFormat = "json"
+)
+
+// ParseOutputFormat parses an output format, defaulting to TextOutput.
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch OutputFormat(s) {
+	case "", TextOutput:
+		return TextOutput, nil
+	case JSONOutput:
+		return JSONOutput, nil
+	default:
+		return "", fmt.Errorf("invalid output format %q: must be one of %s, %s", s, TextOutput, JSONOutput)
+	}
+}
+
+// PrintJSON writes v to w as an indented JSON document.
+func PrintJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ui
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Output", func() {
+	It("parses output formats, defaulting to text", func() {
+		Expect(ParseOutputFormat("")).To(Equal(TextOutput))
+		Expect(ParseOutputFormat("text")).To(Equal(TextOutput))
+		Expect(ParseOutputFormat("json")).To(Equal(JSONOutput))
+
+		_, err := ParseOutputFormat("yaml")
+		Expect(err).To(MatchError(ContainSubstring(`invalid output format "yaml"`)))
+	})
+
+	It("prints indented JSON", func() {
+		var b bytes.Buffer
+		Expect(PrintJSON(&b, map[string]string{"name": "CAPI"})).To(Succeed())
+		Expect(b.String()).To(Equal("{\n  \"name\": \"CAPI\"\n}\n"))
+	})
+})
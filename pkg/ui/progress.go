@@ -0,0 +1,142 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ui
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/briandowns/spinner"
+	"golang.org/x/term"
+)
+
+// ProgressReporter reports the progress of a long running operation to the user.
+type ProgressReporter interface {
+	// Step reports that a new step is in progress.
+	Step(msg string)
+
+	// Done reports that a step is completed.
+	Done(msg string)
+
+	// Fail reports that the operation failed.
+	Fail(err error)
+}
+
+// NewProgressReporter returns a ProgressReporter writing to f; it uses a spinner when f is a terminal
+// and plain lines otherwise, e.g. in CI logs or piped output. If quiet is true, nothing is reported.
+func NewProgressReporter(f *os.File, quiet bool) ProgressReporter {
+	if quiet {
+		return NewNoopReporter()
+	}
+	if term.IsTerminal(int(f.Fd())) {
+		return NewSpinnerReporter(f)
+	}
+	return NewPlainReporter(f)
+}
+
+var spinnerFrames = []string{
+	"⠈⠁",
+	"⠈⠑",
+	"⠈⠱",
+	"⠈⡱",
+	"⢀⡱",
+	"⢄⡱",
+	"⢄⡱",
+	"⢆⡱",
+	"⢎⡱",
+	"⢎⡰",
+	"⢎⡠",
+	"⢎⡀",
+	"⢎⠁",
+	"⠎⠁",
+	"⠊⠁",
+}
+
+// spinnerReporter is a ProgressReporter showing a spinner while a step is in progress.
+type spinnerReporter struct {
+	w io.Writer
+	s *spinner.Spinner
+}
+
+// NewSpinnerReporter returns a ProgressReporter showing a spinner while a step is in progress;
+// it should be used only when w is a terminal.
+func NewSpinnerReporter(w io.Writer) ProgressReporter {
+	s := spinner.New(spinnerFrames, 200*time.Millisecond, spinner.WithWriter(w))
+	s.Prefix = " "
+	return &spinnerReporter{w: w, s: s}
+}
+
+func (r *spinnerReporter) Step(msg string) {
+	r.s.Suffix = " " + msg
+	if !r.s.Active() {
+		r.s.Start()
+	}
+}
+
+func (r *spinnerReporter) Done(msg string) {
+	r.s.Stop()
+	fmt.Fprintf(r.w, " \u001B[32m✓\u001B[0m %s\n", msg)
+}
+
+func (r *spinnerReporter) Fail(err error) {
+	r.s.Stop()
+	fmt.Fprintf(r.w, " \u001B[31m✗\u001B[0m %v\n", err)
+}
+
+// plainReporter is a ProgressReporter writing one plain line for each event, without escape sequences.
+type plainReporter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewPlainReporter returns a ProgressReporter writing one plain line for each event, without escape sequences.
+func NewPlainReporter(w io.Writer) ProgressReporter {
+	return &plainReporter{w: w}
+}
+
+func (r *plainReporter) Step(msg string) {
+	r.printf(" • %s\n", msg)
+}
+
+func (r *plainReporter) Done(msg string) {
+	r.printf(" ✓ %s\n", msg)
+}
+
+func (r *plainReporter) Fail(err error) {
+	r.printf(" ✗ %v\n", err)
+}
+
+func (r *plainReporter) printf(format string, a ...interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	fmt.Fprintf(r.w, format, a...)
+}
+
+// noopReporter is a ProgressReporter that doesn't report anything.
+type noopReporter struct{}
+
+// NewNoopReporter returns a ProgressReporter that doesn't report anything.
+func NewNoopReporter() ProgressReporter {
+	return noopReporter{}
+}
+
+func (noopReporter) Step(string) {}
+func (noopReporter) Done(string) {}
+func (noopReporter) Fail(error)  {}
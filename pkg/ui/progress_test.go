@@ -0,0 +1,54 @@
+/*
+Copyright 2022 The kBB-8 Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ui
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ProgressReporter", func() {
+	It("writes plain lines without escape sequences", func() {
+		var b bytes.Buffer
+		r := NewPlainReporter(&b)
+		r.Step("Starting kBB-8 ...")
+		r.Done("kBB-8 started!")
+		r.Fail(errors.New("boom"))
+
+		Expect(b.String()).To(Equal(" • Starting kBB-8 ...\n ✓ kBB-8 started!\n ✗ boom\n"))
+		Expect(b.String()).NotTo(ContainSubstring("\u001B"))
+	})
+
+	It("uses plain lines when not writing to a terminal", func() {
+		f, err := ioutil.TempFile("", "progress-test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		Expect(NewProgressReporter(f, false)).To(BeAssignableToTypeOf(&plainReporter{}))
+	})
+
+	It("doesn't report anything when quiet", func() {
+		r := NewProgressReporter(os.Stdout, true)
+		Expect(r).To(BeAssignableToTypeOf(noopReporter{}))
+	})
+})
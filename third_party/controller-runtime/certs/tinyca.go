@@ -33,6 +33,7 @@ import (
 	"fmt"
 	"math/big"
 	"net"
+	"sync"
 	"time"
 
 	certutil "k8s.io/client-go/util/cert"
@@ -81,6 +82,8 @@ type TinyCA struct {
 	CA      CertPair
 	orgName string
 
+	// serialLock protects nextSerial, so certs can be issued concurrently, e.g. by providers sharing the CA.
+	serialLock sync.Mutex
 	nextSerial *big.Int
 }
 
@@ -110,6 +113,48 @@ func NewTinyCA() (*TinyCA, error) {
 	}, nil
 }
 
+// NewTinyCAFromCertPair creates a tiny CA utility using an existing CA, e.g. a CA shared with other tools,
+// for provisioning serving certs and client certs FOR TESTING ONLY.
+func NewTinyCAFromCertPair(ca CertPair) (*TinyCA, error) {
+	orgName := "envtest"
+	if ca.Cert != nil && len(ca.Cert.Subject.Organization) > 0 {
+		orgName = ca.Cert.Subject.Organization[0]
+	}
+	c := &TinyCA{
+		CA:         ca,
+		orgName:    orgName,
+		nextSerial: big.NewInt(time.Now().UnixNano()),
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks that the CA is usable for signing certificates.
+func (c *TinyCA) Validate() error {
+	if c == nil || c.CA.Cert == nil || c.CA.Key == nil {
+		return fmt.Errorf("the CA must have both a certificate and a private key")
+	}
+	if c.nextSerial == nil {
+		return fmt.Errorf("the CA must be created with NewTinyCA or NewTinyCAFromCertPair")
+	}
+	if !c.CA.Cert.IsCA {
+		return fmt.Errorf("the CA certificate %q is not a CA certificate", c.CA.Cert.Subject.CommonName)
+	}
+	if c.CA.Cert.KeyUsage != 0 && c.CA.Cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return fmt.Errorf("the CA certificate %q can't be used for signing certificates", c.CA.Cert.Subject.CommonName)
+	}
+	if now := time.Now(); now.Before(c.CA.Cert.NotBefore) || now.After(c.CA.Cert.NotAfter) {
+		return fmt.Errorf("the CA certificate %q is not valid at the current time", c.CA.Cert.Subject.CommonName)
+	}
+	publicKey, ok := c.CA.Key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(c.CA.Cert.PublicKey) {
+		return fmt.Errorf("the CA private key does not match the CA certificate %q", c.CA.Cert.Subject.CommonName)
+	}
+	return nil
+}
+
 func (c *TinyCA) makeCert(cfg certutil.Config) (CertPair, error) {
 	now := time.Now()
 
@@ -118,8 +163,10 @@ func (c *TinyCA) makeCert(cfg certutil.Config) (CertPair, error) {
 		return CertPair{}, fmt.Errorf("unable to create private key: %v", err)
 	}
 
+	c.serialLock.Lock()
 	serial := new(big.Int).Set(c.nextSerial)
 	c.nextSerial.Add(c.nextSerial, bigOne)
+	c.serialLock.Unlock()
 
 	template := x509.Certificate{
 		Subject:      pkix.Name{CommonName: cfg.CommonName, Organization: cfg.Organization},
@@ -156,13 +203,20 @@ func (c *TinyCA) makeCert(cfg certutil.Config) (CertPair, error) {
 
 // NewServingCert returns a new CertPair for a serving HTTPS on localhost (or other specified names).
 func (c *TinyCA) NewServingCert(names ...string) (CertPair, error) {
+	return c.NewServingCertWithDNSNames(names, nil)
+}
+
+// NewServingCertWithDNSNames returns a new CertPair for a serving HTTPS on localhost (or other specified names),
+// valid also for dnsNames, that are not resolved, e.g. in-cluster Service hostnames.
+func (c *TinyCA) NewServingCertWithDNSNames(names, dnsNames []string) (CertPair, error) {
 	if len(names) == 0 {
 		names = []string{"localhost"}
 	}
-	dnsNames, ips, err := resolveNames(names)
+	resolvedNames, ips, err := resolveNames(names)
 	if err != nil {
 		return CertPair{}, err
 	}
+	dnsNames = append(resolvedNames, dnsNames...)
 
 	return c.makeCert(certutil.Config{
 		CommonName:   "localhost",
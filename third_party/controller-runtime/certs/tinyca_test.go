@@ -52,6 +52,37 @@ var _ = Describe("TinyCA", func() {
 		})
 	})
 
+	Describe("an existing CA", func() {
+		It("should be usable for signing", func() {
+			existing, err := certs.NewTinyCAFromCertPair(ca.CA)
+			Expect(err).NotTo(HaveOccurred())
+
+			servingCert, err := existing.NewServingCert()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(servingCert.Cert.CheckSignatureFrom(ca.CA.Cert)).To(Succeed())
+		})
+
+		It("should be rejected if not a CA certificate", func() {
+			servingCert, err := ca.NewServingCert()
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = certs.NewTinyCAFromCertPair(servingCert)
+			Expect(err).To(MatchError(ContainSubstring("is not a CA certificate")))
+		})
+
+		It("should be rejected if the private key does not match the certificate", func() {
+			other, err := certs.NewTinyCA()
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = certs.NewTinyCAFromCertPair(certs.CertPair{Key: other.CA.Key, Cert: ca.CA.Cert})
+			Expect(err).To(MatchError(ContainSubstring("does not match")))
+		})
+
+		It("should be rejected if incomplete", func() {
+			Expect((&certs.TinyCA{}).Validate()).To(MatchError(ContainSubstring("both a certificate and a private key")))
+		})
+	})
+
 	It("should produce unique serials among all generated certificates of all types", func() {
 		By("generating a few cert pairs for both serving and client auth")
 		firstCerts, err := ca.NewServingCert()